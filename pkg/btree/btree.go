@@ -1,8 +1,13 @@
 package btree
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"sort"
+	"sync/atomic"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
 	utils "github.com/brown-csci1270/db/pkg/utils"
@@ -10,30 +15,85 @@ import (
 
 // Tables are an abstraction over the entries stored in our database.
 type BTreeIndex struct {
-	pager  *pager.Pager // The page handler to read from files.
-	rootPN int64        // The root page number.
+	pager      *pager.Pager     // The page handler to read from files.
+	rootPN     int64            // The root page number.
+	splitRatio float64          // The fraction of entries a splitting leaf keeps.
+	codec      utils.EntryCodec // How entries are encoded in leaf cells.
+	tombstones bool             // Whether Delete leaves tombstones rather than removing entries.
+	fastAppend bool             // Whether ascending keys are appended straight to the last leaf.
+	lastLeafPN int64            // The last leaf's page number, as of the last check. Accessed atomically.
+	schema     utils.Schema     // What the table's keys and values mean.
+	ops        utils.OpCounter  // Counts the finds, inserts, updates and deletes run against the table.
+	height     int              // Number of levels in the tree. Changed with the root locked.
+	onHeight   func(height int) // Called with the new height whenever it changes, if set.
 }
 
 // OpenTable returns a table associated with the given database filename.
 func OpenTable(filename string) (table *BTreeIndex, err error) {
+	return OpenTableWithCodec(filename, DefaultCodec)
+}
+
+// OpenTableWithCodec returns a table associated with the given database filename,
+// whose entries are encoded with the given codec. The codec isn't stored in the
+// file, so a table must always be opened with the same one. Errors with
+// ErrCodecSize if the codec's entries are too small or too big for leaf cells.
+func OpenTableWithCodec(filename string, codec utils.EntryCodec) (table *BTreeIndex, err error) {
+	return openTable(filename, codec, false)
+}
+
+// OpenTableReadOnly returns a table associated with the given database
+// filename, which must exist, without opening the file for writing. The table
+// can be read from, but writing to it returns ErrReadOnly.
+func OpenTableReadOnly(filename string) (table *BTreeIndex, err error) {
+	return openTable(filename, DefaultCodec, true)
+}
+
+// openTable returns a table associated with the given database filename, opened read-only if asked to.
+func openTable(filename string, codec utils.EntryCodec, readOnly bool) (table *BTreeIndex, err error) {
+	if err = checkCodec(codec); err != nil {
+		return nil, err
+	}
 	// Create a pager for the table
-	pager := pager.NewPager()
-	err = pager.Open(filename)
+	p := pager.NewPager()
+	if readOnly {
+		err = p.OpenReadOnly(filename)
+	} else {
+		err = p.Open(filename)
+	}
 	if err != nil {
 		return nil, err
 	}
-	// Initialize the pager if it's new.
-	if pager.GetNumPages() == 0 {
-		rootPage, err := pager.GetPage(ROOT_PN)
+	schema, err := utils.ReadSchema(filename, "btree")
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	// Initialize the pager if it's new. A read-only table that is new stays
+	// empty, since its root is only ever in memory.
+	if p.GetNumPages() == 0 {
+		rootPage, err := p.AllocatePage()
 		if err != nil {
 			return nil, err
 		}
 		defer rootPage.Put()
 		initPage(rootPage, LEAF_NODE)
-		rootNode := pageToLeafNode(rootPage)
-		rootNode.setRightSibling(-1)
+		rootNode := pageToLeafNode(rootPage, codec)
+		rootNode.setRightSibling(pager.NOPAGE)
 	}
-	return &BTreeIndex{pager: pager, rootPN: ROOT_PN}, nil
+	table = &BTreeIndex{
+		pager:      p,
+		rootPN:     ROOT_PN,
+		splitRatio: DEFAULT_SPLIT_RATIO,
+		codec:      codec,
+		fastAppend: true,
+		lastLeafPN: pager.NOPAGE,
+		schema:     schema,
+	}
+	if table.height, err = table.measureHeight(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return table, nil
 }
 
 // Get this index's filename.
@@ -41,11 +101,131 @@ func (table *BTreeIndex) GetName() string {
 	return table.pager.GetFileName()
 }
 
+// Get this index's entry codec.
+func (table *BTreeIndex) GetCodec() utils.EntryCodec {
+	return table.codec
+}
+
+// Get this index's schema.
+func (table *BTreeIndex) Schema() utils.Schema {
+	return table.schema
+}
+
+// SetSchema sets this index's schema, and stores it alongside the table.
+func (table *BTreeIndex) SetSchema(schema utils.Schema) error {
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+	if schema.IndexType != "btree" {
+		return fmt.Errorf("schema is for a %s table", schema.IndexType)
+	}
+	if err := utils.WriteSchema(table.pager.GetFilePath(), schema); err != nil {
+		return err
+	}
+	table.schema = schema
+	return nil
+}
+
+// Get the number of finds, inserts, updates and deletes run against this index.
+func (table *BTreeIndex) OpStats() utils.OpStats {
+	return table.ops.Stats()
+}
+
 // Get this index's pager.
 func (table *BTreeIndex) GetPager() *pager.Pager {
 	return table.pager
 }
 
+// Get the fraction of entries a splitting leaf keeps.
+func (table *BTreeIndex) GetSplitRatio() float64 {
+	return table.splitRatio
+}
+
+// SetSplitRatio sets the fraction of entries a splitting leaf keeps.
+// The default splits leaves in half, which suits random inserts; a higher
+// ratio (e.g. 0.9) packs leaves densely when keys are inserted in ascending order.
+// Not persisted; set it after opening the table and before inserting.
+func (table *BTreeIndex) SetSplitRatio(ratio float64) error {
+	if ratio <= 0 || ratio >= 1 {
+		return fmt.Errorf("split ratio must be between 0 and 1, got %v", ratio)
+	}
+	table.splitRatio = ratio
+	return nil
+}
+
+// Get whether Delete leaves tombstones rather than removing entries.
+func (table *BTreeIndex) GetTombstones() bool {
+	return table.tombstones
+}
+
+// SetTombstones sets whether Delete leaves tombstones rather than removing entries.
+// A tombstoned entry stays in its leaf but can't be found, updated, or scanned,
+// until it is reinserted or removed by Purge. Not persisted, but tombstones are.
+// Tombstones need a flag in every leaf cell, which plain leaves don't have, so
+// the first time they are enabled on a table it is rebuilt as by Defragment.
+func (table *BTreeIndex) SetTombstones(enabled bool) error {
+	if enabled {
+		if err := table.rebuild(true, false); err != nil {
+			return err
+		}
+	}
+	table.tombstones = enabled
+	return nil
+}
+
+// Get whether ascending keys are appended straight to the last leaf.
+func (table *BTreeIndex) GetAppendFastPath() bool {
+	return table.fastAppend
+}
+
+// SetAppendFastPath sets whether a key greater than every key in the table is
+// appended straight to the last leaf, rather than descending from the root.
+// On by default; not persisted.
+func (table *BTreeIndex) SetAppendFastPath(enabled bool) {
+	table.fastAppend = enabled
+}
+
+// HeightOverTime sets a callback to be called with the tree's new height
+// whenever it changes: when the root splits, adding a level, and when
+// Defragment collapses the tree to a lone leaf before rebuilding it. A lone
+// leaf has height 1. The callback is called with the root locked, so calls
+// come in the order the height changed, and it must not use the table. A nil
+// callback removes it. Set it after opening the table and before inserting.
+func (table *BTreeIndex) HeightOverTime(callback func(height int)) {
+	table.onHeight = callback
+}
+
+// setHeight records the tree's new height, and reports it if it changed. Expects the root to be locked.
+func (table *BTreeIndex) setHeight(height int) {
+	if height == table.height {
+		return
+	}
+	table.height = height
+	if table.onHeight != nil {
+		table.onHeight(height)
+	}
+}
+
+// checkOpen returns ErrIndexClosed if the table has been closed.
+func (table *BTreeIndex) checkOpen() error {
+	if table.pager.IsClosed() {
+		return fmt.Errorf("%s: %w", table.GetName(), utils.ErrIndexClosed)
+	}
+	return nil
+}
+
+// checkWritable returns ErrIndexClosed if the table has been closed, or
+// ErrReadOnly if it was opened read-only.
+func (table *BTreeIndex) checkWritable() error {
+	if err := table.checkOpen(); err != nil {
+		return err
+	}
+	if table.pager.IsReadOnly() {
+		return fmt.Errorf("%s: %w", table.GetName(), utils.ErrReadOnly)
+	}
+	return nil
+}
+
 // Close flushes all changes to disk.
 func (table *BTreeIndex) Close() (err error) {
 	err = table.pager.Close()
@@ -54,6 +234,10 @@ func (table *BTreeIndex) Close() (err error) {
 
 // Finds the given key.
 func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
+	table.ops.Find()
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -61,20 +245,96 @@ func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
 	}
 	// [CONCURRENCY] Lock and eventually unlock the root node.
 	lockRoot(rootPage)
-	rootNode := pageToNode(rootPage)
+	rootNode := pageToNode(rootPage, table.codec)
 	initRootNode(rootNode)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Insert the entry into the root node.
-	value, found := rootNode.get(key)
+	entry, found := rootNode.get(key)
 	if found {
-		return BTreeEntry{key: key, value: value}, nil
+		return entry, nil
+	}
+	return nil, fmt.Errorf("entry could not be found: %w", utils.ErrKeyNotFound)
+}
+
+// MultiGet looks up many keys at once, returning the value of each one that
+// is in the table; keys that aren't are left out. The keys are looked up in
+// ascending order, leaf by leaf: a leaf is searched for every key up to its
+// last one, then the next key is looked for in its right sibling if it could
+// be there, or else with a new descent from the root. A run of clustered keys
+// thus takes a single descent, rather than one per key. Nodes are read-locked
+// hand over hand, as Find locks them, so a leaf is never read in the middle of
+// a split, and lookups don't hold each other up.
+func (table *BTreeIndex) MultiGet(keys []int64) (map[int64]int64, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
+	sorted := append([]int64(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	values := make(map[int64]int64, len(sorted))
+	var page *pager.Page // The read-locked leaf, if any.
+	defer func() {
+		if page != nil {
+			page.RUnlock()
+			page.Put()
+		}
+	}()
+	for _, key := range sorted {
+		table.ops.Find()
+		if page != nil && !leafCovers(pageToLeafNode(page, table.codec), key) {
+			// Step right, locking the sibling before letting go of the leaf.
+			siblingPN := pageToLeafNode(page, table.codec).rightSiblingPN
+			sibling, err := table.pager.GetPage(siblingPN)
+			if err != nil {
+				return nil, err
+			}
+			sibling.RLock()
+			page.RUnlock()
+			page.Put()
+			page = sibling
+			if !leafCovers(pageToLeafNode(page, table.codec), key) {
+				page.RUnlock()
+				page.Put()
+				page = nil
+			}
+		}
+		if page == nil {
+			var err error
+			if page, err = table.readLockLeaf(key); err != nil {
+				return nil, err
+			}
+		}
+		// Every smaller key was looked for already, so if the key is in the table, it is in this leaf.
+		leaf := pageToLeafNode(page, table.codec)
+		index := leaf.search(key)
+		if index < leaf.numKeys && leaf.getKeyAt(index) == key && !leaf.isTombstone(index) {
+			values[key] = leaf.getCell(index).GetValue()
+		}
 	}
-	return nil, errors.New("entry could not be found")
+	return values, nil
 }
 
 // Inserts an entry to the table.
 func (table *BTreeIndex) Insert(key int64, value int64) error {
+	return table.InsertEntry(BTreeEntry{key: key, value: value})
+}
+
+// InsertEntry inserts an entry, encoded with the table's codec, into the table.
+func (table *BTreeIndex) InsertEntry(entry utils.Entry) error {
+	table.ops.Insert()
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+	// Try appending to the last leaf, and find it again if it has moved on.
+	if table.fastAppend {
+		appended, stale := table.tryAppend(entry)
+		if appended {
+			return nil
+		}
+		if stale {
+			defer table.cacheLastLeaf()
+		}
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -82,12 +342,12 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 	}
 	// [CONCURRENCY] Lock and eventually unlock the root node.
 	lockRoot(rootPage)
-	rootNode := pageToNode(rootPage)
+	rootNode := pageToNode(rootPage, table.codec)
 	initRootNode(rootNode)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Insert the entry into the root node.
-	result := rootNode.insert(key, value, false)
+	result := rootNode.insert(entry, false, table.splitRatio)
 	// Check if we need to split the root node.
 	// Remember to preserve the invariant that the root node occupies page 0.
 	if result.isSplit {
@@ -102,41 +362,73 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 		// Depending on whether the root is a leaf or an internal node...
 		if rootNode.getNodeType() == LEAF_NODE {
 			// Create a new leaf node.
-			newNode, err := createLeafNode(table.pager)
+			newNode, err := createLeafNode(table.pager, table.codec)
 			if err != nil {
 				return errors.New("failed to split root node")
 			}
 			defer newNode.page.Put()
 			// Copy the attributes from the root node.
-			leafyRoot := pageToLeafNode(rootNode.getPage())
+			leafyRoot := pageToLeafNode(rootNode.getPage(), table.codec)
 			newNode.copy(leafyRoot)
 			newNodePN = newNode.page.GetPageNum()
 		} else {
 			// Create a new internal node.
-			newNode, err := createInternalNode(table.pager)
+			newNode, err := createInternalNode(table.pager, table.codec)
 			if err != nil {
 				return errors.New("failed to split root node")
 			}
 			defer newNode.page.Put()
 			// Copy the attributes from the root node.
-			internedRoot := pageToInternalNode(rootNode.getPage())
+			internedRoot := pageToInternalNode(rootNode.getPage(), table.codec)
 			newNode.copy(internedRoot)
 			newNodePN = newNode.page.GetPageNum()
 		}
 		// Reinitialize the root node.
 		initPage(rootNode.getPage(), INTERNAL_NODE)
-		newRoot := pageToInternalNode(rootNode.getPage())
+		newRoot := pageToInternalNode(rootNode.getPage(), table.codec)
 		// Populate the pointers to children.
 		newRoot.updateKeyAt(0, result.key)
 		newRoot.updatePNAt(0, newNodePN)
 		newRoot.updatePNAt(1, result.rightPN)
 		newRoot.updateNumKeys(1)
+		table.setHeight(table.height + 1)
 	}
 	return result.err
 }
 
+// InsertAndSeek inserts an entry, then returns a cursor pointing to it.
+// The cursor is found after the insert completes, so it is valid even if the
+// insert split the entry's leaf.
+func (table *BTreeIndex) InsertAndSeek(key int64, value int64) (utils.Cursor, error) {
+	if err := table.checkWritable(); err != nil {
+		return nil, err
+	}
+	err := table.Insert(key, value)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := table.TableFind(key)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure that the entry is still there.
+	if curKey, err := cursor.GetKey(); err != nil || curKey != key {
+		return nil, errors.New("inserted entry could not be found")
+	}
+	return cursor, nil
+}
+
 // Update modifies an existing entry.
 func (table *BTreeIndex) Update(key int64, value int64) error {
+	return table.UpdateEntry(BTreeEntry{key: key, value: value})
+}
+
+// UpdateEntry replaces the existing entry with the given entry's key.
+func (table *BTreeIndex) UpdateEntry(entry utils.Entry) error {
+	table.ops.Update()
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -144,17 +436,48 @@ func (table *BTreeIndex) Update(key int64, value int64) error {
 	}
 	// [CONCURRENCY] Lock and eventually unlock the root node.
 	lockRoot(rootPage)
-	rootNode := pageToNode(rootPage)
+	rootNode := pageToNode(rootPage, table.codec)
 	initRootNode(rootNode)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Update the entry.
-	result := rootNode.insert(key, value, true)
+	result := rootNode.insert(entry, true, table.splitRatio)
 	return result.err
 }
 
+// CompareAndSwap sets the value of the given key to value, but only if its
+// current value is expected. The check and the write happen under the leaf's
+// write latch, so no other write can slip in between them. Returns whether
+// the value was swapped. Values are int64s, so the table must use the default
+// codec; errors with ErrCodecUnsupported otherwise. Counts as an update.
+func (table *BTreeIndex) CompareAndSwap(key int64, expected int64, value int64) (bool, error) {
+	table.ops.Update()
+	if err := table.checkWritable(); err != nil {
+		return false, err
+	}
+	if table.codec != DefaultCodec {
+		return false, fmt.Errorf("compare and swap on %s: %w", table.GetName(), ErrCodecUnsupported)
+	}
+	// Get the root node.
+	rootPage, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return false, err
+	}
+	// [CONCURRENCY] Lock and eventually unlock the root node.
+	lockRoot(rootPage)
+	rootNode := pageToNode(rootPage, table.codec)
+	initRootNode(rootNode)
+	defer unsafeUnlockRoot(rootNode)
+	defer rootPage.Put()
+	return rootNode.compareAndSwap(key, expected, value)
+}
+
 // Delete removes a key from the table.
 func (table *BTreeIndex) Delete(key int64) error {
+	table.ops.Delete()
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -162,17 +485,20 @@ func (table *BTreeIndex) Delete(key int64) error {
 	}
 	// [CONCURRENCY] Lock and eventually unlock the root node.
 	lockRoot(rootPage)
-	rootNode := pageToNode(rootPage)
+	rootNode := pageToNode(rootPage, table.codec)
 	initRootNode(rootNode)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Delete the key.
-	rootNode.delete(key)
+	rootNode.delete(key, table.tombstones)
 	return nil
 }
 
 // Select returns a slice of all entries in the table.
 func (table *BTreeIndex) Select() ([]utils.Entry, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
 	/* SOLUTION {{{ */
 	// Use a cursor to traverse the table from start to end.
 	entries := make([]utils.Entry, 0)
@@ -197,6 +523,433 @@ func (table *BTreeIndex) Select() ([]utils.Entry, error) {
 	/* SOLUTION }}} */
 }
 
+// FindFirst returns the first entry, in key order, that satisfies pred, and
+// whether there was one. The scan stops at the match, so unlike filtering the
+// result of Select, entries past it are never read.
+func (table *BTreeIndex) FindFirst(pred func(utils.Entry) bool) (utils.Entry, bool, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, false, err
+	}
+	cursor, err := table.TableStart()
+	if err != nil {
+		return nil, false, err
+	}
+	return findFirst(cursor, pred)
+}
+
+// findFirst steps the cursor forward until it reaches an entry satisfying pred.
+func findFirst(cursor utils.Cursor, pred func(utils.Entry) bool) (utils.Entry, bool, error) {
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return nil, false, err
+			}
+			if pred(entry) {
+				return entry, true, nil
+			}
+		}
+		if err := cursor.StepForward(); err != nil {
+			if errors.Is(err, utils.ErrCursorEnd) {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+	}
+}
+
+// SelectPage returns up to limit entries with keys greater than afterKey, in
+// order, along with the key to pass as afterKey to get the next page: the last
+// key returned, or afterKey if nothing was. A page with fewer than limit
+// entries is the last. Start with SelectFirstPage, since no afterKey is below
+// a key of math.MinInt64. Each call is independent, and holds no locks or
+// pins once it returns, so the table may change between pages: entries added
+// behind the continuation key are missed, and none are returned twice.
+func (table *BTreeIndex) SelectPage(afterKey int64, limit int) ([]utils.Entry, int64, error) {
+	return table.selectPage(afterKey, false, limit)
+}
+
+// SelectFirstPage returns up to limit entries from the start of the table, in
+// order, along with the key to pass to SelectPage to get the next page, as
+// SelectPage does. The key is math.MinInt64 if nothing was returned.
+func (table *BTreeIndex) SelectFirstPage(limit int) ([]utils.Entry, int64, error) {
+	return table.selectPage(math.MinInt64, true, limit)
+}
+
+// selectPage returns a page of entries with keys greater than afterKey, or
+// from the start of the table if fromStart is set.
+func (table *BTreeIndex) selectPage(afterKey int64, fromStart bool, limit int) ([]utils.Entry, int64, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, afterKey, err
+	}
+	if limit <= 0 {
+		return nil, afterKey, fmt.Errorf("page limit must be positive, got %d", limit)
+	}
+	entries := make([]utils.Entry, 0, limit)
+	startKey := afterKey
+	if !fromStart {
+		if afterKey == math.MaxInt64 {
+			return entries, afterKey, nil
+		}
+		startKey = afterKey + 1
+	}
+	cursor, err := table.TableFind(startKey)
+	if err != nil {
+		return nil, afterKey, err
+	}
+	next := afterKey
+	for len(entries) < limit {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return nil, afterKey, err
+			}
+			entries = append(entries, entry)
+			next = entry.GetKey()
+		}
+		if err := cursor.StepForward(); errors.Is(err, utils.ErrCursorEnd) {
+			break
+		} else if err != nil {
+			return nil, afterKey, err
+		}
+	}
+	return entries, next, nil
+}
+
+// SelectChan streams all entries in the table, in order, as they are read.
+// The entry channel is closed once the scan ends; the error channel then
+// yields the scan's error, or ctx.Err() if ctx was cancelled first.
+// Cancelling ctx stops the scan before it sends another entry. The cursor
+// only pins a page while stepping onto it, so a stopped scan holds no pages.
+func (table *BTreeIndex) SelectChan(ctx context.Context) (<-chan utils.Entry, <-chan error) {
+	entries := make(chan utils.Entry)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(entries)
+		errs <- table.streamEntries(ctx, entries)
+	}()
+	return entries, errs
+}
+
+// streamEntries sends every entry in the table on the given channel, stopping if ctx is cancelled.
+func (table *BTreeIndex) streamEntries(ctx context.Context, entries chan<- utils.Entry) error {
+	cursor, err := table.TableStart()
+	if err != nil {
+		return err
+	}
+	for {
+		// Check on every step, so that runs of empty leaves don't delay stopping,
+		// and first, since select picks at random when both cases are ready.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case entries <- entry:
+			}
+		}
+		if err := cursor.StepForward(); err != nil {
+			return nil
+		}
+	}
+}
+
+// Defragment rebuilds the table from its own entries, packing them into densely
+// filled leaves and deallocating the pages that are no longer needed.
+// The root stays on page 0, so the tree is rebuilt in place, with the root
+// locked throughout: the entries are read into memory, and the tree is built
+// back up from its leaves, reusing the pages after the root in order.
+// The leaves only keep a tombstone flag in each cell if tombstones are enabled.
+func (table *BTreeIndex) Defragment() error {
+	return table.rebuild(table.tombstones, true)
+}
+
+// rebuild rebuilds the table as described by Defragment, with leaves laid out
+// with or without tombstone cells. Unless force is set, a table whose leaves
+// are already laid out that way is left as is.
+func (table *BTreeIndex) rebuild(tombstoneCells bool, force bool) error {
+	if err := table.checkWritable(); err != nil {
+		return err
+	}
+	rootPage, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return err
+	}
+	defer rootPage.Put()
+	// [CONCURRENCY] Lock the root for the whole rebuild, and keep appends
+	// from going straight to the old last leaf.
+	lockRoot(rootPage)
+	defer SUPER_NODE.page.WUnlock()
+	defer rootPage.WUnlock()
+	if !force {
+		laidOut, err := table.hasTombstoneCells()
+		if err != nil || laidOut == tombstoneCells {
+			return err
+		}
+	}
+	atomic.StoreInt64(&table.lastLeafPN, pager.NOPAGE)
+	entries, err := table.readLeaves()
+	if err != nil {
+		return err
+	}
+	table.setHeight(1)
+	// Fill the leaves, then each level of internal nodes above them, until
+	// the last level fits in the root.
+	nextPN := table.rootPN + 1
+	leafFill := int64(DEFRAGMENT_SPLIT_RATIO * float64(entriesPerLeaf(table.codec, tombstoneCells)))
+	if leafFill < 1 {
+		leafFill = 1
+	}
+	if int64(len(entries)) <= leafFill {
+		initPage(rootPage, LEAF_NODE)
+		root := pageToLeafNode(rootPage, table.codec)
+		root.setRightSibling(pager.NOPAGE)
+		if tombstoneCells {
+			root.setTombstoneCells()
+		}
+		for i, entry := range entries {
+			root.modifyCell(int64(i), entry)
+		}
+		root.updateNumKeys(int64(len(entries)))
+		return table.pager.Truncate(nextPN)
+	}
+	level, err := table.buildLeaves(entries, leafFill, tombstoneCells, &nextPN)
+	if err != nil {
+		return err
+	}
+	table.setHeight(2)
+	internalFill := int64(DEFRAGMENT_SPLIT_RATIO * float64(KEYS_PER_INTERNAL_NODE+1))
+	if internalFill < 2 {
+		internalFill = 2
+	}
+	for height := 2; int64(len(level)) > KEYS_PER_INTERNAL_NODE+1; height++ {
+		if level, err = table.buildInternalLevel(level, internalFill, &nextPN); err != nil {
+			return err
+		}
+		table.setHeight(height + 1)
+	}
+	initPage(rootPage, INTERNAL_NODE)
+	fillInternalNode(pageToInternalNode(rootPage, table.codec), level)
+	return table.pager.Truncate(nextPN)
+}
+
+// hasTombstoneCells returns whether the table's leaves have a tombstone flag in
+// each cell. Every leaf is laid out the same way, so only the first is checked.
+// Expects the root to be locked, so that the internal nodes can't change.
+func (table *BTreeIndex) hasTombstoneCells() (bool, error) {
+	pn := table.rootPN
+	for {
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return false, err
+		}
+		if pageToNodeHeader(page).nodeType == LEAF_NODE {
+			tombstoneCells := pageToLeafNode(page, table.codec).tombstoneCells
+			page.Put()
+			return tombstoneCells, nil
+		}
+		pn = pageToInternalNode(page, table.codec).getPNAt(0)
+		page.Put()
+	}
+}
+
+// rebuiltNode is a node written by Defragment: its page, and the smallest key under it.
+type rebuiltNode struct {
+	pn       int64
+	firstKey int64
+}
+
+// readLeaves returns every entry in the table that isn't a tombstone, in key
+// order. Expects the root to be locked; each other leaf is locked while it is read.
+func (table *BTreeIndex) readLeaves() ([]utils.Entry, error) {
+	leaves, err := table.leafPNs()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]utils.Entry, 0)
+	for _, pn := range leaves {
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return nil, err
+		}
+		if pn != table.rootPN {
+			page.RLock()
+		}
+		leaf := pageToLeafNode(page, table.codec)
+		for i := int64(0); i < leaf.numKeys; i++ {
+			if !leaf.isTombstone(i) {
+				entries = append(entries, leaf.getCell(i))
+			}
+		}
+		if pn != table.rootPN {
+			page.RUnlock()
+		}
+		page.Put()
+	}
+	return entries, nil
+}
+
+// rebuildPage returns the given page, pinned, allocating it if it is past the end
+// of the file, and advances pn. Pages are handed out in order, so each page
+// allocated is the next one.
+func (table *BTreeIndex) rebuildPage(pn *int64) (*pager.Page, error) {
+	defer func() { *pn++ }()
+	if *pn < table.pager.GetNumPages() {
+		return table.pager.GetPage(*pn)
+	}
+	return table.pager.AllocatePage()
+}
+
+// buildLeaves writes the entries into linked leaves of at most fill entries each,
+// and returns the leaves in order.
+func (table *BTreeIndex) buildLeaves(entries []utils.Entry, fill int64, tombstoneCells bool, nextPN *int64) ([]rebuiltNode, error) {
+	leaves := make([]rebuiltNode, 0)
+	var prev *LeafNode
+	for start := int64(0); start < int64(len(entries)); start += fill {
+		page, err := table.rebuildPage(nextPN)
+		if err != nil {
+			if prev != nil {
+				prev.page.Put()
+			}
+			return nil, err
+		}
+		initPage(page, LEAF_NODE)
+		leaf := pageToLeafNode(page, table.codec)
+		leaf.setRightSibling(pager.NOPAGE)
+		if tombstoneCells {
+			leaf.setTombstoneCells()
+		}
+		end := start + fill
+		if end > int64(len(entries)) {
+			end = int64(len(entries))
+		}
+		for i := start; i < end; i++ {
+			leaf.modifyCell(i-start, entries[i])
+		}
+		leaf.updateNumKeys(end - start)
+		if prev != nil {
+			prev.setRightSibling(page.GetPageNum())
+			prev.page.Put()
+		}
+		prev = leaf
+		leaves = append(leaves, rebuiltNode{pn: page.GetPageNum(), firstKey: entries[start].GetKey()})
+	}
+	prev.page.Put()
+	return leaves, nil
+}
+
+// buildInternalLevel writes internal nodes over the given nodes, with at most
+// fill children each, and returns the new nodes in order.
+func (table *BTreeIndex) buildInternalLevel(children []rebuiltNode, fill int64, nextPN *int64) ([]rebuiltNode, error) {
+	level := make([]rebuiltNode, 0)
+	for start := int64(0); start < int64(len(children)); start += fill {
+		page, err := table.rebuildPage(nextPN)
+		if err != nil {
+			return nil, err
+		}
+		initPage(page, INTERNAL_NODE)
+		end := start + fill
+		if end > int64(len(children)) {
+			end = int64(len(children))
+		}
+		fillInternalNode(pageToInternalNode(page, table.codec), children[start:end])
+		page.Put()
+		level = append(level, rebuiltNode{pn: page.GetPageNum(), firstKey: children[start].firstKey})
+	}
+	return level, nil
+}
+
+// fillInternalNode points an empty internal node at the given children,
+// keyed by the first key under each child but the first.
+func fillInternalNode(node *InternalNode, children []rebuiltNode) {
+	for i, child := range children {
+		if i > 0 {
+			node.updateKeyAt(int64(i-1), child.firstKey)
+		}
+		node.updatePNAt(int64(i), child.pn)
+	}
+	node.updateNumKeys(int64(len(children) - 1))
+}
+
+// Purge removes the entries that were deleted as tombstones, and returns how many
+// it removed. Leaves are compacted in place but never merged; Defragment also
+// removes tombstones, and frees the pages they leave empty.
+// Must not run concurrently with other operations on the table.
+func (table *BTreeIndex) Purge() (int, error) {
+	if err := table.checkWritable(); err != nil {
+		return 0, err
+	}
+	leaves, err := table.leafPNs()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, pn := range leaves {
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return purged, err
+		}
+		leaf := pageToLeafNode(page, table.codec)
+		// Shift the remaining entries left over the tombstones.
+		kept := int64(0)
+		for i := int64(0); i < leaf.numKeys; i++ {
+			if leaf.isTombstone(i) {
+				purged++
+				continue
+			}
+			if kept != i {
+				leaf.copyCellFrom(leaf, i, kept)
+			}
+			kept++
+		}
+		leaf.updateNumKeys(kept)
+		page.Put()
+	}
+	return purged, nil
+}
+
+// PageNumbers returns the page numbers of all of the table's nodes, in
+// ascending order, found by walking the tree from the root.
+func (table *BTreeIndex) PageNumbers() ([]int64, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
+	pagenums, err := table.appendPNs(table.rootPN, make([]int64, 0))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pagenums, func(i, j int) bool { return pagenums[i] < pagenums[j] })
+	return pagenums, nil
+}
+
+// appendPNs appends the page numbers of the given page and every node under it to pagenums.
+func (table *BTreeIndex) appendPNs(pn int64, pagenums []int64) ([]int64, error) {
+	page, err := table.pager.GetPage(pn)
+	if err != nil {
+		return nil, err
+	}
+	defer page.Put()
+	pagenums = append(pagenums, pn)
+	if pageToNodeHeader(page).nodeType == LEAF_NODE {
+		return pagenums, nil
+	}
+	node := pageToInternalNode(page, table.codec)
+	for i := int64(0); i <= node.numKeys; i++ {
+		pagenums, err = table.appendPNs(node.getPNAt(i), pagenums)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pagenums, nil
+}
+
 // Print will pretty-print all nodes in the table.
 func (table *BTreeIndex) Print(w io.Writer) {
 	rootPage, err := table.pager.GetPage(table.rootPN)
@@ -204,7 +957,7 @@ func (table *BTreeIndex) Print(w io.Writer) {
 		return
 	}
 	defer rootPage.Put()
-	rootNode := pageToNode(rootPage)
+	rootNode := pageToNode(rootPage, table.codec)
 	rootNode.printNode(w, "", "")
 }
 
@@ -215,6 +968,6 @@ func (table *BTreeIndex) PrintPN(pagenum int, w io.Writer) {
 		return
 	}
 	defer page.Put()
-	node := pageToNode(page)
+	node := pageToNode(page, table.codec)
 	node.printNode(w, "", "")
 }
@@ -4,8 +4,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sync/atomic"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
 // We'll always maintain the invariant that the root's pagenum is 0.
@@ -26,6 +28,22 @@ var RIGHT_SIBLING_PN_SIZE int64 = binary.MaxVarintLen64
 var LEAF_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE + RIGHT_SIBLING_PN_SIZE
 var ENTRIES_PER_LEAF_NODE int64 = ((pager.PAGESIZE - LEAF_NODE_HEADER_SIZE) / ENTRYSIZE) - 1
 
+// A codec's entries must fit at least this many to a leaf, tombstones included,
+// so that a splitting leaf leaves entries on both sides.
+var MIN_ENTRIES_PER_LEAF_NODE int64 = 4
+
+// Leaves written while tombstones are enabled set this bit in their node type
+// byte, and end each cell with a flag set if its entry was deleted. Other
+// leaves keep the plain layout.
+var TOMBSTONE_CELLS_BIT byte = 2
+var TOMBSTONE_SIZE int64 = 1
+
+// By default, a splitting leaf keeps half of its entries.
+var DEFAULT_SPLIT_RATIO float64 = 0.5
+
+// When defragmenting, a splitting leaf keeps most of its entries, packing leaves densely.
+var DEFRAGMENT_SPLIT_RATIO float64 = 0.9
+
 // Internal node header constants.
 var KEY_SIZE int64 = binary.MaxVarintLen64
 var PN_SIZE int64 = binary.MaxVarintLen64
@@ -37,7 +55,7 @@ var KEYS_SIZE int64 = KEY_SIZE * (KEYS_PER_INTERNAL_NODE + 1)
 var PNS_OFFSET int64 = KEYS_OFFSET + KEYS_SIZE
 
 // [CONCURRENCY]
-var SUPER_NODE *InternalNode = &InternalNode{NodeHeader{INTERNAL_NODE, 0, &pager.Page{}}, nil}
+var SUPER_NODE *InternalNode = &InternalNode{NodeHeader{INTERNAL_NODE, 0, &pager.Page{}, nil}, nil}
 
 // NodeType identifies if a node is a leaf node or internal node.
 type NodeType bool
@@ -52,12 +70,14 @@ type NodeHeader struct {
 	nodeType NodeType
 	numKeys  int64
 	page     *pager.Page
+	codec    utils.EntryCodec // How the tree's leaf cells are encoded.
 }
 
 // Leaf Node definition
 type LeafNode struct {
 	NodeHeader           // Include header information
-	rightSiblingPN int64 // Page number of the right sibling node
+	rightSiblingPN int64 // Page number of the right sibling node, or pager.NOPAGE for the last leaf
+	tombstoneCells bool  // Whether each cell ends with a tombstone flag
 	parent         Node  // Pointer to the parent node for unlocking.
 }
 
@@ -81,12 +101,12 @@ func initPage(page *pager.Page, nodeType NodeType) {
 }
 
 // pageToNode returns the node corresponding to the given page.
-func pageToNode(page *pager.Page) Node {
+func pageToNode(page *pager.Page, codec utils.EntryCodec) Node {
 	nodeHeader := pageToNodeHeader(page)
 	if nodeHeader.nodeType == LEAF_NODE {
-		return pageToLeafNode(page)
+		return pageToLeafNode(page, codec)
 	}
-	return pageToInternalNode(page)
+	return pageToInternalNode(page, codec)
 }
 
 // pageToNodeHeader returns node header data from the given page.
@@ -107,9 +127,17 @@ func pageToNodeHeader(page *pager.Page) NodeHeader {
 	}
 }
 
-// cellPos computes the position of a cell within a page given a headersize.
-func cellPos(headersize int64, cellnum int64) int64 {
-	return headersize + cellnum*ENTRYSIZE
+// entriesPerLeaf returns how many entries of the given codec fit in a leaf node,
+// with or without a tombstone flag in each cell.
+func entriesPerLeaf(codec utils.EntryCodec, tombstoneCells bool) int64 {
+	if codec == DefaultCodec && !tombstoneCells {
+		return ENTRIES_PER_LEAF_NODE
+	}
+	cellSize := int64(codec.Size())
+	if tombstoneCells {
+		cellSize += TOMBSTONE_SIZE
+	}
+	return ((pager.PAGESIZE - LEAF_NODE_HEADER_SIZE) / cellSize) - 1
 }
 
 // keyPos returns the offset in the page to the internal node's ith key.
@@ -127,28 +155,29 @@ func pnPos(index int64) int64 {
 /////////////////////////////////////////////////////////////////////////////
 
 // pageToLeafNode returns the leaf node at the corresponding page.
-func pageToLeafNode(page *pager.Page) *LeafNode {
+func pageToLeafNode(page *pager.Page, codec utils.EntryCodec) *LeafNode {
 	nodeHeader := pageToNodeHeader(page)
+	nodeHeader.codec = codec
 	rightSiblingPN, _ := binary.Varint(
 		(*page.GetData())[RIGHT_SIBLING_PN_OFFSET : RIGHT_SIBLING_PN_OFFSET+RIGHT_SIBLING_PN_SIZE],
 	)
 	return &LeafNode{
 		nodeHeader,
 		rightSiblingPN,
+		(*page.GetData())[NODETYPE_OFFSET]&TOMBSTONE_CELLS_BIT != 0,
 		nil,
 	}
 }
 
 // createLeafNode creates and returns a new leaf node.
 // Nodes created with this function must be `Put()` accordingly after use.
-func createLeafNode(pager *pager.Pager) (*LeafNode, error) {
-	newPN := pager.GetFreePN()
-	newPage, err := pager.GetPage(newPN)
+func createLeafNode(pager *pager.Pager, codec utils.EntryCodec) (*LeafNode, error) {
+	newPage, err := pager.AllocatePage()
 	if err != nil {
 		return &LeafNode{}, err
 	}
 	initPage(newPage, LEAF_NODE)
-	return pageToLeafNode(newPage), nil
+	return pageToLeafNode(newPage, codec), nil
 }
 
 // getPage returns a pointer to the leaf node's page.
@@ -166,6 +195,7 @@ func (node *LeafNode) copy(toCopy *LeafNode) {
 	copy(*node.page.GetData(), *toCopy.page.GetData())
 	node.updateNumKeys(toCopy.numKeys)
 	node.setRightSibling(toCopy.rightSiblingPN)
+	node.tombstoneCells = toCopy.tombstoneCells
 }
 
 // isRoot returns true if the current node is the root node.
@@ -190,48 +220,75 @@ func (node *LeafNode) setRightSibling(siblingPN int64) int64 {
 	return oldSiblingPN
 }
 
+// maxEntries returns how many entries the leaf node can hold before splitting.
+func (node *LeafNode) maxEntries() int64 {
+	return entriesPerLeaf(node.codec, node.tombstoneCells)
+}
+
+// cellSize returns the size of a cell: an encoded entry, followed by its tombstone flag if the leaf has them.
+func (node *LeafNode) cellSize() int64 {
+	if node.tombstoneCells {
+		return int64(node.codec.Size()) + TOMBSTONE_SIZE
+	}
+	return int64(node.codec.Size())
+}
+
+// setTombstoneCells switches an empty leaf to the layout with a tombstone flag in each cell.
+func (node *LeafNode) setTombstoneCells() {
+	node.tombstoneCells = true
+	node.page.Update([]byte{1 | TOMBSTONE_CELLS_BIT}, NODETYPE_OFFSET, NODETYPE_SIZE)
+}
+
 // cellPos returns the page offset to the cell at the given index.
 func (node *LeafNode) cellPos(index int64) int64 {
-	return cellPos(LEAF_NODE_HEADER_SIZE, index)
+	return LEAF_NODE_HEADER_SIZE + index*node.cellSize()
 }
 
-// modifyCell updates the data stored in the cell at the given index.
-func (node *LeafNode) modifyCell(index int64, entry BTreeEntry) {
-	newdata := entry.Marshal()
+// modifyCell updates the data stored in the cell at the given index, clearing its tombstone.
+func (node *LeafNode) modifyCell(index int64, entry utils.Entry) {
+	newdata := make([]byte, node.cellSize())
+	copy(newdata, node.codec.Encode(entry))
 	startPos := node.cellPos(index)
-	node.page.Update(newdata, startPos, ENTRYSIZE)
+	node.page.Update(newdata, startPos, node.cellSize())
 }
 
 // getCell returns the entry stored in the cell at the given index.
-func (node *LeafNode) getCell(index int64) BTreeEntry {
+func (node *LeafNode) getCell(index int64) utils.Entry {
 	startPos := node.cellPos(index)
 	// Deserialize the entry.
-	entry := unmarshalEntry((*node.page.GetData())[startPos : startPos+ENTRYSIZE])
-	return entry
+	return node.codec.Decode((*node.page.GetData())[startPos : startPos+int64(node.codec.Size())])
 }
 
-// getKeyAt returns the key stored at the given index of the leaf node.
-func (node *LeafNode) getKeyAt(index int64) int64 {
-	return node.getCell(index).GetKey()
+// copyCellFrom copies the raw cell at index src of the given node into index dst of this one.
+// The nodes may be the same.
+func (node *LeafNode) copyCellFrom(from *LeafNode, src int64, dst int64) {
+	size := node.cellSize()
+	startPos := from.cellPos(src)
+	data := make([]byte, size)
+	copy(data, (*from.page.GetData())[startPos:startPos+size])
+	node.page.Update(data, node.cellPos(dst), size)
 }
 
-// updateKeyAt updates the key at the given index of the leaf node.
-func (node *LeafNode) updateKeyAt(index int64, key int64) {
-	entry := node.getCell(index)
-	entry.SetKey(key)
-	node.modifyCell(index, entry)
+// isTombstone returns true if the entry at the given index was deleted, but not yet purged.
+func (node *LeafNode) isTombstone(index int64) bool {
+	if !node.tombstoneCells {
+		return false
+	}
+	return (*node.page.GetData())[node.cellPos(index)+int64(node.codec.Size())] != 0
 }
 
-// getValueAt returns the value stored at the given index of the leaf node.
-func (node *LeafNode) getValueAt(index int64) int64 {
-	return node.getCell(index).GetValue()
+// setTombstone marks the entry at the given index as deleted, keeping it in the cell.
+// The leaf must have tombstone cells.
+func (node *LeafNode) setTombstone(index int64) {
+	node.page.Update([]byte{1}, node.cellPos(index)+int64(node.codec.Size()), TOMBSTONE_SIZE)
 }
 
-// updateValueAt updates the value at the given index of the leaf node.
-func (node *LeafNode) updateValueAt(index int64, value int64) {
-	entry := node.getCell(index)
-	entry.SetValue(value)
-	node.modifyCell(index, entry)
+// getKeyAt returns the key stored at the given index of the leaf node.
+// Only the key half of the cell is deserialized.
+func (node *LeafNode) getKeyAt(index int64) int64 {
+	startPos := node.cellPos(index)
+	key, _ := binary.Varint((*node.page.GetData())[startPos : startPos+KEY_SIZE])
+	return key
 }
 
 // updateNumKeys updates the numKeys field in the node struct and the page.
@@ -248,21 +305,21 @@ func (node *LeafNode) updateNumKeys(nKeys int64) {
 /////////////////////////////////////////////////////////////////////////////
 
 // pageToInternalNode returns the internal node corresponding to the given page.
-func pageToInternalNode(page *pager.Page) *InternalNode {
+func pageToInternalNode(page *pager.Page, codec utils.EntryCodec) *InternalNode {
 	nodeHeader := pageToNodeHeader(page)
+	nodeHeader.codec = codec
 	return &InternalNode{nodeHeader, nil}
 }
 
 // createInternalNode creates and returns a new internal node.
 // Nodes created with this function must be `Put()` accordingly after use.
-func createInternalNode(pager *pager.Pager) (*InternalNode, error) {
-	newPN := pager.GetFreePN()
-	newPage, err := pager.GetPage(newPN)
+func createInternalNode(pager *pager.Pager, codec utils.EntryCodec) (*InternalNode, error) {
+	newPage, err := pager.AllocatePage()
 	if err != nil {
 		return &InternalNode{}, err
 	}
 	initPage(newPage, INTERNAL_NODE)
-	return pageToInternalNode(newPage), nil
+	return pageToInternalNode(newPage, codec), nil
 }
 
 // getPage returns the internal node's page.
@@ -331,7 +388,7 @@ func (node *InternalNode) getChildAt(index int64, lock bool) (Node, error) {
 	if lock {
 		page.WLock()
 	}
-	return pageToNode(page), nil
+	return pageToNode(page, node.codec), nil
 }
 
 // updateNumKeys updates the numKeys field in the node struct and the page.
@@ -343,6 +400,111 @@ func (node *InternalNode) updateNumKeys(nKeys int64) {
 	node.page.Update(nKeysData, NUM_KEYS_OFFSET, NUM_KEYS_SIZE)
 }
 
+/////////////////////////////////////////////////////////////////////////////
+//////////////////////// Append Fast Path Functions /////////////////////////
+/////////////////////////////////////////////////////////////////////////////
+
+// tryAppend inserts the entry into the cached last leaf if its key is greater than
+// every key there and the leaf has room, so that no split is needed. The last leaf
+// is the only one that can hold such a key, and appending to it doesn't change any
+// internal node, so only the leaf has to be locked. Returns whether the entry was
+// appended, and whether it wasn't because the cache is stale.
+func (table *BTreeIndex) tryAppend(entry utils.Entry) (appended bool, stale bool) {
+	pn := atomic.LoadInt64(&table.lastLeafPN)
+	// The root is locked differently, so it is never appended to directly.
+	if pn <= table.rootPN || pn >= table.pager.GetNumPages() {
+		return false, true
+	}
+	page, err := table.pager.GetPage(pn)
+	if err != nil {
+		return false, true
+	}
+	defer page.Put()
+	page.WLock()
+	defer page.WUnlock()
+	// Now that the leaf is locked, check that it is still the last leaf, and has room.
+	// Defragment clears the cache before reading the leaves, so an append that
+	// gets here after it has read this one gives up rather than being lost.
+	if atomic.LoadInt64(&table.lastLeafPN) != pn || pageToNodeHeader(page).nodeType != LEAF_NODE {
+		return false, true
+	}
+	leaf := pageToLeafNode(page, table.codec)
+	if leaf.rightSiblingPN != pager.NOPAGE {
+		return false, true
+	}
+	// If the leaf is full, the normal path splits it, and the next append finds the new last leaf.
+	if leaf.numKeys >= leaf.maxEntries() || leaf.numKeys == 0 || entry.GetKey() <= leaf.getKeyAt(leaf.numKeys-1) {
+		return false, false
+	}
+	leaf.modifyCell(leaf.numKeys, entry)
+	leaf.updateNumKeys(leaf.numKeys + 1)
+	return true, false
+}
+
+// cacheLastLeaf finds the last leaf for tryAppend, locking nodes hand over hand
+// on the way down so that it never sees a half-finished split.
+func (table *BTreeIndex) cacheLastLeaf() {
+	atomic.StoreInt64(&table.lastLeafPN, pager.NOPAGE)
+	page, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return
+	}
+	page.WLock()
+	for pageToNodeHeader(page).nodeType != LEAF_NODE {
+		node := pageToInternalNode(page, table.codec)
+		child, err := table.pager.GetPage(node.getPNAt(node.numKeys))
+		if err != nil {
+			page.WUnlock()
+			page.Put()
+			return
+		}
+		child.WLock()
+		page.WUnlock()
+		page.Put()
+		page = child
+	}
+	atomic.StoreInt64(&table.lastLeafPN, page.GetPageNum())
+	page.WUnlock()
+	page.Put()
+}
+
+// readLockLeaf descends to the leaf that the given key belongs in, read-locking
+// nodes hand over hand on the way down as Find does, and returns its page
+// pinned and read-locked.
+func (table *BTreeIndex) readLockLeaf(key int64) (*pager.Page, error) {
+	page, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return nil, err
+	}
+	SUPER_NODE.page.RLock()
+	page.RLock()
+	SUPER_NODE.page.RUnlock()
+	for pageToNodeHeader(page).nodeType != LEAF_NODE {
+		node := pageToInternalNode(page, table.codec)
+		child, err := table.pager.GetPage(node.getPNAt(node.search(key)))
+		if err != nil {
+			page.RUnlock()
+			page.Put()
+			return nil, err
+		}
+		child.RLock()
+		page.RUnlock()
+		page.Put()
+		page = child
+	}
+	return page, nil
+}
+
+// leafCovers returns whether a key, no smaller than one that belongs in the
+// given leaf, can only be in it: if it is no larger than the leaf's last key,
+// or the leaf is the last one.
+func leafCovers(leaf *LeafNode, key int64) bool {
+	if leaf.rightSiblingPN == pager.NOPAGE {
+		return true
+	}
+	return leaf.numKeys > 0 && key <= leaf.getKeyAt(leaf.numKeys-1)
+}
+
 /////////////////////////////////////////////////////////////////////////////
 ////////////////////////// Lock  Helper Functions ///////////////////////////
 /////////////////////////////////////////////////////////////////////////////
@@ -430,7 +592,7 @@ func (node *InternalNode) unlock() {
 // only checks if force == false
 func (node *LeafNode) unlockParent(force bool) error {
 	// If we could split and if we're not writing, don't unlock the parents.
-	if !force && node.numKeys == ENTRIES_PER_LEAF_NODE {
+	if !force && node.numKeys == node.maxEntries() {
 		return nil
 	}
 	// Unlock the parents recursively, and remove parent pointers.
@@ -0,0 +1,120 @@
+package btree
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrCompositeKeyRange is returned when a component of a composite key doesn't fit in 32 bits.
+var ErrCompositeKeyRange = errors.New("composite key component out of range")
+
+// PackKey packs a pair of keys into a single key, such that packed keys sort
+// the same way as the pairs do: by first component, then by second. Both
+// components must fit in an int32, since the packed key is an int64.
+func PackKey(first int64, second int64) (int64, error) {
+	if first < math.MinInt32 || first > math.MaxInt32 || second < math.MinInt32 || second > math.MaxInt32 {
+		return 0, ErrCompositeKeyRange
+	}
+	// Offset the second component so that it is never negative.
+	return first<<32 | (second - math.MinInt32), nil
+}
+
+// UnpackKey splits a packed key back into its pair of keys.
+func UnpackKey(key int64) (first int64, second int64) {
+	return key >> 32, key&math.MaxUint32 + math.MinInt32
+}
+
+// CompositeEntry is an entry of a CompositeIndex.
+type CompositeEntry struct {
+	First  int64 // First component of the key.
+	Second int64 // Second component of the key.
+	Value  int64
+}
+
+// CompositeIndex keys a B+ tree on pairs of int64s, ordered by first component,
+// then by second. Pairs are packed into the tree's keys with PackKey, so scans
+// over every pair with a given first component are range scans.
+type CompositeIndex struct {
+	table *BTreeIndex
+}
+
+// NewCompositeIndex wraps the given table. Its keys must all be packed pairs.
+func NewCompositeIndex(table *BTreeIndex) *CompositeIndex {
+	return &CompositeIndex{table: table}
+}
+
+// Get the underlying table.
+func (index *CompositeIndex) GetTable() *BTreeIndex {
+	return index.table
+}
+
+// Finds the entry with the given pair of keys.
+func (index *CompositeIndex) Find(first int64, second int64) (CompositeEntry, error) {
+	key, err := PackKey(first, second)
+	if err != nil {
+		return CompositeEntry{}, err
+	}
+	entry, err := index.table.Find(key)
+	if err != nil {
+		return CompositeEntry{}, err
+	}
+	return CompositeEntry{First: first, Second: second, Value: entry.GetValue()}, nil
+}
+
+// Inserts an entry with the given pair of keys.
+func (index *CompositeIndex) Insert(first int64, second int64, value int64) error {
+	key, err := PackKey(first, second)
+	if err != nil {
+		return err
+	}
+	return index.table.Insert(key, value)
+}
+
+// Update modifies the entry with the given pair of keys.
+func (index *CompositeIndex) Update(first int64, second int64, value int64) error {
+	key, err := PackKey(first, second)
+	if err != nil {
+		return err
+	}
+	return index.table.Update(key, value)
+}
+
+// Delete removes the entry with the given pair of keys.
+func (index *CompositeIndex) Delete(first int64, second int64) error {
+	key, err := PackKey(first, second)
+	if err != nil {
+		return err
+	}
+	return index.table.Delete(key)
+}
+
+// FindPrefix returns every entry whose first component is the given key, ordered by second component.
+func (index *CompositeIndex) FindPrefix(first int64) ([]CompositeEntry, error) {
+	start, err := PackKey(first, math.MinInt32)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]CompositeEntry, 0)
+	cursor, err := index.table.TableFind(start)
+	if err != nil {
+		return nil, err
+	}
+	// Stop at the first key with another first component. The end of the
+	// range can't be given as a packed key, since it may not fit in an int64.
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return nil, err
+			}
+			entryFirst, entrySecond := UnpackKey(entry.GetKey())
+			if entryFirst != first {
+				return entries, nil
+			}
+			entries = append(entries, CompositeEntry{First: entryFirst, Second: entrySecond, Value: entry.GetValue()})
+		}
+		if err := cursor.StepForward(); err != nil {
+			return entries, nil
+		}
+	}
+}
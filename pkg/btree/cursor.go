@@ -1,8 +1,9 @@
 package btree
 
 import (
-	"errors"
+	"fmt"
 
+	pager "github.com/brown-csci1270/db/pkg/pager"
 	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
@@ -16,35 +17,52 @@ type BTreeCursor struct {
 
 // TableStart returns a cursor pointing to the first entry of the table.
 func (table *BTreeIndex) TableStart() (utils.Cursor, error) {
-	cursor := BTreeCursor{table: table, cellnum: 0}
-	// Get the root page.
-	curPage, err := table.pager.GetPage(table.rootPN)
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
+	cursor := BTreeCursor{table: table}
+	err := cursor.Reset()
 	if err != nil {
 		return nil, err
 	}
+	return &cursor, nil
+}
+
+// Reset repositions the cursor at the first entry of the table, reusing the cursor.
+func (cursor *BTreeCursor) Reset() error {
+	// Get the root page.
+	curPage, err := cursor.table.pager.GetPage(cursor.table.rootPN)
+	if err != nil {
+		return err
+	}
 	defer curPage.Put()
 	curHeader := pageToNodeHeader(curPage)
 	// Traverse the leftmost children until we reach a leaf node.
 	for curHeader.nodeType != LEAF_NODE {
-		curNode := pageToInternalNode(curPage)
+		curNode := pageToInternalNode(curPage, cursor.table.codec)
 		leftmostPN := curNode.getPNAt(0)
-		curPage, err = table.pager.GetPage(leftmostPN)
+		curPage, err = cursor.table.pager.GetPage(leftmostPN)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		defer curPage.Put()
 		curHeader = pageToNodeHeader(curPage)
 	}
 	// Set the cursor to point to the first entry in the leftmost leaf node.
-	leftmostNode := pageToLeafNode(curPage)
+	leftmostNode := pageToLeafNode(curPage, cursor.table.codec)
+	cursor.cellnum = 0
 	cursor.isEnd = (leftmostNode.numKeys == 0)
 	cursor.curNode = leftmostNode
-	return &cursor, nil
+	cursor.skipTombstone()
+	return nil
 }
 
 // TableEnd returns a cursor pointing to the last entry in the db.
 // If the db is empty, returns a cursor to the new insertion position.
 func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
 	/* SOLUTION {{{ */
 	cursor := BTreeCursor{table: table, cellnum: 0}
 	// Get the root page.
@@ -56,7 +74,7 @@ func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 	curHeader := pageToNodeHeader(curPage)
 	// Traverse the rightmost children until we reach a leaf node.
 	for curHeader.nodeType != LEAF_NODE {
-		curNode := pageToInternalNode(curPage)
+		curNode := pageToInternalNode(curPage, cursor.table.codec)
 		rightmostPN := curNode.getPNAt(curHeader.numKeys)
 		curPage, err = table.pager.GetPage(rightmostPN)
 		if err != nil {
@@ -66,9 +84,11 @@ func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 		curHeader = pageToNodeHeader(curPage)
 	}
 	// Set the cursor to point to the last entry in the rightmost leaf node.
-	rightmostNode := pageToLeafNode(curPage)
-	cursor.isEnd = false
-	cursor.cellnum = rightmostNode.numKeys - 1
+	rightmostNode := pageToLeafNode(curPage, cursor.table.codec)
+	cursor.isEnd = (rightmostNode.numKeys == 0)
+	if !cursor.isEnd {
+		cursor.cellnum = rightmostNode.numKeys - 1
+	}
 	cursor.curNode = rightmostNode
 	return &cursor, nil
 	/* SOLUTION }}} */
@@ -78,6 +98,9 @@ func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 // If the key is not found, returns a cursor to the new insertion position.
 // Hint: use keyToNodeEntry
 func (table *BTreeIndex) TableFind(key int64) (utils.Cursor, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
 	/* SOLUTION {{{ */
 	cursor := BTreeCursor{table: table}
 	// Get the root page.
@@ -86,7 +109,7 @@ func (table *BTreeIndex) TableFind(key int64) (utils.Cursor, error) {
 		return &BTreeCursor{}, err
 	}
 	defer rootPage.Put()
-	rootNode := pageToNode(rootPage)
+	rootNode := pageToNode(rootPage, table.codec)
 	// Find the leaf node and cellnum that this key belongs to.
 	leaf, cellnum, err := rootNode.keyToNodeEntry(key)
 	if err != nil {
@@ -96,6 +119,7 @@ func (table *BTreeIndex) TableFind(key int64) (utils.Cursor, error) {
 	cursor.cellnum = cellnum
 	cursor.isEnd = (cellnum == leaf.numKeys)
 	cursor.curNode = leaf
+	cursor.skipTombstone()
 	return &cursor, nil
 	/* SOLUTION }}} */
 }
@@ -110,21 +134,61 @@ func (table *BTreeIndex) TableFindRange(startKey int64, endKey int64) ([]utils.E
 		return entries, err
 	}
 	// Keep advancing the cursor and adding the current entry to the list of
-	// entries until reaching the end key.
-	curEntry, err := cursor.GetEntry()
+	// entries until reaching the end key. Only the key is read to check
+	// the bound, so we don't build an entry we're going to throw away.
+	for {
+		if !cursor.IsEnd() {
+			curKey, err := cursor.GetKey()
+			if err != nil {
+				return entries, err
+			}
+			if curKey >= endKey {
+				break
+			}
+			curEntry, err := cursor.GetEntry()
+			if err != nil {
+				return entries, err
+			}
+			entries = append(entries, curEntry)
+		}
+		if err := cursor.StepForward(); err != nil {
+			break
+		}
+	}
+	return entries, nil
+	/* SOLUTION }}} */
+}
+
+// RangeScan returns the entries with keys from startKey up to, but not
+// including, endKey, as TableFindRange does. If ascending is false, the
+// entries are scanned from the highest key down, and come in descending order.
+func (table *BTreeIndex) RangeScan(startKey int64, endKey int64, ascending bool) ([]utils.Entry, error) {
+	if ascending {
+		return table.TableFindRange(startKey, endKey)
+	}
+	entries := make([]utils.Entry, 0)
+	cursor, err := table.tableBelowReverse(endKey)
 	if err != nil {
 		return entries, err
 	}
-	for endKey > curEntry.GetKey() && !cursor.IsEnd() {
-		entries = append(entries, curEntry)
-		cursor.StepForward()
-		curEntry, err = cursor.GetEntry()
+	for !cursor.IsEnd() {
+		curKey, err := cursor.GetKey()
+		if err != nil {
+			return entries, err
+		}
+		if curKey < startKey {
+			break
+		}
+		curEntry, err := cursor.GetEntry()
 		if err != nil {
 			return entries, err
 		}
+		entries = append(entries, curEntry)
+		if err = cursor.StepForward(); err != nil {
+			return entries, err
+		}
 	}
 	return entries, nil
-	/* SOLUTION }}} */
 }
 
 // stepForward moves the cursor ahead by one entry.
@@ -133,21 +197,22 @@ func (cursor *BTreeCursor) StepForward() error {
 	if cursor.isEnd {
 		// Get the next node's page number.
 		nextPN := cursor.curNode.rightSiblingPN
-		if nextPN < 0 {
-			return errors.New("cannot advance the cursor further")
+		if nextPN == pager.NOPAGE {
+			return utils.ErrCursorEnd
 		}
 		// Convert the page into a node.
 		nextPage, err := cursor.table.pager.GetPage(nextPN)
 		if err != nil {
 			return err
 		}
-		defer nextPage.Put()
-		nextNode := pageToLeafNode(nextPage)
+		nextNode := pageToLeafNode(nextPage, cursor.table.codec)
+		// Unpin it before stepping on, so that a run of empty leaves doesn't pin them all.
+		nextPage.Put()
 		// Reinitialize the cursor.
 		cursor.cellnum = 0
 		cursor.isEnd = (cursor.cellnum == nextNode.numKeys)
 		cursor.curNode = nextNode
-		if cursor.isEnd {
+		if cursor.isEnd || nextNode.isTombstone(0) {
 			return cursor.StepForward()
 		}
 		return nil
@@ -156,10 +221,20 @@ func (cursor *BTreeCursor) StepForward() error {
 	cursor.cellnum++
 	if cursor.cellnum >= cursor.curNode.numKeys {
 		cursor.isEnd = true
+	} else if cursor.curNode.isTombstone(cursor.cellnum) {
+		return cursor.StepForward()
 	}
 	return nil
 }
 
+// skipTombstone moves the cursor past the entry it points to if that entry is a tombstone.
+// If there are no entries after it, the cursor is left at the end of the table.
+func (cursor *BTreeCursor) skipTombstone() {
+	if !cursor.isEnd && cursor.curNode.isTombstone(cursor.cellnum) {
+		cursor.StepForward()
+	}
+}
+
 // IsEnd returns true if at end.
 func (cursor *BTreeCursor) IsEnd() bool {
 	return cursor.isEnd
@@ -169,8 +244,196 @@ func (cursor *BTreeCursor) IsEnd() bool {
 func (cursor *BTreeCursor) GetEntry() (utils.Entry, error) {
 	// Check if we're retrieving a non-existent entry.
 	if cursor.isEnd {
-		return BTreeEntry{}, errors.New("getEntry: entry is non-existent")
+		return BTreeEntry{}, fmt.Errorf("getEntry: entry is non-existent: %w", utils.ErrKeyNotFound)
 	}
 	entry := cursor.curNode.getCell(cursor.cellnum)
 	return entry, nil
 }
+
+// GetKey returns the key currently pointed to by the cursor, without building an entry.
+func (cursor *BTreeCursor) GetKey() (int64, error) {
+	// Check if we're retrieving a non-existent entry.
+	if cursor.isEnd {
+		return 0, fmt.Errorf("getKey: entry is non-existent: %w", utils.ErrKeyNotFound)
+	}
+	return cursor.curNode.getKeyAt(cursor.cellnum), nil
+}
+
+// BTreeReverseCursor traverses a table in descending key order: StepForward
+// moves it to the next smaller key. Leaves only link to their right sibling, so
+// the cursor keeps the path from the root down to its leaf instead, and reaches
+// the previous leaf by backing up that path to the nearest internal node with
+// a child to the left. Like BTreeCursor, it isn't kept valid across writes.
+type BTreeReverseCursor struct {
+	table   *BTreeIndex // The table that this cursor point to.
+	path    []pathStep  // The internal nodes from the root down to the current leaf.
+	cellnum int64       // The cell number within a leaf node.
+	isEnd   bool        // Indicates that this cursor points before the first entry of the table.
+	curNode *LeafNode   // Current node.
+}
+
+// pathStep is an internal node on a reverse cursor's path, and the child it took.
+type pathStep struct {
+	pagenum int64
+	index   int64
+}
+
+// TableStartReverse returns a cursor pointing to the last entry of the table,
+// that steps towards smaller keys.
+func (table *BTreeIndex) TableStartReverse() (utils.Cursor, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
+	cursor := BTreeReverseCursor{table: table}
+	if err := cursor.descendRightmost(table.rootPN); err != nil {
+		return nil, err
+	}
+	if err := cursor.settle(); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// tableBelowReverse returns a reverse cursor pointing to the entry with the
+// largest key below the given key, which is before the first entry if there is none.
+func (table *BTreeIndex) tableBelowReverse(key int64) (*BTreeReverseCursor, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
+	cursor := BTreeReverseCursor{table: table}
+	if err := cursor.descendBelow(table.rootPN, key); err != nil {
+		return nil, err
+	}
+	if err := cursor.settle(); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// descendBelow follows the children that the given key belongs in from the
+// given node down to a leaf, and points the cursor at the last entry of that
+// leaf with a smaller key. Every smaller key in the tree is in that leaf or
+// one before it.
+func (cursor *BTreeReverseCursor) descendBelow(pagenum int64, key int64) error {
+	curPage, err := cursor.table.pager.GetPage(pagenum)
+	if err != nil {
+		return err
+	}
+	defer curPage.Put()
+	curHeader := pageToNodeHeader(curPage)
+	for curHeader.nodeType != LEAF_NODE {
+		curNode := pageToInternalNode(curPage, cursor.table.codec)
+		index := curNode.search(key)
+		cursor.path = append(cursor.path, pathStep{pagenum: pagenum, index: index})
+		pagenum = curNode.getPNAt(index)
+		curPage, err = cursor.table.pager.GetPage(pagenum)
+		if err != nil {
+			return err
+		}
+		defer curPage.Put()
+		curHeader = pageToNodeHeader(curPage)
+	}
+	cursor.curNode = pageToLeafNode(curPage, cursor.table.codec)
+	cursor.cellnum = cursor.curNode.search(key) - 1
+	return nil
+}
+
+// descendRightmost follows the rightmost children from the given node down to
+// a leaf, and points the cursor at that leaf's last entry.
+func (cursor *BTreeReverseCursor) descendRightmost(pagenum int64) error {
+	curPage, err := cursor.table.pager.GetPage(pagenum)
+	if err != nil {
+		return err
+	}
+	defer curPage.Put()
+	curHeader := pageToNodeHeader(curPage)
+	for curHeader.nodeType != LEAF_NODE {
+		curNode := pageToInternalNode(curPage, cursor.table.codec)
+		cursor.path = append(cursor.path, pathStep{pagenum: pagenum, index: curHeader.numKeys})
+		pagenum = curNode.getPNAt(curHeader.numKeys)
+		curPage, err = cursor.table.pager.GetPage(pagenum)
+		if err != nil {
+			return err
+		}
+		defer curPage.Put()
+		curHeader = pageToNodeHeader(curPage)
+	}
+	cursor.curNode = pageToLeafNode(curPage, cursor.table.codec)
+	cursor.cellnum = cursor.curNode.numKeys - 1
+	return nil
+}
+
+// previousLeaf moves the cursor to the last entry of the leaf before its
+// current one. Returns false if the current leaf is the first.
+func (cursor *BTreeReverseCursor) previousLeaf() (bool, error) {
+	for len(cursor.path) > 0 {
+		last := len(cursor.path) - 1
+		step := cursor.path[last]
+		if step.index == 0 {
+			// No children to the left here; back up a level.
+			cursor.path = cursor.path[:last]
+			continue
+		}
+		page, err := cursor.table.pager.GetPage(step.pagenum)
+		if err != nil {
+			return false, err
+		}
+		childPN := pageToInternalNode(page, cursor.table.codec).getPNAt(step.index - 1)
+		page.Put()
+		cursor.path[last].index--
+		return true, cursor.descendRightmost(childPN)
+	}
+	return false, nil
+}
+
+// settle moves the cursor back past tombstones and empty leaves, until it
+// points to an entry or is before the first one.
+func (cursor *BTreeReverseCursor) settle() error {
+	for {
+		if cursor.cellnum < 0 {
+			moved, err := cursor.previousLeaf()
+			if err != nil {
+				return err
+			}
+			if !moved {
+				cursor.isEnd = true
+				return nil
+			}
+			continue
+		}
+		if !cursor.curNode.isTombstone(cursor.cellnum) {
+			return nil
+		}
+		cursor.cellnum--
+	}
+}
+
+// StepForward moves the cursor to the entry with the next smaller key.
+func (cursor *BTreeReverseCursor) StepForward() error {
+	if cursor.isEnd {
+		return utils.ErrCursorEnd
+	}
+	cursor.cellnum--
+	return cursor.settle()
+}
+
+// IsEnd returns true if the cursor is before the first entry.
+func (cursor *BTreeReverseCursor) IsEnd() bool {
+	return cursor.isEnd
+}
+
+// GetEntry returns the entry currently pointed to by the cursor.
+func (cursor *BTreeReverseCursor) GetEntry() (utils.Entry, error) {
+	if cursor.isEnd {
+		return BTreeEntry{}, fmt.Errorf("getEntry: entry is non-existent: %w", utils.ErrKeyNotFound)
+	}
+	return cursor.curNode.getCell(cursor.cellnum), nil
+}
+
+// GetKey returns the key currently pointed to by the cursor, without building an entry.
+func (cursor *BTreeReverseCursor) GetKey() (int64, error) {
+	if cursor.isEnd {
+		return 0, fmt.Errorf("getKey: entry is non-existent: %w", utils.ErrKeyNotFound)
+	}
+	return cursor.curNode.getKeyAt(cursor.cellnum), nil
+}
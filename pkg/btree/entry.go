@@ -2,6 +2,10 @@ package btree
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
 // Global size for Entries.
@@ -54,3 +58,43 @@ func unmarshalEntry(data []byte) (entry BTreeEntry) {
 	v, _ := binary.Varint(data[len(data)/2:])
 	return BTreeEntry{key: k, value: v}
 }
+
+// int64Codec stores BTreeEntries, with an int64 value. It is the default codec.
+type int64Codec struct{}
+
+// The codec tables use unless they are opened with another one.
+var DefaultCodec utils.EntryCodec = int64Codec{}
+
+// ErrCodecUnsupported is returned by operations that only work on tables using the default codec.
+var ErrCodecUnsupported = errors.New("operation needs the default codec")
+
+// ErrCodecSize is returned when opening a table with a codec whose entries are
+// too small to start with a key, or too big to fit enough of them in a leaf.
+var ErrCodecSize = errors.New("codec size doesn't fit leaf cells")
+
+// checkCodec errors with ErrCodecSize if the codec's entries can't hold a key,
+// or fewer than MIN_ENTRIES_PER_LEAF_NODE of them fit in a leaf.
+func checkCodec(codec utils.EntryCodec) error {
+	if int64(codec.Size()) < KEY_SIZE {
+		return fmt.Errorf("codec size %d is smaller than a key: %w", codec.Size(), ErrCodecSize)
+	}
+	if entriesPerLeaf(codec, true) < MIN_ENTRIES_PER_LEAF_NODE {
+		return fmt.Errorf("codec size %d fits fewer than %d entries in a leaf: %w", codec.Size(), MIN_ENTRIES_PER_LEAF_NODE, ErrCodecSize)
+	}
+	return nil
+}
+
+// Encode serializes an entry's key and value.
+func (int64Codec) Encode(entry utils.Entry) []byte {
+	return BTreeEntry{key: entry.GetKey(), value: entry.GetValue()}.Marshal()
+}
+
+// Decode deserializes a BTreeEntry.
+func (int64Codec) Decode(data []byte) utils.Entry {
+	return unmarshalEntry(data)
+}
+
+// Size returns the size of an encoded entry.
+func (int64Codec) Size() int {
+	return int(ENTRYSIZE)
+}
@@ -1,13 +1,13 @@
 package btree
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"sort"
 	"strconv"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
 // Split is a supporting data structure to propagate keys up our B+ tree.
@@ -23,9 +23,10 @@ type Split struct {
 type Node interface {
 	// Interface for main node functions.
 	search(int64) int64
-	insert(int64, int64, bool) Split
-	delete(int64)
-	get(int64) (int64, bool)
+	insert(utils.Entry, bool, float64) Split
+	delete(int64, bool)
+	compareAndSwap(int64, int64, int64) (bool, error)
+	get(int64) (utils.Entry, bool)
 
 	// Interface for helper functions.
 	keyToNodeEntry(int64) (*LeafNode, int64, error)
@@ -55,24 +56,34 @@ func (node *LeafNode) search(key int64) int64 {
 
 // insert finds the appropriate place in a leaf node to insert a new tuple.
 // if update is true, allow overwriting existing keys. else, error.
-func (node *LeafNode) insert(key int64, value int64, update bool) Split {
+// If the leaf overflows, it is split so the left node keeps splitRatio of the entries.
+func (node *LeafNode) insert(entry utils.Entry, update bool, splitRatio float64) Split {
 	/* SOLUTION {{{ */
 	/* CONCURRENCY {{{ */
 	node.unlockParent(false)
 	defer node.unlock()
 	/* CONCURRENCY }}} */
 	// Get insert position.
+	key := entry.GetKey()
 	insertPos := node.search(key)
 	// Check if this is a duplicate entry.
 	if insertPos < node.numKeys && node.getKeyAt(insertPos) == key {
 		/* CONCURRENCY {{{ */
 		defer node.unlockParent(true)
 		/* CONCURRENCY }}} */
+		// A tombstoned key is missing to an update, but free to an insert.
+		if node.isTombstone(insertPos) {
+			if update {
+				return Split{err: fmt.Errorf("update aborted: %w", utils.ErrUpdateMissing)}
+			}
+			node.modifyCell(insertPos, entry)
+			return Split{}
+		}
 		if update {
-			node.updateValueAt(insertPos, value)
+			node.modifyCell(insertPos, entry)
 			return Split{}
 		} else {
-			return Split{err: errors.New("cannot insert duplicate key")}
+			return Split{err: fmt.Errorf("cannot insert duplicate key: %w", utils.ErrKeyExists)}
 		}
 	}
 	// Return an error if we're updating a non-existent entry.
@@ -80,19 +91,18 @@ func (node *LeafNode) insert(key int64, value int64, update bool) Split {
 		/* CONCURRENCY {{{ */
 		node.unlockParent(true)
 		/* CONCURRENCY }}} */
-		return Split{err: errors.New("cannot update non-existent entry")}
+		return Split{err: fmt.Errorf("update aborted: %w", utils.ErrUpdateMissing)}
 	}
 	// Shift entries to the right if needed.
 	for i := node.numKeys - 1; i >= insertPos; i-- {
-		node.updateKeyAt(i+1, node.getKeyAt(i))
-		node.updateValueAt(i+1, node.getValueAt(i))
+		node.copyCellFrom(node, i, i+1)
 	}
 	node.updateNumKeys(node.numKeys + 1)
 	// Modify the cell at this position.
-	node.modifyCell(insertPos, BTreeEntry{key: key, value: value})
+	node.modifyCell(insertPos, entry)
 	// Check if we need to split the node.
-	if node.numKeys > ENTRIES_PER_LEAF_NODE {
-		return node.split()
+	if node.numKeys > node.maxEntries() {
+		return node.split(splitRatio)
 	}
 	/* CONCURRENCY {{{ */
 	node.unlockParent(true)
@@ -102,7 +112,8 @@ func (node *LeafNode) insert(key int64, value int64, update bool) Split {
 }
 
 // delete removes a given tuple from the leaf node, if the given key exists.
-func (node *LeafNode) delete(key int64) {
+// If tombstone is true, the tuple is only marked as deleted, to be purged later.
+func (node *LeafNode) delete(key int64, tombstone bool) {
 	/* SOLUTION {{{ */
 	/* CONCURRENCY {{{ */
 	// Unlock parents, eventually unlock this node.
@@ -115,32 +126,62 @@ func (node *LeafNode) delete(key int64) {
 		// Thank you Mario! But our key is in another castle!
 		return
 	}
+	if tombstone && node.tombstoneCells {
+		node.setTombstone(deletePos)
+		return
+	}
 	// Shift entries to the left.
 	for i := deletePos; i < node.numKeys-1; i++ {
-		node.updateKeyAt(i, node.getKeyAt(i+1))
-		node.updateValueAt(i, node.getValueAt(i+1))
+		node.copyCellFrom(node, i+1, i)
 	}
 	node.updateNumKeys(node.numKeys - 1)
 	/* SOLUTION }}} */
 }
 
+// compareAndSwap sets the value of the given key to value, if its value is expected.
+// Returns whether it did.
+func (node *LeafNode) compareAndSwap(key int64, expected int64, value int64) (bool, error) {
+	/* CONCURRENCY {{{ */
+	// Unlock parents, eventually unlock this node.
+	node.unlockParent(true)
+	defer node.unlock()
+	/* CONCURRENCY }}} */
+	pos := node.search(key)
+	if pos >= node.numKeys || node.getKeyAt(pos) != key || node.isTombstone(pos) {
+		return false, fmt.Errorf("compare and swap aborted: %w", utils.ErrUpdateMissing)
+	}
+	if node.getCell(pos).GetValue() != expected {
+		return false, nil
+	}
+	node.modifyCell(pos, BTreeEntry{key: key, value: value})
+	return true, nil
+}
+
 // split is a helper function to split a leaf node, then propagate the split upwards.
-func (node *LeafNode) split() Split {
+// The left node keeps splitRatio of the entries, but both nodes keep at least one.
+func (node *LeafNode) split(splitRatio float64) Split {
 	/* SOLUTION {{{ */
 	// Create a new leaf node to split our keys.
-	newNode, err := createLeafNode(node.page.GetPager())
+	newNode, err := createLeafNode(node.page.GetPager(), node.codec)
 	if err != nil {
 		return Split{err: err}
 	}
 	defer newNode.getPage().Put()
+	if node.tombstoneCells {
+		newNode.setTombstoneCells()
+	}
 	// Set the right sibling for our two nodes.
 	prevSiblingPN := node.setRightSibling(newNode.page.GetPageNum())
 	newNode.setRightSibling(prevSiblingPN)
 	// Transfer entries to the new node (plus the new entry) accordingly.
-	midpoint := node.numKeys / 2
+	midpoint := int64(float64(node.numKeys) * splitRatio)
+	if midpoint < 1 {
+		midpoint = 1
+	} else if midpoint > node.numKeys-1 {
+		midpoint = node.numKeys - 1
+	}
 	for i := midpoint; i < node.numKeys; i++ {
-		newNode.updateKeyAt(newNode.numKeys, node.getKeyAt(i))
-		newNode.updateValueAt(newNode.numKeys, node.getValueAt(i))
+		newNode.copyCellFrom(node, i, newNode.numKeys)
 		newNode.updateNumKeys(newNode.numKeys + 1)
 	}
 	node.updateNumKeys(midpoint)
@@ -153,19 +194,18 @@ func (node *LeafNode) split() Split {
 	/* SOLUTION }}} */
 }
 
-// get returns the value associated with a given key from the leaf node.
-func (node *LeafNode) get(key int64) (value int64, found bool) {
+// get returns the entry with the given key from the leaf node.
+func (node *LeafNode) get(key int64) (entry utils.Entry, found bool) {
 	// Unlock parents, eventually unlock this node.
 	node.unlockParent(true)
 	defer node.unlock()
 	// Find index.
 	index := node.search(key)
-	if index >= node.numKeys || node.getKeyAt(index) != key {
+	if index >= node.numKeys || node.getKeyAt(index) != key || node.isTombstone(index) {
 		// Thank you Mario! But our key is in another castle!
-		return 0, false
+		return nil, false
 	}
-	entry := node.getCell(index)
-	return entry.GetValue(), true
+	return node.getCell(index), true
 }
 
 // keyToNodeEntry is a helper function to create cursors that point to a given index within a leaf node.
@@ -188,10 +228,14 @@ func (node *LeafNode) printNode(w io.Writer, firstPrefix string, prefix string)
 	// Print entries.
 	for cellnum := int64(0); cellnum < node.numKeys; cellnum++ {
 		entry := node.getCell(cellnum)
-		io.WriteString(w, fmt.Sprintf("%v |--> (%v, %v)\n",
-			prefix, entry.GetKey(), entry.GetValue()))
+		var tombstone string
+		if node.isTombstone(cellnum) {
+			tombstone = " (deleted)"
+		}
+		io.WriteString(w, fmt.Sprintf("%v |--> (%v, %v)%v\n",
+			prefix, entry.GetKey(), entry.GetValue(), tombstone))
 	}
-	if node.rightSiblingPN > 0 {
+	if node.rightSiblingPN != pager.NOPAGE {
 		io.WriteString(w, fmt.Sprintf("%v |--+\n", prefix))
 		io.WriteString(w, fmt.Sprintf("%v    | right sibling @ [%v]\n",
 			prefix, node.rightSiblingPN))
@@ -219,13 +263,13 @@ func (node *InternalNode) search(key int64) int64 {
 }
 
 // insert finds the appropriate place in a leaf node to insert a new tuple.
-func (node *InternalNode) insert(key int64, value int64, update bool) Split {
+func (node *InternalNode) insert(entry utils.Entry, update bool, splitRatio float64) Split {
 	/* SOLUTION {{{ */
 	/* CONCURRENCY {{{ */
 	node.unlockParent(false)
 	/* CONCURRENCY }}} */
 	// Insert the entry into the appropriate child node.
-	childIdx := node.search(key)
+	childIdx := node.search(entry.GetKey())
 	child, err := node.getChildAt(childIdx, true)
 	if err != nil {
 		return Split{err: err}
@@ -235,7 +279,7 @@ func (node *InternalNode) insert(key int64, value int64, update bool) Split {
 	/* CONCURRENCY }}} */
 	defer child.getPage().Put()
 	// Insert value into the child.
-	result := child.insert(key, value, update)
+	result := child.insert(entry, update, splitRatio)
 	// Insert a new key into our node if necessary.
 	if result.isSplit {
 		split := node.insertSplit(result)
@@ -277,7 +321,7 @@ func (node *InternalNode) insertSplit(split Split) Split {
 }
 
 // delete removes a given tuple from the leaf node, if the given key exists.
-func (node *InternalNode) delete(key int64) {
+func (node *InternalNode) delete(key int64, tombstone bool) {
 	/* SOLUTION {{{ */
 	/* CONCURRENCY {{{ */
 	node.unlockParent(true)
@@ -293,15 +337,35 @@ func (node *InternalNode) delete(key int64) {
 	/* CONCURRENCY }}} */
 	defer child.getPage().Put()
 	// Delete from child.
-	child.delete(key)
+	child.delete(key, tombstone)
 	/* SOLUTION }}} */
 }
 
+// compareAndSwap sets the value of the given key to value, if its value is expected.
+// Returns whether it did.
+func (node *InternalNode) compareAndSwap(key int64, expected int64, value int64) (bool, error) {
+	/* CONCURRENCY {{{ */
+	node.unlockParent(true)
+	/* CONCURRENCY }}} */
+	// Get child.
+	childIdx := node.search(key)
+	child, err := node.getChildAt(childIdx, true)
+	if err != nil {
+		node.unlock()
+		return false, err
+	}
+	/* CONCURRENCY {{{ */
+	node.initChild(child)
+	/* CONCURRENCY }}} */
+	defer child.getPage().Put()
+	return child.compareAndSwap(key, expected, value)
+}
+
 // split is a helper function that splits an internal node, then propagates the split upwards.
 func (node *InternalNode) split() Split {
 	/* SOLUTION {{{ */
 	// Create a new internal node to split our keys.
-	newNode, err := createInternalNode(node.page.GetPager())
+	newNode, err := createInternalNode(node.page.GetPager(), node.codec)
 	if err != nil {
 		return Split{err: err}
 	}
@@ -328,15 +392,15 @@ func (node *InternalNode) split() Split {
 	/* SOLUTION }}} */
 }
 
-// get returns the value associated with a given key from the leaf node.
-func (node *InternalNode) get(key int64) (value int64, found bool) {
+// get returns the entry with the given key from the subtree rooted at this node.
+func (node *InternalNode) get(key int64) (entry utils.Entry, found bool) {
 	// [CONCURRENCY] Unlock parents.
 	node.unlockParent(true)
 	// Find the child.
 	childIdx := node.search(key)
 	child, err := node.getChildAt(childIdx, true)
 	if err != nil {
-		return 0, false
+		return nil, false
 	}
 	node.initChild(child)
 	defer child.getPage().Put()
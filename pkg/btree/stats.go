@@ -0,0 +1,115 @@
+package btree
+
+import (
+	"errors"
+)
+
+// HistogramBucket summarizes a run of consecutive keys in a table.
+type HistogramBucket struct {
+	Low   int64 // Smallest key in the bucket.
+	High  int64 // Largest key in the bucket.
+	Count int64 // Number of keys in the bucket.
+}
+
+// Histogram scans the table once and returns an equi-depth histogram of its keys:
+// up to the given number of buckets, in key order, each holding about the same
+// number of keys. Dense key ranges get narrow buckets and sparse ones wide buckets.
+// Returns fewer buckets if the table has fewer keys than requested.
+func (table *BTreeIndex) Histogram(buckets int) ([]HistogramBucket, error) {
+	if buckets <= 0 {
+		return nil, errors.New("histogram needs at least one bucket")
+	}
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
+	keys, err := table.scanKeys()
+	if err != nil {
+		return nil, err
+	}
+	if buckets > len(keys) {
+		buckets = len(keys)
+	}
+	histogram := make([]HistogramBucket, 0, buckets)
+	for i := 0; i < buckets; i++ {
+		// Spread the remainder over the buckets, rather than leaving it all to the last one.
+		lo := i * len(keys) / buckets
+		hi := (i + 1) * len(keys) / buckets
+		histogram = append(histogram, HistogramBucket{
+			Low:   keys[lo],
+			High:  keys[hi-1],
+			Count: int64(hi - lo),
+		})
+	}
+	return histogram, nil
+}
+
+// EstimateRange estimates the fraction of a table's keys between startKey and endKey,
+// as TableFindRange bounds them, assuming keys are spread evenly within each bucket.
+func EstimateRange(histogram []HistogramBucket, startKey int64, endKey int64) float64 {
+	var total, matched float64
+	for _, bucket := range histogram {
+		total += float64(bucket.Count)
+		lo, hi := bucket.Low, bucket.High
+		if startKey > lo {
+			lo = startKey
+		}
+		// endKey is compared before subtracting from it, so that math.MinInt64 doesn't wrap around.
+		if endKey <= lo {
+			continue
+		}
+		if endKey-1 < hi {
+			hi = endKey - 1
+		}
+		if lo > hi {
+			continue
+		}
+		// Widths are taken as floats, since the difference of keys far apart overflows.
+		width := float64(bucket.High) - float64(bucket.Low) + 1
+		matched += float64(bucket.Count) * (float64(hi) - float64(lo) + 1) / width
+	}
+	if total == 0 {
+		return 0
+	}
+	return matched / total
+}
+
+// scanKeys returns all keys in the table, in order.
+func (table *BTreeIndex) scanKeys() ([]int64, error) {
+	keys := make([]int64, 0)
+	cursor, err := table.TableStart()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if !cursor.IsEnd() {
+			key, err := cursor.GetKey()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		if err := cursor.StepForward(); err != nil {
+			return keys, nil
+		}
+	}
+}
+
+// measureHeight returns the number of levels in the tree, found by following
+// the leftmost children from the root down to a leaf.
+func (table *BTreeIndex) measureHeight() (int, error) {
+	height := 1
+	pn := table.rootPN
+	for {
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return 0, err
+		}
+		if pageToNodeHeader(page).nodeType == LEAF_NODE {
+			page.Put()
+			return height, nil
+		}
+		pn = pageToInternalNode(page, table.codec).getPNAt(0)
+		page.Put()
+		height++
+	}
+}
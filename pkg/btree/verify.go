@@ -2,15 +2,23 @@ package btree
 
 import (
 	"errors"
+	"fmt"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
 )
 
+// ErrBrokenSiblingLink is returned by Validate when the leaves' right-sibling
+// pointers don't chain them together in key order, which makes scans skip or
+// repeat entries. This happens if a crash interrupts a leaf split.
+var ErrBrokenSiblingLink = errors.New("leaf sibling links are broken")
+
 func IsBTree(index *BTreeIndex) (l int64, r int64, isbtree bool, err error) {
 	// Get the node from the page
 	rootPage, err := index.pager.GetPage(index.rootPN)
 	if err != nil {
 		return 0, 0, false, err
 	}
-	n := pageToNode(rootPage)
+	n := pageToNode(rootPage, index.codec)
 	return isBTree(n)
 }
 
@@ -69,3 +77,155 @@ func isBTree(n Node) (l int64, r int64, isbtree bool, err error) {
 		return -1, -1, false, errors.New("should not have gotten here")
 	}
 }
+
+// Validate checks that every leaf's right sibling is the next leaf in key order,
+// as found by walking the internal nodes, and that the leaves' key ranges don't overlap.
+func (table *BTreeIndex) Validate() error {
+	if err := table.checkOpen(); err != nil {
+		return err
+	}
+	leaves, err := table.leafPNs()
+	if err != nil {
+		return err
+	}
+	var prevKey int64
+	seenKey := false
+	for i, pn := range leaves {
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return err
+		}
+		leaf := pageToLeafNode(page, table.codec)
+		siblingPN, numKeys := leaf.rightSiblingPN, leaf.numKeys
+		var firstKey, lastKey int64
+		if numKeys > 0 {
+			firstKey, lastKey = leaf.getKeyAt(0), leaf.getKeyAt(numKeys-1)
+		}
+		page.Put()
+		// The last leaf has no sibling.
+		expectedPN := int64(pager.NOPAGE)
+		if i+1 < len(leaves) {
+			expectedPN = leaves[i+1]
+		}
+		if siblingPN != expectedPN {
+			return fmt.Errorf("leaf %d links to %d instead of %d: %w", pn, siblingPN, expectedPN, ErrBrokenSiblingLink)
+		}
+		if numKeys == 0 {
+			continue
+		}
+		if seenKey && firstKey <= prevKey {
+			return fmt.Errorf("leaf %d starts at key %d, which the previous leaf already covers: %w", pn, firstKey, ErrBrokenSiblingLink)
+		}
+		prevKey, seenKey = lastKey, true
+	}
+	return nil
+}
+
+// Repair relinks every leaf to the next leaf in key order, and returns how many
+// links it had to fix. The internal nodes already order the leaves by their
+// first keys, so only the sibling pointers are rewritten.
+// Must not run concurrently with other operations on the table.
+func (table *BTreeIndex) Repair() (int, error) {
+	if err := table.checkWritable(); err != nil {
+		return 0, err
+	}
+	leaves, err := table.leafPNs()
+	if err != nil {
+		return 0, err
+	}
+	fixed := 0
+	for i, pn := range leaves {
+		expectedPN := int64(pager.NOPAGE)
+		if i+1 < len(leaves) {
+			expectedPN = leaves[i+1]
+		}
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return fixed, err
+		}
+		leaf := pageToLeafNode(page, table.codec)
+		if leaf.rightSiblingPN != expectedPN {
+			leaf.setRightSibling(expectedPN)
+			fixed++
+		}
+		page.Put()
+	}
+	return fixed, nil
+}
+
+// leafPNs returns the page numbers of the table's leaves in key order.
+func (table *BTreeIndex) leafPNs() ([]int64, error) {
+	return table.appendLeafPNs(table.rootPN, make([]int64, 0))
+}
+
+// appendLeafPNs appends the page numbers of the leaves under the given page to leaves, in key order.
+func (table *BTreeIndex) appendLeafPNs(pn int64, leaves []int64) ([]int64, error) {
+	page, err := table.pager.GetPage(pn)
+	if err != nil {
+		return nil, err
+	}
+	defer page.Put()
+	if pageToNodeHeader(page).nodeType == LEAF_NODE {
+		return append(leaves, pn), nil
+	}
+	node := pageToInternalNode(page, table.codec)
+	for i := int64(0); i <= node.numKeys; i++ {
+		leaves, err = table.appendLeafPNs(node.getPNAt(i), leaves)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return leaves, nil
+}
+
+// VerifyPageBounds walks the tree and checks that the root, every child and
+// every right sibling it refers to is a page of the table's file. Returns an
+// error naming the first reference that isn't. Such references are left by
+// crashes or bugs, and following them would read pages that were never written.
+func (table *BTreeIndex) VerifyPageBounds() error {
+	if err := table.checkOpen(); err != nil {
+		return err
+	}
+	numPages := table.pager.GetNumPages()
+	if table.rootPN < 0 || table.rootPN >= numPages {
+		return fmt.Errorf("root is page %d of %d: %w", table.rootPN, numPages, pager.ErrPageOutOfBounds)
+	}
+	return table.verifyPageBounds(table.rootPN, numPages, make(map[int64]bool))
+}
+
+// verifyPageBounds checks the page references of the node at the given page
+// and of the nodes under it. The page itself must be in bounds.
+func (table *BTreeIndex) verifyPageBounds(pn int64, numPages int64, seen map[int64]bool) error {
+	// A page that is reached twice would send the walk around in circles.
+	if seen[pn] {
+		return fmt.Errorf("page %d is referred to by more than one node", pn)
+	}
+	seen[pn] = true
+	page, err := table.pager.GetPage(pn)
+	if err != nil {
+		return err
+	}
+	if pageToNodeHeader(page).nodeType == LEAF_NODE {
+		siblingPN := pageToLeafNode(page, table.codec).rightSiblingPN
+		page.Put()
+		if siblingPN != pager.NOPAGE && (siblingPN < 0 || siblingPN >= numPages) {
+			return fmt.Errorf("leaf %d links to page %d of %d: %w", pn, siblingPN, numPages, pager.ErrPageOutOfBounds)
+		}
+		return nil
+	}
+	node := pageToInternalNode(page, table.codec)
+	children := make([]int64, node.numKeys+1)
+	for i := range children {
+		children[i] = node.getPNAt(int64(i))
+	}
+	page.Put()
+	for i, childPN := range children {
+		if childPN < 0 || childPN >= numPages {
+			return fmt.Errorf("internal node %d has child %d at page %d of %d: %w", pn, i, childPN, numPages, pager.ErrPageOutOfBounds)
+		}
+		if err = table.verifyPageBounds(childPN, numPages, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,7 +2,12 @@ package concurrency
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+
+	uuid "github.com/google/uuid"
 )
 
 // Graph.
@@ -63,6 +68,60 @@ func (g *Graph) RemoveEdge(from *Transaction, to *Transaction) error {
 	return errors.New("edge not found")
 }
 
+// Returns the number of edges in the graph.
+func (g *Graph) Len() int {
+	g.RLock()
+	defer g.RUnlock()
+	return len(g.edges)
+}
+
+// Returns the graph's edges, one "from -> to" line per edge, sorted so that
+// the output is stable. Each transaction is named by its client id.
+func (g *Graph) String() string {
+	g.RLock()
+	defer g.RUnlock()
+	lines := make([]string, 0, len(g.edges))
+	for _, e := range g.edges {
+		lines = append(lines, fmt.Sprintf("%v -> %v\n", e.from.clientId, e.to.clientId))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "")
+}
+
+// Returns the transactions that have an edge to or from them.
+func (g *Graph) transactions() []*Transaction {
+	g.RLock()
+	defer g.RUnlock()
+	transactions := make([]*Transaction, 0)
+	seen := make(map[*Transaction]bool)
+	for _, e := range g.edges {
+		for _, t := range []*Transaction{e.from, e.to} {
+			if !seen[t] {
+				transactions = append(transactions, t)
+				seen[t] = true
+			}
+		}
+	}
+	return transactions
+}
+
+// Removes every edge with an endpoint that isn't one of the given live
+// transactions, and returns how many were removed. Edges are normally removed
+// by the lock request that added them; this cleans up any that were leaked.
+func (g *Graph) Prune(live map[uuid.UUID]*Transaction) int {
+	g.WLock()
+	defer g.WUnlock()
+	kept := g.edges[:0]
+	for _, e := range g.edges {
+		if live[e.from.clientId] == e.from && live[e.to.clientId] == e.to {
+			kept = append(kept, e)
+		}
+	}
+	pruned := len(g.edges) - len(kept)
+	g.edges = kept
+	return pruned
+}
+
 // Return true if a cycle exists; false otherwise.
 func (g *Graph) DetectCycle() bool {
 	g.RLock()
@@ -96,6 +155,48 @@ func (g *Graph) DetectCycle() bool {
 	/* SOLUTION }}} */
 }
 
+// Returns the transactions on a cycle through the given transaction, or nil if there is none.
+func (g *Graph) FindCycle(from *Transaction) []*Transaction {
+	g.RLock()
+	defer g.RUnlock()
+	path := make([]*Transaction, 0)
+	visited := make(map[*Transaction]bool)
+	var visit func(t *Transaction) bool
+	visit = func(t *Transaction) bool {
+		path = append(path, t)
+		visited[t] = true
+		for _, e := range g.edges {
+			if e.from != t {
+				continue
+			}
+			if e.to == from || (!visited[e.to] && visit(e.to)) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(from) {
+		return path
+	}
+	return nil
+}
+
+// Returns the transaction on a cycle through the given transaction that is the
+// cheapest to abort, or nil if there is none. cost gives what aborting a
+// transaction would throw away; ties go to the transaction with the lowest priority.
+func (g *Graph) FindCycleVictim(from *Transaction, cost func(*Transaction) int) *Transaction {
+	var victim *Transaction
+	victimCost := 0
+	for _, t := range g.FindCycle(from) {
+		tCost := cost(t)
+		if victim == nil || tCost < victimCost || (tCost == victimCost && victim.outranks(t)) {
+			victim, victimCost = t, tCost
+		}
+	}
+	return victim
+}
+
 func dfs(g *Graph, from *Transaction, seen []*Transaction) bool {
 	// Go through each edge.
 	for _, e := range g.edges {
@@ -19,6 +19,11 @@ type Resource struct {
 	resourceKey int64
 }
 
+// NewResource returns the resource for a key in a table.
+func NewResource(tableName string, resourceKey int64) Resource {
+	return Resource{tableName: tableName, resourceKey: resourceKey}
+}
+
 // Get resource table name.
 func (r *Resource) GetTableName() string {
 	return r.tableName
@@ -29,37 +34,124 @@ func (r *Resource) GetResourceKey() int64 {
 	return r.resourceKey
 }
 
+// A range of keys in a table, inclusive on both ends.
+type RangeResource struct {
+	tableName string
+	startKey  int64
+	endKey    int64
+}
+
+// Get range table name.
+func (r *RangeResource) GetTableName() string {
+	return r.tableName
+}
+
+// Get range start key.
+func (r *RangeResource) GetStartKey() int64 {
+	return r.startKey
+}
+
+// Get range end key.
+func (r *RangeResource) GetEndKey() int64 {
+	return r.endKey
+}
+
+// Returns true if the given point resource falls within this range.
+func (r *RangeResource) Contains(point Resource) bool {
+	return r.tableName == point.tableName && r.startKey <= point.resourceKey && point.resourceKey <= r.endKey
+}
+
+// Returns true if the given range shares at least one key with this range.
+func (r *RangeResource) Overlaps(other RangeResource) bool {
+	return r.tableName == other.tableName && r.startKey <= other.endKey && other.startKey <= r.endKey
+}
+
+// Number of holders of a lock, by lock type.
+type lockCount struct {
+	readers int
+	writers int
+}
+
+// LockManagerInterface is what the transaction manager needs from a lock
+// manager. Lock and LockRange block until the lock is granted, so the
+// transaction manager only asks for a lock once it has ruled out a deadlock.
+// LockManager implements it; others, such as one that shards its lock table to
+// reduce contention, can be used in its place.
+type LockManagerInterface interface {
+	Lock(r Resource, lType LockType) error
+	Unlock(r Resource, lType LockType) error
+	LockRange(r RangeResource, lType LockType, owned map[Resource]LockType) error
+	UnlockRange(r RangeResource, lType LockType) error
+}
+
 // Lock manager handles transaction-level locks over database resources.
 type LockManager struct {
-	lmMtx sync.Mutex
-	locks map[Resource]*sync.RWMutex
+	lmMtx  sync.Mutex
+	locks  map[Resource]*sync.RWMutex
+	held   map[Resource]*lockCount      // Holders of each point lock.
+	ranges map[RangeResource]*lockCount // Holders of each range lock.
+	cond   *sync.Cond                   // Signalled whenever a lock is released.
 }
 
 // Construct a new lock manager.
 func NewLockManager() *LockManager {
-	return &LockManager{
-		locks: make(map[Resource]*sync.RWMutex),
+	lm := &LockManager{
+		locks:  make(map[Resource]*sync.RWMutex),
+		held:   make(map[Resource]*lockCount),
+		ranges: make(map[RangeResource]*lockCount),
 	}
+	lm.cond = sync.NewCond(&lm.lmMtx)
+	return lm
 }
 
-// Lock a resource.
-func (lm *LockManager) Lock(r Resource, lType LockType) error {
-	// Safely acquire the lock itself, initializing it if needed.
-	lm.lmMtx.Lock()
-	lock, found := lm.locks[r]
-	if !found {
-		lm.locks[r] = &sync.RWMutex{}
-		lock = lm.locks[r]
+// Returns true if a lock of type lType conflicts with a lock held according to count.
+func conflicts(count *lockCount, lType LockType) bool {
+	if count == nil {
+		return false
 	}
-	lm.lmMtx.Unlock()
-	// Lock accordingly.
+	return count.writers > 0 || (lType == W_LOCK && count.readers > 0)
+}
+
+// Record that a lock of type lType was taken (delta = 1) or released (delta = -1).
+func (count *lockCount) add(lType LockType, delta int) {
 	switch lType {
 	case R_LOCK:
-		lock.RLock()
+		count.readers += delta
 	case W_LOCK:
-		lock.Lock()
+		count.writers += delta
+	}
+}
+
+// Lock a resource.
+func (lm *LockManager) Lock(r Resource, lType LockType) error {
+	for {
+		// Safely acquire the lock itself, initializing it if needed.
+		lm.lmMtx.Lock()
+		lock, found := lm.locks[r]
+		if !found {
+			lm.locks[r] = &sync.RWMutex{}
+			lock = lm.locks[r]
+		}
+		// Wait until no range lock covering this resource conflicts with us.
+		for lm.rangeConflict(r, lType) {
+			lm.cond.Wait()
+		}
+		lm.lmMtx.Unlock()
+		lockAs(lock, lType)
+		// Register ourselves as a holder, so that new range locks wait on us,
+		// unless a range lock was granted while we were waiting for the lock.
+		lm.lmMtx.Lock()
+		if !lm.rangeConflict(r, lType) {
+			if _, found := lm.held[r]; !found {
+				lm.held[r] = &lockCount{}
+			}
+			lm.held[r].add(lType, 1)
+			lm.lmMtx.Unlock()
+			return nil
+		}
+		lm.lmMtx.Unlock()
+		unlockAs(lock, lType)
 	}
-	return nil
 }
 
 // Unlock a resource.
@@ -68,15 +160,109 @@ func (lm *LockManager) Unlock(r Resource, lType LockType) error {
 	lm.lmMtx.Lock()
 	lock, found := lm.locks[r]
 	if !found {
+		lm.lmMtx.Unlock()
 		return errors.New("tried to unlock nonexistent resource")
 	}
+	if count, found := lm.held[r]; found {
+		count.add(lType, -1)
+		if count.readers == 0 && count.writers == 0 {
+			delete(lm.held, r)
+		}
+	}
 	lm.lmMtx.Unlock()
-	// Unlock accordingly.
+	unlockAs(lock, lType)
+	// Wake up any range lockers waiting on this resource.
+	lm.cond.Broadcast()
+	return nil
+}
+
+// Takes the given lock as a reader or a writer, according to lType.
+func lockAs(lock *sync.RWMutex, lType LockType) {
+	switch lType {
+	case R_LOCK:
+		lock.RLock()
+	case W_LOCK:
+		lock.Lock()
+	}
+}
+
+// Releases the given lock, which was taken as a reader or a writer according to lType.
+func unlockAs(lock *sync.RWMutex, lType LockType) {
 	switch lType {
 	case R_LOCK:
 		lock.RUnlock()
 	case W_LOCK:
 		lock.Unlock()
 	}
+}
+
+// Lock a range of keys. Point locks held by the caller (given in `owned`)
+// are not considered conflicts. Blocks until no other lock conflicts.
+func (lm *LockManager) LockRange(r RangeResource, lType LockType, owned map[Resource]LockType) error {
+	lm.lmMtx.Lock()
+	defer lm.lmMtx.Unlock()
+	for lm.pointConflict(r, lType, owned) || lm.overlapConflict(r, lType) {
+		lm.cond.Wait()
+	}
+	if _, found := lm.ranges[r]; !found {
+		lm.ranges[r] = &lockCount{}
+	}
+	lm.ranges[r].add(lType, 1)
 	return nil
 }
+
+// Unlock a range of keys.
+func (lm *LockManager) UnlockRange(r RangeResource, lType LockType) error {
+	lm.lmMtx.Lock()
+	count, found := lm.ranges[r]
+	if !found {
+		lm.lmMtx.Unlock()
+		return errors.New("tried to unlock nonexistent range")
+	}
+	count.add(lType, -1)
+	if count.readers == 0 && count.writers == 0 {
+		delete(lm.ranges, r)
+	}
+	lm.lmMtx.Unlock()
+	lm.cond.Broadcast()
+	return nil
+}
+
+// Returns true if a range lock covering r conflicts with lType. Expects lmMtx to be locked.
+func (lm *LockManager) rangeConflict(r Resource, lType LockType) bool {
+	for rr, count := range lm.ranges {
+		if rr.Contains(r) && conflicts(count, lType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if a point lock within r held by someone else conflicts with lType.
+// Expects lmMtx to be locked.
+func (lm *LockManager) pointConflict(r RangeResource, lType LockType, owned map[Resource]LockType) bool {
+	for pr, count := range lm.held {
+		if !r.Contains(pr) {
+			continue
+		}
+		// Discount the caller's own lock on this resource.
+		other := *count
+		if ownType, ok := owned[pr]; ok {
+			other.add(ownType, -1)
+		}
+		if conflicts(&other, lType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if an overlapping range lock conflicts with lType. Expects lmMtx to be locked.
+func (lm *LockManager) overlapConflict(r RangeResource, lType LockType) bool {
+	for rr, count := range lm.ranges {
+		if rr.Overlaps(r) && conflicts(count, lType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package concurrency
+
+import (
+	"errors"
+	"sync"
+)
+
+// Default number of shards in a ShardedLockManager.
+const DEFAULT_LOCK_SHARDS = 16
+
+// A shard of a ShardedLockManager's lock table.
+type lockShard struct {
+	mtx   sync.Mutex
+	locks map[Resource]*sync.RWMutex
+	held  map[Resource]*lockCount // Holders of each point lock.
+	cond  *sync.Cond              // Signalled whenever a lock in the shard, or any range lock, is released.
+}
+
+// ShardedLockManager is a lock manager that spreads its point locks over
+// shards by resource, each with its own mutex, so that locking independent
+// resources doesn't contend on a single mutex like LockManager does. Range
+// locks can cover resources in every shard, so they are kept in one table,
+// which is only changed while holding every shard's mutex; holding any one is
+// enough to read it. A range lock is only taken once nothing conflicts with it,
+// like in LockManager, so waiting for one never makes anyone else wait.
+type ShardedLockManager struct {
+	shards []*lockShard
+	ranges map[RangeResource]*lockCount // Holders of each range lock.
+}
+
+// Construct a new sharded lock manager with the given number of shards.
+func NewShardedLockManager(numShards int) (*ShardedLockManager, error) {
+	if numShards < 1 {
+		return nil, errors.New("a sharded lock manager needs at least one shard")
+	}
+	lm := &ShardedLockManager{
+		shards: make([]*lockShard, numShards),
+		ranges: make(map[RangeResource]*lockCount),
+	}
+	for i := range lm.shards {
+		shard := &lockShard{
+			locks: make(map[Resource]*sync.RWMutex),
+			held:  make(map[Resource]*lockCount),
+		}
+		shard.cond = sync.NewCond(&shard.mtx)
+		lm.shards[i] = shard
+	}
+	return lm, nil
+}
+
+// Returns the shard that holds the given resource's lock.
+func (lm *ShardedLockManager) shardOf(r Resource) *lockShard {
+	// FNV-1a over the table name, mixed with the key.
+	sum := uint64(14695981039346656037)
+	for i := 0; i < len(r.tableName); i++ {
+		sum = (sum ^ uint64(r.tableName[i])) * 1099511628211
+	}
+	sum ^= uint64(r.resourceKey) * 0x9e3779b97f4a7c15
+	return lm.shards[(sum>>32)%uint64(len(lm.shards))]
+}
+
+// Lock a resource.
+func (lm *ShardedLockManager) Lock(r Resource, lType LockType) error {
+	shard := lm.shardOf(r)
+	for {
+		shard.mtx.Lock()
+		lock, found := shard.locks[r]
+		if !found {
+			lock = &sync.RWMutex{}
+			shard.locks[r] = lock
+		}
+		// Wait until no range lock covering this resource conflicts with us.
+		for lm.rangeConflict(r, lType) {
+			shard.cond.Wait()
+		}
+		shard.mtx.Unlock()
+		lockAs(lock, lType)
+		// Register ourselves as a holder, so that new range locks wait on us,
+		// unless a range lock was granted while we were waiting for the lock.
+		shard.mtx.Lock()
+		if !lm.rangeConflict(r, lType) {
+			if _, found := shard.held[r]; !found {
+				shard.held[r] = &lockCount{}
+			}
+			shard.held[r].add(lType, 1)
+			shard.mtx.Unlock()
+			return nil
+		}
+		shard.mtx.Unlock()
+		unlockAs(lock, lType)
+	}
+}
+
+// Unlock a resource.
+func (lm *ShardedLockManager) Unlock(r Resource, lType LockType) error {
+	shard := lm.shardOf(r)
+	shard.mtx.Lock()
+	lock, found := shard.locks[r]
+	if !found {
+		shard.mtx.Unlock()
+		return errors.New("tried to unlock nonexistent resource")
+	}
+	if count, found := shard.held[r]; found {
+		count.add(lType, -1)
+		if count.readers == 0 && count.writers == 0 {
+			delete(shard.held, r)
+		}
+	}
+	shard.mtx.Unlock()
+	unlockAs(lock, lType)
+	// Wake up any range lockers waiting on this resource.
+	shard.cond.Broadcast()
+	return nil
+}
+
+// Lock a range of keys. Point locks held by the caller (given in `owned`)
+// are not considered conflicts. Blocks until no other lock conflicts.
+func (lm *ShardedLockManager) LockRange(r RangeResource, lType LockType, owned map[Resource]LockType) error {
+	for {
+		lm.lockAll()
+		waitOn := lm.rangeWaitShard(r, lType, owned)
+		if waitOn == nil {
+			if _, found := lm.ranges[r]; !found {
+				lm.ranges[r] = &lockCount{}
+			}
+			lm.ranges[r].add(lType, 1)
+			lm.unlockAll(nil)
+			return nil
+		}
+		// Keep the conflicting shard locked while waiting on it, so that
+		// the release we wait for can't happen before we do.
+		lm.unlockAll(waitOn)
+		waitOn.cond.Wait()
+		waitOn.mtx.Unlock()
+	}
+}
+
+// Unlock a range of keys.
+func (lm *ShardedLockManager) UnlockRange(r RangeResource, lType LockType) error {
+	lm.lockAll()
+	count, found := lm.ranges[r]
+	if !found {
+		lm.unlockAll(nil)
+		return errors.New("tried to unlock nonexistent range")
+	}
+	count.add(lType, -1)
+	if count.readers == 0 && count.writers == 0 {
+		delete(lm.ranges, r)
+	}
+	lm.unlockAll(nil)
+	// Anyone waiting on a range lock may be waiting in any shard.
+	for _, shard := range lm.shards {
+		shard.cond.Broadcast()
+	}
+	return nil
+}
+
+// Locks every shard, always in the same order.
+func (lm *ShardedLockManager) lockAll() {
+	for _, shard := range lm.shards {
+		shard.mtx.Lock()
+	}
+}
+
+// Unlocks every shard but keep, if it isn't nil.
+func (lm *ShardedLockManager) unlockAll(keep *lockShard) {
+	for _, shard := range lm.shards {
+		if shard != keep {
+			shard.mtx.Unlock()
+		}
+	}
+}
+
+// Returns true if a range lock covering r conflicts with lType. Expects r's shard to be locked.
+func (lm *ShardedLockManager) rangeConflict(r Resource, lType LockType) bool {
+	for rr, count := range lm.ranges {
+		if rr.Contains(r) && conflicts(count, lType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a shard to wait on before locking the given range, or nil if
+// nothing conflicts with it: the shard of a conflicting point lock held by
+// someone else, or any shard if an overlapping range lock conflicts, since
+// releasing a range wakes every shard. Expects every shard to be locked.
+func (lm *ShardedLockManager) rangeWaitShard(r RangeResource, lType LockType, owned map[Resource]LockType) *lockShard {
+	for rr, count := range lm.ranges {
+		if rr.Overlaps(r) && conflicts(count, lType) {
+			return lm.shards[0]
+		}
+	}
+	for _, shard := range lm.shards {
+		for pr, count := range shard.held {
+			if !r.Contains(pr) {
+				continue
+			}
+			// Discount the caller's own lock on this resource.
+			other := *count
+			if ownType, ok := owned[pr]; ok {
+				other.add(ownType, -1)
+			}
+			if conflicts(&other, lType) {
+				return shard
+			}
+		}
+	}
+	return nil
+}
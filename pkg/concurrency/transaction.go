@@ -2,17 +2,74 @@ package concurrency
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	db "github.com/brown-csci1270/db/pkg/db"
 	uuid "github.com/google/uuid"
 )
 
+// ErrDeadlock is returned when a lock request would create a deadlock, and the
+// requesting transaction has the lowest priority of the transactions involved.
+var ErrDeadlock = errors.New("deadlock detected")
+
+// ErrTransactionAborted is returned by a pending lock request of a transaction
+// that was aborted to break a deadlock.
+var ErrTransactionAborted = errors.New("transaction was aborted to break a deadlock")
+
+// WithRetry waits this long before its first retry, doubling the wait for each
+// retry after that, up to RETRY_MAX_BACKOFF.
+var RETRY_BASE_BACKOFF = 10 * time.Millisecond
+var RETRY_MAX_BACKOFF = time.Second
+
+// The precedence graph is pruned of stale edges once every this many commits.
+const PRUNE_INTERVAL = 64
+
+// VictimPolicy decides which transaction on a cycle is aborted to break a deadlock.
+type VictimPolicy int
+
+const (
+	// Abort the transaction with the lowest priority. Since restarted transactions
+	// keep their priority, no transaction is aborted forever.
+	VictimByPriority VictimPolicy = iota
+	// Abort the transaction holding the fewest locks, which has the least work to
+	// redo, breaking ties by priority. A small transaction that keeps conflicting
+	// with larger ones can be aborted repeatedly.
+	VictimByLocksHeld
+)
+
 // Each client can have a transaction running. Each transaction has a list of locked resources.
 type Transaction struct {
-	clientId  uuid.UUID
-	resources map[Resource]LockType
-	lock      sync.RWMutex
+	clientId    uuid.UUID
+	resources   map[Resource]LockType
+	ranges      map[RangeResource]LockType
+	leases      map[Resource]time.Time      // When each resource was locked.
+	rangeLeases map[RangeResource]time.Time // When each range was locked.
+	priority    Priority                    // Decides which transaction is aborted on deadlock.
+	aborted     bool                        // Set if the transaction was aborted to break a deadlock.
+	writes      map[Resource]bufferedWrite  // Writes to apply on commit, if writes are buffered.
+	lock        sync.RWMutex
+}
+
+// Priority orders transactions when choosing a deadlock victim. A transaction that is
+// aborted keeps its start time when its client begins again, so a repeatedly
+// restarted transaction eventually becomes the oldest and stops being chosen.
+type Priority struct {
+	Started time.Time // When the client's first unfinished attempt began.
+	Aborts  int       // How many times the client's attempts were aborted.
+}
+
+// Returns true if p has priority over other: older transactions win, then those
+// that were aborted more often.
+func (p Priority) Outranks(other Priority) bool {
+	if !p.Started.Equal(other.Started) {
+		return p.Started.Before(other.Started)
+	}
+	return p.Aborts > other.Aborts
 }
 
 // Grab a write lock on the tx
@@ -45,24 +102,122 @@ func (t *Transaction) GetResources() map[Resource]LockType {
 	return t.resources
 }
 
+// Get the transaction's locked key ranges.
+func (t *Transaction) GetRanges() map[RangeResource]LockType {
+	return t.ranges
+}
+
+// Get the transaction's priority.
+func (t *Transaction) GetPriority() Priority {
+	return t.priority
+}
+
+// Returns true if t has priority over other, breaking ties by client id.
+func (t *Transaction) outranks(other *Transaction) bool {
+	if t.priority != other.priority {
+		return t.priority.Outranks(other.priority)
+	}
+	return t.clientId.String() < other.clientId.String()
+}
+
+// Returns how many keys and ranges the transaction holds locks on.
+func (t *Transaction) locksHeld() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.resources) + len(t.ranges)
+}
+
+// Returns the time at which the transaction's oldest lock was acquired, if it holds any.
+// Expects t to be read-locked.
+func (t *Transaction) oldestLease() (time.Time, bool) {
+	var oldest time.Time
+	found := false
+	for _, acquired := range t.leases {
+		if !found || acquired.Before(oldest) {
+			oldest, found = acquired, true
+		}
+	}
+	for _, acquired := range t.rangeLeases {
+		if !found || acquired.Before(oldest) {
+			oldest, found = acquired, true
+		}
+	}
+	return oldest, found
+}
+
+// Returns the lock type of a range held by this transaction that covers the given resource, if any.
+// A covering write lock is preferred over a covering read lock. Expects t to be read-locked.
+func (t *Transaction) coveringRange(r Resource) (LockType, bool) {
+	covered := false
+	coverType := R_LOCK
+	for rr, rType := range t.ranges {
+		if rr.Contains(r) {
+			covered = true
+			if rType == W_LOCK {
+				coverType = W_LOCK
+			}
+		}
+	}
+	return coverType, covered
+}
+
 // Transaction Manager manages all of the transactions on a server.
 type TransactionManager struct {
-	lm           *LockManager
+	lm           LockManagerInterface
 	tmMtx        sync.RWMutex
 	pGraph       *Graph
 	transactions map[uuid.UUID]*Transaction
+	// Index of which transactions hold each resource, and which hold any range,
+	// so that conflict discovery doesn't have to scan every transaction.
+	holders      map[Resource]map[uuid.UUID]*Transaction
+	rangeHolders map[uuid.UUID]*Transaction
+	holdersMtx   sync.Mutex
+	clock        func() time.Time // Timestamps lock leases and transaction starts.
+	// Priorities of clients whose last transaction was a deadlock victim, to be
+	// carried over to their next transaction.
+	restarts map[uuid.UUID]Priority
+	commits  int          // Commits since the precedence graph was last pruned.
+	buffered bool         // Whether writes are buffered in their transaction until it commits.
+	policy   VictimPolicy // How deadlock victims are chosen.
 }
 
 // Get a pointer to a new transaction manager.
-func NewTransactionManager(lm *LockManager) *TransactionManager {
-	return &TransactionManager{lm: lm, pGraph: NewGraph(), transactions: make(map[uuid.UUID]*Transaction)}
+func NewTransactionManager(lm LockManagerInterface) *TransactionManager {
+	return &TransactionManager{
+		lm:           lm,
+		pGraph:       NewGraph(),
+		transactions: make(map[uuid.UUID]*Transaction),
+		holders:      make(map[Resource]map[uuid.UUID]*Transaction),
+		rangeHolders: make(map[uuid.UUID]*Transaction),
+		clock:        time.Now,
+		restarts:     make(map[uuid.UUID]Priority),
+	}
+}
+
+// Set the clock used to timestamp lock leases and transaction starts.
+func (tm *TransactionManager) SetClock(clock func() time.Time) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	tm.clock = clock
+}
+
+// Set how deadlock victims are chosen. Defaults to VictimByPriority.
+func (tm *TransactionManager) SetVictimPolicy(policy VictimPolicy) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	tm.policy = policy
 }
 
 // Get the transactions.
-func (tm *TransactionManager) GetLockManager() *LockManager {
+func (tm *TransactionManager) GetLockManager() LockManagerInterface {
 	return tm.lm
 }
 
+// Get the precedence graph.
+func (tm *TransactionManager) GetGraph() *Graph {
+	return tm.pGraph
+}
+
 // Get the transactions.
 func (tm *TransactionManager) GetTransactions() map[uuid.UUID]*Transaction {
 	return tm.transactions
@@ -76,6 +231,95 @@ func (tm *TransactionManager) GetTransaction(clientId uuid.UUID) (*Transaction,
 	return t, found
 }
 
+// A resource held by a transaction, and the mode it is locked in.
+type HeldResource struct {
+	Resource Resource
+	LockType LockType
+}
+
+// InspectTransaction returns the resources the given client's transaction holds,
+// ordered by table name, then key. Resources covered only by a range lock are not listed.
+func (tm *TransactionManager) InspectTransaction(clientId uuid.UUID) ([]HeldResource, error) {
+	t, found := tm.GetTransaction(clientId)
+	if !found {
+		return nil, errors.New("transaction not found")
+	}
+	t.RLock()
+	held := make([]HeldResource, 0, len(t.resources))
+	for r, lType := range t.resources {
+		held = append(held, HeldResource{Resource: r, LockType: lType})
+	}
+	t.RUnlock()
+	sort.Slice(held, func(i, j int) bool {
+		ri, rj := held[i].Resource, held[j].Resource
+		if ri.tableName != rj.tableName {
+			return ri.tableName < rj.tableName
+		}
+		return ri.resourceKey < rj.resourceKey
+	})
+	return held, nil
+}
+
+// DumpLocks writes every running transaction with the resources and ranges it
+// holds, the edges of the precedence graph, and a cycle in the graph if there
+// is one, for debugging a stuck workload. Transactions are ordered by client id.
+// Only reads state, under the same locks that lock requests take.
+func (tm *TransactionManager) DumpLocks(w io.Writer) {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	transactions := make([]*Transaction, 0, len(tm.transactions))
+	for _, t := range tm.transactions {
+		transactions = append(transactions, t)
+	}
+	sortByClientID(transactions)
+	fmt.Fprintf(w, "transactions: %d\n", len(transactions))
+	for _, t := range transactions {
+		t.RLock()
+		held := make([]string, 0, len(t.resources)+len(t.ranges))
+		for r, lType := range t.resources {
+			held = append(held, fmt.Sprintf("%s/%d (%s)", r.tableName, r.resourceKey, lockTypeName(lType)))
+		}
+		for rr, lType := range t.ranges {
+			held = append(held, fmt.Sprintf("%s/[%d, %d] (%s)", rr.tableName, rr.startKey, rr.endKey, lockTypeName(lType)))
+		}
+		t.RUnlock()
+		sort.Strings(held)
+		if len(held) == 0 {
+			held = append(held, "nothing")
+		}
+		fmt.Fprintf(w, "%v holds %s\n", t.clientId, strings.Join(held, ", "))
+	}
+	fmt.Fprintf(w, "waits for:\n%s", tm.pGraph.String())
+	waiting := tm.pGraph.transactions()
+	sortByClientID(waiting)
+	for _, t := range waiting {
+		if cycle := tm.pGraph.FindCycle(t); cycle != nil {
+			ids := make([]string, 0, len(cycle)+1)
+			for _, tt := range append(cycle, t) {
+				ids = append(ids, tt.clientId.String())
+			}
+			fmt.Fprintf(w, "cycle: %s\n", strings.Join(ids, " -> "))
+			return
+		}
+	}
+	io.WriteString(w, "cycle: none\n")
+}
+
+// Sorts transactions by client id.
+func sortByClientID(transactions []*Transaction) {
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].clientId.String() < transactions[j].clientId.String()
+	})
+}
+
+// Returns the short name of a lock type.
+func lockTypeName(lType LockType) string {
+	if lType == W_LOCK {
+		return "W"
+	}
+	return "R"
+}
+
 // Begin a transaction for the given client; error if already began.
 func (tm *TransactionManager) Begin(clientId uuid.UUID) error {
 	tm.tmMtx.Lock()
@@ -84,7 +328,21 @@ func (tm *TransactionManager) Begin(clientId uuid.UUID) error {
 	if found {
 		return errors.New("transaction already began")
 	}
-	tm.transactions[clientId] = &Transaction{clientId: clientId, resources: make(map[Resource]LockType)}
+	// Restarted transactions keep their priority.
+	priority, restarted := tm.restarts[clientId]
+	if restarted {
+		delete(tm.restarts, clientId)
+	} else {
+		priority = Priority{Started: tm.clock()}
+	}
+	tm.transactions[clientId] = &Transaction{
+		clientId:    clientId,
+		resources:   make(map[Resource]LockType),
+		ranges:      make(map[RangeResource]LockType),
+		leases:      make(map[Resource]time.Time),
+		rangeLeases: make(map[RangeResource]time.Time),
+		priority:    priority,
+	}
 	return nil
 }
 
@@ -110,6 +368,15 @@ func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceK
 		t.RUnlock()
 		return errors.New("cannot upgrade to write lock in the middle of transaction")
 	}
+	// Check if one of our ranges already covers the resource
+	if coverType, ok := t.coveringRange(resource); ok {
+		tm.tmMtx.RUnlock()
+		t.RUnlock()
+		if coverType == W_LOCK || coverType == lType {
+			return nil
+		}
+		return errors.New("cannot upgrade to write lock in the middle of transaction")
+	}
 	t.RUnlock()
 	// Create a precedence graph, see if we create a cycle by locking this resource.
 	for _, tt := range tm.discoverTransactions(resource, lType) {
@@ -119,21 +386,147 @@ func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceK
 		tm.pGraph.AddEdge(t, tt)
 		defer tm.pGraph.RemoveEdge(t, tt)
 	}
-	// If a deadlock, unlock and error.
-	if tm.pGraph.DetectCycle() {
+	// If a deadlock, abort the lowest-priority transaction involved.
+	victim := tm.chooseVictim(t)
+	if victim == t {
 		tm.tmMtx.RUnlock()
-		return errors.New("deadlock detected")
+		tm.recordAbort(t)
+		return ErrDeadlock
 	}
 	// Else, lock the resource.
+	clock := tm.clock
 	tm.tmMtx.RUnlock()
-	tm.lm.Lock(resource, lType)
+	if victim != nil {
+		tm.abort(victim)
+	}
+	if err := tm.lm.Lock(resource, lType); err != nil {
+		return err
+	}
 	t.WLock()
 	defer t.WUnlock()
+	// We may have been aborted while waiting.
+	if t.aborted {
+		tm.lm.Unlock(resource, lType)
+		return ErrTransactionAborted
+	}
 	t.resources[resource] = lType
+	t.leases[resource] = clock()
+	tm.addHolder(resource, t)
 	return nil
 	/* SOLUTION }}} */
 }
 
+// A request to lock a key in a table, used by LockMany.
+type LockRequest struct {
+	Table    db.Index
+	Key      int64
+	LockType LockType
+}
+
+// Locks all of the given resources, acquiring them in a canonical order
+// (table name, then key). Transactions that declare all of their locks up
+// front through LockMany can never deadlock with one another.
+func (tm *TransactionManager) LockMany(clientId uuid.UUID, requests []LockRequest) error {
+	// Merge duplicate requests, keeping the strongest lock type.
+	merged := make(map[Resource]LockRequest)
+	for _, req := range requests {
+		r := Resource{tableName: req.Table.GetName(), resourceKey: req.Key}
+		if prev, ok := merged[r]; !ok || prev.LockType == R_LOCK {
+			merged[r] = req
+		}
+	}
+	ordered := make([]LockRequest, 0, len(merged))
+	for _, req := range merged {
+		ordered = append(ordered, req)
+	}
+	// Sort by the global resource order.
+	sort.Slice(ordered, func(i, j int) bool {
+		ti, tj := ordered[i].Table.GetName(), ordered[j].Table.GetName()
+		if ti != tj {
+			return ti < tj
+		}
+		return ordered[i].Key < ordered[j].Key
+	})
+	for _, req := range ordered {
+		if err := tm.Lock(clientId, req.Table, req.Key, req.LockType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Locks every key in [startKey, endKey] of the given table, including keys that
+// don't exist yet. Will return an error if deadlock is created.
+func (tm *TransactionManager) LockRange(clientId uuid.UUID, table db.Index, startKey int64, endKey int64, lType LockType) error {
+	if startKey > endKey {
+		return errors.New("invalid range")
+	}
+	// Get the transaction we want, and construct the resource.
+	tm.tmMtx.RLock()
+	t, found := tm.GetTransaction(clientId)
+	if !found {
+		tm.tmMtx.RUnlock()
+		return errors.New("transaction not found")
+	}
+	resource := RangeResource{tableName: table.GetName(), startKey: startKey, endKey: endKey}
+	// Check if we already have rights to the range.
+	t.RLock()
+	for rr, rType := range t.ranges {
+		if !rr.Overlaps(resource) || (rType == R_LOCK && lType == R_LOCK) {
+			continue
+		}
+		contained := rr.startKey <= startKey && endKey <= rr.endKey
+		tm.tmMtx.RUnlock()
+		t.RUnlock()
+		if contained && (rType == W_LOCK || rType == lType) {
+			return nil
+		}
+		return errors.New("cannot lock a range overlapping an already-locked range")
+	}
+	owned := make(map[Resource]LockType)
+	for r, rType := range t.resources {
+		owned[r] = rType
+	}
+	t.RUnlock()
+	// Create a precedence graph, see if we create a cycle by locking this range.
+	for _, tt := range tm.discoverRangeTransactions(resource, lType) {
+		if t == tt {
+			continue
+		}
+		tm.pGraph.AddEdge(t, tt)
+		defer tm.pGraph.RemoveEdge(t, tt)
+	}
+	// If a deadlock, abort the lowest-priority transaction involved.
+	victim := tm.chooseVictim(t)
+	if victim == t {
+		tm.tmMtx.RUnlock()
+		tm.recordAbort(t)
+		return ErrDeadlock
+	}
+	// Else, lock the range.
+	clock := tm.clock
+	tm.tmMtx.RUnlock()
+	if victim != nil {
+		tm.abort(victim)
+	}
+	if err := tm.lm.LockRange(resource, lType, owned); err != nil {
+		return err
+	}
+	t.WLock()
+	defer t.WUnlock()
+	// We may have been aborted while waiting.
+	if t.aborted {
+		tm.lm.UnlockRange(resource, lType)
+		return ErrTransactionAborted
+	}
+	t.ranges[resource] = lType
+	t.rangeLeases[resource] = clock()
+	tm.holdersMtx.Lock()
+	tm.rangeHolders[clientId] = t
+	tm.holdersMtx.Unlock()
+	return nil
+}
+
 // Unlocks the given resource.
 func (tm *TransactionManager) Unlock(clientId uuid.UUID, table db.Index, resourceKey int64, lType LockType) error {
 	/* SOLUTION {{{ */
@@ -145,24 +538,20 @@ func (tm *TransactionManager) Unlock(clientId uuid.UUID, table db.Index, resourc
 		return errors.New("transaction not found")
 	}
 	resource := Resource{tableName: table.GetName(), resourceKey: resourceKey}
-	// Iterate through our locks to find the right one and remove it.
+	// Find the right lock and remove it.
 	t.WLock()
 	defer t.WUnlock()
-	removed := false
-	for r, storedType := range t.resources {
-		if storedType != lType {
-			return errors.New("incorrect unlock type")
-		}
-		if r == resource {
-			removed = true
-			delete(t.resources, r)
-			break
-		}
-	}
+	storedType, found := t.resources[resource]
 	// Error if no lock found.
-	if !removed {
+	if !found {
 		return errors.New("resource not locked")
 	}
+	if storedType != lType {
+		return errors.New("incorrect unlock type")
+	}
+	delete(t.resources, resource)
+	delete(t.leases, resource)
+	tm.removeHolder(resource, t)
 	// Unlock the resource.
 	err := tm.lm.Unlock(resource, lType)
 	if err != nil {
@@ -174,6 +563,19 @@ func (tm *TransactionManager) Unlock(clientId uuid.UUID, table db.Index, resourc
 
 // Commits the given transaction and removes it from the running transactions list.
 func (tm *TransactionManager) Commit(clientId uuid.UUID) error {
+	return tm.end(clientId, true)
+}
+
+// Aborts the given transaction, discarding its buffered writes, and removes it
+// from the running transactions list. Undoing edits that were written through
+// to tables is up to the caller.
+func (tm *TransactionManager) Abort(clientId uuid.UUID) error {
+	return tm.end(clientId, false)
+}
+
+// Ends the given transaction, applying its buffered writes if it commits or
+// discarding them if it aborts, then releases its locks.
+func (tm *TransactionManager) end(clientId uuid.UUID, commit bool) error {
 	tm.tmMtx.Lock()
 	defer tm.tmMtx.Unlock()
 	// Get the transaction we want.
@@ -181,6 +583,36 @@ func (tm *TransactionManager) Commit(clientId uuid.UUID) error {
 	if !found {
 		return errors.New("no transactions running")
 	}
+	// Apply buffered writes while the transaction still holds its locks.
+	if !commit {
+		t.discardWrites()
+	} else if err := t.applyWrites(); err != nil {
+		return err
+	}
+	if err := tm.release(t); err != nil {
+		return err
+	}
+	// Periodically clean up edges leaked by finished transactions.
+	tm.commits++
+	if tm.commits >= PRUNE_INTERVAL {
+		tm.pGraph.Prune(tm.transactions)
+		tm.commits = 0
+	}
+	return nil
+}
+
+// Removes the precedence graph's edges to or from transactions that are no
+// longer running, and returns how many were removed.
+func (tm *TransactionManager) PruneGraph() int {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	return tm.pGraph.Prune(tm.transactions)
+}
+
+// Unlocks all of a transaction's resources and removes it from the running
+// transactions list. Expects tmMtx to be locked.
+func (tm *TransactionManager) release(t *Transaction) error {
+	clientId := t.clientId
 	// Unlock all resources.
 	t.RLock()
 	defer t.RUnlock()
@@ -190,23 +622,233 @@ func (tm *TransactionManager) Commit(clientId uuid.UUID) error {
 			return err
 		}
 	}
-	// Remove the transaction from our transactions list.
+	for rr, lType := range t.ranges {
+		err := tm.lm.UnlockRange(rr, lType)
+		if err != nil {
+			return err
+		}
+	}
+	// Remove the transaction from our transactions list and holder index.
+	for r := range t.resources {
+		tm.removeHolder(r, t)
+	}
+	tm.holdersMtx.Lock()
+	delete(tm.rangeHolders, clientId)
+	tm.holdersMtx.Unlock()
 	delete(tm.transactions, clientId)
 	return nil
 }
 
+// WithRetry runs fn in a transaction for the given client, and commits it if fn succeeds.
+// If the transaction is aborted to break a deadlock, its locks are released and fn
+// is run again in a new transaction, after an exponential backoff, up to maxRetries
+// times. A retry keeps the aborted transaction's priority, so it eventually wins.
+// Other errors abort the transaction and are returned. Like ReapExpired, aborting
+// discards buffered writes and releases locks, so fn must not write through to
+// tables when it fails.
+func (tm *TransactionManager) WithRetry(clientId uuid.UUID, maxRetries int, fn func() error) error {
+	backoff := RETRY_BASE_BACKOFF
+	for retries := 0; ; retries++ {
+		if err := tm.Begin(clientId); err != nil {
+			return err
+		}
+		t, _ := tm.GetTransaction(clientId)
+		err := fn()
+		// The transaction may also have been aborted after its last lock was granted.
+		t.RLock()
+		aborted := t.aborted
+		t.RUnlock()
+		if err == nil && !aborted {
+			return tm.Commit(clientId)
+		}
+		// An aborted transaction's locks were already released.
+		if !aborted {
+			tm.Abort(clientId)
+		}
+		if !aborted && !errors.Is(err, ErrDeadlock) {
+			return err
+		}
+		if err == nil {
+			err = ErrTransactionAborted
+		}
+		if retries == maxRetries {
+			return fmt.Errorf("gave up after %d retries: %w", maxRetries, err)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > RETRY_MAX_BACKOFF {
+			backoff = RETRY_MAX_BACKOFF
+		}
+	}
+}
+
+// ReapExpired aborts every transaction holding a lock older than maxAge,
+// discarding its buffered writes and releasing all of its locks, and returns the
+// ids of the aborted transactions. Undoing edits that were written through to
+// tables is up to the caller.
+func (tm *TransactionManager) ReapExpired(maxAge time.Duration) ([]uuid.UUID, error) {
+	// Find the transactions with expired leases.
+	tm.tmMtx.RLock()
+	now := tm.clock()
+	expired := make([]uuid.UUID, 0)
+	for clientId, t := range tm.transactions {
+		t.RLock()
+		oldest, ok := t.oldestLease()
+		t.RUnlock()
+		if ok && now.Sub(oldest) > maxAge {
+			expired = append(expired, clientId)
+		}
+	}
+	tm.tmMtx.RUnlock()
+	// Abort them, skipping any that finished in the meantime.
+	reaped := make([]uuid.UUID, 0)
+	for _, clientId := range expired {
+		if _, found := tm.GetTransaction(clientId); !found {
+			continue
+		}
+		if err := tm.Abort(clientId); err != nil {
+			return reaped, err
+		}
+		reaped = append(reaped, clientId)
+	}
+	return reaped, nil
+}
+
+// Returns the transaction to abort if t waiting on the graph's current edges
+// creates a deadlock, or nil if it doesn't. The victim is chosen from the cycle
+// through t according to the victim policy. Expects tmMtx to be read-locked.
+func (tm *TransactionManager) chooseVictim(t *Transaction) *Transaction {
+	if !tm.pGraph.DetectCycle() {
+		return nil
+	}
+	if tm.policy == VictimByLocksHeld {
+		if victim := tm.pGraph.FindCycleVictim(t, (*Transaction).locksHeld); victim != nil {
+			return victim
+		}
+		return t
+	}
+	victim := t
+	for _, tt := range tm.pGraph.FindCycle(t) {
+		if victim.outranks(tt) {
+			victim = tt
+		}
+	}
+	return victim
+}
+
+// Remembers the priority of a deadlock victim, so that its client's next transaction keeps it.
+func (tm *TransactionManager) recordAbort(t *Transaction) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	tm.restarts[t.clientId] = Priority{Started: t.priority.Started, Aborts: t.priority.Aborts + 1}
+}
+
+// Aborts a transaction to break a deadlock, discarding its buffered writes and
+// releasing all of its locks. Like ReapExpired, undoing edits that were written
+// through to tables is up to its client, whose pending lock request fails with
+// ErrTransactionAborted.
+func (tm *TransactionManager) abort(t *Transaction) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	// Skip it if it finished in the meantime.
+	if tm.transactions[t.clientId] != t {
+		return
+	}
+	t.WLock()
+	t.aborted = true
+	t.WUnlock()
+	t.discardWrites()
+	tm.restarts[t.clientId] = Priority{Started: t.priority.Started, Aborts: t.priority.Aborts + 1}
+	tm.release(t)
+}
+
+// Records that the given transaction holds the given resource.
+func (tm *TransactionManager) addHolder(r Resource, t *Transaction) {
+	tm.holdersMtx.Lock()
+	defer tm.holdersMtx.Unlock()
+	ts, ok := tm.holders[r]
+	if !ok {
+		ts = make(map[uuid.UUID]*Transaction)
+		tm.holders[r] = ts
+	}
+	ts[t.clientId] = t
+}
+
+// Records that the given transaction no longer holds the given resource.
+func (tm *TransactionManager) removeHolder(r Resource, t *Transaction) {
+	tm.holdersMtx.Lock()
+	defer tm.holdersMtx.Unlock()
+	delete(tm.holders[r], t.clientId)
+	if len(tm.holders[r]) == 0 {
+		delete(tm.holders, r)
+	}
+}
+
 // Returns a slice of all transactions that conflict w/ the given resource and locktype.
+// Only the transactions holding this resource or a range are visited.
 func (tm *TransactionManager) discoverTransactions(r Resource, lType LockType) []*Transaction {
+	ret := make([]*Transaction, 0)
+	// Snapshot the holders, since a transaction's lock must not be taken while
+	// holding holdersMtx.
+	tm.holdersMtx.Lock()
+	holders := make([]*Transaction, 0, len(tm.holders[r]))
+	for _, t := range tm.holders[r] {
+		holders = append(holders, t)
+	}
+	rangeHolders := make([]*Transaction, 0, len(tm.rangeHolders))
+	for _, t := range tm.rangeHolders {
+		rangeHolders = append(rangeHolders, t)
+	}
+	tm.holdersMtx.Unlock()
+	for _, t := range holders {
+		t.RLock()
+		if storedType, ok := t.resources[r]; ok && (storedType == W_LOCK || lType == W_LOCK) {
+			ret = append(ret, t)
+		}
+		t.RUnlock()
+	}
+	// A range lock covering this resource conflicts just like a point lock would.
+	for _, t := range rangeHolders {
+		t.RLock()
+		if coverType, ok := t.coveringRange(r); ok && (coverType == W_LOCK || lType == W_LOCK) && !containsTransaction(ret, t) {
+			ret = append(ret, t)
+		}
+		t.RUnlock()
+	}
+	return ret
+}
+
+// Returns a slice of all transactions that conflict w/ the given range and locktype.
+func (tm *TransactionManager) discoverRangeTransactions(r RangeResource, lType LockType) []*Transaction {
 	ret := make([]*Transaction, 0)
 	for _, t := range tm.transactions {
 		t.RLock()
+		conflict := false
 		for storedResource, storedType := range t.resources {
-			if storedResource == r && (storedType == W_LOCK || lType == W_LOCK) {
-				ret = append(ret, t)
+			if r.Contains(storedResource) && (storedType == W_LOCK || lType == W_LOCK) {
+				conflict = true
+				break
+			}
+		}
+		for storedRange, storedType := range t.ranges {
+			if r.Overlaps(storedRange) && (storedType == W_LOCK || lType == W_LOCK) {
+				conflict = true
 				break
 			}
 		}
+		if conflict {
+			ret = append(ret, t)
+		}
 		t.RUnlock()
 	}
 	return ret
 }
+
+// Returns true if t is in the given slice.
+func containsTransaction(ts []*Transaction, t *Transaction) bool {
+	for _, tt := range ts {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
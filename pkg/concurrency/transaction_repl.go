@@ -19,7 +19,7 @@ func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 	r := repl.NewRepl()
 	r.AddCommand("create", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCreateTable(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Create a table. usage: create table <table>")
+	}, "Create a table. usage: create <btree|hash> table <table> [<key name> <value name>]")
 	r.AddCommand("find", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleFind(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Find an element. usage: find <key> from <table>")
@@ -47,6 +47,9 @@ func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(d, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
+	r.AddMetaCommand(".locks", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleLocks(tm, payload, replConfig.GetWriter())
+	}, "Print the running transactions, the locks they hold, and any deadlock. usage: .locks")
 	return r
 }
 
@@ -90,12 +93,12 @@ func HandleFind(d *db.Database, tm *TransactionManager, payload string, w io.Wri
 		return fmt.Errorf("find error: %v", err)
 	}
 	// Get the transaction, run the find, release lock and rollback if error.
-	if err = tm.Lock(clientId, table, int64(key), R_LOCK); err != nil {
-		return fmt.Errorf("find error: %v", err)
-	}
-	if err = db.HandleFind(d, payload, w); err != nil {
+	entry, err := tm.Find(clientId, table, int64(key))
+	if err != nil {
 		return fmt.Errorf("find error: %v", err)
 	}
+	io.WriteString(w, fmt.Sprintf("found entry: (%d, %d)\n",
+		entry.GetKey(), entry.GetValue()))
 	return nil
 }
 
@@ -104,7 +107,7 @@ func HandleInsert(d *db.Database, tm *TransactionManager, payload string, client
 	fields := strings.Fields(payload)
 	numFields := len(fields)
 	// Usage: insert <key> <value> into <table>
-	var key int
+	var key, value int
 	var table db.Index
 	if numFields != 5 || fields[3] != "into" {
 		return fmt.Errorf("usage: insert <key> <value> into <table>")
@@ -112,14 +115,14 @@ func HandleInsert(d *db.Database, tm *TransactionManager, payload string, client
 	if key, err = strconv.Atoi(fields[1]); err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
-	if table, err = d.GetTable(fields[4]); err != nil {
+	if value, err = strconv.Atoi(fields[2]); err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
-	// Get the transaction, run the find, release lock and rollback if error.
-	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
+	if table, err = d.GetTable(fields[4]); err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
-	if err = db.HandleInsert(d, payload); err != nil {
+	// Get the transaction, run the find, release lock and rollback if error.
+	if err = tm.Insert(clientId, table, int64(key), int64(value)); err != nil {
 		return fmt.Errorf("insert error: %v", err)
 	}
 	return nil
@@ -130,7 +133,7 @@ func HandleUpdate(d *db.Database, tm *TransactionManager, payload string, client
 	fields := strings.Fields(payload)
 	numFields := len(fields)
 	// Usage: update <table> <key> <value>
-	var key int
+	var key, value int
 	var table db.Index
 	if numFields != 4 {
 		return fmt.Errorf("usage: update <table> <key> <value>")
@@ -138,14 +141,14 @@ func HandleUpdate(d *db.Database, tm *TransactionManager, payload string, client
 	if key, err = strconv.Atoi(fields[2]); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
-	if table, err = d.GetTable(fields[1]); err != nil {
+	if value, err = strconv.Atoi(fields[3]); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
-	// Get the transaction, run the find, release lock and rollback if error.
-	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
+	if table, err = d.GetTable(fields[1]); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
-	if err = db.HandleUpdate(d, payload); err != nil {
+	// Get the transaction, run the find, release lock and rollback if error.
+	if err = tm.Update(clientId, table, int64(key), int64(value)); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
 	return nil
@@ -168,10 +171,7 @@ func HandleDelete(d *db.Database, tm *TransactionManager, payload string, client
 		return fmt.Errorf("delete error: %v", err)
 	}
 	// Get the transaction, run the find, release lock and rollback if error.
-	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
-		return fmt.Errorf("delete error: %v", err)
-	}
-	if err = db.HandleDelete(d, payload); err != nil {
+	if err = tm.Delete(clientId, table, int64(key)); err != nil {
 		return fmt.Errorf("delete error: %v", err)
 	}
 	return nil
@@ -231,3 +231,14 @@ func HandleLock(d *db.Database, tm *TransactionManager, payload string, w io.Wri
 func HandlePretty(d *db.Database, payload string, w io.Writer) (err error) {
 	return db.HandlePretty(d, payload, w)
 }
+
+// Handle printing the lock state.
+func HandleLocks(tm *TransactionManager, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	// Usage: .locks
+	if len(fields) != 1 {
+		return fmt.Errorf("usage: .locks")
+	}
+	tm.DumpLocks(w)
+	return nil
+}
@@ -0,0 +1,202 @@
+package concurrency
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+
+	uuid "github.com/google/uuid"
+)
+
+// A write buffered by a transaction: the key's value as the transaction
+// sees it, to be applied to the table on commit.
+type bufferedWrite struct {
+	table   db.Index
+	value   int64
+	deleted bool
+}
+
+// bufferedEntry is an entry read from a transaction's write buffer.
+type bufferedEntry struct {
+	key   int64
+	value int64
+}
+
+// Get key.
+func (entry bufferedEntry) GetKey() int64 {
+	return entry.key
+}
+
+// Get value.
+func (entry bufferedEntry) GetValue() int64 {
+	return entry.value
+}
+
+// Marshal serializes the entry's key and value as varints.
+func (entry bufferedEntry) Marshal() []byte {
+	data := make([]byte, 2*binary.MaxVarintLen64)
+	binary.PutVarint(data, entry.key)
+	binary.PutVarint(data[binary.MaxVarintLen64:], entry.value)
+	return data
+}
+
+// Get whether writes are buffered in their transaction until it commits.
+func (tm *TransactionManager) GetBufferedWrites() bool {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	return tm.buffered
+}
+
+// SetBufferedWrites sets whether Insert, Update and Delete buffer their writes in
+// the transaction until it commits, rather than writing through to the table.
+// Either way, a transaction's Find sees its own writes. Off by default.
+func (tm *TransactionManager) SetBufferedWrites(enabled bool) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	tm.buffered = enabled
+}
+
+// lockForWrite write-locks the given key for the client's transaction, and
+// returns the transaction and whether its writes should be buffered.
+func (tm *TransactionManager) lockForWrite(clientId uuid.UUID, table db.Index, key int64) (*Transaction, bool, error) {
+	if err := tm.Lock(clientId, table, key, W_LOCK); err != nil {
+		return nil, false, err
+	}
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	t, found := tm.transactions[clientId]
+	if !found {
+		return nil, false, errors.New("transaction not found")
+	}
+	return t, tm.buffered, nil
+}
+
+// Find read-locks the given key and returns its entry, as the client's
+// transaction sees it: the transaction's own buffered writes come first.
+func (tm *TransactionManager) Find(clientId uuid.UUID, table db.Index, key int64) (utils.Entry, error) {
+	if err := tm.Lock(clientId, table, key, R_LOCK); err != nil {
+		return nil, err
+	}
+	t, found := tm.GetTransaction(clientId)
+	if !found {
+		return nil, errors.New("transaction not found")
+	}
+	if write, ok := t.bufferedWrite(table, key); ok {
+		if write.deleted {
+			return nil, fmt.Errorf("find: %w", utils.ErrKeyNotFound)
+		}
+		return bufferedEntry{key: key, value: write.value}, nil
+	}
+	return table.Find(key)
+}
+
+// Insert write-locks the given key and inserts it in the client's transaction.
+func (tm *TransactionManager) Insert(clientId uuid.UUID, table db.Index, key int64, value int64) error {
+	t, buffered, err := tm.lockForWrite(clientId, table, key)
+	if err != nil {
+		return err
+	}
+	if !buffered {
+		return table.Insert(key, value)
+	}
+	if t.sees(table, key) {
+		return fmt.Errorf("insert: %w", utils.ErrKeyExists)
+	}
+	t.bufferWrite(table, key, bufferedWrite{table: table, value: value})
+	return nil
+}
+
+// Update write-locks the given key and updates it in the client's transaction.
+func (tm *TransactionManager) Update(clientId uuid.UUID, table db.Index, key int64, value int64) error {
+	t, buffered, err := tm.lockForWrite(clientId, table, key)
+	if err != nil {
+		return err
+	}
+	if !buffered {
+		return table.Update(key, value)
+	}
+	if !t.sees(table, key) {
+		return fmt.Errorf("update: %w", utils.ErrUpdateMissing)
+	}
+	t.bufferWrite(table, key, bufferedWrite{table: table, value: value})
+	return nil
+}
+
+// Delete write-locks the given key and deletes it in the client's transaction.
+func (tm *TransactionManager) Delete(clientId uuid.UUID, table db.Index, key int64) error {
+	t, buffered, err := tm.lockForWrite(clientId, table, key)
+	if err != nil {
+		return err
+	}
+	if !buffered {
+		return table.Delete(key)
+	}
+	if !t.sees(table, key) {
+		return fmt.Errorf("delete: %w", utils.ErrKeyNotFound)
+	}
+	t.bufferWrite(table, key, bufferedWrite{table: table, deleted: true})
+	return nil
+}
+
+// bufferedWrite returns the transaction's buffered write to the given key, if any.
+func (t *Transaction) bufferedWrite(table db.Index, key int64) (bufferedWrite, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	write, ok := t.writes[Resource{tableName: table.GetName(), resourceKey: key}]
+	return write, ok
+}
+
+// sees reports whether the given key exists, as the transaction sees it.
+func (t *Transaction) sees(table db.Index, key int64) bool {
+	if write, ok := t.bufferedWrite(table, key); ok {
+		return !write.deleted
+	}
+	_, err := table.Find(key)
+	return err == nil
+}
+
+// bufferWrite records a write to the given key, replacing any earlier one.
+func (t *Transaction) bufferWrite(table db.Index, key int64, write bufferedWrite) {
+	t.WLock()
+	defer t.WUnlock()
+	if t.writes == nil {
+		t.writes = make(map[Resource]bufferedWrite)
+	}
+	t.writes[Resource{tableName: table.GetName(), resourceKey: key}] = write
+}
+
+// applyWrites writes the transaction's buffered writes through to their tables.
+// The transaction still holds write locks on every buffered key.
+func (t *Transaction) applyWrites() error {
+	t.WLock()
+	defer t.WUnlock()
+	for r, write := range t.writes {
+		_, err := write.table.Find(r.resourceKey)
+		exists := err == nil
+		switch {
+		case write.deleted && exists:
+			err = write.table.Delete(r.resourceKey)
+		case write.deleted:
+			err = nil
+		case exists:
+			err = write.table.Update(r.resourceKey, write.value)
+		default:
+			err = write.table.Insert(r.resourceKey, write.value)
+		}
+		if err != nil {
+			return err
+		}
+		delete(t.writes, r)
+	}
+	return nil
+}
+
+// discardWrites drops the transaction's buffered writes without applying them.
+func (t *Transaction) discardWrites() {
+	t.WLock()
+	defer t.WUnlock()
+	t.writes = nil
+}
@@ -10,6 +10,10 @@ const Prompt = DBName + "> "
 // Number of pages.
 const NumPages = 32
 
+// Whether pagers open their files with O_DIRECT and use aligned frames.
+// Turn this off on filesystems without O_DIRECT support (e.g. tmpfs).
+var DirectIO = true
+
 // Name of log file.
 const LogFileName = "./db.log"
 
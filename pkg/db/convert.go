@@ -0,0 +1,166 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// ConvertBTreeToHash builds a new hash index at the given path, holding all of
+// the given B+ tree's entries. The B+ tree is left unchanged.
+func ConvertBTreeToHash(src *btree.BTreeIndex, path string) (*hash.HashIndex, error) {
+	entries, err := scanIndex(src)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := hash.OpenTable(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = dst.SetSchema(convertSchema(src.Schema(), "hash")); err != nil {
+		removeIndex(dst, path)
+		return nil, err
+	}
+	pairs := make([]struct{ K, V int64 }, len(entries))
+	for i, entry := range entries {
+		pairs[i].K, pairs[i].V = entry.GetKey(), entry.GetValue()
+	}
+	if err = dst.BulkInsert(pairs); err != nil {
+		removeIndex(dst, path)
+		return nil, err
+	}
+	return dst, nil
+}
+
+// ConvertHashToBTree builds a new B+ tree at the given path, holding all of
+// the given hash index's entries. The hash index is left unchanged.
+func ConvertHashToBTree(src *hash.HashIndex, path string) (*btree.BTreeIndex, error) {
+	entries, err := scanIndex(src)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := btree.OpenTable(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = dst.SetSchema(convertSchema(src.Schema(), "btree")); err != nil {
+		removeIndex(dst, path)
+		return nil, err
+	}
+	// Insert in key order, so that every insert appends to the last leaf.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].GetKey() < entries[j].GetKey()
+	})
+	for _, entry := range entries {
+		if err = dst.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+			removeIndex(dst, path)
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// Reindex rebuilds the named table as an index of the given type, and replaces
+// the table with it. The new index is built alongside the old one, so the table
+// is left unchanged if building it fails. Must not run concurrently with other
+// operations on the table.
+func (db *Database) Reindex(name string, indexType IndexType) (Index, error) {
+	if db.readOnly {
+		return nil, fmt.Errorf("cannot reindex table %s: %w", name, utils.ErrReadOnly)
+	}
+	src, err := db.GetTable(name)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(db.basepath, name)
+	tmpPath := path + ".reindex"
+	// Build the new index.
+	var dst Index
+	switch src := src.(type) {
+	case *btree.BTreeIndex:
+		if indexType != HashIndexType {
+			return nil, errors.New("table is already a B+ tree")
+		}
+		dst, err = ConvertBTreeToHash(src, tmpPath)
+	case *hash.HashIndex:
+		if indexType != BTreeIndexType {
+			return nil, errors.New("table is already a hash table")
+		}
+		dst, err = ConvertHashToBTree(src, tmpPath)
+	default:
+		return nil, errors.New("invalid index type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = dst.Close(); err != nil {
+		removeIndex(dst, tmpPath)
+		return nil, err
+	}
+	// Swap it in for the old one.
+	delete(db.tables, name)
+	removeIndex(src, path)
+	if err = os.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(utils.SchemaFile(tmpPath), utils.SchemaFile(path)); err != nil {
+		return nil, err
+	}
+	if indexType == HashIndexType {
+		// Hash tables keep their .meta file in the working directory.
+		if err = os.Rename(filepath.Base(tmpPath)+".meta", name+".meta"); err != nil {
+			return nil, err
+		}
+		dst, err = hash.OpenTable(path)
+	} else {
+		dst, err = btree.OpenTable(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	db.tables[name] = dst
+	return dst, nil
+}
+
+// convertSchema returns the given schema, for a table stored in another type of index.
+func convertSchema(schema utils.Schema, indexType string) utils.Schema {
+	schema.IndexType = indexType
+	return schema
+}
+
+// scanIndex returns all of an index's entries, read with a cursor.
+func scanIndex(index Index) ([]utils.Entry, error) {
+	entries := make([]utils.Entry, 0)
+	cursor, err := index.TableStart()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+		if err := cursor.StepForward(); err != nil {
+			return entries, nil
+		}
+	}
+}
+
+// removeIndex closes an index and removes its files.
+func removeIndex(index Index, path string) {
+	index.Close()
+	os.Remove(path)
+	os.Remove(utils.SchemaFile(path))
+	if _, ok := index.(*hash.HashIndex); ok {
+		os.Remove(filepath.Base(path) + ".meta")
+	}
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -18,6 +19,7 @@ import (
 type Database struct {
 	basepath string
 	tables   map[string]Index
+	readOnly bool // Whether tables are opened read-only.
 }
 
 // Index interface.
@@ -25,6 +27,8 @@ type Index interface {
 	Close() error
 	GetName() string
 	GetPager() *pager.Pager
+	Schema() utils.Schema
+	OpStats() utils.OpStats
 	Find(int64) (utils.Entry, error)
 	Insert(int64, int64) error
 	Update(int64, int64) error
@@ -35,6 +39,12 @@ type Index interface {
 	TableStart() (utils.Cursor, error)
 }
 
+// A Checkpointer is an index with state outside its pages, such as a hash
+// table's directory, which it writes out when the database is checkpointed.
+type Checkpointer interface {
+	Checkpoint() error
+}
+
 // An index can either be a B+Tree or a Hash Table.
 type IndexType int64
 
@@ -61,6 +71,35 @@ func Open(folder string) (*Database, error) {
 	}, nil
 }
 
+// Opens an existing database's data folder read-only, for inspecting it
+// without changing it. Its tables are opened without opening their files for
+// writing, so they can be scanned and searched, but writing to them returns
+// utils.ErrReadOnly, as does creating a table. Unlike recovery, opening it
+// this way doesn't touch the recovery folder.
+func OpenReadOnly(folder string) (*Database, error) {
+	// Ensure folder is of the form */
+	if !strings.HasSuffix(folder, "/") {
+		folder += "/"
+	}
+	info, err := os.Stat(folder)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("database folder is not a directory")
+	}
+	return &Database{
+		basepath: folder,
+		tables:   make(map[string]Index),
+		readOnly: true,
+	}, nil
+}
+
+// Returns whether the database was opened read-only.
+func (db *Database) IsReadOnly() bool {
+	return db.readOnly
+}
+
 // Close each table in the database, then close the database.
 func (db *Database) Close() (err error) {
 	for _, table := range db.tables {
@@ -84,32 +123,38 @@ func (db *Database) CreateLogFile(filename string) error {
 	return file.Close()
 }
 
-// Create a table with the given type.
-func (db *Database) createTable(name string, indexType IndexType) (index Index, err error) {
+// Create a table with the given schema, which says what type of index it is stored in.
+func (db *Database) createTable(name string, schema utils.Schema) (index Index, err error) {
+	if db.readOnly {
+		return nil, fmt.Errorf("cannot create table %s: %w", name, utils.ErrReadOnly)
+	}
 	// Ensure the db name is alphanumeric.
 	alphanumeric, _ := regexp.Compile(`\W`)
 	if alphanumeric.MatchString(name) {
 		return nil, errors.New("table name must be alphanumeric")
 	}
+	if err = schema.Validate(); err != nil {
+		return nil, err
+	}
 	// Create the file, if not exists.
 	path := filepath.Join(db.basepath, name)
 	if _, err := os.Stat(path); err == nil {
 		return nil, errors.New("table already exists")
 	}
+	// Store the schema first, so that the table is opened with it.
+	if err = utils.WriteSchema(path, schema); err != nil {
+		return nil, err
+	}
 	// Open the right type of index.
-	switch indexType {
-	case BTreeIndexType:
+	switch schema.IndexType {
+	case "btree":
 		index, err = btree.OpenTable(path)
-		if err != nil {
-			return nil, err
-		}
-	case HashIndexType:
+	case "hash":
 		index, err = hash.OpenTable(path)
-		if err != nil {
-			return nil, err
-		}
-	default:
-		return nil, errors.New("invalid index type")
+	}
+	if err != nil {
+		os.Remove(utils.SchemaFile(path))
+		return nil, err
 	}
 	db.tables[name] = index
 	return index, nil
@@ -126,16 +171,32 @@ func (db *Database) GetTable(name string) (index Index, err error) {
 	if _, err := os.Stat(path); err != nil {
 		return nil, errors.New("table not found")
 	}
-	// Else, open from disk.
-	// NOTE: This is janky; assumes that if a .meta file exists, then it is a hash index,
-	// else, it is a btree index.
+	// Else, open from disk, as the type of index its schema says.
+	// NOTE: Tables without a schema file predate them; for those, this is janky:
+	// assumes that if a .meta file exists, then it is a hash index, else, it is a btree index.
+	indexType := "btree"
 	if _, err := os.Stat(path + ".meta"); err == nil {
-		index, err = hash.OpenTable(path)
+		indexType = "hash"
+	}
+	schema, err := utils.ReadSchema(path, indexType)
+	if err != nil {
+		return nil, err
+	}
+	if schema.IndexType == "hash" {
+		if db.readOnly {
+			index, err = hash.OpenTableReadOnly(path)
+		} else {
+			index, err = hash.OpenTable(path)
+		}
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		index, err = btree.OpenTable(path)
+		if db.readOnly {
+			index, err = btree.OpenTableReadOnly(path)
+		} else {
+			index, err = btree.OpenTable(path)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -153,3 +214,57 @@ func (db *Database) GetTables() map[string]Index {
 func (db *Database) GetBasePath() string {
 	return db.basepath
 }
+
+// TableStats summarizes a single table.
+type TableStats struct {
+	Entries int64            // Number of entries in the table.
+	Pages   int64            // Number of pages in the table's file.
+	Frames  pager.FrameStats // How the table's buffer pool is being used.
+	Ops     utils.OpStats    // Operations run against the table since it was opened.
+}
+
+// DatabaseStats summarizes every open table, along with their totals.
+// Each table has its own pager, so the buffer pool totals are summed across tables.
+type DatabaseStats struct {
+	Tables      map[string]TableStats
+	Entries     int64            // Total entries across tables.
+	Pages       int64            // Total pages across tables.
+	Frames      pager.FrameStats // Total frame usage across tables.
+	TotalFrames int64            // Total frames across tables.
+	Ops         utils.OpStats    // Total operations across tables.
+}
+
+// Utilization returns the fraction of frames that are holding a page.
+func (stats DatabaseStats) Utilization() float64 {
+	if stats.TotalFrames == 0 {
+		return 0
+	}
+	return float64(stats.Frames.Pinned+stats.Frames.Unpinned) / float64(stats.TotalFrames)
+}
+
+// Stats collects the sizes and buffer pool usage of each open table.
+func (db *Database) Stats() (DatabaseStats, error) {
+	stats := DatabaseStats{Tables: make(map[string]TableStats)}
+	for name, table := range db.GetTables() {
+		entries, err := table.Select()
+		if err != nil {
+			return DatabaseStats{}, err
+		}
+		tableStats := TableStats{
+			Entries: int64(len(entries)),
+			Pages:   table.GetPager().GetNumPages(),
+			Frames:  table.GetPager().FrameStats(),
+			Ops:     table.OpStats(),
+		}
+		stats.Tables[name] = tableStats
+		stats.Entries += tableStats.Entries
+		stats.Pages += tableStats.Pages
+		stats.Frames.Free += tableStats.Frames.Free
+		stats.Frames.Unpinned += tableStats.Frames.Unpinned
+		stats.Frames.Pinned += tableStats.Frames.Pinned
+		stats.Frames.PageTable += tableStats.Frames.PageTable
+		stats.TotalFrames += pager.NUMPAGES
+		stats.Ops = stats.Ops.Add(tableStats.Ops)
+	}
+	return stats, nil
+}
@@ -1,12 +1,13 @@
 package db
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
 
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	hash "github.com/brown-csci1270/db/pkg/hash"
 	repl "github.com/brown-csci1270/db/pkg/repl"
 	utils "github.com/brown-csci1270/db/pkg/utils"
 )
@@ -16,7 +17,7 @@ func DatabaseRepl(db *Database) *repl.REPL {
 	r := repl.NewRepl()
 	r.AddCommand("create", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCreateTable(db, payload, replConfig.GetWriter())
-	}, "Create a table. usage: create table <table>")
+	}, "Create a table. usage: create <btree|hash> table <table> [<key name> <value name>]")
 	r.AddCommand("find", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleFind(db, payload, replConfig.GetWriter())
 	}, "Find an element. usage: find <key> from <table>")
@@ -29,6 +30,15 @@ func DatabaseRepl(db *Database) *repl.REPL {
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(db, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
+	r.AddCommand("hash_print_key", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleHashPrintKey(db, payload, replConfig.GetWriter())
+	}, "Print out the hash bucket that a key belongs to. usage: hash_print_key <key> from <table>")
+	r.AddCommand("defragment", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleDefragment(db, payload)
+	}, "Rebuild a B+ tree table with densely packed leaves. usage: defragment <table>")
+	r.AddCommand("reindex", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleReindex(db, payload, replConfig.GetWriter())
+	}, "Convert a table to another index type. usage: reindex <table> <btree|hash>")
 	return r
 }
 
@@ -36,21 +46,16 @@ func DatabaseRepl(db *Database) *repl.REPL {
 func HandleCreateTable(d *Database, payload string, w io.Writer) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: create <type> table <table>
-	if numFields != 4 || fields[2] != "table" || (fields[1] != "btree" && fields[1] != "hash") {
-		return fmt.Errorf("usage: create <btree|hash> table <table>")
-	}
-	var tableType IndexType
-	switch fields[1] {
-	case "btree":
-		tableType = BTreeIndexType
-	case "hash":
-		tableType = HashIndexType
-	default:
-		return errors.New("create error: internal error")
+	// Usage: create <type> table <table> [<key name> <value name>]
+	if (numFields != 4 && numFields != 6) || fields[2] != "table" || (fields[1] != "btree" && fields[1] != "hash") {
+		return fmt.Errorf("usage: create <btree|hash> table <table> [<key name> <value name>]")
+	}
+	schema := utils.DefaultSchema(fields[1])
+	if numFields == 6 {
+		schema.KeyName, schema.ValueName = fields[4], fields[5]
 	}
 	tableName := fields[3]
-	_, err = d.createTable(tableName, tableType)
+	_, err = d.createTable(tableName, schema)
 	if err != nil {
 		return err
 	}
@@ -68,16 +73,16 @@ func HandleFind(d *Database, payload string, w io.Writer) (err error) {
 		return fmt.Errorf("usage: find <key> from <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
 	}
 	tableName := fields[3]
 	table, err := d.GetTable(tableName)
 	if err != nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
 	}
 	entry, err := table.Find(int64(key))
 	if err != nil || entry == nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
 	}
 	io.WriteString(w, fmt.Sprintf("found entry: (%d, %d)\n",
 		entry.GetKey(), entry.GetValue()))
@@ -94,23 +99,23 @@ func HandleInsert(d *Database, payload string) (err error) {
 		return fmt.Errorf("usage: insert <key> <value> into <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	if value, err = strconv.Atoi(fields[2]); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	tableName := fields[4]
 	table, err := d.GetTable(tableName)
 	if err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	val, _ := table.Find(int64(key))
 	if val != nil {
-		return fmt.Errorf("insert error: key already in table")
+		return fmt.Errorf("insert error: %w", utils.ErrKeyExists)
 	}
 	err = table.Insert(int64(key), int64(value))
 	if err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	return nil
 }
@@ -125,19 +130,19 @@ func HandleUpdate(d *Database, payload string) (err error) {
 		return fmt.Errorf("usage: update <table> <key> <value>")
 	}
 	if key, err = strconv.Atoi(fields[2]); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	if value, err = strconv.Atoi(fields[3]); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	tableName := fields[1]
 	table, err := d.GetTable(tableName)
 	if err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	err = table.Update(int64(key), int64(value))
 	if err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	return nil
 }
@@ -152,16 +157,16 @@ func HandleDelete(d *Database, payload string) (err error) {
 		return fmt.Errorf("usage: delete <key> from <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	tableName := fields[3]
 	table, err := d.GetTable(tableName)
 	if err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	err = table.Delete(int64(key))
 	if err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	return nil
 }
@@ -216,6 +221,74 @@ func HandlePretty(d *Database, payload string, w io.Writer) (err error) {
 	return nil
 }
 
+// Handle printing the hash bucket that a key belongs to.
+func HandleHashPrintKey(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: hash_print_key <key> from <table>
+	var key int
+	if numFields != 4 || fields[2] != "from" {
+		return fmt.Errorf("usage: hash_print_key <key> from <table>")
+	}
+	if key, err = strconv.Atoi(fields[1]); err != nil {
+		return fmt.Errorf("hash_print_key error: %v", err)
+	}
+	tableName := fields[3]
+	table, err := d.GetTable(tableName)
+	if err != nil {
+		return fmt.Errorf("hash_print_key error: %v", err)
+	}
+	hashTable, ok := table.(*hash.HashIndex)
+	if !ok {
+		return fmt.Errorf("hash_print_key error: %s is not a hash table", tableName)
+	}
+	hashTable.GetTable().PrintKey(int64(key), w)
+	return nil
+}
+
+// Handle defragment.
+func HandleDefragment(d *Database, payload string) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: defragment <table>
+	if numFields != 2 {
+		return fmt.Errorf("usage: defragment <table>")
+	}
+	tableName := fields[1]
+	table, err := d.GetTable(tableName)
+	if err != nil {
+		return fmt.Errorf("defragment error: %w", err)
+	}
+	btreeTable, ok := table.(*btree.BTreeIndex)
+	if !ok {
+		return fmt.Errorf("defragment error: %s is not a B+ tree table", tableName)
+	}
+	if err = btreeTable.Defragment(); err != nil {
+		return fmt.Errorf("defragment error: %w", err)
+	}
+	return nil
+}
+
+// Handle reindex.
+func HandleReindex(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: reindex <table> <btree|hash>
+	if numFields != 3 || (fields[2] != "btree" && fields[2] != "hash") {
+		return fmt.Errorf("usage: reindex <table> <btree|hash>")
+	}
+	indexType := BTreeIndexType
+	if fields[2] == "hash" {
+		indexType = HashIndexType
+	}
+	tableName := fields[1]
+	if _, err = d.Reindex(tableName, indexType); err != nil {
+		return fmt.Errorf("reindex error: %w", err)
+	}
+	io.WriteString(w, fmt.Sprintf("table %s converted to %s.\n", tableName, fields[2]))
+	return nil
+}
+
 // printResults prints all given entries in a standard format.
 func printResults(entries []utils.Entry, w io.Writer) {
 	for _, entry := range entries {
@@ -1,7 +1,6 @@
 package hash
 
 import (
-	"errors"
 	"fmt"
 	"io"
 
@@ -18,8 +17,7 @@ type HashBucket struct {
 
 // Construct a new HashBucket.
 func NewHashBucket(pager *pager.Pager, depth int64) (*HashBucket, error) {
-	newPN := pager.GetFreePN()
-	newPage, err := pager.GetPage(newPN)
+	newPage, err := pager.AllocatePage()
 	if err != nil {
 		return nil, err
 	}
@@ -38,7 +36,8 @@ func (bucket *HashBucket) GetPage() *pager.Page {
 	return bucket.page
 }
 
-// Finds the entry with the given key.
+// Finds the entry with the given key. An entry whose value is in overflow
+// pages is returned as it is stored, with the first page as its value.
 func (bucket *HashBucket) Find(key int64) (utils.Entry, bool) {
 	/* SOLUTION {{{ */
 	for i := int64(0); i < bucket.numKeys; i++ {
@@ -59,6 +58,23 @@ func (bucket *HashBucket) Insert(key int64, value int64) (bool, error) {
 	/* SOLUTION }}} */
 }
 
+// insertEntry inserts the given entry as it is stored, and returns whether the bucket must split.
+func (bucket *HashBucket) insertEntry(entry HashEntry) bool {
+	bucket.modifyCell(bucket.numKeys, entry)
+	bucket.updateNumKeys(bucket.numKeys + 1)
+	return bucket.numKeys >= BUCKETSIZE
+}
+
+// holdsOnly returns whether every entry in the bucket has the given key.
+func (bucket *HashBucket) holdsOnly(key int64) bool {
+	for i := int64(0); i < bucket.numKeys; i++ {
+		if bucket.getKeyAt(i) != key {
+			return false
+		}
+	}
+	return true
+}
+
 // Update the given key-value pair, should never split.
 func (bucket *HashBucket) Update(key int64, value int64) error {
 	/* SOLUTION {{{ */
@@ -71,7 +87,7 @@ func (bucket *HashBucket) Update(key int64, value int64) error {
 		}
 	}
 	if index == -1 {
-		return errors.New("key not found, update aborted")
+		return fmt.Errorf("update aborted: %w", utils.ErrUpdateMissing)
 	}
 	// Update the value.
 	bucket.updateValueAt(index, value)
@@ -91,7 +107,7 @@ func (bucket *HashBucket) Delete(key int64) error {
 		}
 	}
 	if index == -1 {
-		return errors.New("key not found, delete aborted")
+		return fmt.Errorf("delete aborted: %w", utils.ErrKeyNotFound)
 	}
 	// Move all other keys left by one.
 	for i := index; i < bucket.numKeys; i++ {
@@ -102,12 +118,16 @@ func (bucket *HashBucket) Delete(key int64) error {
 	/* SOLUTION }}} */
 }
 
-// Select all entries in this bucket.
+// Select all entries in this bucket, reading in values that are in overflow pages.
 func (bucket *HashBucket) Select() ([]utils.Entry, error) {
 	/* SOLUTION {{{ */
 	ret := make([]utils.Entry, 0)
 	for i := int64(0); i < bucket.numKeys; i++ {
-		ret = append(ret, bucket.getCell(i))
+		entry, err := loadEntry(bucket.page.GetPager(), bucket.getCell(i))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, entry)
 	}
 	return ret, nil
 	/* SOLUTION }}} */
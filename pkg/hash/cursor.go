@@ -16,6 +16,9 @@ type HashCursor struct {
 
 // TableStart returns a cursor to the first entry in the hash table.
 func (table *HashIndex) TableStart() (utils.Cursor, error) {
+	if err := table.checkOpen(); err != nil {
+		return nil, err
+	}
 	cursor := HashCursor{table: table, cellnum: 0}
 
 	curPage, err := table.pager.GetPage(ROOT_PN)
@@ -35,7 +38,7 @@ func (cursor *HashCursor) StepForward() error {
 		// Get the next page number.
 		nextPN := cursor.curBucket.page.GetPageNum() + 1
 		if nextPN >= cursor.curBucket.page.GetPager().GetNumPages() {
-			return errors.New("cannot advance the cursor further")
+			return utils.ErrCursorEnd
 		}
 		// Convert the page to a bucket.
 		nextPage, err := cursor.table.pager.GetPage(nextPN)
@@ -71,6 +74,13 @@ func (cursor *HashCursor) GetEntry() (utils.Entry, error) {
 	if cursor.isEnd {
 		return HashEntry{}, errors.New("getEntry: entry is non-existent")
 	}
-	entry := cursor.curBucket.getCell(cursor.cellnum)
-	return entry, nil
+	return loadEntry(cursor.table.pager, cursor.curBucket.getCell(cursor.cellnum))
+}
+
+// GetKey returns the key currently pointed to by the cursor, without building an entry.
+func (cursor *HashCursor) GetKey() (int64, error) {
+	if cursor.isEnd {
+		return 0, errors.New("getKey: entry is non-existent")
+	}
+	return cursor.curBucket.getKeyAt(cursor.cellnum), nil
 }
@@ -8,8 +8,10 @@ import (
 
 // HashEntry is a single entry in a hashtable. Implements utils.Entry.
 type HashEntry struct {
-	key   int64
-	value int64
+	key      int64
+	value    int64
+	overflow bool   // In a cell, whether value is the first of the overflow pages holding the value.
+	data     []byte // The value's bytes, once read from its overflow pages.
 }
 
 // Get key.
@@ -22,6 +24,12 @@ func (entry HashEntry) GetValue() int64 {
 	return entry.value
 }
 
+// Get the value's bytes, if it was inserted with InsertBytes; nil otherwise.
+// Such an entry's value is the number of bytes.
+func (entry HashEntry) GetBytes() []byte {
+	return entry.data
+}
+
 // Set key.
 func (entry *HashEntry) SetKey(key int64) {
 	entry.key = key
@@ -43,19 +51,35 @@ func (entry HashEntry) Marshal() []byte {
 	bin = make([]byte, binary.MaxVarintLen64)
 	binary.PutVarint(bin, entry.GetValue())
 	newdata = append(newdata, bin...)
+	// Marshall the overflow flag.
+	if entry.overflow {
+		newdata = append(newdata, 1)
+	} else {
+		newdata = append(newdata, 0)
+	}
 	// Return the combined byte array.
 	return newdata
 }
 
 // unmarshalEntry deserializes a byte array into an entry.
 func unmarshalEntry(data []byte) (entry HashEntry) {
-	k, _ := binary.Varint(data[:len(data)/2])
-	v, _ := binary.Varint(data[len(data)/2:])
-	return HashEntry{key: k, value: v}
+	k, _ := binary.Varint(data[:binary.MaxVarintLen64])
+	v, _ := binary.Varint(data[binary.MaxVarintLen64 : 2*binary.MaxVarintLen64])
+	return HashEntry{key: k, value: v, overflow: data[2*binary.MaxVarintLen64] != 0}
 }
 
 // Print this entry.
 func (entry HashEntry) Print(w io.Writer) {
+	if entry.overflow {
+		io.WriteString(w, fmt.Sprintf("(%d, overflow page %d), ",
+			entry.GetKey(), entry.GetValue()))
+		return
+	}
+	if entry.data != nil {
+		io.WriteString(w, fmt.Sprintf("(%d, %d bytes), ",
+			entry.GetKey(), len(entry.data)))
+		return
+	}
 	io.WriteString(w, fmt.Sprintf("(%d, %d), ",
 		entry.GetKey(), entry.GetValue()))
 }
@@ -1,7 +1,11 @@
 package hash
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"os"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
 	utils "github.com/brown-csci1270/db/pkg/utils"
@@ -9,29 +13,78 @@ import (
 
 // HashIndex is an index that uses a HashTable as its datastructure. Implements db.Index.
 type HashIndex struct {
-	table *HashTable
-	pager *pager.Pager
+	table  *HashTable
+	pager  *pager.Pager
+	schema utils.Schema    // What the table's keys and values mean.
+	ops    utils.OpCounter // Counts the finds, inserts, updates and deletes run against the table.
 }
 
 // Opens the pager with the given table name.
 func OpenTable(filename string) (*HashIndex, error) {
+	return openTable(filename, false)
+}
+
+// OpenTableReadOnly opens the existing table with the given name without
+// opening its files for writing. The table can be read from, but writing to it
+// returns ErrReadOnly.
+func OpenTableReadOnly(filename string) (*HashIndex, error) {
+	return openTable(filename, true)
+}
+
+// Opens the pager with the given table name, read-only if asked to.
+func openTable(filename string, readOnly bool) (*HashIndex, error) {
 	// Create a pager for the table.
 	pager := pager.NewPager()
-	err := pager.Open(filename)
+	var err error
+	if readOnly {
+		err = pager.OpenReadOnly(filename)
+	} else {
+		err = pager.Open(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	schema, err := utils.ReadSchema(filename, "hash")
 	if err != nil {
+		pager.Close()
 		return nil, err
 	}
 	// Return index.
 	var table *HashTable
-	if pager.GetNumPages() == 0 {
+	if readOnly {
+		// A read-only table can't be created, or have its splits redone.
+		table, err = readTableReadOnly(pager)
+	} else if pager.GetNumPages() == 0 {
 		table, err = NewHashTable(pager)
 	} else {
 		table, err = ReadHashTable(pager)
+		if err == nil {
+			// Redo the splits that hadn't been written out before a crash.
+			err = table.recoverSplits()
+		}
 	}
 	if err != nil {
+		if readOnly {
+			pager.Close()
+		}
 		return nil, err
 	}
-	return &HashIndex{table: table, pager: pager}, nil
+	return &HashIndex{table: table, pager: pager, schema: schema}, nil
+}
+
+// Reads in the hash table of a pager opened read-only.
+func readTableReadOnly(pager *pager.Pager) (*HashTable, error) {
+	if pager.GetNumPages() == 0 {
+		return nil, errors.New("cannot open an empty hash table read-only")
+	}
+	table, err := ReadHashTable(pager)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(table.splitFileName()); err == nil {
+		return nil, errors.New("hash table has splits that weren't written out, which must be redone by opening it for writing")
+	}
+	return table, nil
 }
 
 // Get name.
@@ -44,41 +97,185 @@ func (table *HashIndex) GetPager() *pager.Pager {
 	return table.pager
 }
 
+// Get schema.
+func (index *HashIndex) Schema() utils.Schema {
+	return index.schema
+}
+
+// SetSchema sets the index's schema, and stores it alongside the table.
+func (index *HashIndex) SetSchema(schema utils.Schema) error {
+	if err := index.checkWritable(); err != nil {
+		return err
+	}
+	if schema.IndexType != "hash" {
+		return fmt.Errorf("schema is for a %s table", schema.IndexType)
+	}
+	if err := utils.WriteSchema(index.pager.GetFilePath(), schema); err != nil {
+		return err
+	}
+	index.schema = schema
+	return nil
+}
+
+// Get the number of finds, inserts, updates and deletes run against the index.
+func (index *HashIndex) OpStats() utils.OpStats {
+	return index.ops.Stats()
+}
+
 // Get table.
 func (index *HashIndex) GetTable() *HashTable {
 	return index.table
 }
 
-// Closes the table by closing the pager.
+// checkOpen returns ErrIndexClosed if the index has been closed.
+func (index *HashIndex) checkOpen() error {
+	if index.pager.IsClosed() {
+		return fmt.Errorf("%s: %w", index.GetName(), utils.ErrIndexClosed)
+	}
+	return nil
+}
+
+// checkWritable returns ErrIndexClosed if the index has been closed, or
+// ErrReadOnly if it was opened read-only.
+func (index *HashIndex) checkWritable() error {
+	if err := index.checkOpen(); err != nil {
+		return err
+	}
+	if index.pager.IsReadOnly() {
+		return fmt.Errorf("%s: %w", index.GetName(), utils.ErrReadOnly)
+	}
+	return nil
+}
+
+// Closes the table by closing the pager. Closing twice is a no-op.
 func (index *HashIndex) Close() error {
+	if index.pager.IsClosed() {
+		return nil
+	}
+	// A read-only table's directory hasn't changed.
+	if index.pager.IsReadOnly() {
+		return index.pager.Close()
+	}
 	return WriteHashTable(index.pager, index.table)
 }
 
+// Checkpoint writes the table's pages and directory to disk, so that the splits
+// since the last checkpoint no longer have to be redone when it is opened.
+func (index *HashIndex) Checkpoint() error {
+	if index.pager.IsClosed() || index.pager.IsReadOnly() {
+		return nil
+	}
+	index.table.WLock()
+	defer index.table.WUnlock()
+	return index.table.persist()
+}
+
 // Find element by key.
 func (index *HashIndex) Find(key int64) (utils.Entry, error) {
+	index.ops.Find()
+	if err := index.checkOpen(); err != nil {
+		return nil, err
+	}
 	return index.table.Find(key)
 }
 
-// Insert given element.
+// Insert given element. Errors with ErrKeyExists if its key is already in the table.
 func (index *HashIndex) Insert(key int64, value int64) error {
-	return index.table.Insert(key, value)
+	index.ops.Insert()
+	if err := index.checkWritable(); err != nil {
+		return err
+	}
+	return index.table.insert(key, value, true)
+}
+
+// Insert the given key with a value of bytes, stored in overflow pages.
+func (index *HashIndex) InsertBytes(key int64, value []byte) error {
+	index.ops.Insert()
+	if err := index.checkWritable(); err != nil {
+		return err
+	}
+	return index.table.InsertBytes(key, value)
+}
+
+// Find the element with the given key, or insert the given element if there is
+// none. Counts as an insert, whether or not the key was found.
+func (index *HashIndex) FindOrInsert(key int64, value int64) (utils.Entry, bool, error) {
+	index.ops.Insert()
+	if err := index.checkWritable(); err != nil {
+		return nil, false, err
+	}
+	return index.table.FindOrInsert(key, value)
+}
+
+// Set the value of the given key, if its current value is the expected one.
+// Counts as an update, whether or not the value was swapped.
+func (index *HashIndex) CompareAndSwap(key int64, expected int64, value int64) (bool, error) {
+	index.ops.Update()
+	if err := index.checkWritable(); err != nil {
+		return false, err
+	}
+	return index.table.CompareAndSwap(key, expected, value)
+}
+
+// Insert all of the given elements, splitting buckets once at the end. Like
+// Insert, errors if a key is already in the table, or if it is given twice.
+func (index *HashIndex) BulkInsert(pairs []struct{ K, V int64 }) error {
+	for range pairs {
+		index.ops.Insert()
+	}
+	if err := index.checkWritable(); err != nil {
+		return err
+	}
+	return index.table.bulkInsert(pairs, true)
 }
 
 // Update given element.
 func (index *HashIndex) Update(key int64, value int64) error {
+	index.ops.Update()
+	if err := index.checkWritable(); err != nil {
+		return err
+	}
 	return index.table.Update(key, value)
 }
 
 // Delete given element.
 func (index *HashIndex) Delete(key int64) error {
+	index.ops.Delete()
+	if err := index.checkWritable(); err != nil {
+		return err
+	}
 	return index.table.Delete(key)
 }
 
-// Select all elements.
+// Select all elements, in page order.
 func (index *HashIndex) Select() ([]utils.Entry, error) {
+	if err := index.checkOpen(); err != nil {
+		return nil, err
+	}
 	return index.table.Select()
 }
 
+// Select all elements, optionally sorted by key.
+func (index *HashIndex) SelectOrdered(sorted bool) ([]utils.Entry, error) {
+	if err := index.checkOpen(); err != nil {
+		return nil, err
+	}
+	return index.table.SelectOrdered(sorted)
+}
+
+// Stream all elements, unsorted, until the stream ends or ctx is cancelled.
+func (index *HashIndex) SelectChan(ctx context.Context) (<-chan utils.Entry, <-chan error) {
+	if err := index.checkOpen(); err != nil {
+		entries := make(chan utils.Entry)
+		errs := make(chan error, 1)
+		close(entries)
+		errs <- err
+		close(errs)
+		return entries, errs
+	}
+	return index.table.SelectChan(ctx)
+}
+
 // Print all elements.
 func (index *HashIndex) Print(w io.Writer) {
 	index.table.Print(w)
@@ -1,7 +1,10 @@
 package hash
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
 	xxhash "github.com/cespare/xxhash"
@@ -17,9 +20,29 @@ var DEPTH_SIZE int64 = binary.MaxVarintLen64
 var NUM_KEYS_OFFSET int64 = DEPTH_OFFSET + DEPTH_SIZE
 var NUM_KEYS_SIZE int64 = binary.MaxVarintLen64
 var BUCKET_HEADER_SIZE int64 = DEPTH_SIZE + NUM_KEYS_SIZE
-var ENTRYSIZE int64 = binary.MaxVarintLen64 * 2                    // int64 key, int64 value
+var OVERFLOW_FLAG_SIZE int64 = 1                                   // Set if the cell's value is in overflow pages
+var ENTRYSIZE int64 = binary.MaxVarintLen64*2 + OVERFLOW_FLAG_SIZE // int64 key, int64 value, overflow flag
 var BUCKETSIZE int64 = (PAGESIZE - BUCKET_HEADER_SIZE) / ENTRYSIZE // num entries
 
+// Meta file variables. The meta file starts with a magic number and the
+// version of the format of the table's pages, followed by the global depth and
+// the bucket directory. Tables from before the format was versioned start with
+// the global depth instead, whose first byte never matches the magic number.
+var META_MAGIC = []byte{0x89, 'B', 'B', 'H'}
+var META_VERSION_OFFSET int64 = int64(len(META_MAGIC))
+var META_VERSION_SIZE int64 = binary.MaxVarintLen64
+var META_DEPTH_OFFSET int64 = META_VERSION_OFFSET + META_VERSION_SIZE
+var META_HEADER_SIZE int64 = META_DEPTH_OFFSET + DEPTH_SIZE
+
+// FORMAT_VERSION is the version of the format of a hash table's pages. Version
+// 2 added the overflow flag to cells, which changed their size, so tables from
+// before it can't be read.
+var FORMAT_VERSION int64 = 2
+
+// ErrFormatVersion is returned when opening a hash table whose pages are in a
+// format other than FORMAT_VERSION.
+var ErrFormatVersion = errors.New("hash table is in an unsupported format")
+
 // Lock Types
 type BucketLockType int
 
@@ -33,11 +56,14 @@ const (
 func getHash(hasher func(b []byte) uint64, key int64, size int64) uint {
 	buf := make([]byte, binary.MaxVarintLen64)
 	binary.PutVarint(buf, key)
-	hash := int64(hasher(buf))
-	if hash < 0 {
-		hash *= -1
+	// Take the hash's magnitude as a signed number, in unsigned arithmetic so
+	// that the most negative one, which has no positive counterpart, doesn't
+	// stay negative and give a negative bucket.
+	hash := hasher(buf)
+	if int64(hash) < 0 {
+		hash = -hash
 	}
-	return uint(hash % size)
+	return uint(hash % uint64(size))
 }
 
 // XxHasher returns the xxHash hash of the given key, bounded by size.
@@ -74,9 +100,11 @@ func (bucket *HashBucket) getCell(index int64) HashEntry {
 	return entry
 }
 
-// Get the key at the given index.
+// Get the key at the given index, only deserializing the key half of the cell.
 func (bucket *HashBucket) getKeyAt(index int64) int64 {
-	return bucket.getCell(index).GetKey()
+	startPos := cellPos(index)
+	key, _ := binary.Varint((*bucket.page.GetData())[startPos : startPos+binary.MaxVarintLen64])
+	return key
 }
 
 // Update the key at the given index.
@@ -91,10 +119,12 @@ func (bucket *HashBucket) getValueAt(index int64) int64 {
 	return bucket.getCell(index).GetValue()
 }
 
-// Update the value at the given index.
+// Update the value at the given index. The value is stored in the cell, even
+// if the old one was in overflow pages.
 func (bucket *HashBucket) updateValueAt(index int64, value int64) {
 	entry := bucket.getCell(index)
 	entry.SetValue(value)
+	entry.overflow = false
 	bucket.modifyCell(index, entry)
 }
 
@@ -157,7 +187,12 @@ func (table *HashTable) GetBucket(hash int64, lock BucketLockType) (*HashBucket,
 // Read hash table in from memory.
 func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 	indexPager := pager.NewPager()
-	err := indexPager.Open(bucketPager.GetFileName() + ".meta")
+	var err error
+	if bucketPager.IsReadOnly() {
+		err = indexPager.OpenReadOnly(bucketPager.GetFileName() + ".meta")
+	} else {
+		err = indexPager.Open(bucketPager.GetFileName() + ".meta")
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -166,9 +201,21 @@ func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Check the format version, which older tables don't have
+	data := *page.GetData()
+	version := int64(1)
+	if bytes.Equal(data[:META_VERSION_OFFSET], META_MAGIC) {
+		version, _ = binary.Varint(data[META_VERSION_OFFSET : META_VERSION_OFFSET+META_VERSION_SIZE])
+	}
+	if version != FORMAT_VERSION {
+		page.Put()
+		indexPager.Close()
+		return nil, fmt.Errorf("%s is version %d, expected %d; rebuild it: %w",
+			bucketPager.GetFileName(), version, FORMAT_VERSION, ErrFormatVersion)
+	}
 	// Read the gobal depth
-	depth, _ := binary.Varint((*page.GetData())[:DEPTH_SIZE])
-	bytesRead := DEPTH_SIZE
+	depth, _ := binary.Varint(data[META_DEPTH_OFFSET : META_DEPTH_OFFSET+DEPTH_SIZE])
+	bytesRead := META_HEADER_SIZE
 	// Read the bucket index
 	pnSize := int64(binary.MaxVarintLen64)
 	numHashes := powInt(2, depth)
@@ -194,43 +241,61 @@ func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 
 // Write hash table out to memory.
 func WriteHashTable(bucketPager *pager.Pager, table *HashTable) error {
-	if bucketPager.HasFile() {
-		indexPager := pager.NewPager()
-		err := indexPager.Open(bucketPager.GetFileName() + ".meta")
-		if err != nil {
-			return err
-		}
-		metaPN := indexPager.GetFreePN()
-		page, err := indexPager.GetPage(metaPN)
-		if err != nil {
-			return err
+	if err := table.persist(); err != nil {
+		return err
+	}
+	return bucketPager.Close()
+}
+
+// Write the table's global depth and bucket directory to the given meta file,
+// from its first page on, and force it to disk.
+func writeDirectory(metaName string, table *HashTable) error {
+	indexPager := pager.NewPager()
+	err := indexPager.Open(metaName)
+	if err != nil {
+		return err
+	}
+	defer indexPager.Close()
+	// The directory may need more pages than it had when it was last written.
+	getPage := func(pn int64) (*pager.Page, error) {
+		if pn < indexPager.GetNumPages() {
+			return indexPager.GetPage(pn)
 		}
-		page.SetDirty(true)
-		// Write global depth to meta file
-		depthData := make([]byte, DEPTH_SIZE)
-		binary.PutVarint(depthData, table.depth)
-		page.Update(depthData, DEPTH_OFFSET, DEPTH_SIZE)
-		bytesWritten := DEPTH_SIZE
-		// Write bucket index to meta file
-		pnSize := int64(binary.MaxVarintLen64)
-		pnData := make([]byte, pnSize)
-		for _, pn := range table.buckets {
-			if bytesWritten+pnSize > PAGESIZE {
-				page.Put()
-				metaPN = indexPager.GetFreePN()
-				page, err = indexPager.GetPage(metaPN)
-				if err != nil {
-					return err
-				}
-				page.SetDirty(true)
-				bytesWritten = 0
+		return indexPager.AllocatePage()
+	}
+	metaPN := int64(0)
+	page, err := getPage(metaPN)
+	if err != nil {
+		return err
+	}
+	page.SetDirty(true)
+	// Write the format version and global depth to meta file
+	page.Update(META_MAGIC, 0, int64(len(META_MAGIC)))
+	versionData := make([]byte, META_VERSION_SIZE)
+	binary.PutVarint(versionData, FORMAT_VERSION)
+	page.Update(versionData, META_VERSION_OFFSET, META_VERSION_SIZE)
+	depthData := make([]byte, DEPTH_SIZE)
+	binary.PutVarint(depthData, table.depth)
+	page.Update(depthData, META_DEPTH_OFFSET, DEPTH_SIZE)
+	bytesWritten := META_HEADER_SIZE
+	// Write bucket index to meta file
+	pnSize := int64(binary.MaxVarintLen64)
+	pnData := make([]byte, pnSize)
+	for _, pn := range table.buckets {
+		if bytesWritten+pnSize > PAGESIZE {
+			page.Put()
+			metaPN++
+			page, err = getPage(metaPN)
+			if err != nil {
+				return err
 			}
-			binary.PutVarint(pnData, pn)
-			page.Update(pnData, bytesWritten, pnSize)
-			bytesWritten += pnSize
+			page.SetDirty(true)
+			bytesWritten = 0
 		}
-		page.Put()
-		indexPager.Close()
+		binary.PutVarint(pnData, pn)
+		page.Update(pnData, bytesWritten, pnSize)
+		bytesWritten += pnSize
 	}
-	return bucketPager.Close()
+	page.Put()
+	return indexPager.Sync()
 }
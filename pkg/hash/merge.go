@@ -0,0 +1,104 @@
+package hash
+
+import (
+	"errors"
+	"fmt"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// MergePolicy decides what MergeInto does with a key that both tables have.
+type MergePolicy int
+
+const (
+	// Fail the merge, before any entry is inserted.
+	MergeError MergePolicy = iota
+	// Replace the destination's value with the source's.
+	MergeOverwrite
+	// Keep the destination's value, and drop the source's.
+	MergeKeep
+)
+
+// MergeInto inserts every entry of src into dst, splitting dst's buckets as
+// they fill up. Keys that dst already has are handled according to the policy,
+// as are keys that src has more than once, once the first copy is inserted.
+// Values inserted as bytes are copied to dst's own overflow pages. The source
+// is read one bucket at a time, and no lock on it is held while inserting, so
+// src is left as it was.
+func MergeInto(dst *HashTable, src *HashTable, policy MergePolicy) error {
+	if dst == src {
+		return errors.New("cannot merge a table into itself")
+	}
+	pns := src.BucketRanges(1)[0]
+	// Check for collisions up front, so that a failed merge changes nothing.
+	// A key that src has more than once collides with itself.
+	if policy == MergeError {
+		for _, pn := range pns {
+			entries, err := src.SelectBuckets([]int64{pn})
+			if err != nil {
+				return err
+			}
+			seen := make(map[int64]bool)
+			for _, entry := range entries {
+				if seen[entry.GetKey()] {
+					return fmt.Errorf("cannot merge repeated key %d: %w", entry.GetKey(), utils.ErrKeyExists)
+				}
+				seen[entry.GetKey()] = true
+				found, err := dst.has(entry.GetKey())
+				if err != nil {
+					return err
+				} else if found {
+					return fmt.Errorf("cannot merge key %d: %w", entry.GetKey(), utils.ErrKeyExists)
+				}
+			}
+		}
+	}
+	for _, pn := range pns {
+		entries, err := src.SelectBuckets([]int64{pn})
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = dst.mergeEntry(entry.(HashEntry), policy); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// has returns whether the table has an entry with the given key.
+func (table *HashTable) has(key int64) (bool, error) {
+	_, err := table.Find(key)
+	if errors.Is(err, utils.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// mergeEntry inserts an entry from another table, handling a key that the
+// table already has according to the policy.
+func (table *HashTable) mergeEntry(entry HashEntry, policy MergePolicy) error {
+	if policy != MergeError {
+		found, err := table.has(entry.key)
+		if err != nil {
+			return err
+		}
+		if found && policy == MergeKeep {
+			return nil
+		}
+		if found && entry.data == nil {
+			return table.Update(entry.key, entry.value)
+		}
+		// A value of bytes can't be updated in place.
+		if found {
+			if err = table.Delete(entry.key); err != nil {
+				return err
+			}
+		}
+	}
+	if entry.data != nil {
+		return table.InsertBytes(entry.key, entry.data)
+	}
+	return table.Insert(entry.key, entry.value)
+}
@@ -0,0 +1,245 @@
+package hash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+)
+
+// A value inserted as bytes doesn't fit in a cell, so it is written to a chain
+// of overflow pages, and its cell holds the first page's number with the
+// overflow flag set. Overflow pages start with a bucket header whose depth is
+// negative and which holds no keys, so that anything walking the table's pages
+// as buckets skips over them. Freed overflow pages are reused by later values.
+// Only values overflow: a bucket that fills up is split rather than chained,
+// so its entries are always on its one page, with no gaps after a delete.
+// Overflow pages changed the cell format, which is versioned in the meta file.
+
+// MAX_VALUE_SIZE is the largest value, in bytes, that InsertBytes accepts.
+var MAX_VALUE_SIZE int64 = 1 << 20
+
+// ErrValueTooLarge is returned when inserting a value larger than MAX_VALUE_SIZE.
+var ErrValueTooLarge = errors.New("value is larger than the maximum value size")
+
+// Overflow page variables
+var OVERFLOW_DEPTH int64 = -1 // Depth of an overflow page in use.
+var FREE_DEPTH int64 = -2     // Depth of an overflow page that was freed.
+var OVERFLOW_NEXT_OFFSET int64 = BUCKET_HEADER_SIZE
+var OVERFLOW_LENGTH_OFFSET int64 = OVERFLOW_NEXT_OFFSET + binary.MaxVarintLen64
+var OVERFLOW_HEADER_SIZE int64 = OVERFLOW_LENGTH_OFFSET + binary.MaxVarintLen64
+var OVERFLOW_DATA_SIZE int64 = PAGESIZE - OVERFLOW_HEADER_SIZE // bytes of the value per page
+
+// Returns the page number of the overflow pages holding the value of the
+// given key, if its value is in overflow pages.
+func (bucket *HashBucket) overflowPN(key int64) (int64, bool) {
+	for i := int64(0); i < bucket.numKeys; i++ {
+		if bucket.getKeyAt(i) == key {
+			entry := bucket.getCell(i)
+			return entry.value, entry.overflow
+		}
+	}
+	return 0, false
+}
+
+// Writes the given value to a new chain of overflow pages, and returns the
+// first page's number. Expects the index to be write-locked.
+func (table *HashTable) writeOverflow(value []byte) (int64, error) {
+	numPages := (int64(len(value)) + OVERFLOW_DATA_SIZE - 1) / OVERFLOW_DATA_SIZE
+	if numPages == 0 {
+		numPages = 1
+	}
+	pns := make([]int64, numPages)
+	for i := range pns {
+		pn, err := table.allocOverflowPN()
+		if err != nil {
+			return 0, err
+		}
+		pns[i] = pn
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	for i, pn := range pns {
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return 0, err
+		}
+		chunk := value[int64(i)*OVERFLOW_DATA_SIZE:]
+		if int64(len(chunk)) > OVERFLOW_DATA_SIZE {
+			chunk = chunk[:OVERFLOW_DATA_SIZE]
+		}
+		next := int64(pager.NOPAGE)
+		if i+1 < len(pns) {
+			next = pns[i+1]
+		}
+		header := pageToBucket(page)
+		header.updateDepth(OVERFLOW_DEPTH)
+		header.updateNumKeys(0)
+		binary.PutVarint(buf, next)
+		page.Update(buf, OVERFLOW_NEXT_OFFSET, binary.MaxVarintLen64)
+		binary.PutVarint(buf, int64(len(chunk)))
+		page.Update(buf, OVERFLOW_LENGTH_OFFSET, binary.MaxVarintLen64)
+		page.Update(chunk, OVERFLOW_HEADER_SIZE, int64(len(chunk)))
+		page.Put()
+	}
+	return pns[0], nil
+}
+
+// Reads the value held by the chain of overflow pages starting at the given page.
+func readOverflow(p *pager.Pager, pn int64) ([]byte, error) {
+	value := make([]byte, 0)
+	for pages := int64(0); pn != pager.NOPAGE; pages++ {
+		// A chain can't be longer than the file, unless it loops.
+		if pages >= p.GetNumPages() {
+			return nil, errors.New("overflow pages form a cycle")
+		}
+		page, err := p.GetPage(pn)
+		if err != nil {
+			return nil, err
+		}
+		data := *page.GetData()
+		if header := pageToBucket(page); header.depth != OVERFLOW_DEPTH {
+			page.Put()
+			return nil, fmt.Errorf("page %d is not an overflow page", pn)
+		}
+		next, _ := binary.Varint(data[OVERFLOW_NEXT_OFFSET : OVERFLOW_NEXT_OFFSET+binary.MaxVarintLen64])
+		length, _ := binary.Varint(data[OVERFLOW_LENGTH_OFFSET : OVERFLOW_LENGTH_OFFSET+binary.MaxVarintLen64])
+		if length < 0 || length > OVERFLOW_DATA_SIZE {
+			page.Put()
+			return nil, fmt.Errorf("overflow page %d has a bad length %d", pn, length)
+		}
+		value = append(value, data[OVERFLOW_HEADER_SIZE:OVERFLOW_HEADER_SIZE+length]...)
+		page.Put()
+		pn = next
+	}
+	return value, nil
+}
+
+// Returns the given entry with its value read in, if its value is in overflow pages.
+func loadEntry(p *pager.Pager, entry HashEntry) (HashEntry, error) {
+	if !entry.overflow {
+		return entry, nil
+	}
+	data, err := readOverflow(p, entry.value)
+	if err != nil {
+		return HashEntry{}, err
+	}
+	return HashEntry{key: entry.key, value: int64(len(data)), data: data}, nil
+}
+
+// Returns the page numbers of the chain of overflow pages starting at the given page.
+func (table *HashTable) overflowChain(pn int64) ([]int64, error) {
+	pns := make([]int64, 0)
+	buf := make([]byte, binary.MaxVarintLen64)
+	for pn != pager.NOPAGE {
+		if int64(len(pns)) >= table.pager.GetNumPages() {
+			return nil, errors.New("overflow pages form a cycle")
+		}
+		pns = append(pns, pn)
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return nil, err
+		}
+		copy(buf, (*page.GetData())[OVERFLOW_NEXT_OFFSET:OVERFLOW_NEXT_OFFSET+binary.MaxVarintLen64])
+		page.Put()
+		pn, _ = binary.Varint(buf)
+	}
+	return pns, nil
+}
+
+// Frees the chain of overflow pages starting at the given page, so that later
+// values can reuse them. Expects the bucket referring to the chain to be write-locked.
+func (table *HashTable) freeOverflow(pn int64) error {
+	pns, err := table.overflowChain(pn)
+	if err != nil {
+		return err
+	}
+	table.overflowMtx.Lock()
+	defer table.overflowMtx.Unlock()
+	for _, pn := range pns {
+		if err = table.markFree(pn); err != nil {
+			return err
+		}
+	}
+	if table.freeScanned {
+		table.freePNs = append(table.freePNs, pns...)
+	}
+	return nil
+}
+
+// Marks the given page as a freed overflow page.
+func (table *HashTable) markFree(pn int64) error {
+	page, err := table.pager.GetPage(pn)
+	if err != nil {
+		return err
+	}
+	header := pageToBucket(page)
+	header.updateDepth(FREE_DEPTH)
+	header.updateNumKeys(0)
+	page.Put()
+	return nil
+}
+
+// Returns a page to write part of a value to: a freed overflow page if there
+// is one, or else a new page at the end of the file. The freed pages are
+// found by scanning the file the first time one is needed. Expects the index
+// to be write-locked.
+func (table *HashTable) allocOverflowPN() (int64, error) {
+	table.overflowMtx.Lock()
+	defer table.overflowMtx.Unlock()
+	if !table.freeScanned {
+		table.freePNs = make([]int64, 0)
+		for pn := int64(0); pn < table.pager.GetNumPages(); pn++ {
+			page, err := table.pager.GetPage(pn)
+			if err != nil {
+				return 0, err
+			}
+			if pageToBucket(page).depth == FREE_DEPTH {
+				table.freePNs = append(table.freePNs, pn)
+			}
+			page.Put()
+		}
+		table.freeScanned = true
+	}
+	if n := len(table.freePNs); n > 0 {
+		pn := table.freePNs[n-1]
+		table.freePNs = table.freePNs[:n-1]
+		return pn, nil
+	}
+	// Like a new bucket, a new page is added to the end of the file.
+	page, err := table.pager.AllocatePage()
+	if err != nil {
+		return 0, err
+	}
+	pn := page.GetPageNum()
+	page.Put()
+	return pn, nil
+}
+
+// Returns the page numbers of every overflow page that a bucket's cell refers
+// to, directly or through the chain. Expects the index to be write-locked.
+func (table *HashTable) overflowPNs() (map[int64]bool, error) {
+	pns := make(map[int64]bool)
+	for _, bucketPN := range table.bucketPNs() {
+		bucket, err := table.GetBucketByPN(bucketPN, NO_LOCK)
+		if err != nil {
+			return nil, err
+		}
+		for i := int64(0); i < bucket.numKeys; i++ {
+			entry := bucket.getCell(i)
+			if !entry.overflow {
+				continue
+			}
+			chain, err := table.overflowChain(entry.value)
+			if err != nil {
+				bucket.page.Put()
+				return nil, err
+			}
+			for _, pn := range chain {
+				pns[pn] = true
+			}
+		}
+		bucket.page.Put()
+	}
+	return pns, nil
+}
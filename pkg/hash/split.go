@@ -0,0 +1,228 @@
+package hash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A split is made crash-safe by appending what it is about to do to the
+// table's split file, and forcing it to disk, before changing anything. The
+// split's pages and the directory are only written out when the table is
+// closed or checkpointed, after which the file is removed. If the table is
+// opened while the file is still there, the splits since the directory was
+// last written are redone from it in order: each record has the split bucket's
+// entries in it, so a bucket whose page is older than the split can be rebuilt.
+
+// splitIntent is the record of a bucket split.
+type splitIntent struct {
+	depth      int64       // Global depth of the table once the bucket is split.
+	localDepth int64       // Local depth of both buckets once the bucket is split.
+	oldPN      int64       // Page of the bucket being split.
+	newPN      int64       // Page of the bucket it is split into.
+	newHash    int64       // First directory slot of the new bucket.
+	entries    []HashEntry // Entries of the bucket before it was split.
+}
+
+// Size of the length that comes before each record in the split file.
+const SPLIT_LENGTH_SIZE = 4
+
+// Returns the name of the table's split file, which lives next to its meta file.
+func (table *HashTable) splitFileName() string {
+	return table.pager.GetFileName() + ".split"
+}
+
+// Serializes the record, preceded by its length and followed by a checksum of it.
+func (intent splitIntent) marshal() []byte {
+	data := make([]byte, SPLIT_LENGTH_SIZE, SPLIT_LENGTH_SIZE+6*binary.MaxVarintLen64+int64(len(intent.entries))*ENTRYSIZE+4)
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, field := range []int64{intent.depth, intent.localDepth, intent.oldPN, intent.newPN, intent.newHash, int64(len(intent.entries))} {
+		n := binary.PutVarint(buf, field)
+		data = append(data, buf[:n]...)
+	}
+	for _, entry := range intent.entries {
+		data = append(data, entry.Marshal()...)
+	}
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(data[SPLIT_LENGTH_SIZE:]))
+	data = append(data, sum...)
+	binary.LittleEndian.PutUint32(data, uint32(len(data)-SPLIT_LENGTH_SIZE))
+	return data
+}
+
+// errTornSplit is returned for a record that is incomplete or doesn't match its checksum.
+var errTornSplit = errors.New("split record is incomplete")
+
+// Deserializes the next record from the reader. Returns io.EOF at the end of
+// the file, and errTornSplit if the record is incomplete or doesn't match its checksum.
+func readSplitIntent(r io.Reader) (intent splitIntent, err error) {
+	lengthData := make([]byte, SPLIT_LENGTH_SIZE)
+	if _, err = io.ReadFull(r, lengthData); err == io.EOF {
+		return intent, io.EOF
+	} else if err != nil {
+		return intent, errTornSplit
+	}
+	length := binary.LittleEndian.Uint32(lengthData)
+	if length < 4 || length > uint32(6*binary.MaxVarintLen64+(BUCKETSIZE+1)*ENTRYSIZE+4) {
+		return intent, errTornSplit
+	}
+	data := make([]byte, length)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return intent, errTornSplit
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return intent, errTornSplit
+	}
+	fields := make([]int64, 6)
+	for i := range fields {
+		field, n := binary.Varint(body)
+		if n <= 0 {
+			return intent, errTornSplit
+		}
+		fields[i], body = field, body[n:]
+	}
+	numEntries := fields[5]
+	if numEntries < 0 || int64(len(body)) != numEntries*ENTRYSIZE {
+		return intent, errTornSplit
+	}
+	intent = splitIntent{depth: fields[0], localDepth: fields[1], oldPN: fields[2], newPN: fields[3], newHash: fields[4]}
+	intent.entries = make([]HashEntry, numEntries)
+	for i := range intent.entries {
+		intent.entries[i] = unmarshalEntry(body[int64(i)*ENTRYSIZE : int64(i+1)*ENTRYSIZE])
+	}
+	return intent, nil
+}
+
+// Appends the record of a split to the table's split file and forces it to disk.
+func (table *HashTable) logSplit(intent splitIntent) error {
+	if !table.pager.HasFile() {
+		return nil
+	}
+	file, err := os.OpenFile(table.splitFileName(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(intent.marshal()); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Sets a bucket to one side of a split: the entries that move to the new
+// bucket if moved is set, or the ones that stay otherwise.
+func fillSplitBucket(bucket *HashBucket, intent splitIntent, moved bool) {
+	bucket.updateDepth(intent.localDepth)
+	numKeys := int64(0)
+	for _, entry := range intent.entries {
+		if (Hasher(entry.GetKey(), intent.localDepth) == intent.newHash) == moved {
+			bucket.modifyCell(numKeys, entry)
+			numKeys++
+		}
+	}
+	bucket.updateNumKeys(numKeys)
+}
+
+// Points the directory slots of a split's new bucket at its page. The
+// directory must already have the split's global depth.
+func (table *HashTable) pointSplit(intent splitIntent) {
+	for i := intent.newHash; i < powInt(2, table.depth); i += powInt(2, intent.localDepth) {
+		table.buckets[i] = intent.newPN
+	}
+}
+
+// Applies a split to the two buckets and the directory, which must already
+// have the split's global depth. Expects the index and buckets to be write-locked.
+func (table *HashTable) applySplit(bucket *HashBucket, newBucket *HashBucket, intent splitIntent) {
+	fillSplitBucket(bucket, intent, false)
+	fillSplitBucket(newBucket, intent, true)
+	table.pointSplit(intent)
+}
+
+// Writes the table's pages and directory to disk, then removes the split
+// file, since the splits in it are now all on disk.
+func (table *HashTable) persist() error {
+	if !table.pager.HasFile() {
+		return nil
+	}
+	if err := table.pager.Sync(); err != nil {
+		return err
+	}
+	if err := writeDirectory(table.pager.GetFileName()+".meta", table); err != nil {
+		return err
+	}
+	if err := os.Remove(table.splitFileName()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Redoes the splits recorded in the table's split file, if there is one, then
+// writes the table out. Reading stops at a record that was only partly
+// written, since its split hadn't started.
+func (table *HashTable) recoverSplits() error {
+	file, err := os.Open(table.splitFileName())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	for {
+		intent, err := readSplitIntent(r)
+		if err == io.EOF || err == errTornSplit {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err = table.redoSplit(intent); err != nil {
+			return err
+		}
+	}
+	return table.persist()
+}
+
+// Redoes a split. Between two writes of the table, pages only ever get deeper,
+// since Compact writes the table out once it has merged buckets. So a bucket
+// whose page is at least as deep as the split was written out after it, and is
+// kept; one that isn't is rebuilt from the record.
+func (table *HashTable) redoSplit(intent splitIntent) error {
+	for table.depth < intent.depth {
+		table.ExtendTable()
+	}
+	// The new bucket's page may not have reached the file before the crash.
+	for table.pager.GetNumPages() <= intent.newPN {
+		page, err := table.pager.AllocatePage()
+		if err != nil {
+			return err
+		}
+		page.Put()
+	}
+	bucket, err := table.GetBucketByPN(intent.oldPN, NO_LOCK)
+	if err != nil {
+		return err
+	}
+	defer bucket.page.Put()
+	newBucket, err := table.GetBucketByPN(intent.newPN, NO_LOCK)
+	if err != nil {
+		return err
+	}
+	defer newBucket.page.Put()
+	if bucket.depth < intent.localDepth {
+		fillSplitBucket(bucket, intent, false)
+	}
+	if newBucket.depth < intent.localDepth {
+		fillSplitBucket(newBucket, intent, true)
+	}
+	table.pointSplit(intent)
+	return nil
+}
@@ -0,0 +1,61 @@
+package hash
+
+import (
+	"math"
+)
+
+// SkewStats summarizes how a hash table's entries are spread over its buckets.
+// Each bucket is counted once, however many directory slots point to it.
+type SkewStats struct {
+	Buckets   int     // Number of buckets.
+	Min       int64   // Fewest entries in a bucket.
+	Max       int64   // Most entries in a bucket.
+	Mean      float64 // Mean entries per bucket.
+	StdDev    float64 // Standard deviation of the entries per bucket.
+	MaxToMean float64 // Ratio of the largest bucket to the mean; 0 if the table is empty.
+}
+
+// SkewReport counts the entries in each of the table's buckets, to diagnose
+// keys that pile up in a few buckets. A ratio of the largest bucket to the
+// mean near 1 means the entries are spread evenly.
+func (table *HashTable) SkewReport() (SkewStats, error) {
+	// [CONCURRENCY] Lock the index
+	table.RLock()
+	defer table.RUnlock()
+	pns := table.bucketPNs()
+	counts := make([]int64, 0, len(pns))
+	for _, pn := range pns {
+		bucket, err := table.GetBucketByPN(pn, READ_LOCK)
+		if err != nil {
+			return SkewStats{}, err
+		}
+		counts = append(counts, bucket.numKeys)
+		bucket.RUnlock()
+		bucket.GetPage().Put()
+	}
+	stats := SkewStats{Buckets: len(counts)}
+	if len(counts) == 0 {
+		return stats, nil
+	}
+	stats.Min, stats.Max = counts[0], counts[0]
+	total := int64(0)
+	for _, count := range counts {
+		if count < stats.Min {
+			stats.Min = count
+		}
+		if count > stats.Max {
+			stats.Max = count
+		}
+		total += count
+	}
+	stats.Mean = float64(total) / float64(len(counts))
+	variance := 0.0
+	for _, count := range counts {
+		variance += (float64(count) - stats.Mean) * (float64(count) - stats.Mean)
+	}
+	stats.StdDev = math.Sqrt(variance / float64(len(counts)))
+	if stats.Mean > 0 {
+		stats.MaxToMean = float64(stats.Max) / stats.Mean
+	}
+	return stats, nil
+}
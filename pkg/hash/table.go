@@ -1,22 +1,34 @@
 package hash
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"sort"
+	"strings"
 	"sync"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
 	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
+// ErrBucketOverflow is returned when inserting a key that already fills a
+// whole bucket on its own. Splitting can't separate entries with the same key,
+// so such a bucket would be split forever.
+var ErrBucketOverflow = errors.New("too many entries with the same key for one bucket")
+
 // HashTable definitions.
 type HashTable struct {
 	depth   int64
 	buckets []int64 // Array of bucket page numbers
 	pager   *pager.Pager
 	rwlock  sync.RWMutex // Lock on the hash table index
+
+	overflowMtx sync.Mutex // Lock on the free overflow pages
+	freePNs     []int64    // Freed overflow pages, once the file has been scanned for them
+	freeScanned bool       // Whether the file has been scanned for freed overflow pages
 }
 
 // Returns a new HashTable.
@@ -31,7 +43,12 @@ func NewHashTable(pager *pager.Pager) (*HashTable, error) {
 		buckets[i] = bucket.page.GetPageNum()
 		bucket.page.Put()
 	}
-	return &HashTable{depth: depth, buckets: buckets, pager: pager}, nil
+	table := &HashTable{depth: depth, buckets: buckets, pager: pager}
+	// Write the empty table out, so that a split always starts from a table on disk.
+	if err := table.persist(); err != nil {
+		return nil, err
+	}
+	return table, nil
 }
 
 // [CONCURRENCY] Grab a write lock on the hash table index
@@ -64,6 +81,15 @@ func (table *HashTable) GetBuckets() []int64 {
 	return table.buckets
 }
 
+// PageNumbers returns the page numbers of all of the table's buckets, in
+// ascending order. Buckets are shared between the directory slots that point
+// to them, so each page appears once.
+func (table *HashTable) PageNumbers() []int64 {
+	table.RLock()
+	defer table.RUnlock()
+	return table.bucketPNs()
+}
+
 // Get pager.
 func (table *HashTable) GetPager() *pager.Pager {
 	return table.pager
@@ -79,7 +105,7 @@ func (table *HashTable) Find(key int64) (utils.Entry, error) {
 	if hash < 0 || int(hash) >= len(table.buckets) {
 		// [CONCURRENCY] Unlock the index on the error path
 		table.RUnlock()
-		return nil, errors.New("not found")
+		return nil, fmt.Errorf("entry could not be found: %w", utils.ErrKeyNotFound)
 	}
 	// Get and lock the corresponding bucket.
 	bucket, err := table.GetBucket(hash, READ_LOCK)
@@ -94,9 +120,13 @@ func (table *HashTable) Find(key int64) (utils.Entry, error) {
 	// Find the entry.
 	entry, found := bucket.Find(key)
 	if !found {
-		return nil, errors.New("not found")
+		return nil, fmt.Errorf("entry could not be found: %w", utils.ErrKeyNotFound)
 	}
-	return entry, nil
+	loaded, err := loadEntry(table.pager, entry.(HashEntry))
+	if err != nil {
+		return nil, err
+	}
+	return loaded, nil
 	/* SOLUTION }}} */
 }
 
@@ -106,7 +136,9 @@ func (table *HashTable) ExtendTable() {
 	table.buckets = append(table.buckets, table.buckets...)
 }
 
-// Split the given bucket into two, extending the table if necessary.
+// Split the given bucket into two, extending the table if necessary. The split
+// is recorded before it is applied, and is durable once Split returns, so a
+// crash part way through it is recovered from when the table is next opened.
 func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 	/* SOLUTION {{{ */
 	// [CONCURRENCY] Note: the index & bucket should be locked before entry
@@ -118,8 +150,7 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 		table.ExtendTable()
 	}
 	// Next, make a new bucket.
-	bucket.updateDepth(bucket.depth + 1)
-	newBucket, err := NewHashBucket(table.pager, bucket.depth)
+	newBucket, err := NewHashBucket(table.pager, bucket.depth+1)
 	if err != nil {
 		return err
 	}
@@ -127,44 +158,43 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 	// [CONCURRENCY] Note: newBucket doesn't have to be locked because we
 	// currently hold a write lock on the index, so no other user can
 	// discover this new bucket
-	// Move entries over to it.
-	tmpEntries := make([]HashEntry, bucket.numKeys)
+	// Record the split, along with the entries to move, before changing anything.
+	intent := splitIntent{
+		depth:      table.depth,
+		localDepth: bucket.depth + 1,
+		oldPN:      bucket.page.GetPageNum(),
+		newPN:      newBucket.page.GetPageNum(),
+		newHash:    newHash,
+		entries:    make([]HashEntry, bucket.numKeys),
+	}
 	for i := int64(0); i < bucket.numKeys; i++ {
-		tmpEntries[i] = bucket.getCell(i)
-	}
-	oldNKeys := int64(0)
-	newNKeys := int64(0)
-	for _, entry := range tmpEntries {
-		if Hasher(entry.GetKey(), bucket.depth) == newHash {
-			newBucket.modifyCell(newNKeys, entry)
-			newNKeys++
-		} else {
-			bucket.modifyCell(oldNKeys, entry)
-			oldNKeys++
-		}
+		intent.entries[i] = bucket.getCell(i)
 	}
-	// Initialize bucket attributes.
-	bucket.updateNumKeys(oldNKeys)
-	newBucket.updateNumKeys(newNKeys)
-	power := bucket.depth
-	// Point the rest of the buckets to the new page.
-	for i := newHash; i < powInt(2, table.depth); {
-		table.buckets[i] = newBucket.page.GetPageNum()
-		i += powInt(2, power)
+	if err = table.logSplit(intent); err != nil {
+		return err
 	}
+	// Move entries over to the new bucket and point the directory at it.
+	table.applySplit(bucket, newBucket, intent)
 	// Check if recursive splitting is required
-	if oldNKeys >= BUCKETSIZE {
+	if bucket.numKeys >= BUCKETSIZE {
 		return table.Split(bucket, oldHash)
 	}
-	if newNKeys >= BUCKETSIZE {
+	if newBucket.numKeys >= BUCKETSIZE {
 		return table.Split(newBucket, newHash)
 	}
 	return nil
 	/* SOLUTION }}} */
 }
 
-// Inserts the given key-value pair, splits if necessary.
+// Inserts the given key-value pair, splits if necessary. A key can be inserted
+// more than once, so that joins can use the table as a multimap.
 func (table *HashTable) Insert(key int64, value int64) error {
+	return table.insert(key, value, false)
+}
+
+// Inserts the given key-value pair, splits if necessary. If unique is set,
+// errors with ErrKeyExists if the key is already in the table.
+func (table *HashTable) insert(key int64, value int64, unique bool) error {
 	/* SOLUTION {{{ */
 	// [CONCURRENCY] Lock the index
 	table.WLock()
@@ -184,6 +214,14 @@ func (table *HashTable) Insert(key int64, value int64) error {
 	} else {
 		defer table.WUnlock()
 	}
+	if unique {
+		if _, found := bucket.Find(key); found {
+			return fmt.Errorf("cannot insert duplicate key: %w", utils.ErrKeyExists)
+		}
+	}
+	if bucket.numKeys == BUCKETSIZE-1 && bucket.holdsOnly(key) {
+		return ErrBucketOverflow
+	}
 	// Insert and split.
 	split, err := bucket.Insert(key, value)
 	if err != nil {
@@ -196,6 +234,213 @@ func (table *HashTable) Insert(key int64, value int64) error {
 	/* SOLUTION }}} */
 }
 
+// InsertBytes inserts the given key with a value of bytes, which is written to
+// overflow pages, splitting if necessary. Finding the key reads the value back
+// into the entry's bytes.
+func (table *HashTable) InsertBytes(key int64, value []byte) error {
+	if int64(len(value)) > MAX_VALUE_SIZE {
+		return ErrValueTooLarge
+	}
+	// [CONCURRENCY] Lock the index, which new pages are added under
+	table.WLock()
+	defer table.WUnlock()
+	hash := Hasher(key, table.depth)
+	bucket, err := table.GetBucket(hash, WRITE_LOCK)
+	if err != nil {
+		return err
+	}
+	defer bucket.WUnlock()
+	defer bucket.page.Put()
+	if bucket.numKeys == BUCKETSIZE-1 && bucket.holdsOnly(key) {
+		return ErrBucketOverflow
+	}
+	// Write the value out before the cell that refers to it.
+	pn, err := table.writeOverflow(value)
+	if err != nil {
+		return err
+	}
+	if !bucket.insertEntry(HashEntry{key: key, value: pn, overflow: true}) {
+		return nil
+	}
+	return table.Split(bucket, hash)
+}
+
+// FindOrInsert returns the entry with the given key if there is one, or else inserts
+// the given key-value pair, splitting if necessary, and returns the new entry.
+// Both happen under the bucket's write lock, so concurrent callers with the same key
+// agree on a single entry. The boolean is true if the entry was inserted.
+func (table *HashTable) FindOrInsert(key int64, value int64) (utils.Entry, bool, error) {
+	// [CONCURRENCY] Lock the index
+	table.WLock()
+	hash := Hasher(key, table.depth)
+	bucket, err := table.GetBucket(hash, WRITE_LOCK)
+	if err != nil {
+		// [CONCURRENCY] Unlock the index on the error path
+		table.WUnlock()
+		return nil, false, err
+	}
+	defer bucket.WUnlock()
+	defer bucket.page.Put()
+	// Release the lock on the index if it's not necessary
+	if bucket.numKeys < BUCKETSIZE-1 {
+		table.WUnlock()
+	} else {
+		defer table.WUnlock()
+	}
+	if entry, found := bucket.Find(key); found {
+		loaded, err := loadEntry(table.pager, entry.(HashEntry))
+		if err != nil {
+			return nil, false, err
+		}
+		return loaded, false, nil
+	}
+	// Insert and split.
+	split, err := bucket.Insert(key, value)
+	if err != nil {
+		return nil, false, err
+	}
+	entry := HashEntry{key: key, value: value}
+	if !split {
+		return entry, true, nil
+	}
+	if err = table.Split(bucket, hash); err != nil {
+		return nil, false, err
+	}
+	return entry, true, nil
+}
+
+// BulkInsert inserts all of the given key-value pairs. The new entries are buffered
+// by the bucket they hash to, and each bucket is split as many times as it needs
+// to be once all of its entries are known, rather than as it fills up. The table
+// ends up in the same state as if the pairs had been inserted one at a time.
+func (table *HashTable) BulkInsert(pairs []struct{ K, V int64 }) error {
+	return table.bulkInsert(pairs, false)
+}
+
+// Inserts all of the given key-value pairs, as BulkInsert does. If unique is
+// set, errors with ErrKeyExists if a key is already in the table or is given
+// more than once. The pairs are checked before any of them are written, so an
+// error leaves the table as it was.
+func (table *HashTable) bulkInsert(pairs []struct{ K, V int64 }, unique bool) error {
+	// [CONCURRENCY] Lock the index
+	table.WLock()
+	defer table.WUnlock()
+	// Buffer the entries by bucket.
+	pending := make(map[int64][]HashEntry)
+	pns := make([]int64, 0)
+	for _, pair := range pairs {
+		pn := table.buckets[Hasher(pair.K, table.depth)]
+		if _, ok := pending[pn]; !ok {
+			pns = append(pns, pn)
+		}
+		pending[pn] = append(pending[pn], HashEntry{key: pair.K, value: pair.V})
+	}
+	// Lock each bucket and add its existing entries, then check them all.
+	buckets := make([]*HashBucket, 0, len(pns))
+	defer func() {
+		for _, bucket := range buckets {
+			bucket.WUnlock()
+			bucket.page.Put()
+		}
+	}()
+	for _, pn := range pns {
+		bucket, err := table.GetBucketByPN(pn, WRITE_LOCK)
+		if err != nil {
+			return err
+		}
+		buckets = append(buckets, bucket)
+		entries := make([]HashEntry, 0, bucket.numKeys+int64(len(pending[pn])))
+		for i := int64(0); i < bucket.numKeys; i++ {
+			entries = append(entries, bucket.getCell(i))
+		}
+		pending[pn] = append(entries, pending[pn]...)
+		counts := make(map[int64]int64)
+		for _, entry := range pending[pn] {
+			counts[entry.key]++
+			if unique && counts[entry.key] > 1 {
+				return fmt.Errorf("cannot insert duplicate key: %w", utils.ErrKeyExists)
+			}
+			if counts[entry.key] >= BUCKETSIZE {
+				return ErrBucketOverflow
+			}
+		}
+	}
+	// Fill each bucket, then write the table out.
+	for i, pn := range pns {
+		if err := table.fill(buckets[i], pending[pn]); err != nil {
+			return err
+		}
+	}
+	return table.persist()
+}
+
+// fill writes the given entries into the bucket, first splitting it as many times
+// as individual inserts would have. Each split is logged like Split does, with
+// the entries already on the bucket's page. Expects the index and bucket to be
+// write-locked.
+func (table *HashTable) fill(bucket *HashBucket, entries []HashEntry) error {
+	if int64(len(entries)) < BUCKETSIZE {
+		for i, entry := range entries {
+			bucket.modifyCell(int64(i), entry)
+		}
+		bucket.updateNumKeys(int64(len(entries)))
+		return nil
+	}
+	// Copies of a key can't be split up, so they would be split forever.
+	if holdsOnly(entries, entries[0].key) {
+		return ErrBucketOverflow
+	}
+	// Split the bucket like Split does, but divide up the entries in memory.
+	oldHash := Hasher(entries[0].GetKey(), bucket.depth)
+	newHash := oldHash + powInt(2, bucket.depth)
+	if bucket.depth == table.depth {
+		table.ExtendTable()
+	}
+	newBucket, err := NewHashBucket(table.pager, bucket.depth+1)
+	if err != nil {
+		return err
+	}
+	defer newBucket.page.Put()
+	intent := splitIntent{
+		depth:      table.depth,
+		localDepth: bucket.depth + 1,
+		oldPN:      bucket.page.GetPageNum(),
+		newPN:      newBucket.page.GetPageNum(),
+		newHash:    newHash,
+		entries:    make([]HashEntry, bucket.numKeys),
+	}
+	for i := int64(0); i < bucket.numKeys; i++ {
+		intent.entries[i] = bucket.getCell(i)
+	}
+	if err = table.logSplit(intent); err != nil {
+		return err
+	}
+	table.applySplit(bucket, newBucket, intent)
+	oldEntries := make([]HashEntry, 0)
+	newEntries := make([]HashEntry, 0)
+	for _, entry := range entries {
+		if Hasher(entry.GetKey(), intent.localDepth) == newHash {
+			newEntries = append(newEntries, entry)
+		} else {
+			oldEntries = append(oldEntries, entry)
+		}
+	}
+	if err = table.fill(bucket, oldEntries); err != nil {
+		return err
+	}
+	return table.fill(newBucket, newEntries)
+}
+
+// holdsOnly returns whether every one of the entries has the given key.
+func holdsOnly(entries []HashEntry, key int64) bool {
+	for _, entry := range entries {
+		if entry.key != key {
+			return false
+		}
+	}
+	return true
+}
+
 // Update the given key-value pair.
 func (table *HashTable) Update(key int64, value int64) error {
 	/* SOLUTION {{{ */
@@ -212,10 +457,45 @@ func (table *HashTable) Update(key int64, value int64) error {
 	defer bucket.WUnlock()
 	defer bucket.page.Put()
 	table.RUnlock()
-	return bucket.Update(key, value)
+	pn, overflow := bucket.overflowPN(key)
+	if err = bucket.Update(key, value); err != nil {
+		return err
+	}
+	// The old value's overflow pages are no longer needed.
+	if overflow {
+		return table.freeOverflow(pn)
+	}
+	return nil
 	/* SOLUTION }}} */
 }
 
+// CompareAndSwap sets the value of the given key to value, but only if its
+// current value is expected. The check and the write happen under the bucket's
+// write lock, so no other write can slip in between them. Returns whether the
+// value was swapped. A value inserted as bytes never matches.
+func (table *HashTable) CompareAndSwap(key int64, expected int64, value int64) (bool, error) {
+	// [CONCURRENCY] Lock the index
+	table.RLock()
+	hash := Hasher(key, table.depth)
+	bucket, err := table.GetBucket(hash, WRITE_LOCK)
+	if err != nil {
+		// [CONCURRENCY] Unlock the index on the error path
+		table.RUnlock()
+		return false, err
+	}
+	defer bucket.WUnlock()
+	defer bucket.page.Put()
+	table.RUnlock()
+	entry, found := bucket.Find(key)
+	if !found {
+		return false, fmt.Errorf("compare and swap aborted: %w", utils.ErrUpdateMissing)
+	}
+	if entry.(HashEntry).overflow || entry.GetValue() != expected {
+		return false, nil
+	}
+	return true, bucket.Update(key, value)
+}
+
 // Delete the given key-value pair, does not coalesce.
 func (table *HashTable) Delete(key int64) error {
 	/* SOLUTION {{{ */
@@ -231,20 +511,33 @@ func (table *HashTable) Delete(key int64) error {
 	defer bucket.WUnlock()
 	defer bucket.page.Put()
 	table.RUnlock()
-	return bucket.Delete(key)
+	pn, overflow := bucket.overflowPN(key)
+	if err = bucket.Delete(key); err != nil {
+		return err
+	}
+	if overflow {
+		return table.freeOverflow(pn)
+	}
+	return nil
 	/* SOLUTION }}} */
 }
 
-// Select all entries in this table.
+// Select all entries in this table, in page order.
 func (table *HashTable) Select() ([]utils.Entry, error) {
+	return table.SelectOrdered(false)
+}
+
+// Select all entries in this table. If sorted is false, entries are returned
+// in page order, which is cheaper but changes as buckets split.
+func (table *HashTable) SelectOrdered(sorted bool) ([]utils.Entry, error) {
 	/* SOLUTION {{{ */
-	// [CONCURRENCY] Lock the index
+	// [CONCURRENCY] Lock the index, which keeps buckets from splitting
 	table.RLock()
 	defer table.RUnlock()
-	// Go over all of the pages.
+	// Go over each bucket once, even if several directory entries point to it.
 	ret := make([]utils.Entry, 0)
-	for i := int64(0); i < table.pager.GetNumPages(); i++ {
-		bucket, err := table.GetBucketByPN(i, READ_LOCK)
+	for _, pn := range table.bucketPNs() {
+		bucket, err := table.GetBucketByPN(pn, READ_LOCK)
 		if err != nil {
 			return nil, err
 		}
@@ -256,10 +549,297 @@ func (table *HashTable) Select() ([]utils.Entry, error) {
 		}
 		ret = append(ret, entries...)
 	}
+	if sorted {
+		sort.Slice(ret, func(i, j int) bool {
+			return ret[i].GetKey() < ret[j].GetKey()
+		})
+	}
 	return ret, nil
 	/* SOLUTION }}} */
 }
 
+// SelectChan streams all entries in this table, one bucket at a time and in page
+// order, without sorting them. The table is read-locked until the stream ends,
+// so the caller must not write to the table while consuming it. The entry
+// channel is closed once the scan ends; the error channel then yields the
+// scan's error, or ctx.Err() if ctx was cancelled first.
+func (table *HashTable) SelectChan(ctx context.Context) (<-chan utils.Entry, <-chan error) {
+	entries := make(chan utils.Entry)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(entries)
+		errs <- table.streamEntries(ctx, entries)
+	}()
+	return entries, errs
+}
+
+// streamEntries sends every entry in this table on the given channel, stopping if ctx is cancelled.
+func (table *HashTable) streamEntries(ctx context.Context, entries chan<- utils.Entry) error {
+	// [CONCURRENCY] Lock the index, which keeps buckets from splitting
+	table.RLock()
+	defer table.RUnlock()
+	for _, pn := range table.bucketPNs() {
+		// Only hold one bucket's entries, and no page locks, while sending.
+		bucket, err := table.GetBucketByPN(pn, READ_LOCK)
+		if err != nil {
+			return err
+		}
+		bucketEntries, err := bucket.Select()
+		bucket.RUnlock()
+		bucket.GetPage().Put()
+		if err != nil {
+			return err
+		}
+		for _, entry := range bucketEntries {
+			// Check first, since select picks at random when both cases are ready.
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case entries <- entry:
+			}
+		}
+	}
+	return nil
+}
+
+// bucketPNs returns the distinct bucket page numbers in the directory, in order.
+// Expects the table to be locked.
+func (table *HashTable) bucketPNs() []int64 {
+	seen := make(map[int64]bool)
+	pns := make([]int64, 0)
+	for _, pn := range table.buckets {
+		if !seen[pn] {
+			seen[pn] = true
+			pns = append(pns, pn)
+		}
+	}
+	sort.Slice(pns, func(i, j int) bool { return pns[i] < pns[j] })
+	return pns
+}
+
+// BucketRanges splits the table's distinct bucket page numbers into n groups
+// of roughly equal size, so that each group can be scanned in parallel with SelectBuckets.
+func (table *HashTable) BucketRanges(n int) [][]int64 {
+	table.RLock()
+	defer table.RUnlock()
+	pns := table.bucketPNs()
+	// Deal them out into contiguous groups.
+	if n < 1 {
+		n = 1
+	}
+	groups := make([][]int64, n)
+	for i := 0; i < n; i++ {
+		groups[i] = pns[i*len(pns)/n : (i+1)*len(pns)/n]
+	}
+	return groups
+}
+
+// SelectBuckets returns all entries in the buckets with the given page numbers, unsorted.
+func (table *HashTable) SelectBuckets(pns []int64) ([]utils.Entry, error) {
+	// [CONCURRENCY] Lock the index
+	table.RLock()
+	defer table.RUnlock()
+	ret := make([]utils.Entry, 0)
+	for _, pn := range pns {
+		bucket, err := table.GetBucketByPN(pn, READ_LOCK)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := bucket.Select()
+		bucket.RUnlock()
+		bucket.GetPage().Put()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, entries...)
+	}
+	return ret, nil
+}
+
+// Compact merges buddy buckets whose entries fit in a single bucket and shrinks
+// the directory, until no further merges are possible. The remaining buckets
+// are then moved to the front of the file and the freed pages are deallocated,
+// and the table is written out, so that no split from before it is redone.
+func (table *HashTable) Compact() error {
+	// [CONCURRENCY] Lock the index
+	table.WLock()
+	defer table.WUnlock()
+	// Merge and shrink until we reach a fixpoint.
+	for {
+		merged, err := table.mergeBuddies()
+		if err != nil {
+			return err
+		}
+		shrunk, err := table.shrinkTable()
+		if err != nil {
+			return err
+		}
+		if !merged && !shrunk {
+			break
+		}
+	}
+	if err := table.relocateBuckets(); err != nil {
+		return err
+	}
+	// Merges and moves aren't logged like splits are, so write the table out.
+	return table.persist()
+}
+
+// mergeBuddies merges each bucket with its buddy if their entries fit in one bucket.
+// Returns true if any buckets were merged. Expects the index to be write-locked.
+func (table *HashTable) mergeBuddies() (bool, error) {
+	merged := false
+	for i := int64(0); i < int64(len(table.buckets)); i++ {
+		bucket, err := table.GetBucket(i, WRITE_LOCK)
+		if err != nil {
+			return merged, err
+		}
+		// The buddy bucket differs in the highest bit of the local depth.
+		depth := bucket.depth
+		buddyPN := int64(pager.NOPAGE)
+		if depth > 0 {
+			buddyPN = table.buckets[i^powInt(2, depth-1)]
+		}
+		if buddyPN == pager.NOPAGE || buddyPN == bucket.page.GetPageNum() {
+			bucket.WUnlock()
+			bucket.page.Put()
+			continue
+		}
+		buddy, err := table.GetBucketByPN(buddyPN, WRITE_LOCK)
+		if err != nil {
+			bucket.WUnlock()
+			bucket.page.Put()
+			return merged, err
+		}
+		if buddy.depth == depth && bucket.numKeys+buddy.numKeys < BUCKETSIZE {
+			// Move the buddy's entries over.
+			for j := int64(0); j < buddy.numKeys; j++ {
+				bucket.modifyCell(bucket.numKeys+j, buddy.getCell(j))
+			}
+			bucket.updateNumKeys(bucket.numKeys + buddy.numKeys)
+			bucket.updateDepth(depth - 1)
+			buddy.updateNumKeys(0)
+			// Point the buddy's slots to the merged bucket.
+			for j := range table.buckets {
+				if table.buckets[j] == buddyPN {
+					table.buckets[j] = bucket.page.GetPageNum()
+				}
+			}
+			merged = true
+		}
+		buddy.WUnlock()
+		buddy.page.Put()
+		bucket.WUnlock()
+		bucket.page.Put()
+	}
+	return merged, nil
+}
+
+// shrinkTable halves the directory while no bucket uses the full global depth.
+// Returns true if the directory shrunk. Expects the index to be write-locked.
+func (table *HashTable) shrinkTable() (bool, error) {
+	shrunk := false
+	for table.depth > 0 {
+		for _, pn := range table.buckets {
+			bucket, err := table.GetBucketByPN(pn, NO_LOCK)
+			if err != nil {
+				return shrunk, err
+			}
+			depth := bucket.depth
+			bucket.page.Put()
+			if depth >= table.depth {
+				return shrunk, nil
+			}
+		}
+		table.depth = table.depth - 1
+		table.buckets = table.buckets[:len(table.buckets)/2]
+		shrunk = true
+	}
+	return shrunk, nil
+}
+
+// relocateBuckets moves all buckets into the lowest page numbers, then truncates
+// the pager to reclaim the pages left behind. Overflow pages stay where they
+// are, so the file ends after the last of them, and the unused pages before
+// that are freed for later values. Expects the index to be write-locked.
+func (table *HashTable) relocateBuckets() error {
+	live := make(map[int64]bool)
+	for _, pn := range table.buckets {
+		live[pn] = true
+	}
+	overflow, err := table.overflowPNs()
+	if err != nil {
+		return err
+	}
+	nLive := int64(len(live) + len(overflow))
+	// Find the unused pages that buckets can be moved into.
+	holes := make([]int64, 0)
+	for pn := int64(0); pn < nLive; pn++ {
+		if !live[pn] && !overflow[pn] {
+			holes = append(holes, pn)
+		}
+	}
+	for pn := nLive; pn < table.pager.GetNumPages(); pn++ {
+		if !live[pn] {
+			continue
+		}
+		if err := table.moveBucket(pn, holes[0]); err != nil {
+			return err
+		}
+		delete(live, pn)
+		live[holes[0]] = true
+		holes = holes[1:]
+	}
+	size := nLive
+	for pn := range overflow {
+		if pn >= size {
+			size = pn + 1
+		}
+	}
+	// Free the pages that are left before the end of the file.
+	table.overflowMtx.Lock()
+	defer table.overflowMtx.Unlock()
+	table.freePNs = make([]int64, 0)
+	for pn := int64(0); pn < size; pn++ {
+		if live[pn] || overflow[pn] {
+			continue
+		}
+		if err = table.markFree(pn); err != nil {
+			return err
+		}
+		table.freePNs = append(table.freePNs, pn)
+	}
+	table.freeScanned = true
+	return table.pager.Truncate(size)
+}
+
+// moveBucket copies the bucket at page srcPN to page dstPN and repoints the directory.
+// Expects the index to be write-locked.
+func (table *HashTable) moveBucket(srcPN int64, dstPN int64) error {
+	src, err := table.GetBucketByPN(srcPN, WRITE_LOCK)
+	if err != nil {
+		return err
+	}
+	defer src.WUnlock()
+	defer src.page.Put()
+	dstPage, err := table.pager.GetPage(dstPN)
+	if err != nil {
+		return err
+	}
+	defer dstPage.Put()
+	dstPage.Update(*src.page.GetData(), 0, PAGESIZE)
+	for i := range table.buckets {
+		if table.buckets[i] == srcPN {
+			table.buckets[i] = dstPN
+		}
+	}
+	return nil
+}
+
 // Print out each bucket.
 func (table *HashTable) Print(w io.Writer) {
 	table.RLock()
@@ -296,6 +876,30 @@ func (table *HashTable) PrintPN(pn int, w io.Writer) {
 	bucket.page.Put()
 }
 
+// Print out the bucket that the given key hashes to, along with every
+// directory entry that points to it.
+func (table *HashTable) PrintKey(key int64, w io.Writer) {
+	table.RLock()
+	defer table.RUnlock()
+	hash := Hasher(key, table.depth)
+	pn := table.buckets[hash]
+	aliases := make([]string, 0)
+	for i, bucketPN := range table.buckets {
+		if bucketPN == pn {
+			aliases = append(aliases, fmt.Sprintf("%d", i))
+		}
+	}
+	bucket, err := table.GetBucketByPN(pn, READ_LOCK)
+	if err != nil {
+		return
+	}
+	io.WriteString(w, fmt.Sprintf("key %d hashes to bucket %d (page %d)\n", key, hash, pn))
+	io.WriteString(w, fmt.Sprintf("directory aliases: %s\n", strings.Join(aliases, ", ")))
+	bucket.Print(w)
+	bucket.RUnlock()
+	bucket.page.Put()
+}
+
 // x^y
 func powInt(x, y int64) int64 {
 	return int64(math.Pow(float64(x), float64(y)))
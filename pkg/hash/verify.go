@@ -6,12 +6,13 @@ func IsHash(index *HashIndex) (bool, error) {
 	for _, pn := range buckets {
 		// Get bucket
 		bucket, err := table.GetBucketByPN(pn, NO_LOCK)
-		d := bucket.GetDepth()
 		if err != nil {
 			return false, err
 		}
+		d := bucket.GetDepth()
 		// Get all entries
 		entries, err := bucket.Select()
+		bucket.GetPage().Put()
 		if err != nil {
 			return false, err
 		}
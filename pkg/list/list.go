@@ -99,15 +99,19 @@ func (list *List) Find(f func(*Link) bool) *Link {
 }
 
 // Map Apply a function to every element in the list. f should alter Link in place.
+// f may remove the link it is given with PopSelf; inserting or removing any other
+// link during Map is undefined.
 func (list *List) Map(f func(*Link)) {
 	if list == nil {
 		return
 	}
 	var temp *Link = list.head
 	for temp != nil {
+		// read next first, since f may detach the node
+		next := temp.next
 		// apply the function to node
 		f(temp)
-		temp = temp.next
+		temp = next
 	}
 }
 
@@ -126,9 +130,9 @@ func (list *List) printList(command string, config *repl.REPLConfig) error {
 }
 
 func (list *List) pushHead(command string, config *repl.REPLConfig) error {
-	args := strings.Split(command, " ")
-	if len(args) < 1 {
-		return errors.New("invalid command")
+	args := strings.Fields(command)
+	if len(args) < 2 {
+		return errors.New("usage: list_push_head <value>")
 	}
 
 	value := args[1]
@@ -140,9 +144,9 @@ func (list *List) pushHead(command string, config *repl.REPLConfig) error {
 }
 
 func (list *List) pushTail(command string, config *repl.REPLConfig) error {
-	args := strings.Split(command, " ")
-	if len(args) < 1 {
-		return errors.New("invalid command")
+	args := strings.Fields(command)
+	if len(args) < 2 {
+		return errors.New("usage: list_push_tail <value>")
 	}
 
 	value := args[1]
@@ -154,9 +158,9 @@ func (list *List) pushTail(command string, config *repl.REPLConfig) error {
 }
 
 func (list *List) remove(command string, config *repl.REPLConfig) error {
-	args := strings.Split(command, " ")
-	if len(args) < 1 {
-		return errors.New("invalid command")
+	args := strings.Fields(command)
+	if len(args) < 2 {
+		return errors.New("usage: list_remove <value>")
 	}
 
 	value := args[1]
@@ -183,9 +187,9 @@ func (list *List) remove(command string, config *repl.REPLConfig) error {
 }
 
 func (list *List) contains(command string, config *repl.REPLConfig) error {
-	args := strings.Split(command, " ")
-	if len(args) < 1 {
-		return errors.New("invalid command")
+	args := strings.Fields(command)
+	if len(args) < 2 {
+		return errors.New("usage: list_contains <value>")
 	}
 
 	value := args[1]
@@ -301,10 +305,11 @@ func ListRepl(list *List) *repl.REPL {
 	linkedList := NewList()
 
 	r.AddCommand("list_print", linkedList.printList, "Prints out all of the elements in the list in order, separated by commas (e.g. \"0, 1, 2\")")
-	r.AddCommand("list_push_head", linkedList.pushHead, "Inserts the given element to the List as a string.")
-	r.AddCommand("list_push_tail", linkedList.pushTail, "Inserts the given element to the end of the List as a string.")
-	r.AddCommand("list_remove", linkedList.remove, "Removes the given element from the list.")
-	r.AddCommand("list_contains", linkedList.contains, "Prints \"found!\" if the element is in the list, prints \"not found\" otherwise.")
+	value := repl.ArgSpec{Names: []string{"value"}}
+	r.AddCommandWithArgs("list_push_head", linkedList.pushHead, "Inserts the given element to the List as a string.", value)
+	r.AddCommandWithArgs("list_push_tail", linkedList.pushTail, "Inserts the given element to the end of the List as a string.", value)
+	r.AddCommandWithArgs("list_remove", linkedList.remove, "Removes the given element from the list.", value)
+	r.AddCommandWithArgs("list_contains", linkedList.contains, "Prints \"found!\" if the element is in the list, prints \"not found\" otherwise.", value)
 
 	return r
 }
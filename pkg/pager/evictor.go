@@ -0,0 +1,125 @@
+package pager
+
+import (
+	"errors"
+	"sync"
+)
+
+// evictor frees frames in the background, so that getting a new page rarely
+// has to evict one itself.
+type evictor struct {
+	low  int           // Number of free frames below which the evictor wakes up.
+	high int           // Number of free frames the evictor frees up to.
+	wake chan struct{} // Signalled when the free frames drop below low.
+	stop chan struct{} // Closed to stop the evictor.
+	done chan struct{} // Closed once the evictor has stopped.
+	once sync.Once     // Makes sure stop is only closed once.
+}
+
+// StartEvictor starts evicting pages in the background: whenever fewer than
+// low frames are free, unpinned pages are flushed and freed, least recently
+// used first, until high frames are free. Returns a function that stops it;
+// closing the pager also stops it. Pinned pages are never evicted.
+func (pager *Pager) StartEvictor(low int, high int) (stop func(), err error) {
+	if low <= 0 || high < low || high > NUMPAGES {
+		return nil, errors.New("watermarks must satisfy 0 < low <= high <= NUMPAGES")
+	}
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if pager.evictor != nil {
+		return nil, errors.New("evictor already running")
+	}
+	e := &evictor{
+		low:  low,
+		high: high,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	pager.evictor = e
+	go pager.runEvictor(e)
+	// Catch up on frames that are already in use.
+	e.signal()
+	return func() {
+		pager.ptMtx.Lock()
+		if pager.evictor == e {
+			pager.evictor = nil
+		}
+		pager.ptMtx.Unlock()
+		e.halt()
+		<-e.done
+	}, nil
+}
+
+// halt tells the evictor to stop, without waiting for it to.
+func (e *evictor) halt() {
+	e.once.Do(func() { close(e.stop) })
+}
+
+// signal wakes the evictor up, if it isn't already awake.
+func (e *evictor) signal() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runEvictor evicts pages each time the evictor is woken up, until it is stopped.
+func (pager *Pager) runEvictor(e *evictor) {
+	defer close(e.done)
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-e.wake:
+			pager.ptMtx.Lock()
+			if !pager.closed && listLen(pager.freeList) < e.low {
+				pager.evictTo(e.high)
+			}
+			pager.ptMtx.Unlock()
+		}
+	}
+}
+
+// EvictTo flushes and frees unpinned pages, least recently used first, until
+// at least the given number of frames are free or no unpinned pages are left.
+// Returns how many pages were evicted.
+func (pager *Pager) EvictTo(free int) int {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if pager.closed {
+		return 0
+	}
+	return pager.evictTo(free)
+}
+
+// evictTo is EvictTo without locking.
+// the ptMtx should be locked on entry
+func (pager *Pager) evictTo(free int) int {
+	evicted := 0
+	for n := listLen(pager.freeList); n < free; n++ {
+		link := pager.unpinnedList.PeekHead()
+		if link == nil || !pager.HasFile() {
+			break
+		}
+		page := link.GetKey().(*Page)
+		if err := pager.FlushPage(page); err != nil {
+			// Keep the page rather than lose its changes.
+			break
+		}
+		link.PopSelf()
+		delete(pager.pageTable, page.pagenum)
+		page.pagenum = NOPAGE
+		pager.freeList.PushTail(page)
+		evicted++
+	}
+	return evicted
+}
+
+// notifyEvictor wakes the evictor up if the free frames have dropped below its low watermark.
+// the ptMtx should be locked on entry
+func (pager *Pager) notifyEvictor() {
+	if pager.evictor != nil && listLen(pager.freeList) < pager.evictor.low {
+		pager.evictor.signal()
+	}
+}
@@ -15,6 +15,8 @@ type Page struct {
 	pagenum    int64        // Position of the page in the file.
 	pinCount   int64        // The number of active references to this page.
 	dirty      bool         // Flag on whether data has to be written back.
+	lsn        int64        // LSN of the latest log record that may describe an update to this page.
+	read       bool         // Whether the frame was read from disk since NewPage handed it out.
 	rwlock     sync.RWMutex // Readers-writers lock on the page itself
 	updateLock sync.Mutex   // Mutex for updating data in a page
 	data       *[]byte      // Serialized data.
@@ -35,11 +37,29 @@ func (page *Page) IsDirty() bool {
 	return page.dirty
 }
 
-// Set dirty.
+// Set dirty. Dirtying a page stamps it with the log's latest LSN.
 func (page *Page) SetDirty(dirty bool) {
+	if dirty && page.pager != nil {
+		page.SetLSN(page.pager.lastLSN())
+	}
 	page.dirty = dirty
 }
 
+// Get the LSN of the latest log record that may describe an update to this page.
+func (page *Page) GetLSN() int64 {
+	return atomic.LoadInt64(&page.lsn)
+}
+
+// SetLSN raises the page's LSN to the given one; it never lowers it.
+func (page *Page) SetLSN(lsn int64) {
+	for {
+		old := atomic.LoadInt64(&page.lsn)
+		if lsn <= old || atomic.CompareAndSwapInt64(&page.lsn, old, lsn) {
+			return
+		}
+	}
+}
+
 // Get data.
 func (page *Page) GetData() *[]byte {
 	return page.data
@@ -72,10 +92,20 @@ func (page *Page) Put() {
 func (page *Page) Update(data []byte, offset int64, size int64) {
 	page.updateLock.Lock()
 	defer page.updateLock.Unlock()
-	page.dirty = true
+	page.SetDirty(true)
 	copy((*page.data)[offset:offset+size], data)
 }
 
+// Clone returns a copy of the page's data, taken under the update lock so
+// that no concurrent Update can tear it. Useful for before-images.
+func (page *Page) Clone() []byte {
+	page.updateLock.Lock()
+	defer page.updateLock.Unlock()
+	data := make([]byte, len(*page.data))
+	copy(data, *page.data)
+	return data
+}
+
 // [CONCURRENCY] Grab a writers lock on the page.
 func (page *Page) WLock() {
 	page.rwlock.Lock()
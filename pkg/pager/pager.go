@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	config "github.com/brown-csci1270/db/pkg/config"
 	list "github.com/brown-csci1270/db/pkg/list"
@@ -21,6 +22,17 @@ const PAGESIZE = int64(directio.BlockSize)
 // Number of pages.
 const NUMPAGES = config.NumPages
 
+// ErrBufferPoolFull is returned when a page can't be brought into memory
+// because every frame holds a pinned page.
+var ErrBufferPoolFull = errors.New("no available pages: all frames are pinned")
+
+// ErrPagerClosed is returned when getting a page from a closed pager.
+var ErrPagerClosed = errors.New("pager is closed")
+
+// ErrPageOutOfBounds is returned when getting a page past the end of the file.
+// New pages are added with AllocatePage.
+var ErrPageOutOfBounds = errors.New("page is past the end of the file")
+
 // Pagers manage pages of data read from a file.
 type Pager struct {
 	file         *os.File             // File descriptor.
@@ -30,16 +42,46 @@ type Pager struct {
 	unpinnedList *list.List           // Unpinned page list.
 	pinnedList   *list.List           // Pinned page list.
 	pageTable    map[int64]*list.Link // Page table.
+	directio     bool                 // Whether the file is opened with O_DIRECT.
+	written      bool                 // Whether the file was written to since the last ResetWritten.
+	reader       io.ReaderAt          // Reads pages in; the file unless set with SetIO.
+	writer       io.WriterAt          // Writes pages out; the file unless set with SetIO.
+	log          atomic.Value         // The LogFlusher pages are written behind, set with SetLogFlusher.
+	evictor      *evictor             // Frees frames in the background, if started with StartEvictor.
+	evictions    int64                // Pages NewPage evicted to make room for another.
+	diskReads    int64                // Pages read from disk.
+	doubleReads  int64                // Reads into a frame that had already been read into since NewPage.
+	closed       bool                 // Whether the pager has been closed.
+	readOnly     bool                 // Whether the file was opened read-only.
+}
+
+// FrameStats is a snapshot of how the pager's frames are being used.
+type FrameStats struct {
+	Free      int // Frames on the free list.
+	Unpinned  int // Frames holding a page that nobody references.
+	Pinned    int // Frames holding a page that is in use.
+	PageTable int // Number of pages in the page table.
 }
 
-// Construct a new Pager.
+// Construct a new Pager, using directio as configured by config.DirectIO.
 func NewPager() *Pager {
-	var pager *Pager = &Pager{}
+	return NewPagerWithDirectIO(config.DirectIO)
+}
+
+// Construct a new Pager; if useDirectIO is false, the file is opened
+// through the regular buffered path and frames are normally allocated.
+func NewPagerWithDirectIO(useDirectIO bool) *Pager {
+	var pager *Pager = &Pager{directio: useDirectIO}
 	pager.pageTable = make(map[int64]*list.Link)
 	pager.freeList = list.NewList()
 	pager.unpinnedList = list.NewList()
 	pager.pinnedList = list.NewList()
-	frames := directio.AlignedBlock(int(PAGESIZE * NUMPAGES))
+	var frames []byte
+	if useDirectIO {
+		frames = directio.AlignedBlock(int(PAGESIZE * NUMPAGES))
+	} else {
+		frames = make([]byte, PAGESIZE*NUMPAGES)
+	}
 	for i := 0; i < NUMPAGES; i++ {
 		frame := frames[i*int(PAGESIZE) : (i+1)*int(PAGESIZE)]
 		page := Page{
@@ -59,11 +101,21 @@ func (pager *Pager) HasFile() bool {
 	return pager.file != nil
 }
 
+// UsesDirectIO checks if the pager bypasses the OS page cache.
+func (pager *Pager) UsesDirectIO() bool {
+	return pager.directio
+}
+
 // GetFileName returns the file name.
 func (pager *Pager) GetFileName() string {
 	return filepath.Base(pager.file.Name())
 }
 
+// GetFilePath returns the path the file was opened at.
+func (pager *Pager) GetFilePath() string {
+	return pager.file.Name()
+}
+
 // GetNumPages returns the number of pages.
 func (pager *Pager) GetNumPages() int64 {
 	return pager.nPages
@@ -75,6 +127,30 @@ func (pager *Pager) GetFreePN() int64 {
 	return pager.nPages
 }
 
+// AllocateContiguous reserves n consecutive page numbers past the end of the
+// file, and returns the first. The file is grown to cover them, so each reads
+// back as a zeroed page until it is written. Unlike GetFreePN, the block is
+// taken under the page table mutex, so concurrent allocations never overlap.
+func (pager *Pager) AllocateContiguous(n int64) (startPN int64, err error) {
+	if n <= 0 {
+		return 0, errors.New("must allocate at least one page")
+	}
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if pager.closed {
+		return 0, ErrPagerClosed
+	}
+	startPN = pager.nPages
+	if pager.file != nil {
+		if err = pager.file.Truncate((startPN + n) * PAGESIZE); err != nil {
+			return 0, err
+		}
+		pager.written = true
+	}
+	pager.nPages += n
+	return startPN, nil
+}
+
 // Open initializes our page with a given database file.
 func (pager *Pager) Open(filename string) (err error) {
 	// Create the necessary prerequisite directories.
@@ -85,7 +161,32 @@ func (pager *Pager) Open(filename string) (err error) {
 		}
 	}
 	// Open or create the db file.
-	pager.file, err = directio.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	pager.readOnly = false
+	return pager.openFile(filename, os.O_RDWR|os.O_CREATE)
+}
+
+// OpenReadOnly initializes our pager with an existing database file, which is
+// opened read-only: pages can be read, but writing them back to the file fails.
+func (pager *Pager) OpenReadOnly(filename string) (err error) {
+	if err = pager.openFile(filename, os.O_RDONLY); err != nil {
+		return err
+	}
+	pager.readOnly = true
+	return nil
+}
+
+// IsReadOnly returns true if the pager's file was opened read-only.
+func (pager *Pager) IsReadOnly() bool {
+	return pager.readOnly
+}
+
+// openFile opens the db file with the given flags and sizes the pager to it.
+func (pager *Pager) openFile(filename string, flag int) (err error) {
+	if pager.directio {
+		pager.file, err = directio.OpenFile(filename, flag, 0666)
+	} else {
+		pager.file, err = os.OpenFile(filename, flag, 0666)
+	}
 	if err != nil {
 		return err
 	}
@@ -100,6 +201,7 @@ func (pager *Pager) Open(filename string) (err error) {
 	}
 	// Set the number of pages and hand off initialization to someone else.
 	pager.nPages = len / PAGESIZE
+	pager.closed = false
 	return nil
 }
 
@@ -107,26 +209,177 @@ func (pager *Pager) Open(filename string) (err error) {
 func (pager *Pager) Close() (err error) {
 	// Prevent new data from being paged in.
 	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	// Closing twice is a no-op.
+	if pager.closed {
+		return nil
+	}
+	pager.closed = true
+	if pager.evictor != nil {
+		pager.evictor.halt()
+		pager.evictor = nil
+	}
 	// Check if all refcounts are 0.
 	curLink := pager.pinnedList.PeekHead()
 	if curLink != nil {
 		fmt.Println("ERROR: pages are still pinned on close")
 	}
 	// Cleanup.
-	pager.FlushAllPages()
+	err = pager.FlushAllPages()
 	if pager.file != nil {
-		err = pager.file.Close()
+		if closeErr := pager.file.Close(); err == nil {
+			err = closeErr
+		}
 	}
-	pager.ptMtx.Unlock()
 	return err
 }
 
+// IsClosed returns true if the pager has been closed.
+func (pager *Pager) IsClosed() bool {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	return pager.closed
+}
+
+// Sync flushes all dirty pages and forces the file's OS buffers to disk,
+// without closing the pager.
+func (pager *Pager) Sync() error {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if err := pager.FlushAllPages(); err != nil {
+		return err
+	}
+	if pager.file == nil {
+		return nil
+	}
+	return pager.file.Sync()
+}
+
+// FrameStats returns how many frames are on each of the pager's lists.
+func (pager *Pager) FrameStats() FrameStats {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	return FrameStats{
+		Free:      listLen(pager.freeList),
+		Unpinned:  listLen(pager.unpinnedList),
+		Pinned:    listLen(pager.pinnedList),
+		PageTable: len(pager.pageTable),
+	}
+}
+
+// Evictions returns how many pages getting a new page has had to evict to make room.
+func (pager *Pager) Evictions() int64 {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	return pager.evictions
+}
+
+// DiskReads returns how many pages have been read from disk.
+func (pager *Pager) DiskReads() int64 {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	return pager.diskReads
+}
+
+// DoubleReads returns how many times a page was read into a frame that had
+// already been read into since it was handed out. Each page is faulted in
+// with a single read, so anything but 0 is a bug.
+func (pager *Pager) DoubleReads() int64 {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	return pager.doubleReads
+}
+
+// listLen returns the number of links in the given list.
+func listLen(l *list.List) int {
+	n := 0
+	l.Map(func(*list.Link) { n++ })
+	return n
+}
+
+// Truncate deallocates all pages with a page number >= n, shrinking the file.
+// Their frames are returned to the free list without being flushed.
+// Errors if any of these pages is still pinned.
+func (pager *Pager) Truncate(n int64) error {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if n < 0 || n > pager.nPages {
+		return errors.New("invalid number of pages to truncate to")
+	}
+	// Make sure no one is still using the pages we're dropping.
+	for pagenum, link := range pager.pageTable {
+		if pagenum >= n && link.GetList() == pager.pinnedList {
+			return errors.New("cannot truncate a pinned page")
+		}
+	}
+	// Move the dropped pages' frames back to the free list.
+	for pagenum, link := range pager.pageTable {
+		if pagenum < n {
+			continue
+		}
+		link.PopSelf()
+		page := link.GetKey().(*Page)
+		page.pagenum = NOPAGE
+		page.dirty = false
+		pager.freeList.PushTail(page)
+		delete(pager.pageTable, pagenum)
+	}
+	pager.nPages = n
+	pager.written = true
+	if pager.file != nil {
+		return pager.file.Truncate(n * PAGESIZE)
+	}
+	return nil
+}
+
+// SetIO makes the pager read and write pages through the given reader and
+// writer rather than its file; nil restores the file. Pages are always read
+// and written whole, at offsets that are multiples of PAGESIZE. Meant as a
+// seam for tests; call it while no other goroutine is using the pager.
+func (pager *Pager) SetIO(reader io.ReaderAt, writer io.WriterAt) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	pager.reader = reader
+	pager.writer = writer
+}
+
+// readerAt returns what pages are read from.
+func (pager *Pager) readerAt() io.ReaderAt {
+	if pager.reader != nil {
+		return pager.reader
+	}
+	return pager.file
+}
+
+// writerAt returns what pages are written to.
+func (pager *Pager) writerAt() io.WriterAt {
+	if pager.writer != nil {
+		return pager.writer
+	}
+	return pager.file
+}
+
+// ResetWritten reports whether the file was written to since the last call,
+// and clears the flag.
+// the ptMtx should be locked on entry
+func (pager *Pager) ResetWritten() bool {
+	written := pager.written
+	pager.written = false
+	return written
+}
+
 // Populate a page's data field, given a pagenumber.
+// the ptMtx should be locked on entry
 func (pager *Pager) ReadPageFromDisk(page *Page, pagenum int64) error {
-	if _, err := pager.file.Seek(pagenum*PAGESIZE, 0); err != nil {
-		return err
+	if page == nil || page.data == nil {
+		return errors.New("cannot read into a page without a buffer")
+	}
+	if page.read {
+		pager.doubleReads++
 	}
-	if _, err := pager.file.Read(*page.data); err != nil && err != io.EOF {
+	page.read = true
+	pager.diskReads++
+	if _, err := pager.readerAt().ReadAt(*page.data, pagenum*PAGESIZE); err != nil && err != io.EOF {
 		return err
 	}
 	return nil
@@ -146,90 +399,186 @@ func (pager *Pager) NewPage(pagenum int64) (*Page, error) {
 		// But skip this if our pager isn't backed by disk.
 		unpinLink.PopSelf()
 		newPage = unpinLink.GetKey().(*Page)
-		pager.FlushPage(newPage)
+		if err := pager.FlushPage(newPage); err != nil {
+			// Keep the victim, still dirty, rather than lose its changes.
+			pager.pageTable[newPage.pagenum] = pager.unpinnedList.PushHead(newPage)
+			return nil, err
+		}
 		delete(pager.pageTable, newPage.pagenum)
+		pager.evictions++
 	} else {
 		// If still no page is found, error.
-		return nil, errors.New("no available pages")
+		return nil, ErrBufferPoolFull
 	}
 	newPage.pagenum = pagenum
 	newPage.dirty = false
+	newPage.lsn = 0
+	newPage.read = false
 	newPage.pinCount = 1
+	pager.notifyEvictor()
 	return newPage, nil
 	/* SOLUTION }}} */
 }
 
 // getPage returns the page corresponding to the given pagenum.
+// A resident page is returned as is; only a page that isn't resident is read from disk.
 func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 	/* SOLUTION {{{ */
 	// Input checking.
 	if pagenum < 0 {
 		return nil, errors.New("invalid pagenum")
 	}
-	// Try to get from page table.
-	var newLink *list.Link
 	pager.ptMtx.Lock()
 	defer pager.ptMtx.Unlock()
-	link, ok := pager.pageTable[pagenum]
-	if ok {
-		page = link.GetKey().(*Page)
-		// Move the page to the pinned list if needed.
-		if link.GetList() == pager.unpinnedList {
-			link.PopSelf()
-			newLink = pager.pinnedList.PushTail(page)
-			pager.pageTable[pagenum] = newLink
-		}
-		page.Get()
-		return page, nil
+	if pager.closed {
+		return nil, ErrPagerClosed
+	}
+	if pagenum >= pager.nPages {
+		return nil, fmt.Errorf("page %d of %d: %w", pagenum, pager.nPages, ErrPageOutOfBounds)
+	}
+	// Fast path: the page is already in the page table.
+	if link, ok := pager.pageTable[pagenum]; ok {
+		return pager.pinResident(link), nil
+	}
+	return pager.faultIn(pagenum)
+	/* SOLUTION }}} */
+}
+
+// AllocatePage adds a new page to the end of the file, and returns it pinned
+// and zeroed. The page number is taken under the page table mutex, so
+// concurrent allocations never get the same page.
+func (pager *Pager) AllocatePage() (*Page, error) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if pager.closed {
+		return nil, ErrPagerClosed
+	}
+	return pager.faultIn(pager.nPages)
+}
+
+// pinResident pins a page that is already in the page table, without touching the disk.
+// the ptMtx should be locked on entry
+func (pager *Pager) pinResident(link *list.Link) *Page {
+	page := link.GetKey().(*Page)
+	// Move the page to the pinned list if needed.
+	if link.GetList() == pager.unpinnedList {
+		link.PopSelf()
+		pager.pageTable[page.pagenum] = pager.pinnedList.PushTail(page)
 	}
-	// Else, create a buffer to hold the new page in.
-	page, err = pager.NewPage(pagenum)
+	page.Get()
+	return page
+}
+
+// faultIn brings a page that isn't resident into a frame, pinned, reading it
+// from disk once if it exists and creating it if it is the next new page.
+// the ptMtx should be locked on entry
+func (pager *Pager) faultIn(pagenum int64) (*Page, error) {
+	page, err := pager.NewPage(pagenum)
 	if err != nil {
 		return nil, err
 	}
-
-	// Check if we need to create a new page.
 	if pagenum >= pager.nPages {
+		// A new page, past the end of the file: there is nothing to read, but
+		// the frame may still hold the page it was last used for.
 		pager.nPages++
 		page.dirty = true
-	} else {
-		// Read an existing page in.
-		page.dirty = false
-		err = pager.ReadPageFromDisk(page, pagenum)
+		data := *page.data
+		for i := range data {
+			data[i] = 0
+		}
+	} else if err = pager.ReadPageFromDisk(page, pagenum); err != nil {
+		pager.freeList.PushTail(page)
+		return nil, err
+	}
+	pager.pageTable[pagenum] = pager.pinnedList.PushTail(page)
+	return page, nil
+}
+
+// IsCached checks if the given page is in the buffer pool, so that the next
+// GetPage for it won't have to read from disk.
+func (pager *Pager) IsCached(pagenum int64) bool {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	_, ok := pager.pageTable[pagenum]
+	return ok
+}
+
+// Prefetch reads up to count existing pages, starting at start, into the
+// buffer pool, evicting unpinned pages as needed. Prefetched pages are left
+// unpinned. This is best-effort: it never prefetches more pages than there
+// are unpinned frames, so prefetched pages don't evict each other.
+func (pager *Pager) Prefetch(start int64, count int64) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if pager.closed {
+		return
+	}
+	if start < 0 {
+		count += start
+		start = 0
+	}
+	if available := int64(NUMPAGES - listLen(pager.pinnedList)); count > available {
+		count = available
+	}
+	end := start + count
+	if end > pager.nPages {
+		end = pager.nPages
+	}
+	for pagenum := start; pagenum < end; pagenum++ {
+		if _, ok := pager.pageTable[pagenum]; ok {
+			continue
+		}
+		page, err := pager.NewPage(pagenum)
 		if err != nil {
+			return
+		}
+		if err = pager.ReadPageFromDisk(page, pagenum); err != nil {
 			pager.freeList.PushTail(page)
-			return nil, err
+			continue
 		}
+		page.pinCount = 0
+		pager.pageTable[pagenum] = pager.unpinnedList.PushTail(page)
 	}
-	// Insert the page into our list of pages.
-	newLink = pager.pinnedList.PushTail(page)
-	pager.pageTable[pagenum] = newLink
-	return page, nil
-	/* SOLUTION }}} */
 }
 
 // Flush a particular page to disk.
-func (pager *Pager) FlushPage(page *Page) {
+// If the write fails, the page stays dirty so that a later flush retries it.
+// With a LogFlusher set, the log is flushed up to the page's LSN first, and
+// the page isn't written if that fails.
+func (pager *Pager) FlushPage(page *Page) error {
 	/* SOLUTION {{{ */
 	if pager.HasFile() && page.IsDirty() {
-		pager.file.WriteAt(
+		if err := pager.flushLogFor(page); err != nil {
+			return err
+		}
+		_, err := pager.writerAt().WriteAt(
 			*page.data,
 			page.pagenum*PAGESIZE,
 		)
+		if err != nil {
+			return err
+		}
 		page.SetDirty(false)
+		pager.written = true
 	}
+	return nil
 	/* SOLUTION }}} */
 }
 
-// Flushes all dirty pages.
-func (pager *Pager) FlushAllPages() {
+// Flushes all dirty pages, returning the first error. Pages that fail to
+// flush stay dirty, and the rest are still flushed.
+func (pager *Pager) FlushAllPages() error {
 	/* SOLUTION {{{ */
+	var firstErr error
 	writer := func(link *list.Link) {
 		page := link.GetKey().(*Page)
-		pager.FlushPage(page)
+		if err := pager.FlushPage(page); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
 	pager.pinnedList.Map(writer)
 	pager.unpinnedList.Map(writer)
+	return firstErr
 	/* SOLUTION }}} */
 }
 
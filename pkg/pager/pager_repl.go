@@ -112,7 +112,7 @@ func HandlePagerNew(p *Pager, payload string, w io.Writer) (err error) {
 	if numFields != 1 {
 		return fmt.Errorf("usage: pager_new")
 	}
-	p.GetPage(int64(p.nPages))
+	p.AllocatePage()
 	return nil
 }
 
@@ -245,8 +245,7 @@ func HandlePagerFlush(p *Pager, payload string, w io.Writer) (err error) {
 	}
 	// Flush.
 	page := link.GetKey().(*Page)
-	p.FlushPage(page)
-	return nil
+	return p.FlushPage(page)
 }
 
 // Function to flush all pages.
@@ -258,6 +257,5 @@ func HandlePagerFlushAll(p *Pager, payload string, w io.Writer) (err error) {
 		return fmt.Errorf("usage: pager_flushall")
 	}
 	// Flush all.
-	p.FlushAllPages()
-	return nil
+	return p.FlushAllPages()
 }
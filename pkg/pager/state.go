@@ -0,0 +1,109 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+
+	list "github.com/brown-csci1270/db/pkg/list"
+)
+
+// PoolState describes which pages the pager's frames hold, and in what order.
+// The head of the unpinned list is the next page to be evicted.
+type PoolState struct {
+	Free     int     // Number of frames holding no page.
+	Unpinned []int64 // Pages that nobody references, head of the list first.
+	Pinned   []int64 // Pages in use, head of the list first.
+}
+
+// DumpState returns a description of the buffer pool.
+func (pager *Pager) DumpState() PoolState {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	return PoolState{
+		Free:     listLen(pager.freeList),
+		Unpinned: listPages(pager.unpinnedList),
+		Pinned:   listPages(pager.pinnedList),
+	}
+}
+
+// listPages returns the page numbers of the pages in the given list, in order.
+func listPages(l *list.List) []int64 {
+	pagenums := make([]int64, 0)
+	l.Map(func(link *list.Link) {
+		pagenums = append(pagenums, link.GetKey().(*Page).pagenum)
+	})
+	return pagenums
+}
+
+// RestoreState sets up the buffer pool as described by the given state, so
+// that eviction can be tested from an exact starting point. Every resident
+// page is flushed and dropped first, then the pages in the state, which must
+// exist, are read back in. The pinned pages are returned, pinned once each
+// for the caller to Put. Errors if any page is pinned when it is called.
+// Meant as a seam for tests; call it while no other goroutine is using the pager.
+func (pager *Pager) RestoreState(state PoolState) ([]*Page, error) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if pager.closed {
+		return nil, ErrPagerClosed
+	}
+	if pager.pinnedList.PeekHead() != nil {
+		return nil, errors.New("cannot restore the pool state while pages are pinned")
+	}
+	if state.Free+len(state.Unpinned)+len(state.Pinned) != NUMPAGES {
+		return nil, fmt.Errorf("pool state must account for all %d frames", NUMPAGES)
+	}
+	seen := make(map[int64]bool)
+	for _, pagenum := range append(append([]int64{}, state.Unpinned...), state.Pinned...) {
+		if pagenum < 0 || pagenum >= pager.nPages {
+			return nil, fmt.Errorf("page %d does not exist", pagenum)
+		}
+		if seen[pagenum] {
+			return nil, fmt.Errorf("page %d appears more than once", pagenum)
+		}
+		seen[pagenum] = true
+	}
+	// Drop every resident page.
+	if err := pager.FlushAllPages(); err != nil {
+		return nil, err
+	}
+	for link := pager.unpinnedList.PeekHead(); link != nil; link = pager.unpinnedList.PeekHead() {
+		page := link.GetKey().(*Page)
+		if page.IsDirty() {
+			return nil, errors.New("could not flush a resident page")
+		}
+		link.PopSelf()
+		delete(pager.pageTable, page.pagenum)
+		page.pagenum = NOPAGE
+		pager.freeList.PushTail(page)
+	}
+	// Read the state's pages back in, in order.
+	restore := func(pagenum int64, l *list.List) (*Page, error) {
+		page, err := pager.NewPage(pagenum)
+		if err != nil {
+			return nil, err
+		}
+		if err = pager.ReadPageFromDisk(page, pagenum); err != nil {
+			pager.freeList.PushTail(page)
+			return nil, err
+		}
+		pager.pageTable[pagenum] = l.PushTail(page)
+		return page, nil
+	}
+	for _, pagenum := range state.Unpinned {
+		page, err := restore(pagenum, pager.unpinnedList)
+		if err != nil {
+			return nil, err
+		}
+		page.pinCount = 0
+	}
+	pinned := make([]*Page, 0, len(state.Pinned))
+	for _, pagenum := range state.Pinned {
+		page, err := restore(pagenum, pager.pinnedList)
+		if err != nil {
+			return nil, err
+		}
+		pinned = append(pinned, page)
+	}
+	return pinned, nil
+}
@@ -0,0 +1,55 @@
+package pager
+
+import (
+	"sync/atomic"
+)
+
+// LogFlusher is the write-ahead log that a pager's pages are written behind.
+// LSNs (log sequence numbers) grow with every record written to the log.
+// Pages are flushed, and so FlushLog called, with the pager's page table
+// mutex held, so FlushLog must not take any lock that is held while calling
+// into a pager: the log's lock always comes after the pager's.
+type LogFlusher interface {
+	LastLSN() int64           // LSN of the last record written to the log.
+	DurableLSN() int64        // LSN up to which the log is known to be on disk.
+	FlushLog(lsn int64) error // Makes the log durable up to at least the given LSN.
+}
+
+// logFlusherHolder lets a LogFlusher be kept in an atomic.Value, which needs
+// every stored value to have the same concrete type.
+type logFlusherHolder struct {
+	flusher LogFlusher
+}
+
+// SetLogFlusher makes the pager follow the write-ahead log protocol with the
+// given log: a page is only written once every log record that may describe
+// its updates is durable. nil turns the protocol off. Safe to call while the
+// pager is in use.
+func (pager *Pager) SetLogFlusher(flusher LogFlusher) {
+	pager.log.Store(logFlusherHolder{flusher: flusher})
+}
+
+// GetLogFlusher returns the log set with SetLogFlusher, or nil.
+func (pager *Pager) GetLogFlusher() LogFlusher {
+	holder, _ := pager.log.Load().(logFlusherHolder)
+	return holder.flusher
+}
+
+// lastLSN returns the LSN of the last record written to the pager's log,
+// or 0 if it has none.
+func (pager *Pager) lastLSN() int64 {
+	if flusher := pager.GetLogFlusher(); flusher != nil {
+		return flusher.LastLSN()
+	}
+	return 0
+}
+
+// flushLogFor makes the log durable up to the given page's LSN, if it isn't already.
+func (pager *Pager) flushLogFor(page *Page) error {
+	flusher := pager.GetLogFlusher()
+	lsn := atomic.LoadInt64(&page.lsn)
+	if flusher == nil || lsn <= flusher.DurableLSN() {
+		return nil
+	}
+	return flusher.FlushLog(lsn)
+}
@@ -0,0 +1,37 @@
+package query
+
+import (
+	"fmt"
+
+	bitset "github.com/bits-and-blooms/bitset"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// BuildBitmapIndex maps each distinct value that the cursor yields to the set
+// of keys that have it. Meant for values with few distinct values, where the
+// bitmaps can be combined to evaluate predicates quickly. Keys are positions
+// in the bitmaps, so they must not be negative.
+func BuildBitmapIndex(source utils.Cursor) (map[int64]*bitset.BitSet, error) {
+	bitmaps := make(map[int64]*bitset.BitSet)
+	ok, err := skipToEntry(source)
+	for ; ok; ok, err = stepToEntry(source) {
+		entry, err := source.GetEntry()
+		if err != nil {
+			return nil, err
+		}
+		key := entry.GetKey()
+		if key < 0 {
+			return nil, fmt.Errorf("cannot add negative key %d to a bitmap", key)
+		}
+		bits, found := bitmaps[entry.GetValue()]
+		if !found {
+			bits = bitset.New(0)
+			bitmaps[entry.GetValue()] = bits
+		}
+		bits.Set(uint(key))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bitmaps, nil
+}
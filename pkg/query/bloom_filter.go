@@ -1,10 +1,15 @@
 package query
 
 import (
+	"math"
+
 	bitset "github.com/bits-and-blooms/bitset"
 	hash "github.com/brown-csci1270/db/pkg/hash"
 )
 
+// Number of hash functions each key is inserted with.
+const NUM_BLOOM_HASHES = 2
+
 type BloomFilter struct {
 	size int64
 	bits *bitset.BitSet
@@ -38,3 +43,86 @@ func (filter *BloomFilter) Contains(key int64) bool {
 
 	return filter.bits.Test(xxHash) && filter.bits.Test(murmurHash)
 }
+
+// EstimatedFPR returns the current theoretical false-positive rate, which is
+// the chance that all of a key's bits happen to be set.
+func (filter *BloomFilter) EstimatedFPR() float64 {
+	fractionSet := float64(filter.bits.Count()) / float64(filter.size)
+	return math.Pow(fractionSet, NUM_BLOOM_HASHES)
+}
+
+// Each sub-filter of a ScalableBloomFilter is this many times larger than the last.
+const SCALABLE_GROWTH = 2
+
+// Each sub-filter of a ScalableBloomFilter targets this fraction of the last one's FPR.
+const SCALABLE_TIGHTENING = 0.5
+
+// ScalableBloomFilter chains progressively larger bloom filters, adding a new one
+// whenever the newest fills up, so its false-positive rate stays bounded however
+// many keys are inserted.
+type ScalableBloomFilter struct {
+	filters  []*BloomFilter
+	targets  []float64 // The FPR each sub-filter is filled up to.
+	capacity int64     // How many keys the newest sub-filter can take.
+	count    int64     // How many keys were inserted into the newest sub-filter.
+}
+
+// CreateScalableFilter initializes a ScalableBloomFilter whose first sub-filter has
+// the given size, and whose overall false-positive rate stays under maxFPR.
+func CreateScalableFilter(size int64, maxFPR float64) *ScalableBloomFilter {
+	filter := &ScalableBloomFilter{}
+	// The sub-filters' targets form a geometric series that sums to maxFPR.
+	filter.grow(size, maxFPR*(1-SCALABLE_TIGHTENING))
+	return filter
+}
+
+// grow adds a new sub-filter with the given size and target FPR.
+func (filter *ScalableBloomFilter) grow(size int64, target float64) {
+	filter.filters = append(filter.filters, CreateFilter(size))
+	filter.targets = append(filter.targets, target)
+	// A key sets NUM_BLOOM_HASHES bits, so after n keys we expect a fraction of
+	// 1 - e^(-kn/size) bits to be set, and the FPR is that fraction to the k.
+	fractionSet := math.Pow(target, 1.0/NUM_BLOOM_HASHES)
+	filter.capacity = int64(-float64(size) / NUM_BLOOM_HASHES * math.Log(1-fractionSet))
+	filter.count = 0
+}
+
+// Insert adds an element into the newest sub-filter, growing if it is full.
+func (filter *ScalableBloomFilter) Insert(key int64) {
+	if filter.count >= filter.capacity {
+		last := len(filter.filters) - 1
+		filter.grow(filter.filters[last].size*SCALABLE_GROWTH, filter.targets[last]*SCALABLE_TIGHTENING)
+	}
+	filter.filters[len(filter.filters)-1].Insert(key)
+	filter.count++
+}
+
+// Contains checks if the given key can be found in any of the sub-filters.
+func (filter *ScalableBloomFilter) Contains(key int64) bool {
+	for _, f := range filter.filters {
+		if f.Contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Capacity returns how many keys the newest sub-filter can take before the filter grows.
+func (filter *ScalableBloomFilter) Capacity() int64 {
+	return filter.capacity
+}
+
+// NumFilters returns the number of sub-filters.
+func (filter *ScalableBloomFilter) NumFilters() int {
+	return len(filter.filters)
+}
+
+// EstimatedFPR returns the current theoretical false-positive rate, which is
+// the chance that any of the sub-filters reports a false positive.
+func (filter *ScalableBloomFilter) EstimatedFPR() float64 {
+	negative := 1.0
+	for _, f := range filter.filters {
+		negative *= 1 - f.EstimatedFPR()
+	}
+	return 1 - negative
+}
@@ -0,0 +1,92 @@
+package query
+
+import (
+	"errors"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// DiffCursors compares two cursors over snapshots of the same table, taken at
+// different times, in a single pass. Both cursors must yield entries sorted by
+// key (e.g. B+ tree cursors). Returns the entries whose keys only appear in the
+// new snapshot, the entries whose keys only appear in the old snapshot, and the
+// new entries for keys whose values changed.
+func DiffCursors(oldCur utils.Cursor, newCur utils.Cursor) (added, removed, changed []utils.Entry, err error) {
+	added = make([]utils.Entry, 0)
+	removed = make([]utils.Entry, 0)
+	changed = make([]utils.Entry, 0)
+	oldOk, err := skipToEntry(oldCur)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	newOk, err := skipToEntry(newCur)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var oldEntry, newEntry utils.Entry
+	for oldOk || newOk {
+		if oldOk {
+			if oldEntry, err = oldCur.GetEntry(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		if newOk {
+			if newEntry, err = newCur.GetEntry(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		switch {
+		case !newOk || (oldOk && oldEntry.GetKey() < newEntry.GetKey()):
+			// The key is gone from the new snapshot.
+			removed = append(removed, oldEntry)
+			oldOk, err = stepToEntry(oldCur)
+		case !oldOk || newEntry.GetKey() < oldEntry.GetKey():
+			// The key is new in the new snapshot.
+			added = append(added, newEntry)
+			newOk, err = stepToEntry(newCur)
+		default:
+			// The key is in both snapshots.
+			if oldEntry.GetValue() != newEntry.GetValue() {
+				changed = append(changed, newEntry)
+			}
+			if oldOk, err = stepToEntry(oldCur); err == nil {
+				newOk, err = stepToEntry(newCur)
+			}
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return added, removed, changed, nil
+}
+
+// skipToEntry advances the cursor until it points to an entry.
+// Returns false if the cursor ran out of entries, and any other error it hit.
+func skipToEntry(cursor utils.Cursor) (bool, error) {
+	for cursor.IsEnd() {
+		if ok, err := step(cursor); !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// stepToEntry advances the cursor to its next entry.
+// Returns false if the cursor ran out of entries, and any other error it hit.
+func stepToEntry(cursor utils.Cursor) (bool, error) {
+	if ok, err := step(cursor); !ok {
+		return false, err
+	}
+	return skipToEntry(cursor)
+}
+
+// step advances the cursor once. Returns false if it didn't advance: with no
+// error if the cursor ran out of entries, or with the error it hit otherwise.
+func step(cursor utils.Cursor) (bool, error) {
+	if err := cursor.StepForward(); errors.Is(err, utils.ErrCursorEnd) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,49 @@
+package query
+
+import (
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// CountDistinct counts the distinct keys that the cursor yields.
+// B+ tree cursors yield keys in order, so we count the boundaries between
+// runs of equal keys; any other cursor is counted with a set.
+func CountDistinct(source utils.Cursor) (int64, error) {
+	if _, sorted := source.(*btree.BTreeCursor); sorted {
+		return countDistinctSorted(source)
+	}
+	seen := make(map[int64]bool)
+	ok, err := skipToEntry(source)
+	for ; ok; ok, err = stepToEntry(source) {
+		key, err := source.GetKey()
+		if err != nil {
+			return 0, err
+		}
+		seen[key] = true
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(seen)), nil
+}
+
+// countDistinctSorted counts the distinct keys of a cursor that yields keys in order.
+func countDistinctSorted(source utils.Cursor) (int64, error) {
+	count := int64(0)
+	var prevKey int64
+	ok, err := skipToEntry(source)
+	for ; ok; ok, err = stepToEntry(source) {
+		key, err := source.GetKey()
+		if err != nil {
+			return 0, err
+		}
+		if count == 0 || key != prevKey {
+			count++
+		}
+		prevKey = key
+	}
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
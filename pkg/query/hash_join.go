@@ -2,7 +2,9 @@ package query
 
 import (
 	"context"
+	"errors"
 	"os"
+	"sync/atomic"
 
 	db "github.com/brown-csci1270/db/pkg/db"
 	hash "github.com/brown-csci1270/db/pkg/hash"
@@ -13,57 +15,118 @@ import (
 
 var DEFAULT_FILTER_SIZE int64 = 1024
 
+// PROBE_WORKERS is the most bucket pairs that a join probes at once.
+var PROBE_WORKERS = 16
+
 // EntryPair Entry pair struct - output of a join.
 type EntryPair struct {
 	l utils.Entry
 	r utils.Entry
 }
 
+// GetLeft returns the pair's entry from the left table, or nil if it has none.
+func (pair EntryPair) GetLeft() utils.Entry {
+	return pair.l
+}
+
+// GetRight returns the pair's entry from the right table, or nil if it has none.
+func (pair EntryPair) GetRight() utils.Entry {
+	return pair.r
+}
+
+// Number of probes running, and the most that have run at once.
+var activeProbes, probePeak int64
+
+// JoinStats is how much work joins are doing at once, and the most they have.
+type JoinStats struct {
+	ActiveProbes int64 // Bucket pairs being probed now.
+	ProbePeak    int64 // Most bucket pairs probed at once.
+	SpillPeak    int64 // Most spilled entries held in memory at once.
+}
+
+// GetJoinStats returns how much work joins are doing at once, and the most
+// they have since ResetJoinStats.
+func GetJoinStats() JoinStats {
+	return JoinStats{
+		ActiveProbes: atomic.LoadInt64(&activeProbes),
+		ProbePeak:    atomic.LoadInt64(&probePeak),
+		SpillPeak:    atomic.LoadInt64(&spillPeak),
+	}
+}
+
+// ResetJoinStats clears the most work joins have done at once.
+func ResetJoinStats() {
+	atomic.StoreInt64(&probePeak, 0)
+	atomic.StoreInt64(&spillPeak, 0)
+}
+
 // Int pair struct - to keep track of seen bucket pairs.
 type pair struct {
 	l int64
 	r int64
 }
 
+// joinSide is one side of a join, keyed on the join key: a temporary hash
+// table of its entries, and a spill file of the entries whose keys have too
+// many of them to fit in a hash bucket.
+type joinSide struct {
+	index   *hash.HashIndex
+	dbName  string
+	spill   *spillFile
+	spilled map[int64]bool // Keys whose entries are all in the spill file.
+}
+
 // buildHashIndex constructs a temporary hash table for all the entries in the given sourceTable.
 func buildHashIndex(
 	sourceTable db.Index,
 	useKey bool,
-) (tempIndex *hash.HashIndex, dbName string, err error) {
+) (side *joinSide, err error) {
 	// Get a temporary db file.
-	dbName, err = db.GetTempDB()
+	dbName, err := db.GetTempDB()
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	// Init the temporary hash table.
-	tempIndex, err = hash.OpenTable(dbName)
+	tempIndex, err := hash.OpenTable(dbName)
 	if err != nil {
-		return nil, "", err
+		os.Remove(dbName)
+		return nil, err
+	}
+	spill, err := newSpillFile()
+	if err != nil {
+		removeTempIndex(tempIndex, dbName)
+		return nil, err
+	}
+	side = &joinSide{index: tempIndex, dbName: dbName, spill: spill, spilled: make(map[int64]bool)}
+	// Remove the temporary hash table and spill file if building them fails.
+	fail := func(err error) (*joinSide, error) {
+		side.remove()
+		return nil, err
 	}
 	// Build the hash index.
 	cursor, err := sourceTable.TableStart()
 
 	if err != nil {
-		return nil, "", err
+		return fail(err)
 	}
 
 	for {
 		if !cursor.IsEnd() {
 			entry, err := cursor.GetEntry()
 			if err != nil {
-				return nil, "", err
+				return fail(err)
 			}
 
 			if useKey {
 				// compute hash on entry key
-				err = tempIndex.Insert(entry.GetKey(), entry.GetValue())
+				err = side.insert(entry.GetKey(), entry.GetValue())
 			} else {
 				// compute hash on entry value
-				err = tempIndex.Insert(entry.GetValue(), entry.GetKey())
+				err = side.insert(entry.GetValue(), entry.GetKey())
 			}
 
 			if err != nil {
-				return nil, "", err
+				return fail(err)
 			}
 		}
 
@@ -73,7 +136,57 @@ func buildHashIndex(
 			break
 		}
 	}
-	return tempIndex, dbName, nil
+	return side, nil
+}
+
+// insert adds an entry to the side's hash table, or to its spill file if the
+// entry's key has too many entries for a hash bucket.
+func (side *joinSide) insert(key int64, value int64) error {
+	if side.spilled[key] {
+		return side.spill.add(key, value)
+	}
+	// Insert into the table itself, which allows repeated keys.
+	err := side.index.GetTable().Insert(key, value)
+	if !errors.Is(err, hash.ErrBucketOverflow) {
+		return err
+	}
+	if err = side.spillKey(key); err != nil {
+		return err
+	}
+	return side.spill.add(key, value)
+}
+
+// spillKey moves every entry with the given key from the side's hash table
+// to its spill file, and spills any more entries with that key.
+func (side *joinSide) spillKey(key int64) error {
+	side.spilled[key] = true
+	for {
+		entry, err := side.index.Find(key)
+		if errors.Is(err, utils.ErrKeyNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = side.spill.add(key, entry.GetValue()); err != nil {
+			return err
+		}
+		if err = side.index.Delete(key); err != nil {
+			return err
+		}
+	}
+}
+
+// remove removes the side's temporary hash table and spill file.
+func (side *joinSide) remove() {
+	removeTempIndex(side.index, side.dbName)
+	side.spill.remove()
+}
+
+// removeTempIndex closes a temporary hash table and removes its files.
+func removeTempIndex(tempIndex *hash.HashIndex, dbName string) {
+	tempIndex.Close()
+	os.Remove(dbName)
+	os.Remove(dbName + ".meta")
 }
 
 // sendResult attempts to send a single join result to the resultsChan channel as long as the errgroup hasn't been cancelled.
@@ -90,6 +203,27 @@ func sendResult(
 	}
 }
 
+// joinedPair builds the join result for a matching pair of entries, which are
+// keyed on the join key, restoring each to its table's key and value.
+func joinedPair(lKey int64, lValue int64, rKey int64, rValue int64, joinOnLeftKey bool, joinOnRightKey bool) EntryPair {
+	var lHashEntry, rHashEntry hash.HashEntry
+	if joinOnLeftKey {
+		lHashEntry.SetKey(lKey)
+		lHashEntry.SetValue(lValue)
+	} else {
+		lHashEntry.SetKey(lValue)
+		lHashEntry.SetValue(lKey)
+	}
+	if joinOnRightKey {
+		rHashEntry.SetKey(rKey)
+		rHashEntry.SetValue(rValue)
+	} else {
+		rHashEntry.SetKey(rValue)
+		rHashEntry.SetValue(rKey)
+	}
+	return EntryPair{l: lHashEntry, r: rHashEntry}
+}
+
 // See which entries in rBucket have a match in lBucket.
 func probeBuckets(
 	ctx context.Context,
@@ -125,26 +259,9 @@ func probeBuckets(
 		}
 		for _, rEntry := range rEntries {
 			if lEntry.GetKey() == rEntry.GetKey() {
-				var lHashEntry, rHashEntry hash.HashEntry
-
-				if joinOnLeftKey {
-					lHashEntry.SetKey(lEntry.GetKey())
-					lHashEntry.SetValue(lEntry.GetValue())
-				} else {
-					lHashEntry.SetKey(lEntry.GetValue())
-					lHashEntry.SetValue(lEntry.GetKey())
-				}
-
-				if joinOnRightKey {
-					rHashEntry.SetKey(rEntry.GetKey())
-					rHashEntry.SetValue(rEntry.GetValue())
-				} else {
-					rHashEntry.SetKey(rEntry.GetValue())
-					rHashEntry.SetValue(rEntry.GetKey())
-				}
-
 				// send the result
-				err = sendResult(ctx, resultsChan, EntryPair{l: lHashEntry, r: rHashEntry})
+				pair := joinedPair(lEntry.GetKey(), lEntry.GetValue(), rEntry.GetKey(), rEntry.GetValue(), joinOnLeftKey, joinOnRightKey)
+				err = sendResult(ctx, resultsChan, pair)
 				if err != nil {
 					return err
 				}
@@ -154,7 +271,60 @@ func probeBuckets(
 	return nil
 }
 
-// Join leftTable on rightTable using Grace Hash Join.
+// dispatchProbes probes every distinct pair of buckets in the same position of
+// the two tables, which must have the same global depth, running at most
+// PROBE_WORKERS probes at once. Stops starting probes once one has failed.
+func dispatchProbes(
+	ctx context.Context,
+	group *errgroup.Group,
+	resultsChan chan EntryPair,
+	leftHashTable *hash.HashTable,
+	rightHashTable *hash.HashTable,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+) error {
+	workers := make(chan struct{}, PROBE_WORKERS)
+	// Iterate through hash buckets, keeping track of pairs we've seen before.
+	leftBuckets := leftHashTable.GetBuckets()
+	rightBuckets := rightHashTable.GetBuckets()
+	seenList := make(map[pair]bool)
+	for i, lBucketPN := range leftBuckets {
+		bucketPair := pair{l: lBucketPN, r: rightBuckets[i]}
+		if _, seen := seenList[bucketPair]; seen {
+			continue
+		}
+		seenList[bucketPair] = true
+		// Wait for a free worker.
+		select {
+		case <-ctx.Done():
+			return nil
+		case workers <- struct{}{}:
+		}
+		group.Go(func() error {
+			defer func() { <-workers }()
+			active := atomic.AddInt64(&activeProbes, 1)
+			defer atomic.AddInt64(&activeProbes, -1)
+			trackPeak(&probePeak, active)
+			lBucket, err := leftHashTable.GetBucketByPN(bucketPair.l, hash.NO_LOCK)
+			if err != nil {
+				return err
+			}
+			rBucket, err := rightHashTable.GetBucketByPN(bucketPair.r, hash.NO_LOCK)
+			if err != nil {
+				lBucket.GetPage().Put()
+				return err
+			}
+			return probeBuckets(ctx, resultsChan, lBucket, rBucket, joinOnLeftKey, joinOnRightKey)
+		})
+	}
+	return nil
+}
+
+// Join leftTable on rightTable using Grace Hash Join. The pairs are sent on
+// the returned channel, which is closed once every probe has finished, even if
+// one failed: a failed probe cancels the rest, so consumers can range over the
+// channel without hanging. Call Wait on the returned group to find out whether
+// the join failed, then the cleanup function to remove its temporary files.
 func Join(
 	ctx context.Context,
 	leftTable db.Index,
@@ -162,25 +332,34 @@ func Join(
 	joinOnLeftKey bool,
 	joinOnRightKey bool,
 ) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
-	leftHashIndex, leftDbName, err := buildHashIndex(leftTable, joinOnLeftKey)
+	left, err := buildHashIndex(leftTable, joinOnLeftKey)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
-	rightHashIndex, rightDbName, err := buildHashIndex(rightTable, joinOnRightKey)
+	right, err := buildHashIndex(rightTable, joinOnRightKey)
 	if err != nil {
-		os.Remove(leftDbName)
-		os.Remove(leftDbName + ".meta")
+		left.remove()
 		return nil, nil, nil, nil, err
 	}
 	cleanupCallback := func() {
-		os.Remove(leftDbName)
-		os.Remove(leftDbName + ".meta")
-		os.Remove(rightDbName)
-		os.Remove(rightDbName + ".meta")
+		left.remove()
+		right.remove()
+	}
+	// Keys spilled on either side are joined from the spill files alone,
+	// so spill them on both.
+	for key := range left.spilled {
+		if err = right.spillKey(key); err != nil {
+			return nil, nil, nil, cleanupCallback, err
+		}
+	}
+	for key := range right.spilled {
+		if err = left.spillKey(key); err != nil {
+			return nil, nil, nil, cleanupCallback, err
+		}
 	}
 	// Make both hash indices the same global size.
-	leftHashTable := leftHashIndex.GetTable()
-	rightHashTable := rightHashIndex.GetTable()
+	leftHashTable := left.index.GetTable()
+	rightHashTable := right.index.GetTable()
 	for leftHashTable.GetDepth() != rightHashTable.GetDepth() {
 		if leftHashTable.GetDepth() < rightHashTable.GetDepth() {
 			// Split the left table
@@ -193,30 +372,16 @@ func Join(
 	// Probe phase: match buckets to buckets and emit entries that match.
 	group, ctx := errgroup.WithContext(ctx)
 	resultsChan := make(chan EntryPair, 1024)
-	// Iterate through hash buckets, keeping track of pairs we've seen before.
-	leftBuckets := leftHashTable.GetBuckets()
-	rightBuckets := rightHashTable.GetBuckets()
-	seenList := make(map[pair]bool)
-	for i, lBucketPN := range leftBuckets {
-		rBucketPN := rightBuckets[i]
-		bucketPair := pair{l: lBucketPN, r: rBucketPN}
-		if _, seen := seenList[bucketPair]; seen {
-			continue
-		}
-		seenList[bucketPair] = true
-
-		lBucket, err := leftHashTable.GetBucketByPN(lBucketPN, hash.NO_LOCK)
-		if err != nil {
-			return nil, nil, nil, cleanupCallback, err
-		}
-		rBucket, err := rightHashTable.GetBucketByPN(rBucketPN, hash.NO_LOCK)
-		if err != nil {
-			lBucket.GetPage().Put()
-			return nil, nil, nil, cleanupCallback, err
-		}
-		group.Go(func() error {
-			return probeBuckets(ctx, resultsChan, lBucket, rBucket, joinOnLeftKey, joinOnRightKey)
-		})
-	}
+	group.Go(func() error {
+		return dispatchProbes(ctx, group, resultsChan, leftHashTable, rightHashTable, joinOnLeftKey, joinOnRightKey)
+	})
+	// Join the spilled keys, which are too skewed for the hash tables.
+	group.Go(func() error {
+		return joinSpilled(ctx, resultsChan, left.spill, right.spill, 0, joinOnLeftKey, joinOnRightKey)
+	})
+	go func() {
+		group.Wait()
+		close(resultsChan)
+	}()
 	return resultsChan, ctx, group, cleanupCallback, nil
 }
@@ -0,0 +1,118 @@
+package query
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Bounds on the precision of a HyperLogLog, which has 2^precision registers.
+const MIN_HLL_PRECISION = 4
+const MAX_HLL_PRECISION = 16
+
+// Number of hash bits a HyperLogLog uses: XxHasher returns non-negative int64s.
+const hllHashBits = 63
+
+// HyperLogLog estimates the number of distinct keys added to it, in a fixed
+// amount of memory. Each key's hash picks a register by its top bits, which
+// keeps the longest run of leading zeros seen in the rest of the hash. The
+// estimate has a relative standard error of about 1.04/sqrt(2^precision).
+type HyperLogLog struct {
+	precision uint
+	registers []uint8
+}
+
+// CreateHyperLogLog initializes an empty HyperLogLog with 2^precision registers.
+func CreateHyperLogLog(precision int) (*HyperLogLog, error) {
+	if precision < MIN_HLL_PRECISION || precision > MAX_HLL_PRECISION {
+		return nil, errors.New("hyperloglog precision must be between 4 and 16")
+	}
+	return &HyperLogLog{precision: uint(precision), registers: make([]uint8, 1<<uint(precision))}, nil
+}
+
+// Add records a key.
+func (hll *HyperLogLog) Add(key int64) {
+	h := uint64(hash.XxHasher(key, math.MaxInt64))
+	restBits := hllHashBits - hll.precision
+	index := (h >> restBits) & (1<<hll.precision - 1)
+	rest := h & (1<<restBits - 1)
+	// The position of the first set bit in the rest of the hash.
+	rank := uint8(restBits - uint(bits.Len64(rest)) + 1)
+	if rank > hll.registers[index] {
+		hll.registers[index] = rank
+	}
+}
+
+// Estimate returns the estimated number of distinct keys added.
+func (hll *HyperLogLog) Estimate() int64 {
+	m := float64(len(hll.registers))
+	sum := 0.0
+	zeros := 0
+	for _, rank := range hll.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := hllAlpha(len(hll.registers)) * m * m / sum
+	// The raw estimate is biased until most registers are set. Until then,
+	// the number of empty registers gives a better estimate.
+	if zeros > 0 {
+		if linear := m * math.Log(m/float64(zeros)); linear <= 3*m {
+			estimate = linear
+		}
+	}
+	return int64(estimate + 0.5)
+}
+
+// Merge adds the keys recorded by other, as if they had been added to this
+// sketch. Both must have the same precision.
+func (hll *HyperLogLog) Merge(other *HyperLogLog) error {
+	if hll.precision != other.precision {
+		return errors.New("cannot merge hyperloglogs of different precisions")
+	}
+	for i, rank := range other.registers {
+		if rank > hll.registers[i] {
+			hll.registers[i] = rank
+		}
+	}
+	return nil
+}
+
+// hllAlpha returns the bias correction for a HyperLogLog with m registers.
+func hllAlpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	default:
+		return 0.7213 / (1 + 1.079/float64(m))
+	}
+}
+
+// EstimateDistinct estimates the distinct keys that the cursor yields, with a
+// HyperLogLog of the given precision, instead of remembering every key like CountDistinct.
+func EstimateDistinct(source utils.Cursor, precision int) (int64, error) {
+	hll, err := CreateHyperLogLog(precision)
+	if err != nil {
+		return 0, err
+	}
+	ok, err := skipToEntry(source)
+	for ; ok; ok, err = stepToEntry(source) {
+		key, err := source.GetKey()
+		if err != nil {
+			return 0, err
+		}
+		hll.Add(key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return hll.Estimate(), nil
+}
@@ -0,0 +1,112 @@
+package query
+
+import (
+	"errors"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// OuterMergeCursor merges two cursors by key, as a full outer join.
+type OuterMergeCursor struct {
+	left    utils.Cursor // The left cursor being merged.
+	right   utils.Cursor // The right cursor being merged.
+	leftOk  bool         // Whether the left cursor points to an entry.
+	rightOk bool         // Whether the right cursor points to an entry.
+	pair    EntryPair    // The current pair.
+	isEnd   bool         // Set once both cursors run out of entries.
+	err     error        // Set if either cursor failed.
+}
+
+// FullOuterMergeCursor returns a cursor over the full outer join of two
+// cursors on their keys, in a single pass over both. Both cursors must yield
+// entries sorted by key (e.g. B+ tree cursors). Each pair holds the entries
+// of both cursors for a key; a key that only one cursor has is paired with
+// nil on the other side. Pairs come in key order, and the cursors are
+// consumed as the returned cursor advances.
+func FullOuterMergeCursor(leftCur utils.Cursor, rightCur utils.Cursor) (*OuterMergeCursor, error) {
+	cursor := &OuterMergeCursor{left: leftCur, right: rightCur}
+	var err error
+	if cursor.leftOk, err = skipToEntry(leftCur); err != nil {
+		return nil, err
+	}
+	if cursor.rightOk, err = skipToEntry(rightCur); err != nil {
+		return nil, err
+	}
+	cursor.merge()
+	if cursor.err != nil {
+		return nil, cursor.err
+	}
+	return cursor, nil
+}
+
+// merge pairs up the entries that the cursors point to, consuming the pair's entries.
+func (cursor *OuterMergeCursor) merge() {
+	if !cursor.leftOk && !cursor.rightOk {
+		cursor.isEnd = true
+		return
+	}
+	var leftEntry, rightEntry utils.Entry
+	var err error
+	if cursor.leftOk {
+		if leftEntry, err = cursor.left.GetEntry(); err != nil {
+			cursor.fail(err)
+			return
+		}
+	}
+	if cursor.rightOk {
+		if rightEntry, err = cursor.right.GetEntry(); err != nil {
+			cursor.fail(err)
+			return
+		}
+	}
+	switch {
+	case !cursor.rightOk || (cursor.leftOk && leftEntry.GetKey() < rightEntry.GetKey()):
+		// The key is only on the left.
+		cursor.pair = EntryPair{l: leftEntry}
+		cursor.leftOk, err = stepToEntry(cursor.left)
+	case !cursor.leftOk || rightEntry.GetKey() < leftEntry.GetKey():
+		// The key is only on the right.
+		cursor.pair = EntryPair{r: rightEntry}
+		cursor.rightOk, err = stepToEntry(cursor.right)
+	default:
+		// The key is on both sides.
+		cursor.pair = EntryPair{l: leftEntry, r: rightEntry}
+		if cursor.leftOk, err = stepToEntry(cursor.left); err == nil {
+			cursor.rightOk, err = stepToEntry(cursor.right)
+		}
+	}
+	if err != nil {
+		cursor.fail(err)
+	}
+}
+
+// fail stops the cursor with the given error.
+func (cursor *OuterMergeCursor) fail(err error) {
+	cursor.err = err
+	cursor.isEnd = true
+}
+
+// StepForward moves to the next pair.
+func (cursor *OuterMergeCursor) StepForward() error {
+	if cursor.err != nil {
+		return cursor.err
+	}
+	if cursor.isEnd {
+		return utils.ErrCursorEnd
+	}
+	cursor.merge()
+	return cursor.err
+}
+
+// IsEnd returns true if at end.
+func (cursor *OuterMergeCursor) IsEnd() bool {
+	return cursor.isEnd
+}
+
+// GetPair returns the current pair.
+func (cursor *OuterMergeCursor) GetPair() (EntryPair, error) {
+	if cursor.isEnd {
+		return EntryPair{}, errors.New("getPair: pair is non-existent")
+	}
+	return cursor.pair, nil
+}
@@ -15,7 +15,7 @@ func QueryRepl(d *db.Database) *repl.REPL {
 	r := repl.NewRepl()
 	r.AddCommand("join", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleJoin(d, payload, replConfig.GetWriter())
-	}, "Create a table. usage: create table <table>")
+	}, "Join two tables. usage: join <table1> <key/val for table1> on <table2> <key/val for table2>")
 	return r
 }
 
@@ -61,7 +61,6 @@ func HandleJoin(d *db.Database, payload string, w io.Writer) (err error) {
 		done <- true
 	}()
 	err = group.Wait()
-	close(resultsChan)
 	<-done
 	if err != nil {
 		return fmt.Errorf("join error: %v", err)
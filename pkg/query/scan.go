@@ -0,0 +1,82 @@
+package query
+
+import (
+	"errors"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// ScanCursor streams a running fold over another cursor.
+type ScanCursor struct {
+	source utils.Cursor                         // The cursor being folded over.
+	fn     func(acc int64, e utils.Entry) int64 // The folding function.
+	acc    int64                                // The accumulated value so far.
+	key    int64                                // The key of the current entry.
+	isEnd  bool                                 // Set once the source runs out of entries.
+	err    error                                // Set if the source failed.
+}
+
+// Scan returns a cursor that yields, for each entry of the source, an entry with
+// the same key whose value is the fold of fn over all entries so far, starting at init.
+// The source is consumed as the returned cursor advances.
+func Scan(source utils.Cursor, init int64, fn func(acc int64, e utils.Entry) int64) utils.Cursor {
+	cursor := &ScanCursor{source: source, fn: fn, acc: init}
+	ok, err := skipToEntry(source)
+	cursor.isEnd, cursor.err = !ok, err
+	cursor.fold()
+	return cursor
+}
+
+// fold applies the folding function to the source's current entry.
+func (cursor *ScanCursor) fold() {
+	if cursor.isEnd {
+		return
+	}
+	entry, err := cursor.source.GetEntry()
+	if err != nil {
+		cursor.err = err
+		cursor.isEnd = true
+		return
+	}
+	cursor.key = entry.GetKey()
+	cursor.acc = cursor.fn(cursor.acc, entry)
+}
+
+// StepForward folds in the next entry of the source.
+func (cursor *ScanCursor) StepForward() error {
+	if cursor.err != nil {
+		return cursor.err
+	}
+	if cursor.isEnd {
+		return utils.ErrCursorEnd
+	}
+	ok, err := stepToEntry(cursor.source)
+	cursor.isEnd, cursor.err = !ok, err
+	cursor.fold()
+	return cursor.err
+}
+
+// IsEnd returns true if at end.
+func (cursor *ScanCursor) IsEnd() bool {
+	return cursor.isEnd
+}
+
+// GetEntry returns the current key along with the accumulated value.
+func (cursor *ScanCursor) GetEntry() (utils.Entry, error) {
+	if cursor.isEnd {
+		return nil, errors.New("getEntry: entry is non-existent")
+	}
+	var entry btree.BTreeEntry
+	entry.SetKey(cursor.key)
+	entry.SetValue(cursor.acc)
+	return entry, nil
+}
+
+// GetKey returns the current key.
+func (cursor *ScanCursor) GetKey() (int64, error) {
+	if cursor.isEnd {
+		return 0, errors.New("getKey: entry is non-existent")
+	}
+	return cursor.key, nil
+}
@@ -0,0 +1,222 @@
+package query
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync/atomic"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+)
+
+// JOIN_MEMORY_BUDGET is the most spilled entries a join holds in memory at once.
+var JOIN_MEMORY_BUDGET int64 = 1 << 16
+
+// SPILL_FANOUT is the number of partitions each hash round splits a spilled partition into.
+const SPILL_FANOUT int64 = 16
+
+// MAX_SPILL_ROUNDS is the number of hash rounds after which a spilled
+// partition pair that is still too large is joined in blocks instead.
+const MAX_SPILL_ROUNDS = 4
+
+// Size of an entry in a spill file: its key, then its value.
+const SPILL_ENTRY_SIZE = 16
+
+// Most spilled entries that a join has held in memory at once.
+var spillPeak int64
+
+// trackPeak raises the given high-water mark to n, if n is higher.
+func trackPeak(peak *int64, n int64) {
+	for {
+		old := atomic.LoadInt64(peak)
+		if n <= old || atomic.CompareAndSwapInt64(peak, old, n) {
+			return
+		}
+	}
+}
+
+// spillFile is a temporary file of entries, keyed on the join key, that are
+// joined outside of the hash tables. Entries are appended, then read back in order.
+type spillFile struct {
+	name string
+	file *os.File
+	w    *bufio.Writer
+	size int64 // Number of entries in the file.
+}
+
+// newSpillFile creates an empty spill file.
+func newSpillFile() (*spillFile, error) {
+	name, err := db.GetTempDB()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	return &spillFile{name: name, file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// add appends an entry to the spill file.
+func (spill *spillFile) add(key int64, value int64) error {
+	var buf [SPILL_ENTRY_SIZE]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(key))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(value))
+	if _, err := spill.w.Write(buf[:]); err != nil {
+		return err
+	}
+	spill.size++
+	return nil
+}
+
+// forEach calls fn on every entry in the spill file, in the order they were
+// added, stopping at the first error.
+func (spill *spillFile) forEach(fn func(key int64, value int64) error) error {
+	if err := spill.w.Flush(); err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(spill.file, 0, spill.size*SPILL_ENTRY_SIZE))
+	var buf [SPILL_ENTRY_SIZE]byte
+	for i := int64(0); i < spill.size; i++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return err
+		}
+		key := int64(binary.LittleEndian.Uint64(buf[:8]))
+		value := int64(binary.LittleEndian.Uint64(buf[8:]))
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove closes the spill file and deletes it.
+func (spill *spillFile) remove() {
+	spill.file.Close()
+	os.Remove(spill.name)
+}
+
+// partition splits the spill file into SPILL_FANOUT spill files by the hash
+// of each entry's key. Each round uses a different hash, so that a partition
+// split in one round is spread out again in the next.
+func (spill *spillFile) partition(round int) ([]*spillFile, error) {
+	parts := make([]*spillFile, SPILL_FANOUT)
+	fail := func(err error) ([]*spillFile, error) {
+		removeSpillFiles(parts)
+		return nil, err
+	}
+	for i := range parts {
+		part, err := newSpillFile()
+		if err != nil {
+			return fail(err)
+		}
+		parts[i] = part
+	}
+	err := spill.forEach(func(key int64, value int64) error {
+		salted := key ^ int64(round+1)*0x5bd1e995
+		return parts[hash.MurmurHasher(salted, SPILL_FANOUT)].add(key, value)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	return parts, nil
+}
+
+// removeSpillFiles removes the given spill files, skipping nil ones.
+func removeSpillFiles(spills []*spillFile) {
+	for _, spill := range spills {
+		if spill != nil {
+			spill.remove()
+		}
+	}
+}
+
+// joinSpilled joins two spill files, holding at most JOIN_MEMORY_BUDGET
+// entries in memory. A pair too large for that is partitioned with another
+// hash round and each partition pair joined in turn. Partitioning can't split
+// up the entries of a single key, so once another round doesn't shrink the
+// pair, or after MAX_SPILL_ROUNDS, it is joined in blocks instead.
+func joinSpilled(
+	ctx context.Context,
+	resultsChan chan EntryPair,
+	left *spillFile,
+	right *spillFile,
+	round int,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+) error {
+	if left.size == 0 || right.size == 0 {
+		return nil
+	}
+	if left.size+right.size <= JOIN_MEMORY_BUDGET || round >= MAX_SPILL_ROUNDS {
+		return blockJoin(ctx, resultsChan, left, right, joinOnLeftKey, joinOnRightKey)
+	}
+	lParts, err := left.partition(round)
+	if err != nil {
+		return err
+	}
+	defer removeSpillFiles(lParts)
+	rParts, err := right.partition(round)
+	if err != nil {
+		return err
+	}
+	defer removeSpillFiles(rParts)
+	for i := range lParts {
+		if lParts[i].size == left.size && rParts[i].size == right.size {
+			// Everything hashed to the same partition, and will again.
+			return blockJoin(ctx, resultsChan, left, right, joinOnLeftKey, joinOnRightKey)
+		}
+	}
+	for i := range lParts {
+		err = joinSpilled(ctx, resultsChan, lParts[i], rParts[i], round+1, joinOnLeftKey, joinOnRightKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockJoin joins two spill files by loading the left one JOIN_MEMORY_BUDGET
+// entries at a time, and scanning the right one for matches to each block.
+func blockJoin(
+	ctx context.Context,
+	resultsChan chan EntryPair,
+	left *spillFile,
+	right *spillFile,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+) error {
+	block := make(map[int64][]int64)
+	loaded := int64(0)
+	probe := func() error {
+		trackPeak(&spillPeak, loaded)
+		err := right.forEach(func(key int64, value int64) error {
+			for _, lValue := range block[key] {
+				pair := joinedPair(key, lValue, key, value, joinOnLeftKey, joinOnRightKey)
+				if err := sendResult(ctx, resultsChan, pair); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		block = make(map[int64][]int64)
+		loaded = 0
+		return err
+	}
+	err := left.forEach(func(key int64, value int64) error {
+		block[key] = append(block[key], value)
+		loaded++
+		if loaded == JOIN_MEMORY_BUDGET {
+			return probe()
+		}
+		return nil
+	})
+	if err != nil || loaded == 0 {
+		return err
+	}
+	return probe()
+}
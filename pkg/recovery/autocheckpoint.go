@@ -0,0 +1,106 @@
+package recovery
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// autoCheckpointer checkpoints the database in the background, once enough
+// records have been logged or enough time has passed.
+type autoCheckpointer struct {
+	every    int           // Number of records after which to checkpoint; 0 to never count.
+	interval time.Duration // Time after which to checkpoint; 0 to never time out.
+	wake     chan struct{} // Signalled when every records have been logged.
+	stop     chan struct{} // Closed to stop the checkpointer.
+	done     chan struct{} // Closed once the checkpointer has stopped.
+	once     sync.Once     // Makes sure stop is only closed once.
+}
+
+// StartAutoCheckpoint starts checkpointing in the background: whenever
+// everyNRecords records have been logged since the last checkpoint, or
+// orInterval has passed with at least one record logged since it. A zero
+// threshold is never hit, but not both. Checkpoints take the manager's lock
+// like any other call, so they never interleave with edits or commits.
+func (rm *RecoveryManager) StartAutoCheckpoint(everyNRecords int, orInterval time.Duration) error {
+	if everyNRecords < 0 || orInterval < 0 || (everyNRecords == 0 && orInterval == 0) {
+		return errors.New("auto checkpoint needs a positive record count or interval")
+	}
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	if rm.autoCheckpoint != nil {
+		return errors.New("auto checkpoint already running")
+	}
+	ac := &autoCheckpointer{
+		every:    everyNRecords,
+		interval: orInterval,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	rm.autoCheckpoint = ac
+	go rm.runAutoCheckpoint(ac)
+	// Catch up on records that are already logged.
+	rm.notifyAutoCheckpoint()
+	return nil
+}
+
+// StopAutoCheckpoint stops checkpointing in the background, and waits for a
+// checkpoint that is underway to finish. Does nothing if it isn't running.
+func (rm *RecoveryManager) StopAutoCheckpoint() {
+	rm.mtx.Lock()
+	ac := rm.autoCheckpoint
+	rm.autoCheckpoint = nil
+	rm.mtx.Unlock()
+	if ac == nil {
+		return
+	}
+	ac.once.Do(func() { close(ac.stop) })
+	<-ac.done
+}
+
+// runAutoCheckpoint checkpoints each time the checkpointer is woken up or its
+// interval passes, until it is stopped.
+func (rm *RecoveryManager) runAutoCheckpoint(ac *autoCheckpointer) {
+	defer close(ac.done)
+	var tick <-chan time.Time
+	if ac.interval > 0 {
+		ticker := time.NewTicker(ac.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ac.stop:
+			return
+		case <-ac.wake:
+			if rm.recordsSinceCheckpoint() >= ac.every {
+				rm.Checkpoint()
+			}
+		case <-tick:
+			if rm.recordsSinceCheckpoint() > 0 {
+				rm.Checkpoint()
+			}
+		}
+	}
+}
+
+// recordsSinceCheckpoint returns how many records were logged since the last checkpoint.
+func (rm *RecoveryManager) recordsSinceCheckpoint() int {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return rm.records
+}
+
+// notifyAutoCheckpoint wakes the checkpointer up if enough records have been
+// logged since the last checkpoint. Expects rm.mtx to be locked
+func (rm *RecoveryManager) notifyAutoCheckpoint() {
+	ac := rm.autoCheckpoint
+	if ac == nil || ac.every == 0 || rm.records < ac.every {
+		return
+	}
+	select {
+	case ac.wake <- struct{}{}:
+	default:
+	}
+}
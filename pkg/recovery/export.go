@@ -0,0 +1,93 @@
+package recovery
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// ExportSnapshot writes every table's entries to w as CSV rows of table,
+// key and value, ordered by table name and then by key. Rather than scanning
+// the live tables while they are written to, which would mix entries from
+// before and after concurrent writes, it takes a checkpoint and exports the
+// copy of the database that the checkpoint made in the recovery folder. The
+// export is then the state of the tables at that checkpoint, and writers are
+// only held up for the checkpoint itself. Like recovery's, that state includes
+// the writes of transactions that were running at the checkpoint. Another
+// checkpoint waits for the export to finish before replacing the copy. Hash
+// tables keep their directory outside of the database folder, so the copy
+// doesn't have one of its own, and a database with any can't be exported.
+func (rm *RecoveryManager) ExportSnapshot(w io.Writer) error {
+	rm.writeMtx.Lock()
+	rm.mtx.Lock()
+	err := rm.checkpoint()
+	if err == nil {
+		rm.snapshotMtx.RLock()
+	}
+	rm.mtx.Unlock()
+	rm.writeMtx.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot checkpoint the database to export: %w", err)
+	}
+	defer rm.snapshotMtx.RUnlock()
+	recoveryFolder := strings.TrimSuffix(rm.d.GetBasePath(), "/") + "-recovery"
+	return exportFolder(recoveryFolder, w)
+}
+
+// exportFolder writes the entries of each table in the given database folder to w as CSV.
+func exportFolder(folder string, w io.Writer) error {
+	snapshot, err := db.OpenReadOnly(folder)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	// ReadDir sorts the files by name.
+	names := make([]string, 0)
+	for _, file := range files {
+		if file.IsDir() || !tableFileExp.MatchString(file.Name()) {
+			continue
+		}
+		schema, err := utils.ReadSchema(filepath.Join(folder, file.Name()), "btree")
+		if err != nil {
+			return err
+		}
+		if schema.IndexType == "hash" {
+			return fmt.Errorf("cannot export hash table %s from a snapshot, since its directory isn't in it", file.Name())
+		}
+		names = append(names, file.Name())
+	}
+	out := csv.NewWriter(w)
+	for _, name := range names {
+		table, err := snapshot.GetTable(name)
+		if err != nil {
+			return fmt.Errorf("cannot open table %s in the snapshot: %w", name, err)
+		}
+		entries, err := table.Select()
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			row := []string{
+				name,
+				strconv.FormatInt(entry.GetKey(), 10),
+				strconv.FormatInt(entry.GetValue(), 10),
+			}
+			if err = out.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 
+	utils "github.com/brown-csci1270/db/pkg/utils"
+
 	uuid "github.com/google/uuid"
 )
 
@@ -19,11 +21,21 @@ import (
    START log -- start of a transaction:
    < Tx start >
 
+   PREPARE log -- a transaction is ready to commit:
+   < Tx prepare >
+
    COMMIT log -- end of a transaction:
    < Tx commit >
 
+   TABLE log -- creation of a table, with its key and value names:
+   < create btree|hash table name keyname valuename >
+
    CHECKPOINT log -- lists the currently running transactions:
    < Tx1, Tx2... checkpoint >
+
+   RECOVER log -- recovery is about to undo the unfinished transactions, so
+   the edits after it undo edits before it:
+   < recover >
 */
 
 // A log.
@@ -40,22 +52,35 @@ const (
 	DELETE_ACTION = "DELETE"
 )
 
+// Regular expressions matching each kind of textual log; compiled once, since
+// recovery parses every line of the log.
+var (
+	tableExp      = regexp.MustCompile(fmt.Sprintf("< create (?P<tblType>\\w+) table (?P<tblName>\\w+)(?: (?P<keyName>\\w+) (?P<valueName>\\w+))? >"))
+	editExp       = regexp.MustCompile(fmt.Sprintf("< (?P<uuid>%s), (?P<table>\\w+), (?P<action>UPDATE|INSERT|DELETE), (?P<key>\\d+), (?P<oldval>\\d+), (?P<newval>\\d+) >", uuidPattern))
+	startExp      = regexp.MustCompile(fmt.Sprintf("< (%s) start >", uuidPattern))
+	prepareExp    = regexp.MustCompile(fmt.Sprintf("< (%s) prepare >", uuidPattern))
+	commitExp     = regexp.MustCompile(fmt.Sprintf("< (%s) commit >", uuidPattern))
+	checkpointExp = regexp.MustCompile(fmt.Sprintf("< (%s,?\\s)*checkpoint >", uuidPattern))
+	recoverExp    = regexp.MustCompile("< recover >")
+	uuidExp       = regexp.MustCompile(uuidPattern)
+)
+
 // Convert a textual log to its respective struct.
 func FromString(s string) (Log, error) {
-	tableExp, _ := regexp.Compile(fmt.Sprintf("< create (?P<tblType>\\w+) table (?P<tblName>\\w+) >"))
-	editExp, _ := regexp.Compile(fmt.Sprintf("< (?P<uuid>%s), (?P<table>\\w+), (?P<action>UPDATE|INSERT|DELETE), (?P<key>\\d+), (?P<oldval>\\d+), (?P<newval>\\d+) >", uuidPattern))
-	startExp, _ := regexp.Compile(fmt.Sprintf("< (%s) start >", uuidPattern))
-	commitExp, _ := regexp.Compile(fmt.Sprintf("< (%s) commit >", uuidPattern))
-	checkpointExp, _ := regexp.Compile(fmt.Sprintf("< (%s,?\\s)*checkpoint >", uuidPattern))
-	uuidExp, _ := regexp.Compile(uuidPattern)
 	switch {
 	case tableExp.MatchString(s):
 		expStrs := tableExp.FindStringSubmatch(s)
 		tblType := expStrs[1]
 		tblName := expStrs[2]
-		return &tableLog{
+		// Logs written before schemas were logged have no column names.
+		schema := utils.DefaultSchema(tblType)
+		if expStrs[3] != "" {
+			schema.KeyName, schema.ValueName = expStrs[3], expStrs[4]
+		}
+		return &TableLog{
 			tblType: tblType,
 			tblName: tblName,
+			schema:  schema,
 		}, nil
 	case editExp.MatchString(s):
 		expStrs := editExp.FindStringSubmatch(s)
@@ -63,7 +88,7 @@ func FromString(s string) (Log, error) {
 		key, _ := strconv.Atoi(expStrs[4])
 		oldval, _ := strconv.Atoi(expStrs[5])
 		newval, _ := strconv.Atoi(expStrs[6])
-		return &editLog{
+		return &EditLog{
 			id:        uuid,
 			tablename: expStrs[2],
 			action:    Action(expStrs[3]),
@@ -73,17 +98,22 @@ func FromString(s string) (Log, error) {
 		}, nil
 	case startExp.MatchString(s):
 		uuid := uuid.MustParse(uuidExp.FindString(s))
-		return &startLog{id: uuid}, nil
+		return &StartLog{id: uuid}, nil
+	case prepareExp.MatchString(s):
+		uuid := uuid.MustParse(uuidExp.FindString(s))
+		return &PrepareLog{id: uuid}, nil
 	case commitExp.MatchString(s):
 		uuid := uuid.MustParse(uuidExp.FindString(s))
-		return &commitLog{id: uuid}, nil
+		return &CommitLog{id: uuid}, nil
 	case checkpointExp.MatchString(s):
 		uuidStrs := uuidExp.FindAllString(s, -1)
 		uuids := make([]uuid.UUID, 0)
 		for _, uuidStr := range uuidStrs {
 			uuids = append(uuids, uuid.MustParse(uuidStr))
 		}
-		return &checkpointLog{ids: uuids}, nil
+		return &CheckpointLog{ids: uuids}, nil
+	case recoverExp.MatchString(s):
+		return &RecoverLog{}, nil
 	default:
 		return nil, errors.New("could not parse log")
 	}
@@ -92,17 +122,33 @@ func FromString(s string) (Log, error) {
 var uuidPattern string = "[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}"
 
 // Log for a transaction edit.
-type tableLog struct {
+type TableLog struct {
 	tblType string
 	tblName string
+	schema  utils.Schema
 }
 
-func (tl *tableLog) toString() string {
-	return fmt.Sprintf("< create %s table %s >\n", tl.tblType, tl.tblName)
+func (tl *TableLog) toString() string {
+	return fmt.Sprintf("< create %s table %s %s %s >\n", tl.tblType, tl.tblName, tl.schema.KeyName, tl.schema.ValueName)
+}
+
+// Get the type of the created table.
+func (tl *TableLog) GetTableType() string {
+	return tl.tblType
+}
+
+// Get the name of the created table.
+func (tl *TableLog) GetTableName() string {
+	return tl.tblName
+}
+
+// Get the schema of the created table.
+func (tl *TableLog) GetSchema() utils.Schema {
+	return tl.schema
 }
 
 // Log for a transaction edit.
-type editLog struct {
+type EditLog struct {
 	id        uuid.UUID
 	tablename string
 	action    Action
@@ -111,34 +157,88 @@ type editLog struct {
 	newval    int64
 }
 
-func (el *editLog) toString() string {
+func (el *EditLog) toString() string {
 	return fmt.Sprintf("< %s, %s, %s, %v, %v, %v >\n", el.id.String(), el.tablename, el.action, el.key, el.oldval, el.newval)
 }
 
+// Get the id of the transaction that made the edit.
+func (el *EditLog) GetClientID() uuid.UUID {
+	return el.id
+}
+
+// Get the name of the edited table.
+func (el *EditLog) GetTableName() string {
+	return el.tablename
+}
+
+// Get the edit's action.
+func (el *EditLog) GetAction() Action {
+	return el.action
+}
+
+// Get the edited key.
+func (el *EditLog) GetKey() int64 {
+	return el.key
+}
+
+// Get the value before the edit.
+func (el *EditLog) GetOldValue() int64 {
+	return el.oldval
+}
+
+// Get the value after the edit.
+func (el *EditLog) GetNewValue() int64 {
+	return el.newval
+}
+
 // Log for a transaction start.
-type startLog struct {
+type StartLog struct {
 	id uuid.UUID
 }
 
-func (sl *startLog) toString() string {
+func (sl *StartLog) toString() string {
 	return fmt.Sprintf("< %s start >\n", sl.id.String())
 }
 
+// Get the id of the started transaction.
+func (sl *StartLog) GetClientID() uuid.UUID {
+	return sl.id
+}
+
+// Log for a transaction prepare.
+type PrepareLog struct {
+	id uuid.UUID
+}
+
+func (pl *PrepareLog) toString() string {
+	return fmt.Sprintf("< %s prepare >\n", pl.id.String())
+}
+
+// Get the id of the prepared transaction.
+func (pl *PrepareLog) GetClientID() uuid.UUID {
+	return pl.id
+}
+
 // Log for a transaction commit.
-type commitLog struct {
+type CommitLog struct {
 	id uuid.UUID
 }
 
-func (cl *commitLog) toString() string {
+func (cl *CommitLog) toString() string {
 	return fmt.Sprintf("< %s commit >\n", cl.id.String())
 }
 
+// Get the id of the committed transaction.
+func (cl *CommitLog) GetClientID() uuid.UUID {
+	return cl.id
+}
+
 // Log for a transcation checkpoint.
-type checkpointLog struct {
+type CheckpointLog struct {
 	ids []uuid.UUID
 }
 
-func (cl *checkpointLog) toString() string {
+func (cl *CheckpointLog) toString() string {
 	idStrings := make([]string, 0)
 	for _, id := range cl.ids {
 		idStrings = append(idStrings, id.String())
@@ -148,3 +248,15 @@ func (cl *checkpointLog) toString() string {
 	}
 	return fmt.Sprintf("< %s checkpoint >\n", strings.Join(idStrings, ", "))
 }
+
+// Get the ids of the transactions running at the checkpoint.
+func (cl *CheckpointLog) GetClientIDs() []uuid.UUID {
+	return cl.ids
+}
+
+// Log for the start of recovery's undo pass.
+type RecoverLog struct{}
+
+func (rl *RecoverLog) toString() string {
+	return "< recover >\n"
+}
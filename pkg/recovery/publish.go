@@ -0,0 +1,34 @@
+package recovery
+
+import (
+	"io"
+	"strings"
+)
+
+// SetSubscriber registers w to be sent the log records that a follower needs
+// to replay the database: each table record once it is written, and each
+// transaction's records, from its start to its commit, once its commit record
+// is durable. Transactions are sent whole, in the order they commit, and
+// rolled back transactions aren't sent. Records are sent in the log's textual
+// form, one per line. If writing to w fails, it is unregistered, since
+// anything it were sent after that would follow a gap. A nil w unregisters
+// the current subscriber.
+func (rm *RecoveryManager) SetSubscriber(w io.Writer) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.subscriber = w
+}
+
+// publish sends the given records to the subscriber, if there is one. Expects rm.mtx to be locked
+func (rm *RecoveryManager) publish(logs ...Log) {
+	if rm.subscriber == nil {
+		return
+	}
+	var sb strings.Builder
+	for _, l := range logs {
+		sb.WriteString(l.toString())
+	}
+	if _, err := io.WriteString(rm.subscriber, sb.String()); err != nil {
+		rm.subscriber = nil
+	}
+}
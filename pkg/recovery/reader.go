@@ -1,44 +1,98 @@
 package recovery
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"os"
 
 	uuid "github.com/google/uuid"
 	backscanner "github.com/icza/backscanner"
 )
 
+// LogReader iterates over the records of a log file, oldest first.
+// It doesn't need a running database, so it can be used to inspect logs offline.
+type LogReader struct {
+	fd      *os.File
+	scanner *bufio.Scanner
+}
+
+// OpenLogReader opens the log file at the given path for reading.
+func OpenLogReader(path string) (*LogReader, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &LogReader{fd: fd, scanner: bufio.NewScanner(fd)}, nil
+}
+
+// Next returns the next record in the log, or io.EOF once all records have been read.
+func (lr *LogReader) Next() (Log, error) {
+	for lr.scanner.Scan() {
+		line := lr.scanner.Bytes()
+		// Skip blank lines.
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		return FromString(string(line))
+	}
+	if err := lr.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close closes the underlying log file.
+func (lr *LogReader) Close() error {
+	return lr.fd.Close()
+}
+
 func (rm *RecoveryManager) getRelevantStrings() (
 	relevantStrings []string, checkpointPos int, err error) {
-	fstats, err := rm.fd.Stat()
+	rm.mtx.Lock()
+	sr, err := rm.openSegments()
+	rm.mtx.Unlock()
 	if err != nil {
 		return nil, 0, err
 	}
+	defer sr.Close()
+	relevantStrings, checkpointPos, _, err = scanRelevantStrings(sr)
+	return relevantStrings, checkpointPos, err
+}
 
-	scanner := backscanner.New(rm.fd, int(fstats.Size()))
+// scanRelevantStrings scans the log backwards until the last checkpoint and the
+// start of every transaction it lists as running, and returns the lines it read,
+// oldest first. startPos is the offset of the earliest of those lines, or 0 if
+// the scan reached the start of the log.
+func scanRelevantStrings(sr *segmentReader) (
+	relevantStrings []string, checkpointPos int, startPos int64, err error) {
+	scanner := backscanner.New(sr, int(sr.Size()))
 	checkpointTarget := []byte("checkpoint")
 	startTarget := []byte("start")
 	relevantStrings = make([]string, 0)
 	checkpointHit := false
 	txs := make(map[uuid.UUID]bool)
 	for {
-		line, _, err := scanner.LineBytes()
+		line, pos, err := scanner.LineBytes()
 		if err != nil {
 			if err == io.EOF {
-				return relevantStrings, 0, nil
+				reverseStrings(relevantStrings)
+				return relevantStrings, 0, 0, nil
 			} else {
-				return nil, 0, err
+				return nil, 0, 0, err
 			}
 		}
-		relevantStrings = append([]string{string(line)}, relevantStrings...)
+		relevantStrings = append(relevantStrings, string(line))
 		checkpointPos += 1
+		startPos = int64(pos)
 		if checkpointHit {
 			if bytes.Contains(line, startTarget) {
 				log, err := FromString(string(line))
 				if err != nil {
-					return nil, 0, err
+					return nil, 0, 0, err
 				}
-				id := log.(*startLog).id
+				id := log.(*StartLog).id
 				delete(txs, id)
 			}
 		}
@@ -46,9 +100,9 @@ func (rm *RecoveryManager) getRelevantStrings() (
 			checkpointHit = true
 			log, err := FromString(string(line))
 			if err != nil {
-				return nil, 0, err
+				return nil, 0, 0, err
 			}
-			for _, tx := range log.(*checkpointLog).ids {
+			for _, tx := range log.(*CheckpointLog).ids {
 				txs[tx] = true
 			}
 			checkpointPos = 0
@@ -57,7 +111,62 @@ func (rm *RecoveryManager) getRelevantStrings() (
 			break
 		}
 	}
-	return relevantStrings, checkpointPos, err
+	reverseStrings(relevantStrings)
+	return relevantStrings, checkpointPos, startPos, err
+}
+
+// reverseStrings reverses a slice of strings in place.
+func reverseStrings(strs []string) {
+	for i, j := 0, len(strs)-1; i < j; i, j = i+1, j-1 {
+		strs[i], strs[j] = strs[j], strs[i]
+	}
+}
+
+// readTxLogs scans the log backwards and returns the given transaction's
+// start log followed by its edit logs, in the order they were written.
+// Errors if the transaction's start log could not be found.
+// Expects rm.mtx to be locked
+func (rm *RecoveryManager) readTxLogs(clientId uuid.UUID) (logs []Log, err error) {
+	sr, err := rm.openSegments()
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+	scanner := backscanner.New(sr, int(sr.Size()))
+	idTarget := []byte(clientId.String())
+	logs = make([]Log, 0)
+	for {
+		line, _, err := scanner.LineBytes()
+		if err != nil {
+			if err == io.EOF {
+				return nil, fmt.Errorf("no start log for transaction %v", clientId)
+			}
+			return nil, err
+		}
+		// Skip lines that don't concern this transaction.
+		if !bytes.Contains(line, idTarget) {
+			continue
+		}
+		log, err := FromString(string(line))
+		if err != nil {
+			return nil, err
+		}
+		switch log := log.(type) {
+		case *EditLog:
+			if log.id == clientId {
+				logs = append(logs, log)
+			}
+		case *StartLog:
+			if log.id == clientId {
+				// The logs were read newest first.
+				logs = append(logs, log)
+				for i, j := 0, len(logs)-1; i < j; i, j = i+1, j-1 {
+					logs[i], logs[j] = logs[j], logs[i]
+				}
+				return logs, nil
+			}
+		}
+	}
 }
 
 func (rm *RecoveryManager) readLogs() (
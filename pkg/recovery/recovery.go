@@ -1,26 +1,57 @@
 package recovery
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
 	db "github.com/brown-csci1270/db/pkg/db"
+	utils "github.com/brown-csci1270/db/pkg/utils"
 	"github.com/otiai10/copy"
 
 	uuid "github.com/google/uuid"
 )
 
+// Default size after which the log rolls over to a new segment.
+const DEFAULT_SEGMENT_SIZE int64 = 1 << 24
+
 // RecoveryManager Recovery Manager.
 type RecoveryManager struct {
 	d       *db.Database
 	tm      *concurrency.TransactionManager
 	txStack map[uuid.UUID]([]Log)
-	fd      *os.File
+	fd      *os.File // The current log segment.
 	mtx     sync.Mutex
+
+	logName      string // Name of the log, and of its first segment.
+	segments     []int  // Numbers of the log's segments, oldest first.
+	segmentSize  int64  // Size after which the log rolls over to a new segment.
+	segmentBytes int64  // Size of the current segment.
+	lsn          int64  // Bytes written to the log by this manager; the LSN of its last record.
+	durableLSN   int64  // LSN up to which the log has been synced.
+
+	logMtx sync.Mutex // Guards logBuf and writes to fd. Nothing else is locked while it is held.
+	logBuf []byte     // Records written to the log, but not yet to its file.
+
+	incremental bool                        // Whether Delta only copies changed tables.
+	changed     map[string]bool             // Tables written to since the last checkpoint.
+	copier      func(src, dst string) error // Copies a file or folder into the recovery folder.
+
+	subscriber io.Writer // Sent each committed transaction's records, if set.
+
+	records        int               // Records logged since the last checkpoint.
+	autoCheckpoint *autoCheckpointer // Checkpoints in the background, if started with StartAutoCheckpoint.
+
+	writeMtx    sync.RWMutex // Held for reading while tables are written to, and for writing by checkpoints.
+	snapshotMtx sync.RWMutex // Held for reading while a snapshot export reads the recovery folder.
 }
 
 // NewRecoveryManager Construct a recovery manager.
@@ -29,36 +60,134 @@ func NewRecoveryManager(
 	tm *concurrency.TransactionManager,
 	logName string,
 ) (*RecoveryManager, error) {
-	fd, err := os.OpenFile(logName, os.O_APPEND|os.O_RDWR, 0666)
+	// Keep appending to the latest segment.
+	segments, err := findSegments(logName)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(segmentName(logName, segments[len(segments)-1]), os.O_APPEND|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fstats, err := fd.Stat()
 	if err != nil {
+		fd.Close()
 		return nil, err
 	}
 	return &RecoveryManager{
-		d:       d,
-		tm:      tm,
-		txStack: make(map[uuid.UUID][]Log),
-		fd:      fd,
+		d:            d,
+		tm:           tm,
+		txStack:      make(map[uuid.UUID][]Log),
+		fd:           fd,
+		logName:      logName,
+		segments:     segments,
+		segmentSize:  DEFAULT_SEGMENT_SIZE,
+		segmentBytes: fstats.Size(),
+		changed:      make(map[string]bool),
+		copier:       func(src, dst string) error { return copy.Copy(src, dst) },
 	}, nil
 }
 
-// Write the string `s` to the log file. Expects rm.mtx to be locked
+// SetIncremental sets whether checkpoints only copy the tables that changed
+// since the last checkpoint into the recovery folder, instead of the whole database.
+func (rm *RecoveryManager) SetIncremental(incremental bool) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.incremental = incremental
+}
+
+// SetCopier sets the function used to copy data into the recovery folder.
+func (rm *RecoveryManager) SetCopier(copier func(src, dst string) error) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.copier = copier
+}
+
+// Write the string `s` to the log's buffer, rolling over to a new segment once
+// the current one is full. The buffer reaches the file when the log is flushed:
+// before a page the record describes is written, or by writeDurably.
+// Expects rm.mtx to be locked
 func (rm *RecoveryManager) writeToBuffer(s string) error {
-	_, err := rm.fd.WriteString(s)
+	rm.logMtx.Lock()
+	rm.logBuf = append(rm.logBuf, s...)
+	atomic.AddInt64(&rm.lsn, int64(len(s)))
+	rm.logMtx.Unlock()
+	rm.segmentBytes += int64(len(s))
+	rm.records++
+	rm.notifyAutoCheckpoint()
+	if rm.segmentSize > 0 && rm.segmentBytes >= rm.segmentSize {
+		return rm.rotate()
+	}
+	return nil
+}
+
+// writeDurably writes the string `s` to the log, and only returns once it is
+// on disk. Expects rm.mtx to be locked
+func (rm *RecoveryManager) writeDurably(s string) error {
+	if err := rm.writeToBuffer(s); err != nil {
+		return err
+	}
+	return rm.FlushLog(rm.LastLSN())
+}
+
+// flushBuffer writes the buffered records to the log file and syncs it.
+// Records that couldn't be written stay buffered. Expects rm.logMtx to be locked
+func (rm *RecoveryManager) flushBuffer() error {
+	lsn := atomic.LoadInt64(&rm.lsn)
+	n, err := rm.fd.Write(rm.logBuf)
+	rm.logBuf = append(rm.logBuf[:0], rm.logBuf[n:]...)
 	if err != nil {
 		return err
 	}
-	err = rm.fd.Sync()
-	return err
+	if err = rm.fd.Sync(); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&rm.durableLSN, lsn)
+	return nil
 }
 
-// Table Write a table log.
+// LastLSN returns the LSN of the last record written to the log. LSNs count
+// the bytes this manager has written, so they only order records written
+// since it was constructed; pages don't keep their LSNs across restarts.
+func (rm *RecoveryManager) LastLSN() int64 {
+	return atomic.LoadInt64(&rm.lsn)
+}
+
+// DurableLSN returns the LSN up to which the log has been synced.
+func (rm *RecoveryManager) DurableLSN() int64 {
+	return atomic.LoadInt64(&rm.durableLSN)
+}
+
+// FlushLog writes the buffered records to the log file and syncs it, if the
+// log isn't already durable up to the given LSN. It only takes rm.logMtx, so
+// pagers can call it while holding their own locks.
+func (rm *RecoveryManager) FlushLog(lsn int64) error {
+	if lsn <= rm.DurableLSN() {
+		return nil
+	}
+	rm.logMtx.Lock()
+	defer rm.logMtx.Unlock()
+	if lsn <= rm.DurableLSN() {
+		return nil
+	}
+	return rm.flushBuffer()
+}
+
+// Table Write a table log, for a table with the default schema.
 func (rm *RecoveryManager) Table(tblType string, tblName string) {
+	rm.TableWithSchema(tblName, utils.DefaultSchema(tblType))
+}
+
+// TableWithSchema Write a table log, for a table with the given schema.
+func (rm *RecoveryManager) TableWithSchema(tblName string, schema utils.Schema) {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
 
 	// write the log using the manager
-	l := tableLog{tblType: tblType, tblName: tblName}
-	_ = rm.writeToBuffer(l.toString())
+	l := TableLog{tblType: schema.IndexType, tblName: tblName, schema: schema}
+	if err := rm.writeDurably(l.toString()); err == nil {
+		rm.publish(&l)
+	}
 }
 
 // Edit Write an edit log.
@@ -67,7 +196,7 @@ func (rm *RecoveryManager) Edit(clientId uuid.UUID, table db.Index, action Actio
 	defer rm.mtx.Unlock()
 
 	// make and log
-	l := editLog{
+	l := EditLog{
 		id:        clientId,
 		tablename: table.GetName(),
 		action:    action,
@@ -76,6 +205,11 @@ func (rm *RecoveryManager) Edit(clientId uuid.UUID, table db.Index, action Actio
 		newval:    newval,
 	}
 
+	// the table's pages must not reach disk before this log does
+	if table.GetPager().GetLogFlusher() == nil {
+		table.GetPager().SetLogFlusher(rm)
+	}
+
 	// append the log to the corresponding array
 	_, ok := rm.txStack[clientId]
 	if ok {
@@ -92,7 +226,7 @@ func (rm *RecoveryManager) Start(clientId uuid.UUID) {
 	defer rm.mtx.Unlock()
 
 	// make the log
-	l := startLog{id: clientId}
+	l := StartLog{id: clientId}
 
 	// make the log array and add to txStack
 	var logs []Log
@@ -101,25 +235,54 @@ func (rm *RecoveryManager) Start(clientId uuid.UUID) {
 	_ = rm.writeToBuffer(l.toString())
 }
 
+// Prepare Write a transaction prepare log.
+// Once a transaction is prepared, it can still be finalized with Commit or
+// aborted with Rollback; if we crash before either, recovery commits it.
+func (rm *RecoveryManager) Prepare(clientId uuid.UUID) error {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+
+	// only running transactions can be prepared
+	if _, ok := rm.txStack[clientId]; !ok {
+		return errors.New("no running transaction to prepare")
+	}
+
+	// make the log, and make sure it hits the disk
+	l := PrepareLog{id: clientId}
+	return rm.writeDurably(l.toString())
+}
+
 // Commit Write a transaction commit log.
 func (rm *RecoveryManager) Commit(clientId uuid.UUID) {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
 
 	// make the log
-	l := commitLog{id: clientId}
+	l := CommitLog{id: clientId}
 
 	// delete the log array from txStack
+	logs, running := rm.txStack[clientId]
 	delete(rm.txStack, clientId)
 
-	_ = rm.writeToBuffer(l.toString())
+	// the transaction is only sent on once its commit is durable
+	if err := rm.writeDurably(l.toString()); err == nil && running {
+		rm.publish(append(logs, &l)...)
+	}
 }
 
 // Checkpoint Flush all pages to disk and write a checkpoint log.
 func (rm *RecoveryManager) Checkpoint() {
+	rm.writeMtx.Lock()
+	defer rm.writeMtx.Unlock()
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
+	_ = rm.checkpoint()
+}
 
+// checkpoint flushes all pages, logs a checkpoint and copies the database to
+// the recovery folder, returning whether the copy failed. Expects rm.writeMtx
+// and rm.mtx to be locked, so that no write to a table is halfway done.
+func (rm *RecoveryManager) checkpoint() error {
 	// make the log
 	allUUIDs := make([]uuid.UUID, 0)
 	for id, _ := range rm.txStack {
@@ -127,53 +290,97 @@ func (rm *RecoveryManager) Checkpoint() {
 	}
 
 	// write the log to the disk
-	l := checkpointLog{ids: allUUIDs}
+	l := CheckpointLog{ids: allUUIDs}
 
-	// flush all the tables
+	// flush all the tables, noting which ones were written to. The log is
+	// flushed first, so that the pages don't each wait on it. Updates stay
+	// blocked until the tables are copied, so that the copy is of them all
+	// at this point, rather than of pages written after their flush.
+	flushErr := rm.FlushLog(rm.LastLSN())
 	tables := rm.d.GetTables()
 	for _, table := range tables {
+		if c, ok := table.(db.Checkpointer); ok {
+			if err := c.Checkpoint(); err != nil && flushErr == nil {
+				flushErr = err
+			}
+		}
+	}
+	for name, table := range tables {
 		table.GetPager().LockAllUpdates()
-		table.GetPager().FlushAllPages()
+		if err := table.GetPager().FlushAllPages(); err != nil && flushErr == nil {
+			flushErr = err
+		}
+		if table.GetPager().ResetWritten() {
+			rm.changed[name] = true
+		}
+	}
+
+	// a page that couldn't be flushed may still need the log before this point
+	if flushErr != nil {
+		for _, table := range tables {
+			table.GetPager().UnlockAllUpdates()
+		}
+		return flushErr
+	}
+	_ = rm.writeDurably(l.toString())
+	rm.records = 0
+
+	// Sorta-semi-pseudo-copy-on-write (to ensure db recoverability). The copy
+	// waits for any snapshot export still reading the previous one.
+	rm.snapshotMtx.Lock()
+	err := rm.Delta()
+	rm.snapshotMtx.Unlock()
+	for _, table := range tables {
 		table.GetPager().UnlockAllUpdates()
 	}
 
-	_ = rm.writeToBuffer(l.toString())
+	// the segments before the checkpoint are no longer needed
+	_, _ = rm.compact()
+	return err
+}
 
-	rm.Delta() // Sorta-semi-pseudo-copy-on-write (to ensure db recoverability)
+// holdCheckpoints runs write, which writes to tables, without letting a
+// checkpoint start until it is done, so that none copies a table halfway
+// through a write, such as with a node split in two. It must not wait on a
+// lock held by another transaction, since that would hold off checkpoints too.
+func (rm *RecoveryManager) holdCheckpoints(write func() error) error {
+	rm.writeMtx.RLock()
+	defer rm.writeMtx.RUnlock()
+	return write()
 }
 
 // Redo a given log's action.
 func (rm *RecoveryManager) Redo(log Log) error {
 	switch log := log.(type) {
-	case *tableLog:
-		payload := fmt.Sprintf("create %s table %s", log.tblType, log.tblName)
+	case *TableLog:
+		payload := fmt.Sprintf("create %s table %s %s %s", log.tblType, log.tblName, log.schema.KeyName, log.schema.ValueName)
 		err := db.HandleCreateTable(rm.d, payload, os.Stdout)
 		if err != nil {
 			return err
 		}
-	case *editLog:
+	case *EditLog:
 		switch log.action {
 		case INSERT_ACTION:
 			payload := fmt.Sprintf("insert %v %v into %s", log.key, log.newval, log.tablename)
 			err := db.HandleInsert(rm.d, payload)
-			if err != nil {
+			if errors.Is(err, utils.ErrKeyExists) {
 				// There is already an entry, try updating
 				payload := fmt.Sprintf("update %s %v %v", log.tablename, log.key, log.newval)
 				err = db.HandleUpdate(rm.d, payload)
-				if err != nil {
-					return err
-				}
+			}
+			if err != nil {
+				return err
 			}
 		case UPDATE_ACTION:
 			payload := fmt.Sprintf("update %s %v %v", log.tablename, log.key, log.newval)
 			err := db.HandleUpdate(rm.d, payload)
-			if err != nil {
+			if errors.Is(err, utils.ErrUpdateMissing) {
 				// Entry may have been deleted, try inserting
 				payload := fmt.Sprintf("insert %v %v into %s", log.key, log.newval, log.tablename)
-				err := db.HandleInsert(rm.d, payload)
-				if err != nil {
-					return err
-				}
+				err = db.HandleInsert(rm.d, payload)
+			}
+			if err != nil {
+				return err
 			}
 		case DELETE_ACTION:
 			payload := fmt.Sprintf("delete %v from %s", log.key, log.tablename)
@@ -188,10 +395,45 @@ func (rm *RecoveryManager) Redo(log Log) error {
 	return nil
 }
 
+// Redo a batch of edit logs that all target the same table, applying them
+// directly to the index. Has the same effect as calling Redo on each log.
+func (rm *RecoveryManager) redoBatch(logs []*EditLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	table, err := rm.d.GetTable(logs[0].tablename)
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		switch log.action {
+		case INSERT_ACTION:
+			// If there is already an entry, update it instead
+			if _, err = table.Find(log.key); err == nil {
+				err = table.Update(log.key, log.newval)
+			} else {
+				err = table.Insert(log.key, log.newval)
+			}
+		case UPDATE_ACTION:
+			// The entry may have been deleted, if so insert it instead
+			err = table.Update(log.key, log.newval)
+			if errors.Is(err, utils.ErrUpdateMissing) {
+				err = table.Insert(log.key, log.newval)
+			}
+		case DELETE_ACTION:
+			err = table.Delete(log.key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Undo a given log's action.
 func (rm *RecoveryManager) Undo(log Log) error {
 	switch log := log.(type) {
-	case *editLog:
+	case *EditLog:
 		switch log.action {
 		case INSERT_ACTION:
 			payload := fmt.Sprintf("delete %v from %s", log.key, log.tablename)
@@ -219,7 +461,22 @@ func (rm *RecoveryManager) Undo(log Log) error {
 }
 
 // Recover Do a full recovery to the most recent checkpoint on startup.
+// Recovery ends with a checkpoint, so running it again finds nothing to do.
+// If recovery itself crashed partway through undoing, the edits it had
+// already undone are not undone twice when it is run again.
 func (rm *RecoveryManager) Recover() error {
+	return rm.RecoverContext(context.Background(), nil)
+}
+
+// RecoverContext is Recover, but it stops once ctx is cancelled, and if
+// progress isn't nil, calls it after each log record it goes through with how
+// many it has gone through out of the total. Records after the checkpoint are
+// gone through once to redo them, and records of unfinished transactions again
+// to undo them. Stopping returns ctx's error, and ends the transactions that
+// recovery began without logging anything for them; since redoing is
+// idempotent and edits that were already undone are skipped, a later Recover
+// picks up where it stopped.
+func (rm *RecoveryManager) RecoverContext(ctx context.Context, progress func(done, total int)) error {
 	logs, checkpointPos, err := rm.readLogs()
 	if err != nil {
 		return err
@@ -229,12 +486,16 @@ func (rm *RecoveryManager) Recover() error {
 	if checkpointPos >= length {
 		return nil
 	}
+	if checkPoint, ok := logs[checkpointPos].(*CheckpointLog); ok && checkpointPos == length-1 && len(checkPoint.ids) == 0 {
+		// nothing happened since the last checkpoint
+		return nil
+	}
 
 	// iterate from the checkpoint to redo all the log
 	// while examining which transaction is still active at crash
 	undoSet := make(map[uuid.UUID]bool)
 	switch checkPoint := logs[checkpointPos].(type) {
-	case *checkpointLog:
+	case *CheckpointLog:
 		// add all current active transactions
 		for _, id := range checkPoint.ids {
 			undoSet[id] = true
@@ -246,35 +507,110 @@ func (rm *RecoveryManager) Recover() error {
 	default:
 	}
 
+	// keep track of which transactions were prepared
+	prepared := make(map[uuid.UUID]bool)
+	for _, l := range logs {
+		if l, ok := l.(*PrepareLog); ok {
+			prepared[l.id] = true
+		}
+	}
+
+	// stopping early ends the transactions begun so far, so that they can be
+	// begun again by a later recovery
+	done, total := 0, undoExtent(logs, checkpointPos, prepared)+length-checkpointPos
+	step := func(n int) {
+		done += n
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+	stop := func() error {
+		for id := range undoSet {
+			rm.tm.Commit(id)
+		}
+		return ctx.Err()
+	}
+
 	// keep track of which transaction has ended
 	for i := checkpointPos; i < length; i += 1 {
+		if ctx.Err() != nil {
+			return stop()
+		}
+		first := i
 		switch l := logs[i].(type) {
-		case *startLog:
+		case *StartLog:
 			// a new active transaction
 			undoSet[l.id] = true
 			err = rm.tm.Begin(l.id)
 			if err != nil {
 				return err
 			}
-		case *editLog:
-			err = rm.Redo(l)
+		case *EditLog:
+			// redo the whole run of consecutive edits to this table at once
+			batch := []*EditLog{l}
+			for i+1 < length {
+				next, ok := logs[i+1].(*EditLog)
+				if !ok || next.tablename != l.tablename {
+					break
+				}
+				batch = append(batch, next)
+				i += 1
+			}
+			err = rm.redoBatch(batch)
 			if err != nil {
 				return err
 			}
-		case *tableLog:
+		case *TableLog:
 			err = rm.Redo(l)
 			if err != nil {
 				return err
 			}
-		case *commitLog:
+		case *CommitLog:
 			// transaction has finished, no need to undo
 			delete(undoSet, l.id)
 			err = rm.tm.Commit(l.id)
 			if err != nil {
 				return err
 			}
-		default:
-			continue
+		}
+		step(i - first + 1)
+	}
+
+	// prepared transactions that never finished are committed
+	for id := range undoSet {
+		if prepared[id] {
+			delete(undoSet, id)
+			rm.Commit(id)
+			err = rm.tm.Commit(id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// a previous recovery that crashed while undoing has already undone some
+	// edits: its edits, after its recover log, undo the latest edits of each
+	// transaction, which must not be undone again
+	undone := make(map[uuid.UUID]int)
+	undoPos := length
+	for i := checkpointPos; i < length; i += 1 {
+		switch l := logs[i].(type) {
+		case *RecoverLog:
+			if undoPos == length {
+				undoPos = i
+			}
+		case *EditLog:
+			if undoPos < i {
+				undone[l.id] += 1
+			}
+		}
+	}
+	if len(undoSet) > 0 {
+		rm.mtx.Lock()
+		err = rm.writeToBuffer((&RecoverLog{}).toString())
+		rm.mtx.Unlock()
+		if err != nil {
+			return err
 		}
 	}
 
@@ -283,9 +619,13 @@ func (rm *RecoveryManager) Recover() error {
 			// no more transaction to undo, break the loop
 			break
 		}
+		if ctx.Err() != nil {
+			return stop()
+		}
+		step(1)
 
 		switch l := logs[i].(type) {
-		case *startLog:
+		case *StartLog:
 			if _, exist := undoSet[l.id]; exist {
 				delete(undoSet, l.id)
 				rm.Commit(l.id)
@@ -294,31 +634,79 @@ func (rm *RecoveryManager) Recover() error {
 					return err
 				}
 			}
-		case *editLog:
-			if _, exist := undoSet[l.id]; exist {
-				err = rm.Undo(l)
-				if err != nil {
-					return err
-				}
+		case *EditLog:
+			if _, exist := undoSet[l.id]; !exist || i > undoPos {
+				continue
+			}
+			if undone[l.id] > 0 {
+				undone[l.id] -= 1
+				continue
+			}
+			err = rm.Undo(l)
+			if err != nil {
+				return err
 			}
 		}
 	}
+
+	// mark recovery as finished
+	rm.Checkpoint()
 	return nil
 }
 
+// undoExtent returns how many records recovery goes back through to undo the
+// transactions that are unfinished at the end of the log: those running at the
+// checkpoint or started after it, which neither committed nor were prepared.
+func undoExtent(logs []Log, checkpointPos int, prepared map[uuid.UUID]bool) int {
+	unfinished := make(map[uuid.UUID]bool)
+	if checkPoint, ok := logs[checkpointPos].(*CheckpointLog); ok {
+		for _, id := range checkPoint.ids {
+			unfinished[id] = true
+		}
+	}
+	for _, l := range logs[checkpointPos:] {
+		switch l := l.(type) {
+		case *StartLog:
+			unfinished[l.id] = true
+		case *CommitLog:
+			delete(unfinished, l.id)
+		}
+	}
+	for id := range prepared {
+		delete(unfinished, id)
+	}
+	if len(unfinished) == 0 {
+		return 0
+	}
+	// undoing stops at the earliest of their start logs
+	for i, l := range logs {
+		if l, ok := l.(*StartLog); ok && unfinished[l.id] {
+			return len(logs) - i
+		}
+	}
+	return len(logs)
+}
+
 // Rollback Roll back a particular transaction.
+// If the in-memory stack doesn't hold the whole transaction, starting with its
+// start log (e.g. after a restart), its logs are recovered by scanning the log
+// file backwards. Errors if the transaction's start log can't be found.
 func (rm *RecoveryManager) Rollback(clientId uuid.UUID) error {
+	rm.mtx.Lock()
 	logs := rm.txStack[clientId]
-
-	if len(logs) == 0 {
-		rm.Commit(clientId)
-		err := rm.tm.Commit(clientId)
-		return err
+	complete := len(logs) > 0
+	if complete {
+		_, complete = logs[0].(*StartLog)
 	}
-
-	if _, ok := logs[0].(*startLog); !ok {
-		return errors.New("transaction does not begin with startLog")
+	if !complete {
+		var err error
+		logs, err = rm.readTxLogs(clientId)
+		if err != nil {
+			rm.mtx.Unlock()
+			return err
+		}
 	}
+	rm.mtx.Unlock()
 
 	for i := len(logs) - 1; i > 0; i -= 1 {
 		err := rm.Undo(logs[i])
@@ -327,10 +715,13 @@ func (rm *RecoveryManager) Rollback(clientId uuid.UUID) error {
 		}
 	}
 
-	// commit the transaction after the rollback
+	// commit the transaction after the rollback, without sending it on, and
+	// abort it in the transaction manager so no buffered writes are applied
+	rm.mtx.Lock()
+	delete(rm.txStack, clientId)
+	rm.mtx.Unlock()
 	rm.Commit(clientId)
-	err := rm.tm.Commit(clientId)
-	return err
+	return rm.holdCheckpoints(func() error { return rm.tm.Abort(clientId) })
 }
 
 // Prime the database for recovery
@@ -364,11 +755,52 @@ func Prime(folder string) (*db.Database, error) {
 }
 
 // Delta should be called at end of Checkpoint.
+// Expects rm.mtx to be locked
 func (rm *RecoveryManager) Delta() error {
 	folder := strings.TrimSuffix(rm.d.GetBasePath(), "/")
 	recoveryFolder := folder + "-recovery/"
 	folder += "/"
+	if rm.incremental {
+		return rm.incrementalDelta(folder, recoveryFolder)
+	}
 	os.RemoveAll(recoveryFolder)
-	err := copy.Copy(folder, recoveryFolder)
+	err := rm.copier(folder, recoveryFolder)
+	rm.changed = make(map[string]bool)
 	return err
 }
+
+// incrementalDelta copies the tables that changed since the last checkpoint,
+// and any other file missing from the recovery folder. Files that aren't
+// tables are always copied, since we can't tell whether they changed.
+func (rm *RecoveryManager) incrementalDelta(folder string, recoveryFolder string) error {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(recoveryFolder, 0775); err != nil {
+		return err
+	}
+	tables := rm.d.GetTables()
+	copied := make([]string, 0)
+	for _, file := range files {
+		name := file.Name()
+		src := filepath.Join(folder, name)
+		dst := filepath.Join(recoveryFolder, name)
+		// A table's schema file is copied along with the table.
+		table := strings.TrimSuffix(name, ".schema")
+		_, isTable := tables[table]
+		_, statErr := os.Stat(dst)
+		if isTable && !rm.changed[table] && statErr == nil {
+			continue
+		}
+		os.RemoveAll(dst)
+		if err = rm.copier(src, dst); err != nil {
+			return err
+		}
+		copied = append(copied, table)
+	}
+	for _, table := range copied {
+		delete(rm.changed, table)
+	}
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	db "github.com/brown-csci1270/db/pkg/db"
 	query "github.com/brown-csci1270/db/pkg/query"
 	repl "github.com/brown-csci1270/db/pkg/repl"
+	utils "github.com/brown-csci1270/db/pkg/utils"
 
 	uuid "github.com/google/uuid"
 )
@@ -20,7 +21,7 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	r := repl.NewRepl()
 	r.AddCommand("create", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCreateTable(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Create a table. usage: create table <table>")
+	}, "Create a table. usage: create <btree|hash> table <table> [<key name> <value name>]")
 	r.AddCommand("find", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleFind(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Find an element. usage: find <key> from <table>")
@@ -38,16 +39,19 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	}, "Select elements from a table. usage: select from <table>")
 	r.AddCommand("join", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleJoin(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Create a table. usage: create table <table>")
+	}, "Join two tables. usage: join <table1> <key/val for table1> on <table2> <key/val for table2>")
 	r.AddCommand("transaction", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleTransaction(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Handle transactions. usage: transaction <begin|commit>")
+	}, "Handle transactions. usage: transaction <begin|prepare|commit>")
 	r.AddCommand("lock", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleLock(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Grabs a write lock on a resource. usage: lock <table> <key>")
 	r.AddCommand("checkpoint", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCheckpoint(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Simulate an abort of the current transaction. usage: abort")
+	r.AddCommand("export", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleExport(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
+	}, "Export a consistent snapshot of every table as CSV rows of table, key and value. usage: export")
 	r.AddCommand("abort", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleAbort(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Simulate an abort of the current transaction. usage: abort")
@@ -64,17 +68,19 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 func HandleTransaction(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: transaction <begin|commit>
-	if numFields != 2 || (fields[1] != "begin" && fields[1] != "commit") {
-		return errors.New("usage: transaction <begin|commit>")
+	// Usage: transaction <begin|prepare|commit>
+	if numFields != 2 || (fields[1] != "begin" && fields[1] != "prepare" && fields[1] != "commit") {
+		return errors.New("usage: transaction <begin|prepare|commit>")
 	}
 	switch fields[1] {
 	case "begin":
 		rm.Start(clientId)
 		err = tm.Begin(clientId)
+	case "prepare":
+		err = rm.Prepare(clientId)
 	case "commit":
 		rm.Commit(clientId)
-		err = tm.Commit(clientId)
+		err = rm.holdCheckpoints(func() error { return tm.Commit(clientId) })
 	default:
 		return errors.New("internal error in create table handler")
 	}
@@ -91,11 +97,18 @@ func HandleTransaction(d *db.Database, tm *concurrency.TransactionManager, rm *R
 func HandleCreateTable(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: create <type> table <table>
-	if numFields != 4 || fields[2] != "table" || (fields[1] != "btree" && fields[1] != "hash") {
-		return fmt.Errorf("usage: create <btree|hash> table <table>")
+	// Usage: create <type> table <table> [<key name> <value name>]
+	if (numFields != 4 && numFields != 6) || fields[2] != "table" || (fields[1] != "btree" && fields[1] != "hash") {
+		return fmt.Errorf("usage: create <btree|hash> table <table> [<key name> <value name>]")
 	}
-	rm.Table(fields[1], fields[3])
+	schema := utils.DefaultSchema(fields[1])
+	if numFields == 6 {
+		schema.KeyName, schema.ValueName = fields[4], fields[5]
+	}
+	if err = schema.Validate(); err != nil {
+		return err
+	}
+	rm.TableWithSchema(fields[3], schema)
 	return db.HandleCreateTable(d, payload, w)
 }
 
@@ -130,8 +143,10 @@ func HandleInsert(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	}
 	// Log.
 	rm.Edit(clientId, table, INSERT_ACTION, int64(key), 0, int64(newval))
-	// Run transaction insert.
-	err = concurrency.HandleInsert(d, tm, payload, clientId)
+	// Run transaction insert, once the key is locked.
+	err = writeKey(tm, rm, table, int64(key), clientId, func() error {
+		return concurrency.HandleInsert(d, tm, payload, clientId)
+	})
 	if err != nil {
 		// Add a log to mark this insert as a no-op.
 		rm.Edit(clientId, table, DELETE_ACTION, int64(key), int64(newval), int64(0))
@@ -147,6 +162,15 @@ func HandleInsert(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	return err
 }
 
+// writeKey write-locks the key, then runs write, which writes to it, holding
+// off checkpoints. The lock is taken first, so that waiting on it doesn't.
+func writeKey(tm *concurrency.TransactionManager, rm *RecoveryManager, table db.Index, key int64, clientId uuid.UUID, write func() error) error {
+	if err := tm.Lock(clientId, table, key, concurrency.W_LOCK); err != nil {
+		return err
+	}
+	return rm.holdCheckpoints(write)
+}
+
 // Handle update.
 func HandleUpdate(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
@@ -173,8 +197,10 @@ func HandleUpdate(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	}
 	// Log.
 	rm.Edit(clientId, table, UPDATE_ACTION, int64(key), oldval.GetValue(), int64(newval))
-	// Run transaction insert.
-	err = concurrency.HandleUpdate(d, tm, payload, clientId)
+	// Run transaction update, once the key is locked.
+	err = writeKey(tm, rm, table, int64(key), clientId, func() error {
+		return concurrency.HandleUpdate(d, tm, payload, clientId)
+	})
 	if err != nil {
 		// Add a log to mark this update as a no-op.
 		rm.Edit(clientId, table, UPDATE_ACTION, int64(key), int64(newval), oldval.GetValue())
@@ -213,8 +239,10 @@ func HandleDelete(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	}
 	// Log.
 	rm.Edit(clientId, table, DELETE_ACTION, int64(key), oldval.GetValue(), 0)
-	// Run transaction insert.
-	err = concurrency.HandleDelete(d, tm, payload, clientId)
+	// Run transaction delete, once the key is locked.
+	err = writeKey(tm, rm, table, int64(key), clientId, func() error {
+		return concurrency.HandleDelete(d, tm, payload, clientId)
+	})
 	if err != nil {
 		// Add a log to mark this delete as a no-op.
 		rm.Edit(clientId, table, INSERT_ACTION, int64(key), 0, oldval.GetValue())
@@ -274,6 +302,17 @@ func HandleCheckpoint(d *db.Database, tm *concurrency.TransactionManager, rm *Re
 	return err
 }
 
+// Handle export.
+func HandleExport(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: export
+	if numFields != 1 {
+		return fmt.Errorf("usage: export")
+	}
+	return rm.ExportSnapshot(w)
+}
+
 // Handle abort.
 func HandleAbort(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
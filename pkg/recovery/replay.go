@@ -0,0 +1,104 @@
+package recovery
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+
+	uuid "github.com/google/uuid"
+)
+
+// ReplayInto rebuilds a database in targetFolder, which must be empty or not
+// exist, by replaying the whole log at logPath, later segments included: every
+// table it creates, and the edits of every transaction that committed or
+// prepared, in the order they were logged. Unlike Recover, it neither starts
+// from a checkpoint nor uses the recovery folder, so the result shows whether
+// the log alone accounts for the database. Checkpoints drop the segments
+// before them, so only a log kept whole since the database was created
+// replays to the database's contents.
+func ReplayInto(logPath string, targetFolder string) (*db.Database, error) {
+	if files, err := ioutil.ReadDir(targetFolder); err == nil && len(files) > 0 {
+		return nil, errors.New("replay target folder is not empty")
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	logs, err := readWholeLog(logPath)
+	if err != nil {
+		return nil, err
+	}
+	// Prepared transactions that never finished would be committed by recovery.
+	committed := make(map[uuid.UUID]bool)
+	for _, l := range logs {
+		switch l := l.(type) {
+		case *CommitLog:
+			committed[l.id] = true
+		case *PrepareLog:
+			committed[l.id] = true
+		}
+	}
+	d, err := db.Open(targetFolder)
+	if err != nil {
+		return nil, err
+	}
+	// Replaying only redoes records, which needs nothing but the database.
+	replayer := &RecoveryManager{d: d}
+	for i := 0; i < len(logs); i++ {
+		switch l := logs[i].(type) {
+		case *TableLog:
+			err = replayer.Redo(l)
+		case *EditLog:
+			if !committed[l.id] {
+				continue
+			}
+			// Redo the whole run of consecutive committed edits to this table at once.
+			batch := []*EditLog{l}
+			for i+1 < len(logs) {
+				next, ok := logs[i+1].(*EditLog)
+				if !ok || next.tablename != l.tablename || !committed[next.id] {
+					break
+				}
+				batch = append(batch, next)
+				i += 1
+			}
+			err = replayer.redoBatch(batch)
+		}
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// readWholeLog reads every record of the log at logPath, across all of its segments, oldest first.
+func readWholeLog(logPath string) ([]Log, error) {
+	segments, err := findSegments(logPath)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := (&RecoveryManager{logName: logPath, segments: segments}).openSegments()
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+	logs := make([]Log, 0)
+	scanner := bufio.NewScanner(io.NewSectionReader(sr, 0, sr.Size()))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		// Skip blank lines.
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		l, err := FromString(string(line))
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, scanner.Err()
+}
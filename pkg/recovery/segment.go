@@ -0,0 +1,250 @@
+package recovery
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The log is split into segments: the first one is the log file itself, and
+// the n-th one after it is the log file's name followed by ".n".
+// Records are only ever appended to the last segment.
+
+// segmentName returns the name of the n-th segment of the given log.
+func segmentName(logName string, n int) string {
+	if n == 0 {
+		return logName
+	}
+	return fmt.Sprintf("%s.%d", logName, n)
+}
+
+// segmentNumber returns the number of the segment with the given name,
+// or false if the name isn't one of the given log's segments.
+func segmentNumber(logName string, name string) (int, bool) {
+	if name == logName {
+		return 0, true
+	}
+	suffix := strings.TrimPrefix(name, logName+".")
+	if suffix == name {
+		return 0, false
+	}
+	n, err := strconv.Atoi(suffix)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// findSegments returns the numbers of the given log's existing segments, in order.
+// The first segment is always included.
+func findSegments(logName string) ([]int, error) {
+	dir, base := filepath.Split(logName)
+	if dir == "" {
+		dir = "."
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	nums := []int{0}
+	for _, file := range files {
+		if n, ok := segmentNumber(base, file.Name()); ok && n > 0 {
+			nums = append(nums, n)
+		}
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+// segmentReader reads the log's segments as if they were a single file.
+type segmentReader struct {
+	files []*os.File
+	ends  []int64 // Offset just past the end of each segment.
+}
+
+// openSegments opens all of the log's segments for reading, flushing the log
+// first so that none of its records are missed. Expects rm.mtx to be locked
+func (rm *RecoveryManager) openSegments() (*segmentReader, error) {
+	if err := rm.FlushLog(rm.LastLSN()); err != nil {
+		return nil, err
+	}
+	sr := &segmentReader{}
+	var size int64
+	for _, n := range rm.segments {
+		fd, err := os.Open(segmentName(rm.logName, n))
+		if err != nil {
+			sr.Close()
+			return nil, err
+		}
+		fstats, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			sr.Close()
+			return nil, err
+		}
+		size += fstats.Size()
+		sr.files = append(sr.files, fd)
+		sr.ends = append(sr.ends, size)
+	}
+	return sr, nil
+}
+
+// Size returns the total size of the segments.
+func (sr *segmentReader) Size() int64 {
+	if len(sr.ends) == 0 {
+		return 0
+	}
+	return sr.ends[len(sr.ends)-1]
+}
+
+// ReadAt reads from the segments starting at the given offset.
+func (sr *segmentReader) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for i, end := range sr.ends {
+		if len(p) == 0 {
+			break
+		}
+		if off >= end {
+			continue
+		}
+		var start int64
+		if i > 0 {
+			start = sr.ends[i-1]
+		}
+		want := p
+		if int64(len(want)) > end-off {
+			want = want[:end-off]
+		}
+		n, err := sr.files[i].ReadAt(want, off-start)
+		read += n
+		off += int64(n)
+		p = p[n:]
+		if err != nil && err != io.EOF {
+			return read, err
+		}
+		if n < len(want) {
+			// The segment shrank since it was opened.
+			return read, io.ErrUnexpectedEOF
+		}
+	}
+	if len(p) > 0 {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Close closes all of the segments.
+func (sr *segmentReader) Close() error {
+	var firstErr error
+	for _, fd := range sr.files {
+		if err := fd.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SetSegmentSize sets the size in bytes after which the log rolls over to a
+// new segment. A size of 0 or less keeps the whole log in a single file.
+func (rm *RecoveryManager) SetSegmentSize(size int64) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.segmentSize = size
+}
+
+// Segments returns the names of the log's segments, oldest first.
+func (rm *RecoveryManager) Segments() []string {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	names := make([]string, len(rm.segments))
+	for i, n := range rm.segments {
+		names[i] = segmentName(rm.logName, n)
+	}
+	return names
+}
+
+// rotate flushes the log, then closes the current segment and starts appending
+// to a new one. Expects rm.mtx to be locked
+func (rm *RecoveryManager) rotate() error {
+	rm.logMtx.Lock()
+	defer rm.logMtx.Unlock()
+	if err := rm.flushBuffer(); err != nil {
+		return err
+	}
+	n := rm.segments[len(rm.segments)-1] + 1
+	fd, err := os.OpenFile(segmentName(rm.logName, n), os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	if err = rm.fd.Close(); err != nil {
+		fd.Close()
+		return err
+	}
+	rm.fd = fd
+	rm.segments = append(rm.segments, n)
+	rm.segmentBytes = 0
+	return nil
+}
+
+// dropSegments removes the segments that end at or before the given offset into
+// the log, never removing the current segment. The first segment is emptied
+// rather than removed, since it names the log. Returns how many were dropped.
+// Expects rm.mtx to be locked
+func (rm *RecoveryManager) dropSegments(ends []int64, offset int64) (int, error) {
+	i, dropped := 0, 0
+	var err error
+	for ; i < len(rm.segments)-1 && ends[i] <= offset; i += 1 {
+		n := rm.segments[i]
+		if n == 0 {
+			// Already empty, nothing to drop.
+			if ends[i] == 0 {
+				continue
+			}
+			err = os.Truncate(rm.logName, 0)
+		} else {
+			err = os.Remove(segmentName(rm.logName, n))
+		}
+		if err != nil {
+			break
+		}
+		dropped += 1
+	}
+	remaining := rm.segments[i:]
+	if rm.segments[0] == 0 && i > 0 {
+		remaining = append([]int{0}, remaining...)
+	}
+	rm.segments = remaining
+	return dropped, err
+}
+
+// Compact drops the log segments that recovery no longer needs: those that
+// lie entirely before the last checkpoint and the start of every transaction
+// it lists as running. Returns how many segments were dropped.
+func (rm *RecoveryManager) Compact() (int, error) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return rm.compact()
+}
+
+// compact is Compact without locking. Expects rm.mtx to be locked
+func (rm *RecoveryManager) compact() (int, error) {
+	if len(rm.segments) <= 1 {
+		return 0, nil
+	}
+	sr, err := rm.openSegments()
+	if err != nil {
+		return 0, err
+	}
+	_, _, startPos, err := scanRelevantStrings(sr)
+	ends := sr.ends
+	sr.Close()
+	if err != nil || startPos <= 0 {
+		return 0, err
+	}
+	return rm.dropSegments(ends, startPos)
+}
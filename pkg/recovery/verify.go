@@ -0,0 +1,88 @@
+package recovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+	"github.com/otiai10/copy"
+)
+
+// Table files are named after their table, which is alphanumeric.
+var tableFileExp = regexp.MustCompile(`^\w+$`)
+
+// VerifyRecoveryCopy checks the tables in the recovery folder that the last
+// checkpoint copied the database to, so that a corrupt copy is found before
+// recovery needs it. Every table file must hold whole pages, and every B+
+// tree must have its nodes within the file and its leaves linked in key order.
+// Hash tables keep their directory outside of the database folder, so only
+// their size can be checked. The recovery folder is left untouched: each B+
+// tree is checked on a temporary copy of its file.
+func (rm *RecoveryManager) VerifyRecoveryCopy() error {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	recoveryFolder := strings.TrimSuffix(rm.d.GetBasePath(), "/") + "-recovery"
+	files, err := ioutil.ReadDir(recoveryFolder)
+	if err != nil {
+		return fmt.Errorf("cannot read the recovery folder: %w", err)
+	}
+	for _, file := range files {
+		if file.IsDir() || !tableFileExp.MatchString(file.Name()) {
+			continue
+		}
+		if err = verifyTableCopy(filepath.Join(recoveryFolder, file.Name()), file.Size()); err != nil {
+			return fmt.Errorf("recovery copy of table %s is corrupt: %w", file.Name(), err)
+		}
+	}
+	return nil
+}
+
+// verifyTableCopy checks the copy of a table at the given path, whose file has the given size.
+func verifyTableCopy(path string, size int64) error {
+	if size == 0 || size%pager.PAGESIZE != 0 {
+		return fmt.Errorf("file size %d is not a whole number of pages", size)
+	}
+	indexType := "btree"
+	if _, err := os.Stat(path + ".meta"); err == nil {
+		indexType = "hash"
+	}
+	schema, err := utils.ReadSchema(path, indexType)
+	if err != nil {
+		return err
+	}
+	if schema.IndexType != "btree" {
+		return nil
+	}
+	// Opening a damaged tree can write to it, so check a copy.
+	tmpfile, err := ioutil.TempFile("", "db-verify-*")
+	if err != nil {
+		return err
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+	if err = copy.Copy(path, tmpfile.Name()); err != nil {
+		return err
+	}
+	index, err := btree.OpenTable(tmpfile.Name())
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	pagenums, err := index.PageNumbers()
+	if err != nil {
+		return err
+	}
+	numPages := size / pager.PAGESIZE
+	for _, pn := range pagenums {
+		if pn >= numPages {
+			return fmt.Errorf("node on page %d is past the end of the file's %d pages", pn, numPages)
+		}
+	}
+	return index.Validate()
+}
@@ -9,20 +9,54 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	uuid "github.com/google/uuid"
 )
 
+// ErrCommandTimeout is reported when a command doesn't return within the REPL's timeout.
+var ErrCommandTimeout = errors.New("command timed out")
+
 // REPL struct.
 type REPL struct {
 	commands map[string]func(string, *REPLConfig) error
 	help     map[string]string
+	args     map[string]ArgSpec // Arguments of the commands that declared them.
+	timeout  time.Duration      // How long a command may run; no limit if 0.
+}
+
+// ArgSpec describes the arguments a command takes after its trigger.
+type ArgSpec struct {
+	Names []string // The name of each argument, in order.
+}
+
+// Usage returns the usage string for a command with these arguments.
+func (spec ArgSpec) Usage(trigger string) string {
+	usage := "usage: " + trigger
+	for _, name := range spec.Names {
+		usage += " <" + name + ">"
+	}
+	return usage
+}
+
+// Check returns a usage error unless the payload has exactly the declared arguments.
+func (spec ArgSpec) Check(payload string) error {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 || len(fields)-1 != len(spec.Names) {
+		trigger := ""
+		if len(fields) > 0 {
+			trigger = fields[0]
+		}
+		return errors.New(spec.Usage(trigger))
+	}
+	return nil
 }
 
 // REPLConfig REPL Config struct.
 type REPLConfig struct {
 	writer   io.Writer
 	clientId uuid.UUID
+	timeout  time.Duration
 }
 
 // GetWriter Get writer.
@@ -35,11 +69,17 @@ func (replConfig *REPLConfig) GetAddr() uuid.UUID {
 	return replConfig.clientId
 }
 
+// GetTimeout Get how long a command may run before the REPL moves on; 0 if there's no limit.
+func (replConfig *REPLConfig) GetTimeout() time.Duration {
+	return replConfig.timeout
+}
+
 // NewRepl Construct an empty REPL.
 func NewRepl() *REPL {
 	r := new(REPL)
 	r.help = make(map[string]string)
 	r.commands = make(map[string]func(string, *REPLConfig) error)
+	r.args = make(map[string]ArgSpec)
 
 	return r
 }
@@ -62,6 +102,9 @@ func CombineRepls(repls []*REPL) (*REPL, error) {
 
 			combinedRepl.help[trigger] = repls[i].help[trigger]
 			combinedRepl.commands[trigger] = repls[i].commands[trigger]
+			if spec, ok := repls[i].args[trigger]; ok {
+				combinedRepl.args[trigger] = spec
+			}
 		}
 	}
 	return combinedRepl, nil
@@ -90,6 +133,69 @@ func (r *REPL) AddCommand(trigger string, action func(string, *REPLConfig) error
 	r.help[trigger] = help
 }
 
+// AddMetaCommand Add a meta command, whose trigger starts with a '.', along with its
+// help string. Meta commands inspect the server rather than the database.
+func (r *REPL) AddMetaCommand(trigger string, action func(string, *REPLConfig) error, help string) {
+	if r == nil {
+		return
+	}
+	if !strings.HasPrefix(trigger, ".") || trigger == ".help" {
+		fmt.Printf("Meta commands must start with '.' and can't replace .help!")
+		return
+	}
+	r.commands[trigger] = action
+	r.help[trigger] = help
+}
+
+// SetCommandTimeout Set how long a command may run. If a command doesn't return in
+// time, the REPL reports ErrCommandTimeout and moves on to the next command, while
+// the command keeps running in the background; its result is discarded.
+// A timeout of 0 or less lets commands run for as long as they need.
+func (r *REPL) SetCommandTimeout(timeout time.Duration) {
+	r.timeout = timeout
+}
+
+// runCommand runs a command, giving up on it once the config's timeout expires.
+func runCommand(command func(string, *REPLConfig) error, payload string, replConfig *REPLConfig) error {
+	if replConfig.timeout <= 0 {
+		return command(payload, replConfig)
+	}
+	// Buffered, so that a command that times out can still finish.
+	result := make(chan error, 1)
+	go func() {
+		result <- command(payload, replConfig)
+	}()
+	timer := time.NewTimer(replConfig.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%s: %w after %v", strings.Fields(payload)[0], ErrCommandTimeout, replConfig.timeout)
+	}
+}
+
+// AddCommandWithArgs Add a command that takes the given arguments. The REPL checks
+// that a command has exactly these arguments before running it, and reports its
+// usage otherwise, so the action can index its arguments without checking.
+func (r *REPL) AddCommandWithArgs(trigger string, action func(string, *REPLConfig) error, help string, spec ArgSpec) {
+	r.AddCommand(trigger, action, help)
+	if r == nil || strings.HasPrefix(trigger, ".") {
+		return
+	}
+	r.args[trigger] = spec
+}
+
+// dispatch checks a command's arguments, if it declared them, then runs it.
+func (r *REPL) dispatch(trigger string, command func(string, *REPLConfig) error, payload string, replConfig *REPLConfig) error {
+	if spec, ok := r.args[trigger]; ok {
+		if err := spec.Check(payload); err != nil {
+			return err
+		}
+	}
+	return runCommand(command, payload, replConfig)
+}
+
 // HelpString Return all REPL usage information as a string.
 func (r *REPL) HelpString() string {
 	if r == nil {
@@ -115,7 +221,7 @@ func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 		writer = c
 	}
 	scanner := bufio.NewScanner(reader)
-	replConfig := &REPLConfig{writer: writer, clientId: clientId}
+	replConfig := &REPLConfig{writer: writer, clientId: clientId, timeout: r.timeout}
 
 	// print the prompt
 	fmt.Print(prompt)
@@ -130,7 +236,7 @@ func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 		} else {
 			action, present := r.commands[inputCommand[0]]
 			if present {
-				err := action(command, replConfig)
+				err := r.dispatch(inputCommand[0], action, command, replConfig)
 				if err != nil {
 					log.Print(err)
 				}
@@ -145,7 +251,7 @@ func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 func (r *REPL) RunChan(c chan string, clientId uuid.UUID, prompt string) {
 	// Get reader and writer; stdin and stdout if no conn.
 	writer := os.Stdout
-	replConfig := &REPLConfig{writer: writer, clientId: clientId}
+	replConfig := &REPLConfig{writer: writer, clientId: clientId, timeout: r.timeout}
 	// Begin the repl loop!
 	io.WriteString(writer, prompt)
 	for payload := range c {
@@ -167,7 +273,7 @@ func (r *REPL) RunChan(c chan string, clientId uuid.UUID, prompt string) {
 		// Else, check user commands.
 		if command, exists := r.commands[trigger]; exists {
 			// Call a hardcoded function.
-			err := command(payload, replConfig)
+			err := r.dispatch(trigger, command, payload, replConfig)
 			if err != nil {
 				io.WriteString(writer, fmt.Sprintf("%v\n", err))
 			}
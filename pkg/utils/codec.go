@@ -0,0 +1,11 @@
+package utils
+
+// EntryCodec serializes entries into fixed-size cells, letting an index store
+// payloads other than an int64 value. An encoding must be Size() bytes long and
+// start with the entry's key, written by binary.PutVarint into
+// binary.MaxVarintLen64 bytes, so that keys can be read without decoding the payload.
+type EntryCodec interface {
+	Encode(Entry) []byte
+	Decode([]byte) Entry
+	Size() int
+}
@@ -0,0 +1,20 @@
+package utils
+
+import "errors"
+
+// Errors shared by all index types. Indexes wrap these with context, so
+// callers should compare against them using errors.Is.
+var (
+	// ErrKeyExists is returned when inserting a key that is already present.
+	ErrKeyExists = errors.New("key already exists")
+	// ErrKeyNotFound is returned when finding or deleting a missing key.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrUpdateMissing is returned when updating a missing key.
+	ErrUpdateMissing = errors.New("cannot update non-existent entry")
+	// ErrCursorEnd is returned when stepping a cursor that has no entries left.
+	ErrCursorEnd = errors.New("cannot advance the cursor further")
+	// ErrIndexClosed is returned when using an index after it has been closed.
+	ErrIndexClosed = errors.New("index is closed")
+	// ErrReadOnly is returned when writing to an index that was opened read-only.
+	ErrReadOnly = errors.New("index is read-only")
+)
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"sync/atomic"
+)
+
+// OpStats counts the operations run against a table.
+type OpStats struct {
+	Finds   int64
+	Inserts int64
+	Updates int64
+	Deletes int64
+}
+
+// Reads returns the number of read operations.
+func (stats OpStats) Reads() int64 {
+	return stats.Finds
+}
+
+// Writes returns the number of write operations.
+func (stats OpStats) Writes() int64 {
+	return stats.Inserts + stats.Updates + stats.Deletes
+}
+
+// Add returns the sum of two sets of counts.
+func (stats OpStats) Add(other OpStats) OpStats {
+	return OpStats{
+		Finds:   stats.Finds + other.Finds,
+		Inserts: stats.Inserts + other.Inserts,
+		Updates: stats.Updates + other.Updates,
+		Deletes: stats.Deletes + other.Deletes,
+	}
+}
+
+// OpCounter keeps an index's OpStats. Safe for concurrent use.
+type OpCounter struct {
+	finds   int64
+	inserts int64
+	updates int64
+	deletes int64
+}
+
+// Count a find.
+func (counter *OpCounter) Find() {
+	atomic.AddInt64(&counter.finds, 1)
+}
+
+// Count an insert.
+func (counter *OpCounter) Insert() {
+	atomic.AddInt64(&counter.inserts, 1)
+}
+
+// Count an update.
+func (counter *OpCounter) Update() {
+	atomic.AddInt64(&counter.updates, 1)
+}
+
+// Count a delete.
+func (counter *OpCounter) Delete() {
+	atomic.AddInt64(&counter.deletes, 1)
+}
+
+// Stats returns the counts so far.
+func (counter *OpCounter) Stats() OpStats {
+	return OpStats{
+		Finds:   atomic.LoadInt64(&counter.finds),
+		Inserts: atomic.LoadInt64(&counter.inserts),
+		Updates: atomic.LoadInt64(&counter.updates),
+		Deletes: atomic.LoadInt64(&counter.deletes),
+	}
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Schema describes what a table's keys and values mean.
+type Schema struct {
+	KeyName   string // Name of the key column.
+	ValueName string // Name of the value column.
+	IndexType string // Kind of index the table is stored in: "btree" or "hash".
+}
+
+// Column names must be alphanumeric, like table names.
+var columnExp = regexp.MustCompile(`^\w+$`)
+
+// DefaultSchema is the schema of a table created without one.
+func DefaultSchema(indexType string) Schema {
+	return Schema{KeyName: "key", ValueName: "value", IndexType: indexType}
+}
+
+// Validate checks that the schema's column names are alphanumeric, and that
+// its index type is one we know.
+func (schema Schema) Validate() error {
+	if !columnExp.MatchString(schema.KeyName) || !columnExp.MatchString(schema.ValueName) {
+		return errors.New("column names must be alphanumeric")
+	}
+	if schema.KeyName == schema.ValueName {
+		return errors.New("key and value columns must have different names")
+	}
+	if schema.IndexType != "btree" && schema.IndexType != "hash" {
+		return fmt.Errorf("invalid index type %q", schema.IndexType)
+	}
+	return nil
+}
+
+// SchemaFile returns the name of the file that the schema of the table stored
+// in the given file is kept in.
+func SchemaFile(filename string) string {
+	return filename + ".schema"
+}
+
+// ReadSchema reads the schema of the table stored in the given file. A table
+// without a schema file, such as one created before schemas were kept, has
+// the default schema for the given index type.
+func ReadSchema(filename string, indexType string) (Schema, error) {
+	data, err := ioutil.ReadFile(SchemaFile(filename))
+	if os.IsNotExist(err) {
+		return DefaultSchema(indexType), nil
+	}
+	if err != nil {
+		return Schema{}, err
+	}
+	// The file holds a single line: <index type> <key name> <value name>
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return Schema{}, fmt.Errorf("malformed schema file %s", SchemaFile(filename))
+	}
+	schema := Schema{KeyName: fields[1], ValueName: fields[2], IndexType: fields[0]}
+	if err = schema.Validate(); err != nil {
+		return Schema{}, fmt.Errorf("malformed schema file %s: %w", SchemaFile(filename), err)
+	}
+	return schema, nil
+}
+
+// WriteSchema stores the schema of the table stored in the given file.
+func WriteSchema(filename string, schema Schema) error {
+	if err := schema.Validate(); err != nil {
+		return err
+	}
+	data := fmt.Sprintf("%s %s %s\n", schema.IndexType, schema.KeyName, schema.ValueName)
+	return ioutil.WriteFile(SchemaFile(filename), []byte(data), 0666)
+}
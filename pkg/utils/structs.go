@@ -12,4 +12,5 @@ type Cursor interface {
 	StepForward() error
 	IsEnd() bool
 	GetEntry() (Entry, error)
+	GetKey() (int64, error)
 }
@@ -0,0 +1,2070 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+func TestBTree(t *testing.T) {
+	t.Run("TestBTreeInsertAndSeek", testBTreeInsertAndSeek)
+	t.Run("TestBTreeErrors", testBTreeErrors)
+	t.Run("TestBTreeCursorReset", testBTreeCursorReset)
+	t.Run("TestBTreeClosed", testBTreeClosed)
+	t.Run("TestBTreeDefragment", testBTreeDefragment)
+	t.Run("TestBTreeDefragmentConcurrent", testBTreeDefragmentConcurrent)
+	t.Run("TestBTreeCodec", testBTreeCodec)
+	t.Run("TestBTreeCodecSize", testBTreeCodecSize)
+	t.Run("TestBTreeSelectChan", testBTreeSelectChan)
+	t.Run("TestBTreeTombstones", testBTreeTombstones)
+	t.Run("TestBTreeTombstoneLayout", testBTreeTombstoneLayout)
+	t.Run("TestBTreeExtremeKeys", testBTreeExtremeKeys)
+	t.Run("TestBTreeAppendFastPathMixed", testBTreeAppendFastPathMixed)
+	t.Run("TestBTreeAppendFastPathConcurrent", testBTreeAppendFastPathConcurrent)
+	t.Run("TestBTreeHistogramUniform", testBTreeHistogramUniform)
+	t.Run("TestBTreeHistogramSkewed", testBTreeHistogramSkewed)
+	t.Run("TestBTreePackKeyOrder", testBTreePackKeyOrder)
+	t.Run("TestBTreeCompositeIndexPrefix", testBTreeCompositeIndexPrefix)
+	t.Run("TestBTreeSelectPage", testBTreeSelectPage)
+	t.Run("TestBTreeFindFirst", testBTreeFindFirst)
+	t.Run("TestBTreeHeightOverTime", testBTreeHeightOverTime)
+	t.Run("TestBTreeMultiGet", testBTreeMultiGet)
+	t.Run("TestBTreeMultiGetConcurrent", testBTreeMultiGetConcurrent)
+	t.Run("TestBTreeMultiGetSharesLatches", testBTreeMultiGetSharesLatches)
+	t.Run("TestBTreePageNumbers", testBTreePageNumbers)
+	t.Run("TestBTreeTableStartReverse", testBTreeTableStartReverse)
+	t.Run("TestBTreeRangeScanDirections", testBTreeRangeScanDirections)
+	t.Run("TestBTreeEmptyTableCursors", testBTreeEmptyTableCursors)
+	t.Run("TestBTreeSplitRatioFill", testBTreeSplitRatioFill)
+	t.Run("TestBTreeSetSplitRatioBounds", testBTreeSetSplitRatioBounds)
+	t.Run("TestBTreeRepairSiblingLinks", testBTreeRepairSiblingLinks)
+	t.Run("TestBTreeVerifyPageBounds", testBTreeVerifyPageBounds)
+}
+
+func testBTreeInsertAndSeek(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Insert enough entries in ascending and descending order to split leaves
+	n := btree.ENTRIES_PER_LEAF_NODE * 4
+	keys := make([]int64, 0)
+	for i := int64(0); i < n; i++ {
+		keys = append(keys, i*2)
+	}
+	for i := int64(0); i < n; i++ {
+		keys = append(keys, -i*2-1)
+	}
+	for _, key := range keys {
+		cursor, err := index.InsertAndSeek(key, key%btree_salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.GetKey() != key || entry.GetValue() != key%btree_salt {
+			t.Fatalf("Cursor points at (%d, %d), expected key %d", entry.GetKey(), entry.GetValue(), key)
+		}
+	}
+	// Duplicate inserts should fail
+	if _, err = index.InsertAndSeek(0, 0); err == nil {
+		t.Error("Inserted a duplicate key")
+	}
+}
+
+func testBTreeErrors(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err = index.Insert(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Each failure should match its sentinel error
+	if err = index.Insert(1, 2); !errors.Is(err, utils.ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	if _, err = index.Find(2); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err = index.Update(2, 2); !errors.Is(err, utils.ErrUpdateMissing) {
+		t.Errorf("Expected ErrUpdateMissing, got %v", err)
+	}
+}
+
+func testBTreeCursorReset(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Insert enough entries to split leaves
+	n := btree.ENTRIES_PER_LEAF_NODE * 4
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert((i*btree_salt)%n, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := start.(*btree.BTreeCursor)
+	// Scan, reset, then scan again
+	scan := func() []int64 {
+		keys := make([]int64, 0)
+		for {
+			if !cursor.IsEnd() {
+				key, err := cursor.GetKey()
+				if err != nil {
+					t.Fatal(err)
+				}
+				keys = append(keys, key)
+			}
+			if cursor.StepForward() != nil {
+				break
+			}
+		}
+		return keys
+	}
+	first := scan()
+	if err = cursor.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	second := scan()
+	if int64(len(first)) != n || len(first) != len(second) {
+		t.Fatalf("Expected %d keys, got %d and %d", n, len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Key %d differs after reset: %d != %d", i, first[i], second[i])
+		}
+	}
+}
+
+func testBTreeClosed(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database, insert an entry, then close it
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Insert(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Every operation should now fail cleanly
+	if _, err = index.Find(1); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("Find: expected ErrIndexClosed, got %v", err)
+	}
+	if err = index.Insert(2, 2); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("Insert: expected ErrIndexClosed, got %v", err)
+	}
+	if err = index.Update(1, 2); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("Update: expected ErrIndexClosed, got %v", err)
+	}
+	if err = index.Delete(1); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("Delete: expected ErrIndexClosed, got %v", err)
+	}
+	if _, err = index.Select(); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("Select: expected ErrIndexClosed, got %v", err)
+	}
+	if _, err = index.TableStart(); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("TableStart: expected ErrIndexClosed, got %v", err)
+	}
+	// The pager itself should refuse to hand out pages
+	if _, err = index.GetPager().GetPage(0); !errors.Is(err, pager.ErrPagerClosed) {
+		t.Errorf("GetPage: expected ErrPagerClosed, got %v", err)
+	}
+	// Closing again is a no-op
+	if err = index.Close(); err != nil {
+		t.Errorf("Closing twice failed: %v", err)
+	}
+	// The entry inserted before closing should still be on disk
+	index, err = btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if entry, err := index.Find(1); err != nil || entry.GetValue() != 1 {
+		t.Errorf("Could not find entry inserted before closing: %v", err)
+	}
+}
+
+func testBTreeDefragment(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert enough entries to split a lot, then delete most of them
+	n := int64(5000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < n; i++ {
+		if i%10 != 0 {
+			if err = index.Delete(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	before, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforePages := index.GetPager().GetNumPages()
+	// Defragment
+	if err = index.Defragment(); err != nil {
+		t.Fatal(err)
+	}
+	if afterPages := index.GetPager().GetNumPages(); afterPages >= beforePages {
+		t.Errorf("Page count did not drop: %d before, %d after", beforePages, afterPages)
+	}
+	// The same entries should be there, in order, before and after reopening
+	for reopen := 0; reopen < 2; reopen++ {
+		after, err := index.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(after) != len(before) {
+			t.Fatalf("Expected %d entries, got %d", len(before), len(after))
+		}
+		for i := range before {
+			if after[i].GetKey() != before[i].GetKey() || after[i].GetValue() != before[i].GetValue() {
+				t.Fatalf("Entry %d differs after defragmenting", i)
+			}
+		}
+		for _, entry := range before {
+			if found, err := index.Find(entry.GetKey()); err != nil || found.GetValue() != entry.GetValue() {
+				t.Fatalf("Could not find entry %d", entry.GetKey())
+			}
+		}
+		index.Close()
+		if index, err = btree.OpenTable(dbName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The tree should still take inserts and deletes
+	for i := int64(0); i < n; i++ {
+		if i%10 != 0 {
+			if err = index.Insert(i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if all, err := index.Select(); err != nil || int64(len(all)) != n {
+		t.Errorf("Expected %d entries after reinserting, got %d (%v)", n, len(all), err)
+	}
+	index.Close()
+}
+
+func testBTreeDefragmentConcurrent(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(2000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(2*i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Append past the end and fill in the gaps while defragmenting
+	errs := make(chan error, 2)
+	go func() {
+		for i := int64(0); i < n; i++ {
+			if err := index.Insert(2*n+i, i); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	go func() {
+		for i := int64(0); i < n; i++ {
+			if err := index.Insert(2*i+1, i); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	for i := 0; i < 5; i++ {
+		if err = index.Defragment(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// No insert should have been lost
+	if err = index.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != 3*n {
+		t.Fatalf("Expected %d entries, got %d", 3*n, len(entries))
+	}
+	for i, entry := range entries {
+		if entry.GetKey() != int64(i) {
+			t.Fatalf("Expected key %d at position %d, got %d", i, i, entry.GetKey())
+		}
+	}
+}
+
+// payloadEntry is an entry with a 16-byte payload in place of an int64 value.
+type payloadEntry struct {
+	key     int64
+	payload [16]byte
+}
+
+func (entry payloadEntry) GetKey() int64 {
+	return entry.key
+}
+
+func (entry payloadEntry) GetValue() int64 {
+	return int64(binary.LittleEndian.Uint64(entry.payload[:8]))
+}
+
+func (entry payloadEntry) Marshal() []byte {
+	return payloadCodec{}.Encode(entry)
+}
+
+// payloadCodec stores payloadEntries as a varint key followed by the payload.
+type payloadCodec struct{}
+
+func (payloadCodec) Encode(entry utils.Entry) []byte {
+	data := make([]byte, binary.MaxVarintLen64, payloadCodec{}.Size())
+	binary.PutVarint(data, entry.GetKey())
+	payload := entry.(payloadEntry).payload
+	return append(data, payload[:]...)
+}
+
+func (payloadCodec) Decode(data []byte) utils.Entry {
+	entry := payloadEntry{}
+	entry.key, _ = binary.Varint(data[:binary.MaxVarintLen64])
+	copy(entry.payload[:], data[binary.MaxVarintLen64:])
+	return entry
+}
+
+func (payloadCodec) Size() int {
+	return binary.MaxVarintLen64 + 16
+}
+
+func makePayload(key int64, salt int64) payloadEntry {
+	entry := payloadEntry{key: key}
+	for i := range entry.payload {
+		entry.payload[i] = byte(key*salt + int64(i))
+	}
+	return entry
+}
+
+func testBTreeCodec(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database
+	index, err := btree.OpenTableWithCodec(dbName, payloadCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert enough entries to split leaves and internal nodes
+	n := btree.ENTRIES_PER_LEAF_NODE * 20
+	for i := int64(0); i < n; i++ {
+		if err = index.InsertEntry(makePayload(i, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.InsertEntry(makePayload(0, 1)); err == nil {
+		t.Error("Inserted a duplicate key")
+	}
+	// Update every other entry
+	for i := int64(0); i < n; i += 2 {
+		if err = index.UpdateEntry(makePayload(i, 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Compare and swap only knows int64 values, so it should refuse to touch the payloads
+	if _, err = index.CompareAndSwap(1, makePayload(1, 1).GetValue(), 5); !errors.Is(err, btree.ErrCodecUnsupported) {
+		t.Errorf("Expected ErrCodecUnsupported from compare and swap, got %v", err)
+	}
+	// The payloads should round-trip, before and after reopening
+	for reopen := 0; reopen < 2; reopen++ {
+		for i := int64(0); i < n; i++ {
+			expected := makePayload(i, 1)
+			if i%2 == 0 {
+				expected = makePayload(i, 3)
+			}
+			entry, err := index.Find(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found, ok := entry.(payloadEntry); !ok || found != expected {
+				t.Fatalf("Entry %d did not round-trip: got %v", i, entry)
+			}
+		}
+		index.Close()
+		if index, err = btree.OpenTableWithCodec(dbName, payloadCodec{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer index.Close()
+	// Cursors should decode entries too
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != n {
+		t.Fatalf("Expected %d entries, got %d", n, len(entries))
+	}
+	for i, entry := range entries {
+		if _, ok := entry.(payloadEntry); !ok || entry.GetKey() != int64(i) {
+			t.Fatalf("Entry %d was not decoded with the codec", i)
+		}
+	}
+}
+
+// sizedCodec stores payloadEntries like payloadCodec does, padded to the given size.
+type sizedCodec int64
+
+func (codec sizedCodec) Encode(entry utils.Entry) []byte {
+	data := make([]byte, codec)
+	binary.PutVarint(data, entry.GetKey())
+	payload := entry.(payloadEntry).payload
+	copy(data[binary.MaxVarintLen64:], payload[:])
+	return data
+}
+
+func (codec sizedCodec) Decode(data []byte) utils.Entry {
+	entry := payloadEntry{}
+	entry.key, _ = binary.Varint(data[:binary.MaxVarintLen64])
+	copy(entry.payload[:], data[binary.MaxVarintLen64:])
+	return entry
+}
+
+func (codec sizedCodec) Size() int {
+	return int(codec)
+}
+
+func testBTreeCodecSize(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Codecs too small to hold a key, or too big for enough entries to fit in a leaf, are rejected
+	maxSize := (pager.PAGESIZE-btree.LEAF_NODE_HEADER_SIZE)/(btree.MIN_ENTRIES_PER_LEAF_NODE+1) - btree.TOMBSTONE_SIZE
+	for _, size := range []int64{0, binary.MaxVarintLen64 - 1, maxSize + 1, 3000} {
+		if index, err := btree.OpenTableWithCodec(dbName, sizedCodec(size)); !errors.Is(err, btree.ErrCodecSize) {
+			if err == nil {
+				index.Close()
+			}
+			t.Fatalf("Expected ErrCodecSize for a codec of size %d, got %v", size, err)
+		}
+	}
+	// The biggest codec that fits still splits leaves and finds every key
+	index, err := btree.OpenTableWithCodec(dbName, sizedCodec(maxSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(500)
+	for i := int64(0); i < n; i++ {
+		if err = index.InsertEntry(makePayload(i, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.SetTombstones(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < n; i++ {
+		entry, err := index.Find(i)
+		if err != nil {
+			t.Fatalf("Could not find key %d: %v", i, err)
+		}
+		if found, ok := entry.(payloadEntry); !ok || found != makePayload(i, 1) {
+			t.Fatalf("Entry %d did not round-trip: got %v", i, entry)
+		}
+	}
+}
+
+func testBTreeSelectChan(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(3000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(n-i-1, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Draining the stream should give the same entries as Select, in order
+	expected, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, errs := index.SelectChan(context.Background())
+	i := 0
+	for entry := range entries {
+		if i >= len(expected) {
+			t.Fatal("Streamed more entries than Select returned")
+		}
+		if entry.GetKey() != expected[i].GetKey() || entry.GetValue() != expected[i].GetValue() {
+			t.Fatalf("Entry %d differs from Select", i)
+		}
+		i++
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if i != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), i)
+	}
+	// Consume part of the stream, then cancel; the producer should stop
+	pinned := index.GetPager().FrameStats().Pinned
+	ctx, cancel := context.WithCancel(context.Background())
+	entries, errs = index.SelectChan(ctx)
+	for i := 0; i < 10; i++ {
+		<-entries
+	}
+	cancel()
+	extra := 0
+	for range entries {
+		extra++
+	}
+	if extra > 1 {
+		t.Errorf("Producer sent %d entries after being cancelled", extra)
+	}
+	if err = <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	// The stopped scan should have left no page pinned
+	if got := index.GetPager().FrameStats().Pinned; got != pinned {
+		t.Errorf("Expected %d pinned pages after the scan stopped, got %d", pinned, got)
+	}
+}
+
+func testBTreeTombstones(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := btree.ENTRIES_PER_LEAF_NODE * 10
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Delete the even keys as tombstones
+	if err := index.SetTombstones(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < n; i += 2 {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pages := index.GetPager().GetNumPages()
+	// Tombstones should be invisible, before and after reopening
+	for reopen := 0; reopen < 2; reopen++ {
+		for i := int64(0); i < n; i++ {
+			_, err := index.Find(i)
+			if i%2 == 0 && !errors.Is(err, utils.ErrKeyNotFound) {
+				t.Fatalf("Expected ErrKeyNotFound for deleted key %d, got %v", i, err)
+			} else if i%2 == 1 && err != nil {
+				t.Fatalf("Could not find key %d: %v", i, err)
+			}
+		}
+		entries, err := index.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(entries)) != n/2 {
+			t.Fatalf("Expected %d entries, got %d", n/2, len(entries))
+		}
+		for _, entry := range entries {
+			if entry.GetKey()%2 == 0 {
+				t.Fatalf("Selected deleted key %d", entry.GetKey())
+			}
+		}
+		index.Close()
+		if index, err = btree.OpenTable(dbName); err != nil {
+			t.Fatal(err)
+		}
+		if err := index.SetTombstones(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer index.Close()
+	if err = index.Update(0, 1); !errors.Is(err, utils.ErrUpdateMissing) {
+		t.Errorf("Expected ErrUpdateMissing when updating a deleted key, got %v", err)
+	}
+	// A deleted key can be inserted again
+	if err = index.Insert(0, 42); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := index.Find(0); err != nil || entry.GetValue() != 42 {
+		t.Errorf("Could not find reinserted key: %v", err)
+	}
+	// Purge should physically remove the rest, without touching the entries
+	if index.GetPager().GetNumPages() != pages {
+		t.Error("Tombstoning changed the number of pages")
+	}
+	purged, err := index.Purge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(purged) != n/2-1 {
+		t.Errorf("Expected to purge %d entries, purged %d", n/2-1, purged)
+	}
+	if purged, err = index.Purge(); err != nil || purged != 0 {
+		t.Errorf("Second purge removed %d entries (%v)", purged, err)
+	}
+	if err = index.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != n/2+1 {
+		t.Fatalf("Expected %d entries after purging, got %d", n/2+1, len(entries))
+	}
+	// The purged keys can be inserted again
+	for i := int64(2); i < n; i += 2 {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err = index.Select(); err != nil || int64(len(entries)) != n {
+		t.Errorf("Expected %d entries after reinserting, got %d (%v)", n, len(entries), err)
+	}
+}
+
+// Keys at and around the ends of the int64 range, and around zero, along with
+// enough keys of both signs between them to spread over many nodes.
+func extremeKeys() []int64 {
+	keys := []int64{math.MinInt64, math.MinInt64 + 1, -1 << 40, -1, 0, 1, 1 << 40, math.MaxInt64 - 1, math.MaxInt64}
+	for i := int64(1); i <= 2000; i++ {
+		keys = append(keys, i*7919*1000003, -i*7919*1000003)
+	}
+	return keys
+}
+
+// rootCellKeys reads the keys straight out of the root leaf's cells, assuming cells of the given size.
+func rootCellKeys(t *testing.T, index *btree.BTreeIndex, cellSize int64) (byte, []int64) {
+	page, err := index.GetPager().GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	data := *page.GetData()
+	numKeys, _ := binary.Varint(data[btree.NUM_KEYS_OFFSET : btree.NUM_KEYS_OFFSET+btree.NUM_KEYS_SIZE])
+	keys := make([]int64, 0)
+	for i := int64(0); i < numKeys; i++ {
+		pos := btree.LEAF_NODE_HEADER_SIZE + i*cellSize
+		key, _ := binary.Varint(data[pos : pos+btree.KEY_SIZE])
+		keys = append(keys, key)
+	}
+	return data[btree.NODETYPE_OFFSET], keys
+}
+
+func testBTreeTombstoneLayout(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(10)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Without tombstones, leaves keep the plain layout
+	nodeType, keys := rootCellKeys(t, index, btree.ENTRYSIZE)
+	if nodeType != 1 {
+		t.Errorf("Expected a plain leaf, got node type byte %d", nodeType)
+	}
+	for i, key := range keys {
+		if key != int64(i) {
+			t.Fatalf("Expected key %d in plain cell %d, got %d", i, i, key)
+		}
+	}
+	// Enabling tombstones rebuilds the leaves with a flag in each cell
+	if err = index.SetTombstones(true); err != nil {
+		t.Fatal(err)
+	}
+	nodeType, keys = rootCellKeys(t, index, btree.ENTRYSIZE+btree.TOMBSTONE_SIZE)
+	if nodeType&btree.TOMBSTONE_CELLS_BIT == 0 {
+		t.Errorf("Expected a leaf with tombstone cells, got node type byte %d", nodeType)
+	}
+	if int64(len(keys)) != n {
+		t.Fatalf("Expected %d keys after rebuilding, got %d", n, len(keys))
+	}
+	for i, key := range keys {
+		if key != int64(i) {
+			t.Fatalf("Expected key %d in tombstone cell %d, got %d", i, i, key)
+		}
+	}
+	if err = index.Delete(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = index.Find(3); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for a tombstone, got %v", err)
+	}
+}
+
+func testBTreeExtremeKeys(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	keys := extremeKeys()
+	for _, key := range keys {
+		if err = index.Insert(key, key/2); err != nil {
+			t.Fatalf("Could not insert key %d: %v", key, err)
+		}
+	}
+	if err = index.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, key := range keys {
+		if entry, err := index.Find(key); err != nil || entry.GetValue() != key/2 {
+			t.Fatalf("Could not find key %d: %v", key, err)
+		}
+	}
+	// A full scan returns them all in order, from math.MinInt64 to math.MaxInt64
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(keys) {
+		t.Fatalf("Expected %d entries, got %d", len(keys), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.GetKey() != keys[i] {
+			t.Fatalf("Entry %d has key %d, expected %d", i, entry.GetKey(), keys[i])
+		}
+	}
+	// Range scans over the negative keys, in both directions, stop before zero
+	negative := sort.Search(len(keys), func(i int) bool { return keys[i] >= 0 })
+	for _, ascending := range []bool{true, false} {
+		entries, err := index.RangeScan(math.MinInt64, 0, ascending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != negative {
+			t.Fatalf("Expected %d negative keys, got %d", negative, len(entries))
+		}
+		for i, entry := range entries {
+			expected := keys[i]
+			if !ascending {
+				expected = keys[negative-1-i]
+			}
+			if entry.GetKey() != expected {
+				t.Fatalf("Range scan entry %d has key %d, expected %d", i, entry.GetKey(), expected)
+			}
+		}
+	}
+	// Both ends and zero can be deleted
+	for _, key := range []int64{math.MinInt64, 0, math.MaxInt64} {
+		if err = index.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = index.Find(key); err == nil {
+			t.Errorf("Deleted key %d was still found", key)
+		}
+	}
+}
+
+// Open a table on a temporary file.
+func openTempBTree(tb testing.TB) (*btree.BTreeIndex, string) {
+	dbName := getTempBTreeDB(tb)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return index, dbName
+}
+
+// Whether the page holds a leaf node.
+func isLeafPage(page *pager.Page) bool {
+	return (*page.GetData())[btree.NODETYPE_OFFSET] != 0
+}
+
+// Read a varint out of the page at the given offset.
+func pageVarint(page *pager.Page, offset int64, size int64) int64 {
+	value, _ := binary.Varint((*page.GetData())[offset : offset+size])
+	return value
+}
+
+// Write a varint into the page at the given offset.
+func setPageVarint(page *pager.Page, offset int64, size int64, value int64) {
+	data := make([]byte, size)
+	binary.PutVarint(data, value)
+	page.Update(data, offset, size)
+}
+
+// The offset of an internal node's ith child pagenum.
+func childPNOffset(i int64) int64 {
+	return btree.PNS_OFFSET + i*btree.PN_SIZE
+}
+
+// Collect the pagenums from the root down to the leftmost leaf.
+func leftmostPath(t *testing.T, index *btree.BTreeIndex) []int64 {
+	path := make([]int64, 0)
+	for pn := btree.ROOT_PN; ; {
+		path = append(path, pn)
+		page, err := index.GetPager().GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLeafPage(page) {
+			page.Put()
+			return path
+		}
+		pn = pageVarint(page, childPNOffset(0), btree.PN_SIZE)
+		page.Put()
+	}
+}
+
+// Collect the table's leaf pagenums, from left to right along the sibling links.
+func leafPNs(t *testing.T, index *btree.BTreeIndex) []int64 {
+	path := leftmostPath(t, index)
+	pn := path[len(path)-1]
+	leaves := make([]int64, 0)
+	for pn != pager.NOPAGE {
+		leaves = append(leaves, pn)
+		page, err := index.GetPager().GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pn = pageVarint(page, btree.RIGHT_SIBLING_PN_OFFSET, btree.RIGHT_SIBLING_PN_SIZE)
+		page.Put()
+	}
+	return leaves
+}
+
+// Check that the table is valid and holds exactly the given keys.
+func checkBTreeKeys(t *testing.T, index *btree.BTreeIndex, keys map[int64]bool) {
+	if err := index.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(keys) {
+		t.Fatalf("Expected %d entries, got %d", len(keys), len(entries))
+	}
+	for i, entry := range entries {
+		if !keys[entry.GetKey()] {
+			t.Fatalf("Unexpected key %d", entry.GetKey())
+		}
+		if i > 0 && entry.GetKey() <= entries[i-1].GetKey() {
+			t.Fatalf("Keys out of order: %d after %d", entry.GetKey(), entries[i-1].GetKey())
+		}
+	}
+	for key := range keys {
+		if entry, err := index.Find(key); err != nil || entry.GetValue() != key {
+			t.Fatalf("Could not find key %d: %v", key, err)
+		}
+	}
+}
+
+func testBTreeAppendFastPathMixed(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	// Append even keys in order, with odd keys below them inserted at random
+	r := rand.New(rand.NewSource(1))
+	keys := make(map[int64]bool)
+	n := btree.ENTRIES_PER_LEAF_NODE * 20
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(2*i, 2*i); err != nil {
+			t.Fatal(err)
+		}
+		keys[2*i] = true
+		if i%3 == 0 {
+			odd := 2*r.Int63n(i+1) + 1
+			if !keys[odd] {
+				if err := index.Insert(odd, odd); err != nil {
+					t.Fatal(err)
+				}
+				keys[odd] = true
+			}
+		}
+	}
+	checkBTreeKeys(t, index, keys)
+	// The next append lands at the end of the last leaf
+	if err := index.Insert(2*n, 2*n); err != nil {
+		t.Fatal(err)
+	}
+	leaves := leafPNs(t, index)
+	page, err := index.GetPager().GetPage(leaves[len(leaves)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	numKeys := pageVarint(page, btree.NUM_KEYS_OFFSET, btree.NUM_KEYS_SIZE)
+	last := pageVarint(page, btree.LEAF_NODE_HEADER_SIZE+(numKeys-1)*btree.ENTRYSIZE, btree.KEY_SIZE)
+	if last != 2*n {
+		t.Errorf("Expected the last leaf to end with %d, got %d", 2*n, last)
+	}
+}
+
+func testBTreeAppendFastPathConcurrent(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	// Each goroutine appends its own ascending keys, interleaving with the others
+	workers := int64(4)
+	n := btree.ENTRIES_PER_LEAF_NODE * 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := int64(0); w < workers; w++ {
+		wg.Add(1)
+		go func(w int64) {
+			defer wg.Done()
+			for i := int64(0); i < n; i++ {
+				key := i*workers + w
+				if err := index.Insert(key, key); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	keys := make(map[int64]bool)
+	for key := int64(0); key < n*workers; key++ {
+		keys[key] = true
+	}
+	checkBTreeKeys(t, index, keys)
+}
+
+// Benchmark inserting ascending keys, with and without the append fast path.
+func BenchmarkBTreeAscendingInsert(b *testing.B) {
+	for _, fast := range []bool{true, false} {
+		name := "Descend"
+		if fast {
+			name = "Append"
+		}
+		b.Run(name, func(b *testing.B) {
+			index, dbName := openTempBTree(b)
+			defer os.Remove(dbName)
+			defer index.Close()
+			index.SetAppendFastPath(fast)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := index.Insert(int64(i), int64(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func testBTreeHistogramUniform(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	for i := int64(0); i < 1000; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	histogram, err := index.Histogram(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histogram) != 10 {
+		t.Fatalf("Expected 10 buckets, got %d", len(histogram))
+	}
+	// Evenly spread keys give buckets of equal count and width
+	for i, bucket := range histogram {
+		low := int64(i) * 100
+		if bucket.Low != low || bucket.High != low+99 || bucket.Count != 100 {
+			t.Errorf("Bucket %d is [%d, %d] with %d keys, expected [%d, %d] with 100",
+				i, bucket.Low, bucket.High, bucket.Count, low, low+99)
+		}
+	}
+	if est := btree.EstimateRange(histogram, 250, 500); est < 0.24 || est > 0.26 {
+		t.Errorf("Expected a quarter of the keys in [250, 500), estimated %f", est)
+	}
+}
+
+func testBTreeHistogramSkewed(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	// 900 dense keys, then 100 keys spread over a much wider range
+	for i := int64(0); i < 900; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 100; i++ {
+		if err := index.Insert(10000+i*1000, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Leave a few tombstones, which shouldn't be counted
+	if err := index.SetTombstones(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(900); i < 1000; i += 10 {
+		if err := index.Delete(10000 + (i-900)*1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	histogram, err := index.Histogram(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(histogram) != 10 {
+		t.Fatalf("Expected 10 buckets, got %d", len(histogram))
+	}
+	var total int64
+	for i, bucket := range histogram {
+		total += bucket.Count
+		if bucket.Count < 98 || bucket.Count > 99 {
+			t.Errorf("Bucket %d has %d keys, expected an equal share", i, bucket.Count)
+		}
+		if i > 0 && bucket.Low <= histogram[i-1].High {
+			t.Errorf("Bucket %d overlaps the previous one", i)
+		}
+	}
+	if total != 990 {
+		t.Errorf("Expected 990 keys, got %d", total)
+	}
+	// The dense keys get narrow buckets, the sparse keys one wide bucket
+	first, last := histogram[0], histogram[len(histogram)-1]
+	if first.High-first.Low > 100 || last.High-last.Low < 50000 {
+		t.Errorf("Expected a narrow first bucket and a wide last bucket, got %v and %v", first, last)
+	}
+	if est := btree.EstimateRange(histogram, 20000, 200000); est > 0.15 {
+		t.Errorf("Expected few keys in the sparse range, estimated %f", est)
+	}
+}
+
+func testBTreePackKeyOrder(t *testing.T) {
+	values := []int64{math.MinInt32, math.MinInt32 + 1, -2, -1, 0, 1, 2, math.MaxInt32 - 1, math.MaxInt32}
+	var prev int64
+	first := true
+	for _, a := range values {
+		for _, b := range values {
+			key, err := btree.PackKey(a, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotA, gotB := btree.UnpackKey(key); gotA != a || gotB != b {
+				t.Fatalf("(%d, %d) unpacked to (%d, %d)", a, b, gotA, gotB)
+			}
+			if !first && key <= prev {
+				t.Fatalf("(%d, %d) packed out of order", a, b)
+			}
+			prev, first = key, false
+		}
+	}
+	if _, err := btree.PackKey(math.MaxInt32+1, 0); !errors.Is(err, btree.ErrCompositeKeyRange) {
+		t.Errorf("Expected an out of range first component to fail, got %v", err)
+	}
+	if _, err := btree.PackKey(0, math.MinInt32-1); !errors.Is(err, btree.ErrCompositeKeyRange) {
+		t.Errorf("Expected an out of range second component to fail, got %v", err)
+	}
+}
+
+func testBTreeCompositeIndexPrefix(t *testing.T) {
+	table, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer table.Close()
+	index := btree.NewCompositeIndex(table)
+	// Insert (tableId, rowId) pairs in a shuffled order, including the extremes
+	firsts := []int64{math.MinInt32, -5, 0, 7, math.MaxInt32}
+	seconds := make([]int64, 0)
+	for b := int64(-100); b < 100; b++ {
+		seconds = append(seconds, b*3)
+	}
+	seconds = append(seconds, math.MinInt32, math.MaxInt32)
+	r := rand.New(rand.NewSource(1))
+	pairs := make([][2]int64, 0)
+	for _, a := range firsts {
+		for _, b := range seconds {
+			pairs = append(pairs, [2]int64{a, b})
+		}
+	}
+	r.Shuffle(len(pairs), func(i, j int) { pairs[i], pairs[j] = pairs[j], pairs[i] })
+	for _, pair := range pairs {
+		if err := index.Insert(pair[0], pair[1], pair[0]+pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each prefix scan returns exactly its first component's entries, in order
+	for _, a := range firsts {
+		entries, err := index.FindPrefix(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(seconds) {
+			t.Fatalf("Expected %d entries for %d, got %d", len(seconds), a, len(entries))
+		}
+		for i, entry := range entries {
+			if entry.First != a || entry.Value != entry.First+entry.Second {
+				t.Fatalf("Unexpected entry %v in the scan of %d", entry, a)
+			}
+			if i > 0 && entry.Second <= entries[i-1].Second {
+				t.Fatalf("Entries out of order: %d after %d", entry.Second, entries[i-1].Second)
+			}
+		}
+	}
+	// A missing prefix is empty
+	if entries, err := index.FindPrefix(1); err != nil || len(entries) != 0 {
+		t.Errorf("Expected no entries for a missing prefix, got %v (%v)", entries, err)
+	}
+	// Point operations work on pairs
+	if err := index.Update(7, 3, 100); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := index.Find(7, 3); err != nil || entry.Value != 100 {
+		t.Errorf("Expected the updated value, got %v (%v)", entry, err)
+	}
+	if err := index.Delete(7, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.Find(7, 3); err == nil {
+		t.Error("Deleted entry was still found")
+	}
+}
+func testBTreeSelectPage(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	// A table spanning many leaves, with gaps between keys and some deleted
+	for _, i := range rand.Perm(3000) {
+		if err := index.Insert(int64(i)*2-1000, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(500); i < 900; i++ {
+		if err := index.Delete(i*2 - 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The smallest possible key comes back too, on the first page
+	if err := index.Insert(math.MinInt64, 0); err != nil {
+		t.Fatal(err)
+	}
+	all, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, limit := range []int{1, 7, 100, len(all), len(all) + 1} {
+		// Page through the table, feeding back each continuation key
+		paged := make([]utils.Entry, 0)
+		page, next, err := index.SelectFirstPage(limit)
+		for {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) > limit {
+				t.Fatalf("Limit %d: got a page of %d entries", limit, len(page))
+			}
+			if len(page) > 0 && next != page[len(page)-1].GetKey() {
+				t.Fatalf("Limit %d: continuation key %d isn't the page's last key", limit, next)
+			}
+			paged = append(paged, page...)
+			if len(page) < limit {
+				break
+			}
+			page, next, err = index.SelectPage(next, limit)
+		}
+		if len(paged) != len(all) {
+			t.Fatalf("Limit %d: paged through %d entries, expected %d", limit, len(paged), len(all))
+		}
+		for i := range all {
+			if paged[i].GetKey() != all[i].GetKey() || paged[i].GetValue() != all[i].GetValue() {
+				t.Fatalf("Limit %d: entry %d is %d, expected %d", limit, i, paged[i].GetKey(), all[i].GetKey())
+			}
+		}
+	}
+	// Past the last key, or from the largest possible key, there is nothing left
+	last := all[len(all)-1].GetKey()
+	for _, after := range []int64{last, math.MaxInt64} {
+		if page, next, err := index.SelectPage(after, 10); err != nil || len(page) != 0 || next != after {
+			t.Errorf("Expected an empty last page after %d, got %d entries: %v", after, len(page), err)
+		}
+	}
+	if _, _, err := index.SelectPage(0, 0); err == nil {
+		t.Error("Expected a limit of 0 to be rejected")
+	}
+	if _, _, err := index.SelectFirstPage(0); err == nil {
+		t.Error("Expected a limit of 0 to be rejected from the start")
+	}
+}
+
+func testBTreeFindFirst(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	// Enough entries to span many leaves
+	n := int64(2000)
+	for _, i := range rand.Perm(int(n)) {
+		if err := index.Insert(int64(i), int64(i)*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name  string
+		key   int64 // The key to match, or -1 for none.
+		reads int   // The number of entries the scan should read.
+	}{
+		{"first", 0, 1},
+		{"middle", n / 2, int(n/2) + 1},
+		{"last", n - 1, int(n)},
+		{"absent", -1, int(n)},
+	}
+	for _, test := range tests {
+		// Count the entries read through the predicate calls
+		reads := 0
+		pred := func(entry utils.Entry) bool {
+			reads++
+			return entry.GetKey() == test.key
+		}
+		entry, found, err := index.FindFirst(pred)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if found != (test.key >= 0) {
+			t.Fatalf("%s: expected found to be %v", test.name, test.key >= 0)
+		}
+		if found && (entry.GetKey() != test.key || entry.GetValue() != test.key*10) {
+			t.Fatalf("%s: found entry (%d, %d)", test.name, entry.GetKey(), entry.GetValue())
+		}
+		if reads != test.reads {
+			t.Errorf("%s: read %d entries, expected %d", test.name, reads, test.reads)
+		}
+	}
+	// The predicate sees entries in key order
+	var seen []int64
+	if _, found, err := index.FindFirst(func(entry utils.Entry) bool {
+		seen = append(seen, entry.GetKey())
+		return entry.GetKey() >= 100
+	}); err != nil || !found {
+		t.Fatalf("Expected a match: %v", err)
+	}
+	for i, key := range seen {
+		if key != int64(i) {
+			t.Fatalf("Predicate saw key %d at position %d", key, i)
+		}
+	}
+	// An empty table has nothing to find
+	empty, emptyName := openTempBTree(t)
+	defer os.Remove(emptyName)
+	defer empty.Close()
+	if _, found, err := empty.FindFirst(func(utils.Entry) bool { return true }); err != nil || found {
+		t.Errorf("Expected nothing in an empty table, got found %v: %v", found, err)
+	}
+}
+func testBTreeHeightOverTime(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	heights := make([]int, 0)
+	index.HeightOverTime(func(height int) {
+		heights = append(heights, height)
+	})
+	// Insert until the tree has grown two levels past its root leaf
+	key := int64(0)
+	for ; len(heights) < 2; key++ {
+		if key == 1000000 {
+			t.Fatalf("Tree only grew to heights %v", heights)
+		}
+		if err := index.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(heights, []int{2, 3}) {
+		t.Fatalf("Expected heights [2 3], got %v", heights)
+	}
+	// More inserts at the same height report nothing
+	for end := key + 100; key < end; key++ {
+		if err := index.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(heights) != 2 {
+		t.Fatalf("Expected no more height changes, got %v", heights)
+	}
+	// Defragmenting collapses the tree to a leaf, then grows it back
+	heights = heights[:0]
+	if err := index.Defragment(); err != nil {
+		t.Fatal(err)
+	}
+	if len(heights) < 2 || heights[0] != 1 {
+		t.Fatalf("Expected the tree to collapse then grow, got heights %v", heights)
+	}
+	for i := 1; i < len(heights); i++ {
+		if heights[i] != heights[i-1]+1 {
+			t.Fatalf("Expected the rebuilt tree to grow a level at a time, got heights %v", heights)
+		}
+	}
+	// Reopened, the tree is the height it was last reported at
+	last := heights[len(heights)-1]
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if height := len(leftmostPath(t, index)); height != last {
+		t.Errorf("Expected a height of %d on reopening, got %d", last, height)
+	}
+}
+
+func testBTreeMultiGet(t *testing.T) {
+	for _, tombstones := range []bool{false, true} {
+		index, dbName := openTempBTree(t)
+		if err := index.SetTombstones(tombstones); err != nil {
+			t.Fatal(err)
+		}
+		// Even keys across many leaves, with a run of them deleted
+		for _, i := range rand.Perm(5000) {
+			if err := index.Insert(int64(i)*2, int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for key := int64(3000); key < 5000; key += 2 {
+			if err := index.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Ask for present, deleted and never inserted keys, out of order and repeated
+		keys := []int64{math.MinInt64, -1, math.MaxInt64, 9998, 10000, 0, 0, 7, 4000, 2998, 5000}
+		for key := int64(0); key < 10000; key += 3 {
+			keys = append(keys, key)
+		}
+		rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		values, err := index.MultiGet(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := make(map[int64]int64)
+		for _, key := range keys {
+			if entry, err := index.Find(key); err == nil {
+				expected[key] = entry.GetValue()
+			}
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("Tombstones %v: MultiGet returned %d keys, Find found %d", tombstones, len(values), len(expected))
+		}
+		for _, key := range []int64{-1, 7, 4000, 10000} {
+			if _, ok := values[key]; ok {
+				t.Errorf("Tombstones %v: missing key %d was in the result", tombstones, key)
+			}
+		}
+		if values[9998] != 4999 || values[0] != 0 || values[2998] != 1499 {
+			t.Errorf("Tombstones %v: wrong values for present keys", tombstones)
+		}
+		if values, err := index.MultiGet(nil); err != nil || len(values) != 0 {
+			t.Errorf("Expected no values for no keys, got %v: %v", values, err)
+		}
+		index.Close()
+		os.Remove(dbName)
+	}
+}
+
+func testBTreeMultiGetConcurrent(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	keys := make([]int64, 0)
+	for i := int64(0); i < 2000; i++ {
+		if err := index.Insert(i*4, i); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, i*4)
+	}
+	// Split leaves around the looked up keys while looking them up
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, i := range rand.Perm(4000) {
+			if err := index.Insert(int64(i)*2+1, 0); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		values, err := index.MultiGet(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != len(keys) {
+			t.Fatalf("Expected %d values, got %d", len(keys), len(values))
+		}
+	}
+	wg.Wait()
+}
+
+func testBTreeMultiGetSharesLatches(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	keys := make([]int64, 0)
+	for i := int64(0); i < 2000; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, i)
+	}
+	// Another reader holding the root doesn't hold up a lookup
+	root, err := index.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.RLock()
+	defer root.Put()
+	defer root.RUnlock()
+	done := make(chan error, 1)
+	go func() {
+		values, err := index.MultiGet(keys)
+		if err == nil && len(values) != len(keys) {
+			err = fmt.Errorf("expected %d values, got %d", len(keys), len(values))
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("MultiGet waited on a read latch")
+	}
+}
+
+// Number of entries to populate the scan benchmarks with.
+var benchScanSize int64 = 5000
+
+// Open a table on a temporary file and fill it with benchScanSize entries.
+func openBenchBTree(b *testing.B) (*btree.BTreeIndex, string) {
+	index, dbName := openTempBTree(b)
+	for i := int64(0); i < benchScanSize; i++ {
+		if err := index.Insert(i, i); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return index, dbName
+}
+
+// Benchmark fetching a run of clustered keys, one at a time and all at once.
+func BenchmarkBTreeClusteredGet(b *testing.B) {
+	keys := make([]int64, 500)
+	for i := range keys {
+		keys[i] = int64(2000 + i)
+	}
+	b.Run("Find", func(b *testing.B) {
+		index, dbName := openBenchBTree(b)
+		defer os.Remove(dbName)
+		defer index.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				if _, err := index.Find(key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("MultiGet", func(b *testing.B) {
+		index, dbName := openBenchBTree(b)
+		defer os.Remove(dbName)
+		defer index.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if values, err := index.MultiGet(keys); err != nil || len(values) != len(keys) {
+				b.Fatalf("Expected %d values, got %d: %v", len(keys), len(values), err)
+			}
+		}
+	})
+}
+
+func testBTreePageNumbers(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	// Enough entries for a few levels of nodes, but few enough pages to all stay resident
+	for i := int64(0); index.GetPager().GetNumPages() < pager.NUMPAGES/2; i++ {
+		if err := index.Insert((i*7919)%100003, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.Close()
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	pagenums, err := index.PageNumbers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every page in the file is a node
+	if int64(len(pagenums)) != index.GetPager().GetNumPages() {
+		t.Fatalf("Expected %d pages, got %v", index.GetPager().GetNumPages(), pagenums)
+	}
+	for i, pn := range pagenums {
+		if pn != int64(i) {
+			t.Fatalf("Expected pages 0 to %d in order, got %v", len(pagenums)-1, pagenums)
+		}
+	}
+	// A full scan only touches the table's pages
+	if _, err = index.Select(); err != nil {
+		t.Fatal(err)
+	}
+	state := index.GetPager().DumpState()
+	resident := append(state.Unpinned, state.Pinned...)
+	sort.Slice(resident, func(i, j int) bool { return resident[i] < resident[j] })
+	if !reflect.DeepEqual(resident, pagenums) {
+		t.Errorf("Expected the resident pages %v to be the table's pages %v", resident, pagenums)
+	}
+}
+
+// Scan the whole table, checking the bound using GetEntry.
+func BenchmarkBTreeCursorScanGetEntry(b *testing.B) {
+	index, dbName := openBenchBTree(b)
+	defer os.Remove(dbName)
+	defer index.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cursor, err := index.TableStart()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if !cursor.IsEnd() {
+				entry, err := cursor.GetEntry()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if entry.GetKey() >= benchScanSize {
+					break
+				}
+			}
+			if cursor.StepForward() != nil {
+				break
+			}
+		}
+	}
+}
+
+// Scan the whole table, checking the bound using GetKey.
+func BenchmarkBTreeCursorScanGetKey(b *testing.B) {
+	index, dbName := openBenchBTree(b)
+	defer os.Remove(dbName)
+	defer index.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		cursor, err := index.TableStart()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if !cursor.IsEnd() {
+				key, err := cursor.GetKey()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if key >= benchScanSize {
+					break
+				}
+			}
+			if cursor.StepForward() != nil {
+				break
+			}
+		}
+	}
+}
+
+// Scan the whole table repeatedly, reusing one cursor via Reset.
+func BenchmarkBTreeCursorScanReset(b *testing.B) {
+	index, dbName := openBenchBTree(b)
+	defer os.Remove(dbName)
+	defer index.Close()
+	start, err := index.TableStart()
+	if err != nil {
+		b.Fatal(err)
+	}
+	cursor := start.(*btree.BTreeCursor)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err = cursor.Reset(); err != nil {
+			b.Fatal(err)
+		}
+		for {
+			if !cursor.IsEnd() {
+				key, err := cursor.GetKey()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if key >= benchScanSize {
+					break
+				}
+			}
+			if cursor.StepForward() != nil {
+				break
+			}
+		}
+	}
+}
+
+// Collect the keys a cursor visits, in order.
+func cursorKeys(t *testing.T, cursor utils.Cursor) []int64 {
+	keys := make([]int64, 0)
+	for {
+		if !cursor.IsEnd() {
+			key, err := cursor.GetKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry, err := cursor.GetEntry()
+			if err != nil || entry.GetKey() != key {
+				t.Fatalf("Entry does not match key %d: %v", key, err)
+			}
+			keys = append(keys, key)
+		}
+		if err := cursor.StepForward(); err != nil {
+			return keys
+		}
+	}
+}
+
+// Check that iterating in reverse visits the keys of an ascending scan, backwards.
+func checkReverse(t *testing.T, index *btree.BTreeIndex) int {
+	forward, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ascending := cursorKeys(t, forward)
+	reverse, err := index.TableStartReverse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	descending := cursorKeys(t, reverse)
+	if len(descending) != len(ascending) {
+		t.Fatalf("Reverse scan visited %d keys, ascending scan %d", len(descending), len(ascending))
+	}
+	for i, key := range descending {
+		if expected := ascending[len(ascending)-1-i]; key != expected {
+			t.Fatalf("Reverse scan visited %d at position %d, expected %d", key, i, expected)
+		}
+	}
+	if !reverse.IsEnd() {
+		t.Error("Reverse cursor should be at the end after the last key")
+	}
+	return len(descending)
+}
+
+func testBTreeTableStartReverse(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	// An empty table has nothing to visit
+	if n := checkReverse(t, index); n != 0 {
+		t.Fatalf("Expected an empty scan, got %d keys", n)
+	}
+	// A single leaf
+	for i := int64(0); i < 10; i++ {
+		if err := index.Insert(i*3, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkReverse(t, index)
+	// Enough keys, in random order, to need several levels of internal nodes
+	for _, i := range rand.Perm(20000) {
+		if err := index.Insert(int64(i)*3+1, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := index.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isLeafPage(root) {
+		t.Fatal("Expected a multi-leaf tree")
+	}
+	root.Put()
+	checkReverse(t, index)
+	// Deleting a run of keys leaves empty leaves behind, which are skipped
+	for i := int64(2000); i < 12000; i++ {
+		if err := index.Delete(i*3 + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkReverse(t, index)
+	// So are tombstones
+	if err := index.SetTombstones(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(15000); i < 20000; i += 2 {
+		if err := index.Delete(i*3 + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkReverse(t, index)
+}
+
+func testBTreeRangeScanDirections(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	// Keys are multiples of 3, with a run deleted and some tombstoned
+	present := make(map[int64]bool)
+	for _, i := range rand.Perm(20000) {
+		if err := index.Insert(int64(i)*3, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+		present[int64(i)*3] = true
+	}
+	for i := int64(5000); i < 9000; i++ {
+		if err := index.Delete(i * 3); err != nil {
+			t.Fatal(err)
+		}
+		delete(present, i*3)
+	}
+	if err := index.SetTombstones(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(12000); i < 16000; i += 2 {
+		if err := index.Delete(i * 3); err != nil {
+			t.Fatal(err)
+		}
+		delete(present, i*3)
+	}
+	bounds := [][2]int64{
+		{0, 60000},     // The whole table
+		{-100, 100000}, // Past both ends
+		{30, 31},       // A single key
+		{31, 33},       // Between keys
+		{14000, 28000}, // Into the deleted run
+		{15000, 27000}, // Within the deleted run
+		{35000, 49000}, // Across tombstones
+		{59997, 70000}, // The last key
+		{100, 100},     // Empty
+		{200, 100},     // Backwards
+		{1234, 45678},  // Across many leaves
+	}
+	for _, bound := range bounds {
+		ascending, err := index.RangeScan(bound[0], bound[1], true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descending, err := index.RangeScan(bound[0], bound[1], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 0
+		for key := range present {
+			if bound[0] <= key && key < bound[1] {
+				expected++
+			}
+		}
+		if len(ascending) != expected || len(descending) != expected {
+			t.Fatalf("[%d, %d): expected %d entries, got %d ascending and %d descending",
+				bound[0], bound[1], expected, len(ascending), len(descending))
+		}
+		for i, entry := range descending {
+			if expected := ascending[len(ascending)-1-i]; entry.GetKey() != expected.GetKey() || entry.GetValue() != expected.GetValue() {
+				t.Fatalf("[%d, %d): descending scan has %d at position %d, expected %d",
+					bound[0], bound[1], entry.GetKey(), i, expected.GetKey())
+			}
+		}
+	}
+}
+
+func testBTreeEmptyTableCursors(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	check := func(name string, open func() (utils.Cursor, error)) {
+		cursor, err := open()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !cursor.IsEnd() {
+			t.Errorf("%s: expected an end cursor on an empty table", name)
+		}
+		if _, err := cursor.GetEntry(); !errors.Is(err, utils.ErrKeyNotFound) {
+			t.Errorf("%s: expected GetEntry to fail with ErrKeyNotFound, got %v", name, err)
+		}
+		if _, err := cursor.GetKey(); !errors.Is(err, utils.ErrKeyNotFound) {
+			t.Errorf("%s: expected GetKey to fail with ErrKeyNotFound, got %v", name, err)
+		}
+		if err := cursor.StepForward(); !errors.Is(err, utils.ErrCursorEnd) {
+			t.Errorf("%s: expected StepForward to fail with ErrCursorEnd, got %v", name, err)
+		}
+		if !cursor.IsEnd() {
+			t.Errorf("%s: expected the cursor to stay at the end", name)
+		}
+	}
+	check("TableFind", func() (utils.Cursor, error) { return index.TableFind(42) })
+	check("TableStart", index.TableStart)
+	check("TableEnd", index.TableEnd)
+	check("TableStartReverse", index.TableStartReverse)
+	// Emptying a table leaves it in the same state
+	for i := int64(0); i < 1000; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 1000; i++ {
+		if err := index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("TableFind after deletes", func() (utils.Cursor, error) { return index.TableFind(500) })
+	check("TableStart after deletes", index.TableStart)
+}
+
+// Insert n ascending keys into a fresh table with the given split ratio,
+// then return the average number of entries per leaf.
+func averageLeafFill(t *testing.T, ratio float64, n int64) float64 {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	if err := index.SetSplitRatio(ratio); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Walk every page, summing up the leaves.
+	var leaves, entries int64
+	for pn := int64(0); pn < index.GetPager().GetNumPages(); pn++ {
+		page, err := index.GetPager().GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLeafPage(page) {
+			leaves++
+			entries += pageVarint(page, btree.NUM_KEYS_OFFSET, btree.NUM_KEYS_SIZE)
+		}
+		page.Put()
+	}
+	return float64(entries) / float64(leaves)
+}
+
+func testBTreeSplitRatioFill(t *testing.T) {
+	n := 20 * btree.ENTRIES_PER_LEAF_NODE
+	half := averageLeafFill(t, btree.DEFAULT_SPLIT_RATIO, n)
+	dense := averageLeafFill(t, 0.9, n)
+	if dense <= half {
+		t.Errorf("Expected a 90%% split point to fill leaves more than the default: %.1f vs %.1f", dense, half)
+	}
+	if dense < 0.8*float64(btree.ENTRIES_PER_LEAF_NODE) {
+		t.Errorf("Expected leaves to be at least 80%% full, got %.1f of %d", dense, btree.ENTRIES_PER_LEAF_NODE)
+	}
+}
+
+func testBTreeSetSplitRatioBounds(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	for _, ratio := range []float64{0, 1, -0.5, 1.5} {
+		if index.SetSplitRatio(ratio) == nil {
+			t.Errorf("Expected an error for split ratio %v", ratio)
+		}
+	}
+	if index.GetSplitRatio() != btree.DEFAULT_SPLIT_RATIO {
+		t.Error("Invalid split ratio was applied")
+	}
+}
+
+func testBTreeRepairSiblingLinks(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	n := btree.ENTRIES_PER_LEAF_NODE * 10
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Validate(); err != nil {
+		t.Fatalf("Valid tree failed validation: %v", err)
+	}
+	// Point the first leaf past its sibling, as if a split never linked it in.
+	leaves := leafPNs(t, index)
+	if len(leaves) < 3 {
+		t.Fatalf("Expected at least 3 leaves, got %d", len(leaves))
+	}
+	page, err := index.GetPager().GetPage(leaves[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPageVarint(page, btree.RIGHT_SIBLING_PN_OFFSET, btree.RIGHT_SIBLING_PN_SIZE, leaves[2])
+	page.Put()
+	// The scan now skips the second leaf's entries.
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) >= n {
+		t.Fatalf("Expected the corrupted scan to skip entries, got all %d", len(entries))
+	}
+	if err = index.Validate(); !errors.Is(err, btree.ErrBrokenSiblingLink) {
+		t.Fatalf("Expected ErrBrokenSiblingLink, got %v", err)
+	}
+	// Repairing should relink just that leaf, and fix the scan.
+	fixed, err := index.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed != 1 {
+		t.Errorf("Expected to fix 1 link, fixed %d", fixed)
+	}
+	if err = index.Validate(); err != nil {
+		t.Errorf("Repaired tree failed validation: %v", err)
+	}
+	entries, err = index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != n {
+		t.Fatalf("Expected %d entries after repairing, got %d", n, len(entries))
+	}
+	for i, entry := range entries {
+		if entry.GetKey() != int64(i) {
+			t.Fatalf("Entry %d has key %d", i, entry.GetKey())
+		}
+	}
+}
+
+func testBTreeVerifyPageBounds(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	n := btree.ENTRIES_PER_LEAF_NODE * 10
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.VerifyPageBounds(); err != nil {
+		t.Fatalf("Valid tree failed verification: %v", err)
+	}
+	root, err := index.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Put()
+	if isLeafPage(root) {
+		t.Fatal("Expected the root to be an internal node")
+	}
+	// Point one of the root's children past the end of the file.
+	childPN := pageVarint(root, childPNOffset(1), btree.PN_SIZE)
+	setPageVarint(root, childPNOffset(1), btree.PN_SIZE, index.GetPager().GetNumPages())
+	if err = index.VerifyPageBounds(); !errors.Is(err, pager.ErrPageOutOfBounds) {
+		t.Errorf("Expected ErrPageOutOfBounds for an out of range child, got %v", err)
+	}
+	setPageVarint(root, childPNOffset(1), btree.PN_SIZE, childPN)
+	// Point a leaf's right sibling past the end of the file.
+	leaves := leafPNs(t, index)
+	leaf, err := index.GetPager().GetPage(leaves[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPageVarint(leaf, btree.RIGHT_SIBLING_PN_OFFSET, btree.RIGHT_SIBLING_PN_SIZE, index.GetPager().GetNumPages()+10)
+	if err = index.VerifyPageBounds(); !errors.Is(err, pager.ErrPageOutOfBounds) {
+		t.Errorf("Expected ErrPageOutOfBounds for an out of range sibling, got %v", err)
+	}
+	setPageVarint(leaf, btree.RIGHT_SIBLING_PN_OFFSET, btree.RIGHT_SIBLING_PN_SIZE, leaves[1])
+	leaf.Put()
+	// A child that is referred to twice makes the walk loop.
+	setPageVarint(root, childPNOffset(1), btree.PN_SIZE, pageVarint(root, childPNOffset(0), btree.PN_SIZE))
+	if err = index.VerifyPageBounds(); err == nil {
+		t.Error("Expected a page referred to twice to fail verification")
+	}
+	setPageVarint(root, childPNOffset(1), btree.PN_SIZE, childPN)
+	if err = index.VerifyPageBounds(); err != nil {
+		t.Errorf("Restored tree failed verification: %v", err)
+	}
+}
@@ -0,0 +1,1361 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+
+	uuid "github.com/google/uuid"
+)
+
+// How long to wait before deciding that a lock request is blocked.
+var blockTimeout = 100 * time.Millisecond
+
+func getTempConcurrencyDB(t *testing.T) string {
+	tmpfile, err := ioutil.TempFile(".", "db-*")
+	if err != nil {
+		t.Error(err)
+	}
+	defer tmpfile.Close()
+	return tmpfile.Name()
+}
+
+func TestConcurrency(t *testing.T) {
+	t.Run("TestRangeLockBlocksInsert", testRangeLockBlocksInsert)
+	t.Run("TestLockManyOrdered", testLockManyOrdered)
+	t.Run("TestReapExpired", testReapExpired)
+	t.Run("TestDeadlockVictimPriority", testDeadlockVictimPriority)
+	t.Run("TestWithRetry", testWithRetry)
+	t.Run("TestInspectTransaction", testInspectTransaction)
+	t.Run("TestReadYourWrites", testReadYourWrites)
+	t.Run("TestAbortDiscardsWrites", testAbortDiscardsWrites)
+	t.Run("TestDeadlockVictimLocksHeld", testDeadlockVictimLocksHeld)
+	t.Run("TestCompareAndSwap", testCompareAndSwap)
+	t.Run("TestLockManagerInterface", testLockManagerInterface)
+	t.Run("TestLockWaiterNotHolder", testLockWaiterNotHolder)
+	t.Run("TestShardedLockManagerContention", testShardedLockManagerContention)
+	t.Run("TestLockWaitsOnConflicts", testLockWaitsOnConflicts)
+	t.Run("TestGraphPrune", testGraphPrune)
+	t.Run("TestDumpLocksReportsCycle", testDumpLocksReportsCycle)
+}
+
+func testRangeLockBlocksInsert(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table and transaction manager
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	scanner := uuid.New()
+	writer := uuid.New()
+	if err = tm.Begin(scanner); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Begin(writer); err != nil {
+		t.Fatal(err)
+	}
+	// Range-lock [10, 20] for a scan
+	if err = tm.LockRange(scanner, index, 10, 20, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	// Inserts outside of the range should go through
+	done := make(chan error)
+	go func() { done <- tm.Lock(writer, index, 30, concurrency.W_LOCK) }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(blockTimeout):
+		t.Fatal("Insert outside of the locked range was blocked")
+	}
+	// Inserts into the range should block until the scan commits
+	go func() { done <- tm.Lock(writer, index, 15, concurrency.W_LOCK) }()
+	select {
+	case <-done:
+		t.Fatal("Insert into the locked range was not blocked")
+	case <-time.After(blockTimeout):
+	}
+	if err = tm.Commit(scanner); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(blockTimeout):
+		t.Fatal("Insert was still blocked after the scan committed")
+	}
+	tm.Commit(writer)
+}
+
+func testLockManyOrdered(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table and transaction manager
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	// Two transactions ask for the same resources in opposite orders
+	first := []concurrency.LockRequest{
+		{Table: index, Key: 1, LockType: concurrency.W_LOCK},
+		{Table: index, Key: 2, LockType: concurrency.W_LOCK},
+	}
+	second := []concurrency.LockRequest{
+		{Table: index, Key: 2, LockType: concurrency.W_LOCK},
+		{Table: index, Key: 1, LockType: concurrency.W_LOCK},
+	}
+	done := make(chan error)
+	for _, requests := range [][]concurrency.LockRequest{first, second} {
+		go func(requests []concurrency.LockRequest) {
+			clientId := uuid.New()
+			if err := tm.Begin(clientId); err != nil {
+				done <- err
+				return
+			}
+			if err := tm.LockMany(clientId, requests); err != nil {
+				done <- err
+				return
+			}
+			// Hold the locks for a bit so that the transactions overlap
+			time.Sleep(10 * time.Millisecond)
+			done <- tm.Commit(clientId)
+		}(requests)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(10 * blockTimeout):
+			t.Fatal("LockMany deadlocked")
+		}
+	}
+}
+
+func testReapExpired(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table and a transaction manager with a mock clock
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	now := time.Unix(0, 0)
+	tm.SetClock(func() time.Time { return now })
+	lease := time.Minute
+	// A stale transaction locks some keys, then a fresh one locks others later
+	stale := uuid.New()
+	fresh := uuid.New()
+	if err = tm.Begin(stale); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Begin(fresh); err != nil {
+		t.Fatal(err)
+	}
+	for key := int64(0); key < 3; key++ {
+		if err = tm.Lock(stale, index, key, concurrency.W_LOCK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tm.LockRange(stale, index, 10, 20, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(lease / 2)
+	if err = tm.Lock(fresh, index, 5, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing has outlived its lease yet
+	reaped, err := tm.ReapExpired(lease)
+	if err != nil || len(reaped) != 0 {
+		t.Fatalf("Expected nothing to be reaped, got %v (%v)", reaped, err)
+	}
+	// Advance past the stale transaction's lease only
+	now = now.Add(lease)
+	reaped, err = tm.ReapExpired(lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reaped) != 1 || reaped[0] != stale {
+		t.Fatalf("Expected only the stale transaction to be reaped, got %v", reaped)
+	}
+	if _, found := tm.GetTransaction(stale); found {
+		t.Error("Reaped transaction is still running")
+	}
+	if _, found := tm.GetTransaction(fresh); !found {
+		t.Error("Fresh transaction was reaped")
+	}
+	// The stale transaction's locks should have been released
+	done := make(chan error)
+	go func() {
+		for _, key := range []int64{0, 1, 2, 15} {
+			if err := tm.Lock(fresh, index, key, concurrency.W_LOCK); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(blockTimeout):
+		t.Fatal("Locks of the reaped transaction were not released")
+	}
+	tm.Commit(fresh)
+}
+
+// Make two running transactions deadlock: waiter requests a key held by closer,
+// then closer requests a key held by waiter. Returns the transaction that was
+// aborted, after both transactions have finished.
+func deadlock(t *testing.T, tm *concurrency.TransactionManager, index *btree.BTreeIndex, waiter uuid.UUID, closer uuid.UUID) uuid.UUID {
+	if err := tm.Lock(waiter, index, 1, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Lock(closer, index, 2, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan error)
+	go func() { waited <- tm.Lock(waiter, index, 2, concurrency.W_LOCK) }()
+	time.Sleep(blockTimeout)
+	closed := make(chan error)
+	go func() { closed <- tm.Lock(closer, index, 1, concurrency.W_LOCK) }()
+	var err error
+	select {
+	case err = <-closed:
+	case <-time.After(10 * blockTimeout):
+		t.Fatal("Deadlock was not broken")
+	}
+	// Either the closer is told about the deadlock, and the waiter proceeds...
+	if errors.Is(err, concurrency.ErrDeadlock) {
+		tm.Commit(closer)
+		if err = <-waited; err != nil {
+			t.Fatal(err)
+		}
+		tm.Commit(waiter)
+		return closer
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ...or the waiter is aborted, and its pending request fails once the closer is done.
+	if _, found := tm.GetTransaction(waiter); found {
+		t.Fatal("Closer proceeded, but the waiter was not aborted")
+	}
+	tm.Commit(closer)
+	select {
+	case err = <-waited:
+		if !errors.Is(err, concurrency.ErrTransactionAborted) {
+			t.Fatalf("Expected ErrTransactionAborted, got %v", err)
+		}
+	case <-time.After(10 * blockTimeout):
+		t.Fatal("Aborted transaction's request never returned")
+	}
+	return waiter
+}
+
+func testDeadlockVictimPriority(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table and a transaction manager with a mock clock
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	now := time.Unix(0, 0)
+	tm.SetClock(func() time.Time { return now })
+	// A client retries its transaction until it succeeds, while fresh
+	// transactions that begin just before each attempt conflict with it
+	retrier := uuid.New()
+	for txn := 0; txn < 3; txn++ {
+		attempts := 0
+		for victim := retrier; victim == retrier; attempts++ {
+			if attempts == 5 {
+				t.Fatal("Retried transaction was starved")
+			}
+			fresh := uuid.New()
+			if err = tm.Begin(fresh); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(time.Second)
+			if err = tm.Begin(retrier); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(time.Second)
+			// Alternate which transaction closes the cycle
+			if (txn+attempts)%2 == 0 {
+				victim = deadlock(t, tm, index, fresh, retrier)
+			} else {
+				victim = deadlock(t, tm, index, retrier, fresh)
+			}
+		}
+		// The first attempt is younger and loses, but the retry keeps its start
+		// time, so the older transaction is never the victim again
+		if attempts != 2 {
+			t.Errorf("Expected the transaction to succeed on its second attempt, took %d", attempts)
+		}
+	}
+}
+
+func testWithRetry(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table and transaction manager
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	// Two clients lock the same keys in opposite orders, so they deadlock
+	clients := []uuid.UUID{uuid.New(), uuid.New()}
+	attempts := make([]int, len(clients))
+	results := make(chan error)
+	for i, clientId := range clients {
+		i, clientId := i, clientId
+		first, second := int64(i), int64(1-i)
+		go func() {
+			results <- tm.WithRetry(clientId, 5, func() error {
+				attempts[i]++
+				if err := tm.Lock(clientId, index, first, concurrency.W_LOCK); err != nil {
+					return err
+				}
+				time.Sleep(blockTimeout)
+				if err := tm.Lock(clientId, index, second, concurrency.W_LOCK); err != nil {
+					return err
+				}
+				return index.Insert(first*10+second, int64(i))
+			})
+		}()
+	}
+	for range clients {
+		select {
+		case err = <-results:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(20 * blockTimeout):
+			t.Fatal("Transactions did not finish")
+		}
+	}
+	// One of them should have been retried, and both should have committed
+	if attempts[0]+attempts[1] < 3 {
+		t.Errorf("Expected a retry, got %d and %d attempts", attempts[0], attempts[1])
+	}
+	for _, clientId := range clients {
+		if _, found := tm.GetTransaction(clientId); found {
+			t.Error("Transaction was left running")
+		}
+	}
+	if entries, err := index.Select(); err != nil || len(entries) != 2 {
+		t.Errorf("Expected both transactions' entries, got %d (%v)", len(entries), err)
+	}
+	// Other errors are returned without retrying
+	boom := errors.New("boom")
+	tries := 0
+	err = tm.WithRetry(clients[0], 5, func() error {
+		tries++
+		if err := tm.Lock(clients[0], index, 0, concurrency.W_LOCK); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) || tries != 1 {
+		t.Errorf("Expected boom after 1 try, got %v after %d", err, tries)
+	}
+	if _, found := tm.GetTransaction(clients[0]); found {
+		t.Error("Failed transaction was left running")
+	}
+}
+
+func testInspectTransaction(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table and transaction manager
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	clientId := uuid.New()
+	if _, err = tm.InspectTransaction(clientId); err == nil {
+		t.Error("Inspected a transaction that never began")
+	}
+	if err = tm.Begin(clientId); err != nil {
+		t.Fatal(err)
+	}
+	// Lock keys in mixed modes, out of order
+	locks := map[int64]concurrency.LockType{
+		7: concurrency.W_LOCK,
+		3: concurrency.R_LOCK,
+		5: concurrency.W_LOCK,
+		1: concurrency.R_LOCK,
+	}
+	for key, lType := range locks {
+		if err = tm.Lock(clientId, index, key, lType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func() {
+		held, err := tm.InspectTransaction(clientId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(held) != len(locks) {
+			t.Fatalf("Expected %d held resources, got %d", len(locks), len(held))
+		}
+		for i, h := range held {
+			key := h.Resource.GetResourceKey()
+			if i > 0 && key <= held[i-1].Resource.GetResourceKey() {
+				t.Errorf("Held resources are out of order: %d after %d", key, held[i-1].Resource.GetResourceKey())
+			}
+			if h.Resource.GetTableName() != index.GetName() {
+				t.Errorf("Resource %d is in table %s", key, h.Resource.GetTableName())
+			}
+			if lType, ok := locks[key]; !ok || lType != h.LockType {
+				t.Errorf("Resource %d is held with lock type %v", key, h.LockType)
+			}
+		}
+	}
+	check()
+	// Unlocking should be reflected
+	if err = tm.Unlock(clientId, index, 3, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	delete(locks, 3)
+	check()
+	if err = tm.Commit(clientId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tm.InspectTransaction(clientId); err == nil {
+		t.Error("Inspected a committed transaction")
+	}
+}
+
+func testReadYourWrites(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table and a transaction manager that buffers writes
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	tm.SetBufferedWrites(true)
+	writer := uuid.New()
+	reader := uuid.New()
+	for _, clientId := range []uuid.UUID{writer, reader} {
+		if err = tm.Begin(clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The writer sees its own uncommitted insert, update and delete
+	if err = tm.Insert(writer, index, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Insert(writer, index, 2, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Insert(writer, index, 1, 11); !errors.Is(err, utils.ErrKeyExists) {
+		t.Errorf("Expected a duplicate insert to fail, got %v", err)
+	}
+	if err = tm.Update(writer, index, 1, 12); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Delete(writer, index, 2); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := tm.Find(writer, index, 1); err != nil || entry.GetValue() != 12 {
+		t.Fatalf("Writer could not read its own write: %v", err)
+	}
+	if _, err = tm.Find(writer, index, 2); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Errorf("Writer could read the key it deleted, got %v", err)
+	}
+	// Nothing has reached the table yet
+	if _, err = index.Find(1); err == nil {
+		t.Error("Uncommitted write reached the table")
+	}
+	// Another transaction doesn't see the write, and waits for the writer
+	done := make(chan error)
+	var seen int64
+	go func() {
+		entry, err := tm.Find(reader, index, 1)
+		if err == nil {
+			seen = entry.GetValue()
+		}
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("Reader was not blocked by the uncommitted write")
+	case <-time.After(blockTimeout):
+	}
+	// Once the writer commits, the reader sees the final value
+	if err = tm.Commit(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil || seen != 12 {
+		t.Errorf("Expected the reader to see 12 after commit, got %d (%v)", seen, err)
+	}
+	if _, err = index.Find(2); err == nil {
+		t.Error("Deleted key was written to the table")
+	}
+	if err = tm.Commit(reader); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAbortDiscardsWrites(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table and a transaction manager that buffers writes, with a mock clock
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err = index.Insert(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	tm.SetBufferedWrites(true)
+	now := time.Unix(0, 0)
+	tm.SetClock(func() time.Time { return now })
+	// Buffer an insert, an update and a delete
+	write := func(clientId uuid.UUID, key int64) error {
+		if err := tm.Insert(clientId, index, key, key); err != nil {
+			return err
+		}
+		if err := tm.Update(clientId, index, 1, key); err != nil {
+			return err
+		}
+		return tm.Delete(clientId, index, 1)
+	}
+	// None of them reach the table, and the keys are free again
+	check := func(how string, clientId uuid.UUID, key int64) {
+		if _, found := tm.GetTransaction(clientId); found {
+			t.Errorf("%s: transaction was left running", how)
+		}
+		if _, err := index.Find(key); err == nil {
+			t.Errorf("%s: aborted insert of %d reached the table", how, key)
+		}
+		if entry, err := index.Find(1); err != nil || entry.GetValue() != 10 {
+			t.Errorf("%s: aborted update or delete reached the table", how)
+		}
+		other := uuid.New()
+		if err := tm.Begin(other); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- tm.Lock(other, index, key, concurrency.W_LOCK) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(blockTimeout):
+			t.Fatalf("%s: aborted transaction's locks were not released", how)
+		}
+		if err := tm.Commit(other); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Aborting directly
+	clientId := uuid.New()
+	if err = tm.Begin(clientId); err != nil {
+		t.Fatal(err)
+	}
+	if err = write(clientId, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Abort(clientId); err != nil {
+		t.Fatal(err)
+	}
+	check("Abort", clientId, 2)
+	if err = tm.Abort(clientId); err == nil {
+		t.Error("Expected aborting a finished transaction to fail")
+	}
+	// A failed WithRetry
+	boom := errors.New("boom")
+	err = tm.WithRetry(clientId, 5, func() error {
+		if err := write(clientId, 3); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("Expected boom, got %v", err)
+	}
+	check("WithRetry", clientId, 3)
+	// A reaped transaction
+	if err = tm.Begin(clientId); err != nil {
+		t.Fatal(err)
+	}
+	if err = write(clientId, 4); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	if reaped, err := tm.ReapExpired(time.Minute); err != nil || len(reaped) != 1 {
+		t.Fatalf("Expected the transaction to be reaped, got %v (%v)", reaped, err)
+	}
+	check("ReapExpired", clientId, 4)
+}
+
+func testDeadlockVictimLocksHeld(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table and a transaction manager with a mock clock
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	now := time.Unix(0, 0)
+	for _, policy := range []concurrency.VictimPolicy{concurrency.VictimByPriority, concurrency.VictimByLocksHeld} {
+		tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+		tm.SetClock(func() time.Time { return now })
+		tm.SetVictimPolicy(policy)
+		// Whichever transaction closes the cycle, an older transaction that holds one
+		// lock deadlocks with a younger one that has already locked many keys
+		for closesCycle := 0; closesCycle < 2; closesCycle++ {
+			light := uuid.New()
+			heavy := uuid.New()
+			if err = tm.Begin(light); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(time.Second)
+			if err = tm.Begin(heavy); err != nil {
+				t.Fatal(err)
+			}
+			for key := int64(10); key < 20; key++ {
+				if err = tm.Lock(heavy, index, key, concurrency.W_LOCK); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var victim uuid.UUID
+			if closesCycle == 0 {
+				victim = deadlock(t, tm, index, light, heavy)
+			} else {
+				victim = deadlock(t, tm, index, heavy, light)
+			}
+			// By priority the younger transaction loses; by cost the one with less work does
+			expected := heavy
+			if policy == concurrency.VictimByLocksHeld {
+				expected = light
+			}
+			if victim != expected {
+				t.Errorf("Policy %d aborted the wrong transaction when the cycle was closed by the %s one",
+					policy, map[int]string{0: "heavy", 1: "light"}[closesCycle])
+			}
+		}
+	}
+}
+
+// An index that supports compare-and-swap.
+type casIndex interface {
+	Insert(int64, int64) error
+	Find(int64) (utils.Entry, error)
+	CompareAndSwap(int64, int64, int64) (bool, error)
+}
+
+func testCompareAndSwap(t *testing.T) {
+	btreeName := getTempConcurrencyDB(t)
+	defer os.Remove(btreeName)
+	btreeIndex, err := btree.OpenTable(btreeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	hashName := getTempConcurrencyDB(t)
+	defer removeHashDB(hashName)
+	hashIndex, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	for name, index := range map[string]casIndex{"btree": btreeIndex, "hash": hashIndex} {
+		// Enough keys that the tree has internal nodes and the hash table has split
+		for i := int64(0); i < 2000; i++ {
+			if err = index.Insert(i, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Of many goroutines swapping the same key from 0, exactly one wins
+		var wg sync.WaitGroup
+		var mtx sync.Mutex
+		swaps := 0
+		for g := int64(1); g <= 50; g++ {
+			wg.Add(1)
+			go func(g int64) {
+				defer wg.Done()
+				swapped, err := index.CompareAndSwap(7, 0, g)
+				if err != nil {
+					t.Error(err)
+				}
+				if swapped {
+					mtx.Lock()
+					swaps++
+					mtx.Unlock()
+				}
+			}(g)
+		}
+		wg.Wait()
+		if swaps != 1 {
+			t.Fatalf("%s: expected exactly one swap, got %d", name, swaps)
+		}
+		// Increments that retry until their swap succeeds are never lost
+		workers, increments := 20, 50
+		swaps = 0
+		for g := 0; g < workers; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < increments; {
+					entry, err := index.Find(1000)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					swapped, err := index.CompareAndSwap(1000, entry.GetValue(), entry.GetValue()+1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if swapped {
+						mtx.Lock()
+						swaps++
+						mtx.Unlock()
+						i++
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if swaps != workers*increments {
+			t.Errorf("%s: expected %d swaps, got %d", name, workers*increments, swaps)
+		}
+		if entry, err := index.Find(1000); err != nil || entry.GetValue() != int64(workers*increments) {
+			t.Errorf("%s: expected the counter to reach %d: %v", name, workers*increments, err)
+		}
+		// Swapping a missing key fails
+		if _, err = index.CompareAndSwap(-1, 0, 1); !errors.Is(err, utils.ErrUpdateMissing) {
+			t.Errorf("%s: expected ErrUpdateMissing, got %v", name, err)
+		}
+	}
+}
+
+// A lock manager that records the calls made to it, and grants every lock
+// except those on the key refused.
+type recordingLockManager struct {
+	calls   []string
+	refused int64
+}
+
+func (lm *recordingLockManager) Lock(r concurrency.Resource, lType concurrency.LockType) error {
+	lm.calls = append(lm.calls, fmt.Sprintf("lock %s %d %d", r.GetTableName(), r.GetResourceKey(), lType))
+	if r.GetResourceKey() == lm.refused {
+		return errors.New("lock refused")
+	}
+	return nil
+}
+
+func (lm *recordingLockManager) Unlock(r concurrency.Resource, lType concurrency.LockType) error {
+	lm.calls = append(lm.calls, fmt.Sprintf("unlock %s %d %d", r.GetTableName(), r.GetResourceKey(), lType))
+	return nil
+}
+
+func (lm *recordingLockManager) LockRange(r concurrency.RangeResource, lType concurrency.LockType, owned map[concurrency.Resource]concurrency.LockType) error {
+	lm.calls = append(lm.calls, fmt.Sprintf("lock range %s %d-%d %d", r.GetTableName(), r.GetStartKey(), r.GetEndKey(), lType))
+	return nil
+}
+
+func (lm *recordingLockManager) UnlockRange(r concurrency.RangeResource, lType concurrency.LockType) error {
+	lm.calls = append(lm.calls, fmt.Sprintf("unlock range %s %d-%d %d", r.GetTableName(), r.GetStartKey(), r.GetEndKey(), lType))
+	return nil
+}
+
+func testLockManagerInterface(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	lm := &recordingLockManager{refused: 99}
+	tm := concurrency.NewTransactionManager(lm)
+	if tm.GetLockManager() != lm {
+		t.Error("Expected the transaction manager to use the given lock manager")
+	}
+	clientId := uuid.New()
+	if err = tm.Begin(clientId); err != nil {
+		t.Fatal(err)
+	}
+	name := index.GetName()
+	// Locks are passed on, and a lock already held isn't asked for again
+	if err = tm.Lock(clientId, index, 1, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(clientId, index, 1, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Lock(clientId, index, 2, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.LockRange(clientId, index, 5, 9, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err = tm.Unlock(clientId, index, 2, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	// A lock the lock manager refuses isn't held
+	if err = tm.Lock(clientId, index, 99, concurrency.W_LOCK); err == nil {
+		t.Error("Expected a refused lock to fail")
+	}
+	if held, err := tm.InspectTransaction(clientId); err != nil || len(held) != 1 {
+		t.Errorf("Expected the transaction to hold 1 lock, got %d (%v)", len(held), err)
+	}
+	// Committing releases the rest
+	if err = tm.Commit(clientId); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		fmt.Sprintf("lock %s 1 %d", name, concurrency.R_LOCK),
+		fmt.Sprintf("lock %s 2 %d", name, concurrency.W_LOCK),
+		fmt.Sprintf("lock range %s 5-9 %d", name, concurrency.R_LOCK),
+		fmt.Sprintf("unlock %s 2 %d", name, concurrency.W_LOCK),
+		fmt.Sprintf("lock %s 99 %d", name, concurrency.W_LOCK),
+		fmt.Sprintf("unlock %s 1 %d", name, concurrency.R_LOCK),
+		fmt.Sprintf("unlock range %s 5-9 %d", name, concurrency.R_LOCK),
+	}
+	if fmt.Sprint(lm.calls) != fmt.Sprint(expected) {
+		t.Errorf("Expected calls %q, got %q", expected, lm.calls)
+	}
+}
+
+func testLockWaiterNotHolder(t *testing.T) {
+	dbName := getTempConcurrencyDB(t)
+	defer os.Remove(dbName)
+
+	// Init the table
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	sharded, err := concurrency.NewShardedLockManager(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lm := range []concurrency.LockManagerInterface{concurrency.NewLockManager(), sharded} {
+		tm := concurrency.NewTransactionManager(lm)
+		reader, writer, scanner := uuid.New(), uuid.New(), uuid.New()
+		for _, clientId := range []uuid.UUID{reader, writer, scanner} {
+			if err = tm.Begin(clientId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = tm.Lock(reader, index, 5, concurrency.R_LOCK); err != nil {
+			t.Fatal(err)
+		}
+		// The writer waits on the reader
+		done := make(chan error)
+		go func() { done <- tm.Lock(writer, index, 5, concurrency.W_LOCK) }()
+		select {
+		case <-done:
+			t.Fatal("Write lock was not blocked by a read lock")
+		case <-time.After(blockTimeout):
+		}
+		// A waiting writer doesn't hold the key, so a read range over it goes through
+		ranged := make(chan error)
+		go func() { ranged <- tm.LockRange(scanner, index, 0, 10, concurrency.R_LOCK) }()
+		select {
+		case err = <-ranged:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(blockTimeout):
+			t.Fatal("Read range was blocked by a waiting writer")
+		}
+		// Once the reader is done, the writer still waits on the range
+		if err = tm.Commit(reader); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+			t.Fatal("Write lock was granted under a read range")
+		case <-time.After(blockTimeout):
+		}
+		if err = tm.Commit(scanner); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(blockTimeout):
+			t.Fatal("Write lock was still blocked after the range was released")
+		}
+		tm.Commit(writer)
+	}
+}
+
+func testShardedLockManagerContention(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	lm, err := concurrency.NewShardedLockManager(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(lm)
+	// Writers increment counters under a write lock on their key, while a
+	// scanner checks that none change under its read lock on the whole range.
+	const numKeys, numWriters, numIncrements = 4, 16, 200
+	counters := make([]int, numKeys)
+	var wg sync.WaitGroup
+	errs := make(chan error, numWriters+1)
+	for w := 0; w < numWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < numIncrements; i++ {
+				clientId := uuid.New()
+				key := int64((w + i) % numKeys)
+				if err := tm.Begin(clientId); err != nil {
+					errs <- err
+					return
+				}
+				if err := tm.Lock(clientId, index, key, concurrency.W_LOCK); err != nil {
+					errs <- err
+					return
+				}
+				counters[key]++
+				if err := tm.Commit(clientId); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			clientId := uuid.New()
+			if err := tm.Begin(clientId); err != nil {
+				errs <- err
+				return
+			}
+			if err := tm.LockRange(clientId, index, 0, numKeys-1, concurrency.R_LOCK); err != nil {
+				errs <- err
+				return
+			}
+			before := append([]int(nil), counters...)
+			runtime.Gosched()
+			for key := range counters {
+				if counters[key] != before[key] {
+					t.Errorf("Counter %d changed under a range lock", key)
+				}
+			}
+			if err := tm.Commit(clientId); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, count := range counters {
+		total += count
+	}
+	if total != numWriters*numIncrements {
+		t.Errorf("Expected %d increments, got %d", numWriters*numIncrements, total)
+	}
+}
+
+// Lock and unlock resources that no other goroutine uses, in parallel.
+func benchmarkDisjointLocks(b *testing.B, lm concurrency.LockManagerInterface) {
+	var next int64
+	b.RunParallel(func(pb *testing.PB) {
+		base := atomic.AddInt64(&next, 1) << 32
+		for i := int64(0); pb.Next(); i++ {
+			r := concurrency.NewResource("t", base+i%64)
+			if err := lm.Lock(r, concurrency.W_LOCK); err != nil {
+				b.Fatal(err)
+			}
+			if err := lm.Unlock(r, concurrency.W_LOCK); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkLockManagerDisjoint(b *testing.B) {
+	benchmarkDisjointLocks(b, concurrency.NewLockManager())
+}
+
+func BenchmarkShardedLockManagerDisjoint(b *testing.B) {
+	lm, err := concurrency.NewShardedLockManager(concurrency.DEFAULT_LOCK_SHARDS)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkDisjointLocks(b, lm)
+}
+
+// Begin n transactions that each read-lock the shared keys [0, shared) and
+// write-lock owned keys of their own.
+func beginLockingTransactions(tb testing.TB, tm *concurrency.TransactionManager, index *btree.BTreeIndex, n int, shared int64, owned int64) []uuid.UUID {
+	ids := make([]uuid.UUID, 0)
+	for i := 0; i < n; i++ {
+		clientId := uuid.New()
+		if err := tm.Begin(clientId); err != nil {
+			tb.Fatal(err)
+		}
+		for key := int64(0); key < shared; key++ {
+			if err := tm.Lock(clientId, index, key, concurrency.R_LOCK); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		for j := int64(0); j < owned; j++ {
+			key := shared + int64(i)*owned + j
+			if err := tm.Lock(clientId, index, key, concurrency.W_LOCK); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		ids = append(ids, clientId)
+	}
+	return ids
+}
+
+// scanTransactions finds the transactions that a lock on the key would
+// wait on by scanning every transaction's locks.
+func scanTransactions(tm *concurrency.TransactionManager, tableName string, key int64, lType concurrency.LockType) []*concurrency.Transaction {
+	ret := make([]*concurrency.Transaction, 0)
+	for _, t := range tm.GetTransactions() {
+		conflicts := false
+		for storedResource, storedType := range t.GetResources() {
+			if storedResource.GetTableName() == tableName && storedResource.GetResourceKey() == key &&
+				(storedType == concurrency.W_LOCK || lType == concurrency.W_LOCK) {
+				conflicts = true
+			}
+		}
+		for storedRange, storedType := range t.GetRanges() {
+			if storedRange.GetTableName() == tableName && storedRange.GetStartKey() <= key && key <= storedRange.GetEndKey() &&
+				(storedType == concurrency.W_LOCK || lType == concurrency.W_LOCK) {
+				conflicts = true
+			}
+		}
+		if conflicts {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// The waits-for edges in the transaction manager's lock dump.
+func waitsFor(tm *concurrency.TransactionManager) string {
+	var buf bytes.Buffer
+	tm.DumpLocks(&buf)
+	out := buf.String()
+	out = out[strings.Index(out, "waits for:\n")+len("waits for:\n"):]
+	return out[:strings.Index(out, "cycle: ")]
+}
+
+func testLockWaitsOnConflicts(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	// Twenty transactions share keys 0 to 2 and own three keys each from 3 to
+	// 62, and one more holds a read range over [100, 200]
+	setup := func(release bool) *concurrency.TransactionManager {
+		tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+		ids := beginLockingTransactions(t, tm, index, 20, 3, 3)
+		ranger := uuid.New()
+		if err := tm.Begin(ranger); err != nil {
+			t.Fatal(err)
+		}
+		if err := tm.LockRange(ranger, index, 100, 200, concurrency.R_LOCK); err != nil {
+			t.Fatal(err)
+		}
+		if !release {
+			return tm
+		}
+		// Release some locks and transactions
+		if err := tm.Unlock(ids[0], index, 0, concurrency.R_LOCK); err != nil {
+			t.Fatal(err)
+		}
+		for _, clientId := range append(ids[1:5], ranger) {
+			if err := tm.Commit(clientId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tm
+	}
+	check := func(release bool, key int64, lType concurrency.LockType) {
+		tm := setup(release)
+		expected := scanTransactions(tm, index.GetName(), key, lType)
+		holders := make([]uuid.UUID, 0)
+		for clientId := range tm.GetTransactions() {
+			holders = append(holders, clientId)
+		}
+		waiter := uuid.New()
+		if err := tm.Begin(waiter); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- tm.Lock(waiter, index, key, lType) }()
+		if len(expected) == 0 {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Release %v: lock %d on key %d waited with no conflicts", release, lType, key)
+			}
+		} else {
+			// The waiter has an edge to exactly the conflicting transactions
+			lines := make([]string, 0)
+			for _, tt := range expected {
+				lines = append(lines, fmt.Sprintf("%v -> %v\n", waiter, tt.GetClientID()))
+			}
+			sort.Strings(lines)
+			for strings.Count(waitsFor(tm), "\n") < len(expected) {
+				select {
+				case err := <-done:
+					t.Fatalf("Release %v: lock %d on key %d didn't wait on %d transactions: %v", release, lType, key, len(expected), err)
+				case <-time.After(time.Millisecond):
+				}
+			}
+			if edges := waitsFor(tm); edges != strings.Join(lines, "") {
+				t.Fatalf("Release %v: lock %d on key %d waits on\n%s\nexpected\n%s", release, lType, key, edges, strings.Join(lines, ""))
+			}
+		}
+		for _, clientId := range holders {
+			if err := tm.Commit(clientId); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(expected) != 0 {
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tm.Commit(waiter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, release := range []bool{false, true} {
+		for _, key := range []int64{0, 1, 2, 3, 6, 30, 62, 63, 99, 100, 150, 200, 201} {
+			for _, lType := range []concurrency.LockType{concurrency.R_LOCK, concurrency.W_LOCK} {
+				check(release, key, lType)
+			}
+		}
+	}
+}
+
+func testGraphPrune(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	graph := tm.GetGraph()
+	ids := beginLockingTransactions(t, tm, index, 4, 0, 1)
+	ts := make([]*concurrency.Transaction, 0)
+	for _, clientId := range ids {
+		tt, _ := tm.GetTransaction(clientId)
+		ts = append(ts, tt)
+	}
+	// Leak edges between every pair of transactions, as if their removal was skipped
+	for _, from := range ts {
+		for _, to := range ts {
+			if from != to {
+				graph.AddEdge(from, to)
+			}
+		}
+	}
+	if graph.Len() != 12 {
+		t.Fatalf("Expected 12 edges, got %d", graph.Len())
+	}
+	// Nothing is stale while every transaction is running
+	if pruned := tm.PruneGraph(); pruned != 0 {
+		t.Errorf("Pruned %d edges between running transactions", pruned)
+	}
+	// Commit two of them; only the edges between the other two should be kept
+	for _, clientId := range ids[:2] {
+		if err := tm.Commit(clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pruned := tm.PruneGraph(); pruned != 10 {
+		t.Errorf("Expected 10 edges to be pruned, got %d", pruned)
+	}
+	if graph.Len() != 2 {
+		t.Errorf("Expected 2 edges to be left, got %d", graph.Len())
+	}
+	// A client that begins again is a new transaction, so its old edges are stale
+	if err := tm.Begin(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	graph.AddEdge(ts[0], ts[2])
+	if pruned := tm.PruneGraph(); pruned != 1 {
+		t.Errorf("Expected the restarted client's old edge to be pruned, got %d", pruned)
+	}
+	// Committing enough transactions prunes the graph without being asked
+	for _, clientId := range append(ids[2:], ids[0]) {
+		if err := tm.Commit(clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	graph.AddEdge(ts[2], ts[3])
+	for i := 0; i < concurrency.PRUNE_INTERVAL; i++ {
+		clientId := uuid.New()
+		if err := tm.Begin(clientId); err != nil {
+			t.Fatal(err)
+		}
+		if err := tm.Commit(clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if graph.Len() != 0 {
+		t.Errorf("Expected committing to prune the graph, %d edges left", graph.Len())
+	}
+}
+
+func testDumpLocksReportsCycle(t *testing.T) {
+	index, dbName := openTempBTree(t)
+	defer os.Remove(dbName)
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	graph := tm.GetGraph()
+	ids := beginLockingTransactions(t, tm, index, 2, 0, 1)
+	t0, _ := tm.GetTransaction(ids[0])
+	t1, _ := tm.GetTransaction(ids[1])
+	dump := func() string {
+		var buf bytes.Buffer
+		if err := concurrency.HandleLocks(tm, ".locks", &buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	if out := dump(); !strings.Contains(out, "cycle: none") {
+		t.Errorf("Reported a cycle with nobody waiting:\n%s", out)
+	}
+	// The first transaction waits for the key the second one holds
+	locked := make(chan error, 1)
+	go func() {
+		locked <- tm.Lock(ids[0], index, 1, concurrency.W_LOCK)
+	}()
+	for graph.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Have the second wait for the first too, as if the deadlock went undetected
+	graph.AddEdge(t1, t0)
+	out := dump()
+	for _, expected := range []string{
+		"transactions: 2\n",
+		fmt.Sprintf("%v holds %s/0 (W)\n", ids[0], index.GetName()),
+		fmt.Sprintf("%v holds %s/1 (W)\n", ids[1], index.GetName()),
+		fmt.Sprintf("%v -> %v\n", ids[0], ids[1]),
+		fmt.Sprintf("%v -> %v\n", ids[1], ids[0]),
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in the dump:\n%s", expected, out)
+		}
+	}
+	first, second := ids[0], ids[1]
+	if second.String() < first.String() {
+		first, second = second, first
+	}
+	if !strings.Contains(out, fmt.Sprintf("cycle: %v -> %v -> %v\n", first, second, first)) {
+		t.Errorf("Expected the cycle in the dump:\n%s", out)
+	}
+	// Dumping doesn't change anything
+	if graph.Len() != 2 || len(tm.GetTransactions()) != 2 {
+		t.Errorf("Dumping changed the lock state")
+	}
+	// Break the cycle, and let the waiting transaction through
+	if err := graph.RemoveEdge(t1, t0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	if out = dump(); !strings.Contains(out, "transactions: 1\n") || !strings.Contains(out, "cycle: none") {
+		t.Errorf("Expected one transaction and no cycle:\n%s", out)
+	}
+	// The command is registered with the REPL
+	if _, ok := concurrency.TransactionREPL(nil, tm).GetCommands()[".locks"]; !ok {
+		t.Error("The REPL has no .locks command")
+	}
+}
+
+// Benchmark locking a key held by one of many running transactions.
+func BenchmarkLockAmongTransactions(b *testing.B) {
+	index, dbName := openTempBTree(b)
+	defer os.Remove(dbName)
+	defer index.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	beginLockingTransactions(b, tm, index, 500, 1, 10)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		clientId := uuid.New()
+		if err := tm.Begin(clientId); err != nil {
+			b.Fatal(err)
+		}
+		if err := tm.Lock(clientId, index, 0, concurrency.R_LOCK); err != nil {
+			b.Fatal(err)
+		}
+		if err := tm.Commit(clientId); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	db "github.com/brown-csci1270/db/pkg/db"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+func TestDatabase(t *testing.T) {
+	t.Run("TestDatabaseStats", testDatabaseStats)
+	t.Run("TestConvertBTreeToHash", testConvertBTreeToHash)
+	t.Run("TestReindex", testReindex)
+	t.Run("TestTableSchema", testTableSchema)
+	t.Run("TestOpStats", testOpStats)
+	t.Run("TestOpenReadOnly", testOpenReadOnly)
+}
+
+func testDatabaseStats(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	// Hash tables currently write their .meta file to the working directory.
+	defer os.Remove("hashed.meta")
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// Create a few tables of different sizes and types
+	sizes := map[string]int64{"small": 10, "large": 2000, "hashed": 500}
+	for name, n := range sizes {
+		indexType := "btree"
+		if name == "hashed" {
+			indexType = "hash"
+		}
+		if err = db.HandleCreateTable(d, fmt.Sprintf("create %s table %s", indexType, name), ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		table, err := d.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < n; i++ {
+			if err = table.Insert(i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Tables) != len(sizes) {
+		t.Fatalf("Expected stats for %d tables, got %d", len(sizes), len(stats.Tables))
+	}
+	// Each table's stats should match the table, and add up to the totals
+	var entries, pages int64
+	var used int
+	for name, table := range d.GetTables() {
+		tableStats := stats.Tables[name]
+		if tableStats.Entries != sizes[name] {
+			t.Errorf("Table %s: expected %d entries, got %d", name, sizes[name], tableStats.Entries)
+		}
+		if tableStats.Pages != table.GetPager().GetNumPages() {
+			t.Errorf("Table %s: expected %d pages, got %d", name, table.GetPager().GetNumPages(), tableStats.Pages)
+		}
+		if tableStats.Frames != table.GetPager().FrameStats() {
+			t.Errorf("Table %s: frame stats don't match the pager", name)
+		}
+		entries += tableStats.Entries
+		pages += tableStats.Pages
+		used += tableStats.Frames.Pinned + tableStats.Frames.Unpinned
+	}
+	if stats.Entries != entries || stats.Pages != pages {
+		t.Errorf("Totals don't add up: %d entries and %d pages, expected %d and %d", stats.Entries, stats.Pages, entries, pages)
+	}
+	if stats.TotalFrames != int64(len(sizes))*pager.NUMPAGES {
+		t.Errorf("Expected %d frames in total, got %d", int64(len(sizes))*pager.NUMPAGES, stats.TotalFrames)
+	}
+	if expected := float64(used) / float64(stats.TotalFrames); stats.Utilization() != expected {
+		t.Errorf("Expected utilization %v, got %v", expected, stats.Utilization())
+	}
+}
+
+func testConvertBTreeToHash(t *testing.T) {
+	srcName := getTempHashDB(t)
+	defer os.Remove(srcName)
+	dstName := getTempHashDB(t)
+	defer removeHashDB(dstName)
+	// Populate a B+ tree
+	src, err := btree.OpenTable(srcName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	n := int64(2000)
+	for i := int64(0); i < n; i++ {
+		if err = src.Insert(i*7, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every key should be findable in the converted index
+	dst, err := db.ConvertBTreeToHash(src, dstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if dst.Schema() != utils.DefaultSchema("hash") {
+		t.Errorf("Expected the converted index to keep the schema's columns, got %+v", dst.Schema())
+	}
+	for i := int64(0); i < n; i++ {
+		if entry, err := dst.Find(i * 7); err != nil || entry.GetValue() != i {
+			t.Fatalf("Key %d missing from the hash index: %v", i*7, err)
+		}
+	}
+	entries, err := dst.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != n {
+		t.Errorf("Expected %d entries, got %d", n, len(entries))
+	}
+}
+
+func testReindex(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	// Hash tables currently write their .meta file to the working directory.
+	defer os.Remove("converted.meta")
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err = db.HandleCreateTable(d, "create btree table converted id amount", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	n := 500
+	for i := 0; i < n; i++ {
+		if err = db.HandleInsert(d, fmt.Sprintf("insert %d %d into converted", i, i*2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Convert to a hash table and back, checking the contents each time
+	for _, indexType := range []string{"hash", "btree"} {
+		var out strings.Builder
+		if err = db.HandleReindex(d, "reindex converted "+indexType, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "converted to "+indexType) {
+			t.Errorf("Unexpected output %q", out.String())
+		}
+		table, err := d.GetTable("converted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, isBTree := table.(*btree.BTreeIndex); isBTree != (indexType == "btree") {
+			t.Fatalf("Table is not a %s after reindexing", indexType)
+		}
+		if schema := table.Schema(); schema.IndexType != indexType || schema.KeyName != "id" || schema.ValueName != "amount" {
+			t.Errorf("Unexpected schema %+v after converting to %s", schema, indexType)
+		}
+		for i := int64(0); i < int64(n); i++ {
+			if entry, err := table.Find(i); err != nil || entry.GetValue() != i*2 {
+				t.Fatalf("Key %d missing after converting to %s: %v", i, indexType, err)
+			}
+		}
+	}
+	// Converting to the type the table already has fails
+	if err = db.HandleReindex(d, "reindex converted btree", ioutil.Discard); err == nil {
+		t.Error("Expected reindexing to the same type to fail")
+	}
+	if _, err = os.Stat(folder + "/converted.reindex"); !os.IsNotExist(err) {
+		t.Error("Temporary index was left behind")
+	}
+}
+
+func testTableSchema(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	defer os.Remove("people.meta")
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Create a table with a schema, and one without
+	if err = db.HandleCreateTable(d, "create hash table people id age", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.HandleCreateTable(d, "create btree table plain", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.HandleCreateTable(d, "create btree table bad id id", ioutil.Discard); err == nil {
+		t.Error("Expected a schema with duplicate column names to be rejected")
+	}
+	people, err := d.GetTable("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = people.Insert(1, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopen the database; the tables come back with their schemas
+	d, err = db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	expected := map[string]utils.Schema{
+		"people": {KeyName: "id", ValueName: "age", IndexType: "hash"},
+		"plain":  utils.DefaultSchema("btree"),
+	}
+	for name, schema := range expected {
+		table, err := d.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.Schema() != schema {
+			t.Errorf("Table %s: expected schema %+v, got %+v", name, schema, table.Schema())
+		}
+	}
+	if _, err = d.GetTable("bad"); err == nil {
+		t.Error("Rejected table was created")
+	}
+	people, err = d.GetTable("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := people.Find(1); err != nil || entry.GetValue() != 30 {
+		t.Errorf("Reopened table lost its entry: %v", err)
+	}
+}
+
+func testOpStats(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	defer os.Remove("counted.meta")
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// Run a known mix of operations against a table of each type
+	expected := map[string]utils.OpStats{
+		"tree":    {Finds: 30, Inserts: 20, Updates: 5, Deletes: 3},
+		"counted": {Finds: 4, Inserts: 50, Updates: 10, Deletes: 25},
+	}
+	for name, ops := range expected {
+		indexType := "btree"
+		if name == "counted" {
+			indexType = "hash"
+		}
+		if err = db.HandleCreateTable(d, fmt.Sprintf("create %s table %s", indexType, name), ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		table, err := d.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < ops.Inserts; i++ {
+			if err = table.Insert(i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Failed operations count too
+		for i := int64(0); i < ops.Finds; i++ {
+			table.Find(i * 2)
+		}
+		for i := int64(0); i < ops.Updates; i++ {
+			table.Update(i, -i)
+		}
+		for i := int64(0); i < ops.Deletes; i++ {
+			table.Delete(i)
+		}
+		if table.OpStats() != ops {
+			t.Errorf("Table %s: expected %+v, got %+v", name, ops, table.OpStats())
+		}
+	}
+	// Stats reports each table's counts, and their totals, without counting its own scans
+	stats, err := d.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ops := range expected {
+		if stats.Tables[name].Ops != ops {
+			t.Errorf("Table %s: expected stats %+v, got %+v", name, ops, stats.Tables[name].Ops)
+		}
+	}
+	total := expected["tree"].Add(expected["counted"])
+	if stats.Ops != total {
+		t.Errorf("Expected total %+v, got %+v", total, stats.Ops)
+	}
+	if stats.Ops.Reads() != 34 || stats.Ops.Writes() != 113 {
+		t.Errorf("Expected 34 reads and 113 writes, got %d and %d", stats.Ops.Reads(), stats.Ops.Writes())
+	}
+	// Find-or-insert and bulk inserts count as inserts, and compare-and-swaps as updates
+	table, err := d.GetTable("counted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := table.(*hash.HashIndex)
+	for _, key := range []int64{0, 100, 101} {
+		if _, _, err = counted.FindOrInsert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []int64{100, 200} {
+		counted.CompareAndSwap(key, key, -key)
+	}
+	if err = counted.BulkInsert([]struct{ K, V int64 }{{300, 0}, {301, 0}, {302, 0}, {303, 0}}); err != nil {
+		t.Fatal(err)
+	}
+	ops := expected["counted"].Add(utils.OpStats{Inserts: 7, Updates: 2})
+	if counted.OpStats() != ops {
+		t.Errorf("Table counted: expected %+v, got %+v", ops, counted.OpStats())
+	}
+	if table, err = d.GetTable("tree"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.(*btree.BTreeIndex).CompareAndSwap(10, 10, 11); err != nil {
+		t.Fatal(err)
+	}
+	ops = expected["tree"].Add(utils.OpStats{Updates: 1})
+	if table.OpStats() != ops {
+		t.Errorf("Table tree: expected %+v, got %+v", ops, table.OpStats())
+	}
+}
+
+func testOpenReadOnly(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	defer os.Remove("inspected.meta")
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"create btree table tree", "create hash table inspected"} {
+		if err = db.HandleCreateTable(d, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"tree", "inspected"} {
+		table, err := d.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 1000; i++ {
+			if err = table.Insert(i, i*2); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(folder + "/tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reopen read-only: scans and finds work, writes are rejected
+	d, err = db.OpenReadOnly(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"tree", "inspected"} {
+		table, err := d.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !table.GetPager().IsReadOnly() {
+			t.Errorf("Table %s: expected its file to be opened read-only", name)
+		}
+		entries, err := table.Select()
+		if err != nil || len(entries) != 1000 {
+			t.Errorf("Table %s: expected to scan 1000 entries, got %d (%v)", name, len(entries), err)
+		}
+		if entry, err := table.Find(500); err != nil || entry.GetValue() != 1000 {
+			t.Errorf("Table %s: expected to find key 500: %v", name, err)
+		}
+		if err = table.Insert(5000, 1); !errors.Is(err, utils.ErrReadOnly) {
+			t.Errorf("Table %s: expected insert to return ErrReadOnly, got %v", name, err)
+		}
+		if err = table.Update(1, 1); !errors.Is(err, utils.ErrReadOnly) {
+			t.Errorf("Table %s: expected update to return ErrReadOnly, got %v", name, err)
+		}
+		if err = table.Delete(1); !errors.Is(err, utils.ErrReadOnly) {
+			t.Errorf("Table %s: expected delete to return ErrReadOnly, got %v", name, err)
+		}
+	}
+	if err = db.HandleCreateTable(d, "create btree table another", ioutil.Discard); !errors.Is(err, utils.ErrReadOnly) {
+		t.Errorf("Expected creating a table to return ErrReadOnly, got %v", err)
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing was written, and no recovery copy was made
+	after, err := ioutil.ReadFile(folder + "/tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("Expected the read-only table's file to be unchanged")
+	}
+	if _, err = os.Stat(strings.TrimSuffix(folder, "/") + "-recovery"); !os.IsNotExist(err) {
+		t.Error("Expected no recovery folder to be made")
+	}
+	if _, err = db.OpenReadOnly(folder + "-missing"); err == nil {
+		t.Error("Expected opening a missing folder read-only to fail")
+	}
+}
@@ -12,7 +12,7 @@ import (
 // Set to some other value
 var btree_salt = int64(999999)
 
-func getTempBTreeDB(t *testing.T) string {
+func getTempBTreeDB(t testing.TB) string {
 	tmpfile, err := ioutil.TempFile(".", "db-*")
 	if err != nil {
 		t.Error(err)
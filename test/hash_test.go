@@ -0,0 +1,1463 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Set to some other value
+var hash_salt = int64(7919)
+
+func getTempHashDB(t testing.TB) string {
+	tmpfile, err := ioutil.TempFile(".", "db-*")
+	if err != nil {
+		t.Error(err)
+	}
+	defer tmpfile.Close()
+	return tmpfile.Name()
+}
+
+// Remove a hash table's files.
+func removeHashDB(dbName string) {
+	os.Remove(dbName)
+	os.Remove(dbName + ".meta")
+	os.Remove(dbName + ".split")
+	os.Remove(dbName + ".schema")
+}
+
+func TestHash(t *testing.T) {
+	t.Run("TestHashSelectSorted", testHashSelectSorted)
+	t.Run("TestHashCompact", testHashCompact)
+	t.Run("TestHashErrors", testHashErrors)
+	t.Run("TestHashPrintKey", testHashPrintKey)
+	t.Run("TestHashSelectBuckets", testHashSelectBuckets)
+	t.Run("TestHashClosed", testHashClosed)
+	t.Run("TestHashSelectDuringSplits", testHashSelectDuringSplits)
+	t.Run("TestHashSelectChan", testHashSelectChan)
+	t.Run("TestHashBulkInsert", testHashBulkInsert)
+	t.Run("TestHashBulkInsertErrors", testHashBulkInsertErrors)
+	t.Run("TestHashBulkInsertSplitRecovery", testHashBulkInsertSplitRecovery)
+	t.Run("TestHashFindOrInsert", testHashFindOrInsert)
+	t.Run("TestHashBucketOverflow", testHashBucketOverflow)
+	t.Run("TestHashPageNumbers", testHashPageNumbers)
+	t.Run("TestHashSkewReport", testHashSkewReport)
+	t.Run("TestHashOverflowValue", testHashOverflowValue)
+	t.Run("TestHashMergeInto", testHashMergeInto)
+	t.Run("TestHashExtremeKeys", testHashExtremeKeys)
+	t.Run("TestHashSplitRecovery", testHashSplitRecovery)
+	t.Run("TestHashSplitRecoveryStalePages", testHashSplitRecoveryStalePages)
+	t.Run("TestHashCompactRecovery", testHashCompactRecovery)
+	t.Run("TestHashTornSplitRecord", testHashTornSplitRecord)
+	t.Run("TestHashOldFormatRejected", testHashOldFormatRejected)
+	t.Run("TestHashInRange", testHashInRange)
+}
+
+func testHashSelectSorted(t *testing.T) {
+	hashName := getTempHashDB(t)
+	defer removeHashDB(hashName)
+	btreeName := getTempBTreeDB(t)
+	defer os.Remove(btreeName)
+
+	// Init both indexes
+	hashIndex, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	btreeIndex, err := btree.OpenTable(btreeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	// Insert the same entries, in scrambled order, enough to cause splits
+	n := int64(1000)
+	for i := int64(0); i < n; i++ {
+		key := (i * hash_salt) % n
+		if err = hashIndex.Insert(key, key*2); err != nil {
+			t.Fatal(err)
+		}
+		if err = btreeIndex.Insert(key, key*2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Sorted select should match the B+ tree's scan order
+	hashEntries, err := hashIndex.SelectOrdered(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	btreeEntries, err := btreeIndex.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(hashEntries)) != n || len(hashEntries) != len(btreeEntries) {
+		t.Fatalf("Expected %d entries, got %d and %d", n, len(hashEntries), len(btreeEntries))
+	}
+	for i := range hashEntries {
+		if i > 0 && hashEntries[i-1].GetKey() >= hashEntries[i].GetKey() {
+			t.Fatal("Select output is not sorted by key")
+		}
+		if hashEntries[i].GetKey() != btreeEntries[i].GetKey() ||
+			hashEntries[i].GetValue() != btreeEntries[i].GetValue() {
+			t.Fatalf("Entry %d differs from the B+ tree scan", i)
+		}
+	}
+	// The unsorted path should return the same entries
+	unsorted, err := hashIndex.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unsorted) != len(hashEntries) {
+		t.Errorf("Unsorted select returned %d entries, expected %d", len(unsorted), len(hashEntries))
+	}
+}
+
+func testHashCompact(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+
+	// Init the database
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert enough entries to split a lot, then delete most of them
+	n := int64(3000)
+	kept := int64(50)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := kept; i < n; i++ {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Compact
+	before := index.GetTable().GetPager().GetNumPages()
+	if err = index.GetTable().Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after := index.GetTable().GetPager().GetNumPages()
+	if after >= before {
+		t.Errorf("Page count did not drop: %d before, %d after", before, after)
+	}
+	// All remaining keys should be findable, before and after reopening
+	for reopen := 0; reopen < 2; reopen++ {
+		for i := int64(0); i < n; i++ {
+			entry, err := index.Find(i)
+			if i < kept && (err != nil || entry.GetValue() != i%hash_salt) {
+				t.Errorf("Could not find entry %d", i)
+			}
+			if i >= kept && err == nil {
+				t.Errorf("Found deleted entry %d", i)
+			}
+		}
+		index.Close()
+		if index, err = hash.OpenTable(dbName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if index.GetTable().GetPager().GetNumPages() != after {
+		t.Error("Page count changed after reopening")
+	}
+	index.Close()
+}
+
+func testHashErrors(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+
+	// Init the database
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err = index.Insert(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	// Each failure should match its sentinel error
+	if err = index.Insert(1, 2); !errors.Is(err, utils.ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	if entry, err := index.Find(1); err != nil || entry.GetValue() != 1 {
+		t.Errorf("Duplicate insert changed the entry: %v", err)
+	}
+	// The table underneath still allows repeated keys, which joins rely on
+	if err = index.GetTable().Insert(1, 3); err != nil {
+		t.Errorf("Expected the table to take a repeated key, got %v", err)
+	}
+	if _, err = index.Find(2); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err = index.Update(2, 2); !errors.Is(err, utils.ErrUpdateMissing) {
+		t.Errorf("Expected ErrUpdateMissing, got %v", err)
+	}
+	if err = index.Delete(2); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func testHashPrintKey(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+
+	// Init the database
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Insert enough entries to split a few times
+	n := int64(1000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each key's bucket should contain that key
+	for _, key := range []int64{0, 1, n / 2, n - 1} {
+		var buf bytes.Buffer
+		index.GetTable().PrintKey(key, &buf)
+		out := buf.String()
+		if !strings.Contains(out, fmt.Sprintf("(%d, %d), ", key, key%hash_salt)) {
+			t.Errorf("Bucket printed for key %d does not contain it:\n%s", key, out)
+		}
+		if !strings.Contains(out, "bucket depth:") || !strings.Contains(out, "directory aliases:") {
+			t.Errorf("Bucket printed for key %d is missing its header:\n%s", key, out)
+		}
+	}
+}
+
+func testHashSelectBuckets(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+
+	// Init the database
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Insert enough entries to split a lot
+	n := int64(3000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert((i*hash_salt)%n, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Split the buckets into 4 groups, covering each bucket once
+	groups := index.GetTable().BucketRanges(4)
+	if len(groups) != 4 {
+		t.Fatalf("Expected 4 groups, got %d", len(groups))
+	}
+	seen := make(map[int64]bool)
+	for _, group := range groups {
+		if len(group) == 0 {
+			t.Error("Got an empty group")
+		}
+		for _, pn := range group {
+			if seen[pn] {
+				t.Errorf("Bucket %d is in more than one group", pn)
+			}
+			seen[pn] = true
+		}
+	}
+	// Scan each group in parallel and union the results
+	results := make(chan []utils.Entry, len(groups))
+	errs := make(chan error, len(groups))
+	for _, group := range groups {
+		go func(group []int64) {
+			entries, err := index.GetTable().SelectBuckets(group)
+			errs <- err
+			results <- entries
+		}(group)
+	}
+	union := make([]utils.Entry, 0)
+	for range groups {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		union = append(union, <-results...)
+	}
+	sort.Slice(union, func(i, j int) bool { return union[i].GetKey() < union[j].GetKey() })
+	// The union should equal the full select
+	all, err := index.SelectOrdered(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(union) != len(all) {
+		t.Fatalf("Union has %d entries, full select has %d", len(union), len(all))
+	}
+	for i := range all {
+		if union[i].GetKey() != all[i].GetKey() || union[i].GetValue() != all[i].GetValue() {
+			t.Fatalf("Entry %d differs from the full select", i)
+		}
+	}
+}
+
+func testHashClosed(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+
+	// Init the database, insert an entry, then close it
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Insert(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Every operation should now fail cleanly
+	if _, err = index.Find(1); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("Find: expected ErrIndexClosed, got %v", err)
+	}
+	if err = index.Insert(2, 2); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("Insert: expected ErrIndexClosed, got %v", err)
+	}
+	if err = index.Delete(1); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("Delete: expected ErrIndexClosed, got %v", err)
+	}
+	if _, err = index.TableStart(); !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("TableStart: expected ErrIndexClosed, got %v", err)
+	}
+	// Closing again is a no-op
+	if err = index.Close(); err != nil {
+		t.Errorf("Closing twice failed: %v", err)
+	}
+}
+
+func testHashSelectDuringSplits(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+
+	// Init the database with a baseline of entries
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	baseline := int64(500)
+	for i := int64(0); i < baseline; i++ {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Insert more entries in the background, splitting buckets as we go
+	n := int64(5000)
+	done := make(chan error)
+	go func() {
+		for i := baseline; i < n; i++ {
+			if err := index.Insert(i, i); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	// Every select should see each baseline entry exactly once, and no entry twice
+	check := func(entries []utils.Entry) {
+		seen := make(map[int64]bool)
+		for _, entry := range entries {
+			if seen[entry.GetKey()] {
+				t.Fatalf("Entry %d was selected twice", entry.GetKey())
+			}
+			seen[entry.GetKey()] = true
+		}
+		for i := int64(0); i < baseline; i++ {
+			if !seen[i] {
+				t.Fatalf("Baseline entry %d was not selected", i)
+			}
+		}
+	}
+	for running := true; running; {
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			running = false
+		default:
+		}
+		entries, err := index.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(entries)
+	}
+	// Once quiescent, everything should be there
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(entries)
+	if int64(len(entries)) != n {
+		t.Errorf("Expected %d entries, got %d", n, len(entries))
+	}
+}
+
+func testHashSelectChan(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+
+	// Init the database
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(3000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert((i*hash_salt)%n, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Draining the stream should give the same entries as Select
+	expected, err := index.SelectOrdered(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, errs := index.SelectChan(context.Background())
+	streamed := make([]utils.Entry, 0)
+	for entry := range entries {
+		streamed = append(streamed, entry)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(streamed, func(i, j int) bool { return streamed[i].GetKey() < streamed[j].GetKey() })
+	if len(streamed) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), len(streamed))
+	}
+	for i := range expected {
+		if streamed[i].GetKey() != expected[i].GetKey() || streamed[i].GetValue() != expected[i].GetValue() {
+			t.Fatalf("Entry %d differs from Select", i)
+		}
+	}
+	// Consume part of the stream, then cancel; the producer should stop
+	ctx, cancel := context.WithCancel(context.Background())
+	entries, errs = index.SelectChan(ctx)
+	for i := 0; i < 10; i++ {
+		<-entries
+	}
+	cancel()
+	extra := 0
+	for range entries {
+		extra++
+	}
+	if extra > 1 {
+		t.Errorf("Producer sent %d entries after being cancelled", extra)
+	}
+	if err = <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	// The producer should have released the table
+	if err = index.Insert(n, n); err != nil {
+		t.Fatal(err)
+	}
+	// A closed index streams nothing but the error
+	index.Close()
+	entries, errs = index.SelectChan(context.Background())
+	if _, ok := <-entries; ok {
+		t.Error("Closed index streamed an entry")
+	}
+	if err = <-errs; !errors.Is(err, utils.ErrIndexClosed) {
+		t.Errorf("Expected ErrIndexClosed, got %v", err)
+	}
+}
+
+func testHashFindOrInsert(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+
+	// Init the database, filling it enough that inserts split
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(1000)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Existing keys are found, not inserted
+	if entry, inserted, err := index.FindOrInsert(1, 100); err != nil || inserted || entry.GetValue() != 1 {
+		t.Errorf("Expected to find (1, 1), got %v (inserted: %v, %v)", entry, inserted, err)
+	}
+	// Many goroutines race to insert each new key; exactly one should win
+	workers := 20
+	for key := n; key < 2*n; key++ {
+		var wg sync.WaitGroup
+		values := make(chan int64, workers)
+		inserts := make(chan int64, workers)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(value int64) {
+				defer wg.Done()
+				entry, inserted, err := index.FindOrInsert(key, value)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				values <- entry.GetValue()
+				if inserted {
+					inserts <- value
+				}
+			}(int64(w))
+		}
+		wg.Wait()
+		close(values)
+		close(inserts)
+		if len(inserts) != 1 {
+			t.Fatalf("Expected exactly one insert of key %d, got %d", key, len(inserts))
+		}
+		winner := <-inserts
+		for value := range values {
+			if value != winner {
+				t.Fatalf("Key %d was inserted with %d, but a caller got %d", key, winner, value)
+			}
+		}
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != 2*n {
+		t.Errorf("Expected %d entries, got %d", 2*n, len(entries))
+	}
+}
+
+// Make n key-value pairs, with keys scattered over [offset, offset+n).
+func makePairs(n int64, offset int64) []struct{ K, V int64 } {
+	pairs := make([]struct{ K, V int64 }, n)
+	for i := int64(0); i < n; i++ {
+		pairs[i].K = offset + (i*hash_salt)%n
+		pairs[i].V = i
+	}
+	return pairs
+}
+
+// Describe a hash table's directory and contents, independently of where its buckets are stored.
+// For each hash, lists the first hash sharing its bucket, the bucket's depth, and its sorted entries.
+func describeHashTable(t *testing.T, table *hash.HashTable) []string {
+	first := make(map[int64]int)
+	ret := make([]string, 0)
+	for i, pn := range table.GetBuckets() {
+		if _, ok := first[pn]; !ok {
+			first[pn] = i
+		}
+		bucket, err := table.GetBucket(int64(i), hash.NO_LOCK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := bucket.Select()
+		bucket.GetPage().Put()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].GetKey() < entries[j].GetKey() })
+		var sb strings.Builder
+		for _, entry := range entries {
+			sb.WriteString(fmt.Sprintf("(%d, %d)", entry.GetKey(), entry.GetValue()))
+		}
+		ret = append(ret, fmt.Sprintf("%d %d %s", first[pn], bucket.GetDepth(), sb.String()))
+	}
+	return ret
+}
+
+func testHashBulkInsert(t *testing.T) {
+	seqName := getTempHashDB(t)
+	defer removeHashDB(seqName)
+	bulkName := getTempHashDB(t)
+	defer removeHashDB(bulkName)
+
+	// Init the databases, with some entries already in them
+	seq, err := hash.OpenTable(seqName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seq.Close()
+	bulk, err := hash.OpenTable(bulkName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bulk.Close()
+	existing := makePairs(500, 0)
+	for _, pair := range existing {
+		if err = seq.Insert(pair.K, pair.V); err != nil {
+			t.Fatal(err)
+		}
+		if err = bulk.Insert(pair.K, pair.V); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Insert the same pairs one at a time and in bulk
+	pairs := makePairs(5000, 500)
+	for _, pair := range pairs {
+		if err = seq.Insert(pair.K, pair.V); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = bulk.BulkInsert(pairs); err != nil {
+		t.Fatal(err)
+	}
+	// The directories and their contents should match
+	if seq.GetTable().GetDepth() != bulk.GetTable().GetDepth() {
+		t.Fatalf("Global depths differ: %d sequential, %d bulk", seq.GetTable().GetDepth(), bulk.GetTable().GetDepth())
+	}
+	seqDesc := describeHashTable(t, seq.GetTable())
+	bulkDesc := describeHashTable(t, bulk.GetTable())
+	for i := range seqDesc {
+		if seqDesc[i] != bulkDesc[i] {
+			t.Fatalf("Hash %d differs:\nsequential: %s\nbulk: %s", i, seqDesc[i], bulkDesc[i])
+		}
+	}
+	for _, pair := range append(existing, pairs...) {
+		if entry, err := bulk.Find(pair.K); err != nil || entry.GetValue() != pair.V {
+			t.Fatalf("Could not find key %d: %v", pair.K, err)
+		}
+	}
+}
+
+func testHashBulkInsertErrors(t *testing.T) {
+	hashName := getTempHashDB(t)
+	defer removeHashDB(hashName)
+	index, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for key := int64(0); key < 10; key++ {
+		if err = index.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := describeHashTable(t, index.GetTable())
+	// A key that is already in the index, or that is given twice, is rejected like Insert does
+	existing := makePairs(1000, 5)
+	if err = index.BulkInsert(existing); !errors.Is(err, utils.ErrKeyExists) {
+		t.Fatalf("Expected ErrKeyExists for a key already in the index, got %v", err)
+	}
+	repeated := append(makePairs(1000, 100), struct{ K, V int64 }{150, 0})
+	if err = index.BulkInsert(repeated); !errors.Is(err, utils.ErrKeyExists) {
+		t.Fatalf("Expected ErrKeyExists for a repeated key, got %v", err)
+	}
+	// As many copies of a key as fill a bucket are rejected like Insert does, rather than split forever
+	copies := make([]struct{ K, V int64 }, hash.BUCKETSIZE)
+	for i := range copies {
+		copies[i].K, copies[i].V = 500, int64(i)
+	}
+	if err = index.GetTable().BulkInsert(copies); !errors.Is(err, hash.ErrBucketOverflow) {
+		t.Fatalf("Expected ErrBucketOverflow, got %v", err)
+	}
+	// None of the rejected pairs were inserted
+	after := describeHashTable(t, index.GetTable())
+	if !reflect.DeepEqual(before, after) {
+		t.Fatal("Rejected bulk inserts changed the table")
+	}
+	// Each pair counts as an insert
+	if inserts := index.OpStats().Inserts; inserts != 10+1000+1001 {
+		t.Errorf("Expected %d inserts, got %d", 10+1000+1001, inserts)
+	}
+}
+
+func testHashBulkInsertSplitRecovery(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+	crashName := getTempHashDB(t)
+	defer removeHashDB(crashName)
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(3000)
+	pairs := make([]struct{ K, V int64 }, n)
+	for i := range pairs {
+		pairs[i].K, pairs[i].V = int64(i), int64(i)*10
+	}
+	if err = index.BulkInsert(pairs); err != nil {
+		t.Fatal(err)
+	}
+	// The table is written out once the pairs are in, so there is nothing to redo.
+	if _, err = os.Stat(dbName + ".split"); !os.IsNotExist(err) {
+		t.Error("Expected the split log to be removed once the pairs were inserted")
+	}
+	crashHashDB(t, dbName, crashName)
+	recovered, err := hash.OpenTable(crashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	checkHashKeys(t, recovered, 0, n)
+}
+
+// Benchmark inserting pairs into an empty hash table one at a time.
+func BenchmarkHashSequentialInsert(b *testing.B) {
+	pairs := makePairs(5000, 0)
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		dbName := getTempHashDB(b)
+		index, err := hash.OpenTable(dbName)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		for _, pair := range pairs {
+			if err = index.Insert(pair.K, pair.V); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		index.Close()
+		removeHashDB(dbName)
+	}
+}
+
+// Benchmark inserting the same pairs into an empty hash table in bulk.
+func BenchmarkHashBulkInsert(b *testing.B) {
+	pairs := makePairs(5000, 0)
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		dbName := getTempHashDB(b)
+		index, err := hash.OpenTable(dbName)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if err = index.BulkInsert(pairs); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		index.Close()
+		removeHashDB(dbName)
+	}
+}
+
+func testHashBucketOverflow(t *testing.T) {
+	hashName := getTempHashDB(t)
+	defer removeHashDB(hashName)
+	index, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	table := index.GetTable()
+	// Copies of a key can't be split up, so they fill a bucket and no more
+	for i := int64(0); i < hash.BUCKETSIZE-1; i++ {
+		if err = table.Insert(7, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	depth := table.GetDepth()
+	if err = table.Insert(7, 0); !errors.Is(err, hash.ErrBucketOverflow) {
+		t.Fatalf("Expected ErrBucketOverflow, got %v", err)
+	}
+	if table.GetDepth() != depth {
+		t.Errorf("Overflowing insert changed the depth from %d to %d", depth, table.GetDepth())
+	}
+	// Other keys still go in, splitting the copies away from them
+	for i := int64(100); i < 200; i++ {
+		if err = table.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != hash.BUCKETSIZE-1+100 {
+		t.Errorf("Expected %d entries, got %d", hash.BUCKETSIZE-1+100, len(entries))
+	}
+}
+
+func testHashPageNumbers(t *testing.T) {
+	hashName := getTempHashDB(t)
+	defer removeHashDB(hashName)
+	index, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Split some buckets, then merge some of them back
+	for i := int64(0); i < 3000; i++ {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 2500; i++ {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.GetTable().Compact(); err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+	index, err = hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	pagenums := index.GetTable().PageNumbers()
+	if int64(len(pagenums)) > pager.NUMPAGES {
+		t.Fatalf("Expected the table to fit in the buffer pool, got %d pages", len(pagenums))
+	}
+	for i, pn := range pagenums {
+		if pn < 0 || pn >= index.GetTable().GetPager().GetNumPages() || (i > 0 && pn <= pagenums[i-1]) {
+			t.Fatalf("Bad page numbers %v", pagenums)
+		}
+	}
+	// A full scan only touches the table's buckets, and all of them
+	if _, err = index.Select(); err != nil {
+		t.Fatal(err)
+	}
+	state := index.GetTable().GetPager().DumpState()
+	resident := append(state.Unpinned, state.Pinned...)
+	sort.Slice(resident, func(i, j int) bool { return resident[i] < resident[j] })
+	if !reflect.DeepEqual(resident, pagenums) {
+		t.Errorf("Expected the resident pages %v to be the table's buckets %v", resident, pagenums)
+	}
+}
+
+func testHashSkewReport(t *testing.T) {
+	check := func(keys []int64) hash.SkewStats {
+		hashName := getTempHashDB(t)
+		defer removeHashDB(hashName)
+		index, err := hash.OpenTable(hashName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		for _, key := range keys {
+			if err = index.Insert(key, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats, err := index.GetTable().SkewReport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Buckets != len(index.GetTable().PageNumbers()) {
+			t.Errorf("Expected %d buckets, got %d", len(index.GetTable().PageNumbers()), stats.Buckets)
+		}
+		if total := stats.Mean * float64(stats.Buckets); math.Abs(total-float64(len(keys))) > 0.5 {
+			t.Errorf("Bucket counts add up to %f, expected %d", total, len(keys))
+		}
+		if stats.Min > stats.Max || float64(stats.Max) < stats.Mean || stats.StdDev < 0 {
+			t.Errorf("Inconsistent stats %+v", stats)
+		}
+		return stats
+	}
+	// Sequential keys spread evenly over the buckets
+	balanced := make([]int64, 0)
+	for key := int64(0); key < 20000; key++ {
+		balanced = append(balanced, key)
+	}
+	if stats := check(balanced); stats.MaxToMean > 1.5 {
+		t.Errorf("Expected balanced keys to have a max to mean ratio near 1, got %+v", stats)
+	}
+	// Keys that share the low bits of their hash pile up in a few buckets,
+	// leaving the buckets split off along the way empty
+	skewed := make([]int64, 0)
+	for key := int64(0); len(skewed) < 600; key++ {
+		if hash.Hasher(key, 12) == 0 {
+			skewed = append(skewed, key)
+		}
+	}
+	if stats := check(skewed); stats.MaxToMean < 3 || stats.Min != 0 {
+		t.Errorf("Expected skewed keys to have a max to mean ratio of at least 3, got %+v", stats)
+	}
+	// An empty table has no skew
+	if stats := check(nil); stats.MaxToMean != 0 || stats.Max != 0 {
+		t.Errorf("Expected an empty table to have no skew, got %+v", stats)
+	}
+}
+
+func testHashOverflowValue(t *testing.T) {
+	hashName := getTempHashDB(t)
+	defer removeHashDB(hashName)
+	index, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 500; i++ {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A value that spans several overflow pages
+	value := make([]byte, 10000)
+	for i := range value {
+		value[i] = byte(i * 7)
+	}
+	if err = index.InsertBytes(1000, value); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.InsertBytes(1001, make([]byte, hash.MAX_VALUE_SIZE+1)); !errors.Is(err, hash.ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	// The value is read back after reopening the table, by finds and by scans
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entry, err := index.Find(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entry.(hash.HashEntry).GetBytes(), value) || entry.GetValue() != int64(len(value)) {
+		t.Error("Found the wrong value")
+	}
+	if entry, err = index.Find(499); err != nil || entry.(hash.HashEntry).GetBytes() != nil || entry.GetValue() != 499 {
+		t.Error("Expected other keys to keep their values")
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 501 || !bytes.Equal(entries[500].(hash.HashEntry).GetBytes(), value) {
+		t.Error("Expected a scan to read the value")
+	}
+	// Walking the pages with a cursor skips over the overflow pages
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := 0
+	for {
+		if !cursor.IsEnd() {
+			seen++
+		}
+		if cursor.StepForward() != nil {
+			break
+		}
+	}
+	if seen != 501 {
+		t.Errorf("Expected the cursor to see 501 entries, saw %d", seen)
+	}
+	// Deleting the key frees its overflow pages, which the next value reuses
+	numPages := index.GetPager().GetNumPages()
+	if err = index.Delete(1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = index.Find(1000); !errors.Is(err, utils.ErrKeyNotFound) {
+		t.Errorf("Expected the deleted key to be gone, got %v", err)
+	}
+	if err = index.InsertBytes(2000, value[:5000]); err != nil {
+		t.Fatal(err)
+	}
+	if index.GetPager().GetNumPages() != numPages {
+		t.Errorf("Expected the freed overflow pages to be reused, the file grew from %d to %d pages", numPages, index.GetPager().GetNumPages())
+	}
+	if entry, err = index.Find(2000); err != nil || !bytes.Equal(entry.(hash.HashEntry).GetBytes(), value[:5000]) {
+		t.Error("Found the wrong value after reusing pages")
+	}
+	// Compacting the table moves buckets around the overflow pages
+	for i := int64(0); i < 500; i++ {
+		if err = index.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.GetTable().Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err = index.Find(2000); err != nil || !bytes.Equal(entry.(hash.HashEntry).GetBytes(), value[:5000]) {
+		t.Error("Found the wrong value after compacting")
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Errorf("Expected a valid hash table, got %v", err)
+	}
+}
+
+func testHashMergeInto(t *testing.T) {
+	// Fill a destination with keys [0, 1000) and a source with keys [500, 1500),
+	// where key 700 of the source has a value of bytes.
+	value := bytes.Repeat([]byte("merged"), 2000)
+	open := func() (dst *hash.HashIndex, src *hash.HashIndex, cleanup func()) {
+		dstName := getTempHashDB(t)
+		srcName := getTempHashDB(t)
+		cleanup = func() {
+			removeHashDB(dstName)
+			removeHashDB(srcName)
+		}
+		dst, err := hash.OpenTable(dstName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err = hash.OpenTable(srcName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 1000; i++ {
+			if err = dst.Insert(i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := int64(500); i < 1500; i++ {
+			if i == 700 {
+				err = src.InsertBytes(i, value)
+			} else {
+				err = src.Insert(i, i*2)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dst, src, cleanup
+	}
+	check := func(dst *hash.HashIndex, n int64, expected func(key int64) int64) {
+		if ok, err := hash.IsHash(dst); err != nil || !ok {
+			t.Errorf("Expected the merged table's entries to be in the right buckets (%v)", err)
+		}
+		entries, err := dst.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(entries)) != n {
+			t.Errorf("Expected %d entries, got %d", n, len(entries))
+		}
+		for _, entry := range entries {
+			if entry.GetKey() == 700 && expected(700) < 0 {
+				if !bytes.Equal(entry.(hash.HashEntry).GetBytes(), value) {
+					t.Error("Expected key 700 to have the source's bytes")
+				}
+			} else if entry.GetValue() != expected(entry.GetKey()) {
+				t.Errorf("Key %d has value %d, expected %d", entry.GetKey(), entry.GetValue(), expected(entry.GetKey()))
+			}
+		}
+	}
+	// Erroring on collisions leaves the destination as it was
+	dst, src, cleanup := open()
+	err := hash.MergeInto(dst.GetTable(), src.GetTable(), hash.MergeError)
+	if !errors.Is(err, utils.ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	check(dst, 1000, func(key int64) int64 { return key })
+	// So does a key that the source has twice, even if the destination doesn't have it
+	if err = src.GetTable().Insert(1200, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(500); i < 1000; i++ {
+		if err = dst.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = hash.MergeInto(dst.GetTable(), src.GetTable(), hash.MergeError)
+	if !errors.Is(err, utils.ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists for a repeated key, got %v", err)
+	}
+	check(dst, 500, func(key int64) int64 { return key })
+	dst.Close()
+	src.Close()
+	cleanup()
+	// Overwriting takes the source's values, including its bytes
+	dst, src, cleanup = open()
+	if err = hash.MergeInto(dst.GetTable(), src.GetTable(), hash.MergeOverwrite); err != nil {
+		t.Fatal(err)
+	}
+	check(dst, 1500, func(key int64) int64 {
+		if key == 700 {
+			return -1
+		} else if key >= 500 {
+			return key * 2
+		}
+		return key
+	})
+	dst.Close()
+	src.Close()
+	cleanup()
+	// Keeping takes the source's values only for new keys
+	dst, src, cleanup = open()
+	defer cleanup()
+	defer src.Close()
+	defer dst.Close()
+	if err = hash.MergeInto(dst.GetTable(), src.GetTable(), hash.MergeKeep); err != nil {
+		t.Fatal(err)
+	}
+	check(dst, 1500, func(key int64) int64 {
+		if key >= 1000 {
+			return key * 2
+		}
+		return key
+	})
+	// The source is left as it was
+	if entries, err := src.Select(); err != nil || len(entries) != 1000 {
+		t.Errorf("Expected the source to keep its 1000 entries, got %d (%v)", len(entries), err)
+	}
+	if err = hash.MergeInto(dst.GetTable(), dst.GetTable(), hash.MergeKeep); err == nil {
+		t.Error("Expected merging a table into itself to fail")
+	}
+}
+
+func testHashExtremeKeys(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Enough keys for the table to split, with the extremes among them
+	keys := extremeKeys()
+	for _, key := range keys {
+		if err = index.Insert(key, key/2); err != nil {
+			t.Fatalf("Could not insert key %d: %v", key, err)
+		}
+	}
+	if index.GetTable().GetDepth() <= 2 {
+		t.Fatal("Expected the table to have split")
+	}
+	for _, key := range keys {
+		if entry, err := index.Find(key); err != nil || entry.GetValue() != key/2 {
+			t.Fatalf("Could not find key %d: %v", key, err)
+		}
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned := make(map[int64]bool)
+	for _, entry := range entries {
+		scanned[entry.GetKey()] = true
+	}
+	if len(entries) != len(keys) || len(scanned) != len(keys) {
+		t.Fatalf("Expected %d distinct entries, got %d entries with %d keys", len(keys), len(entries), len(scanned))
+	}
+	for _, key := range keys {
+		if !scanned[key] {
+			t.Fatalf("Key %d was not scanned", key)
+		}
+	}
+	for _, key := range []int64{math.MinInt64, 0, math.MaxInt64} {
+		if err = index.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = index.Find(key); err == nil {
+			t.Errorf("Deleted key %d was still found", key)
+		}
+	}
+}
+
+// Copies a hash table's files, as they are on disk, to another name, as if the
+// table had crashed at this point.
+func crashHashDB(t *testing.T, dbName string, crashName string) {
+	for _, suffix := range []string{"", ".meta", ".split"} {
+		data, err := ioutil.ReadFile(dbName + suffix)
+		if os.IsNotExist(err) {
+			os.Remove(crashName + suffix)
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(crashName+suffix, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Checks that the entries are in the right buckets, each only once, and that
+// the keys in [from, to) can all be found with values ten times their key.
+func checkHashKeys(t *testing.T, index *hash.HashIndex, from int64, to int64) {
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Fatalf("Entries are in the wrong buckets: %v", err)
+	}
+	for key := from; key < to; key++ {
+		entry, err := index.Find(key)
+		if err != nil {
+			t.Fatalf("Key %d is missing: %v", key, err)
+		}
+		if entry.GetValue() != key*10 {
+			t.Fatalf("Key %d has value %d, expected %d", key, entry.GetValue(), key*10)
+		}
+	}
+	// No entry is left behind in the bucket it moved out of.
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int64]bool)
+	for _, entry := range entries {
+		if seen[entry.GetKey()] {
+			t.Fatalf("Key %d is in more than one bucket", entry.GetKey())
+		}
+		seen[entry.GetKey()] = true
+	}
+}
+
+func testHashSplitRecovery(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+	crashName := getTempHashDB(t)
+	defer removeHashDB(crashName)
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	meta, err := ioutil.ReadFile(dbName + ".meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int64(3000)
+	for key := int64(0); key < n; key++ {
+		if err = index.Insert(key, key*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Splits are logged, rather than written out to the directory each time.
+	if after, err := ioutil.ReadFile(dbName + ".meta"); err != nil || !bytes.Equal(meta, after) {
+		t.Fatal("Expected the directory not to be written out by splits")
+	}
+	if _, err = os.Stat(dbName + ".split"); err != nil {
+		t.Fatalf("Expected the splits to be logged: %v", err)
+	}
+	// Crash once the pages are on disk, but the directory is still the empty table's.
+	if err = index.GetPager().Sync(); err != nil {
+		t.Fatal(err)
+	}
+	crashHashDB(t, dbName, crashName)
+	recovered, err := hash.OpenTable(crashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(crashName + ".split"); !os.IsNotExist(err) {
+		t.Error("Expected the split log to be removed once the splits were redone")
+	}
+	checkHashKeys(t, recovered, 0, n)
+	if entries, err := recovered.Select(); err != nil || int64(len(entries)) != n {
+		t.Fatalf("Expected %d entries, got %d: %v", n, len(entries), err)
+	}
+	if err = recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A checkpoint writes the directory out and clears the log.
+	if err = index.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dbName + ".split"); !os.IsNotExist(err) {
+		t.Error("Expected the split log to be removed by a checkpoint")
+	}
+	for key := n; key < 2*n; key++ {
+		if err = index.Insert(key, key*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.GetPager().Sync(); err != nil {
+		t.Fatal(err)
+	}
+	crashHashDB(t, dbName, crashName)
+	if recovered, err = hash.OpenTable(crashName); err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	checkHashKeys(t, recovered, 0, 2*n)
+}
+
+func testHashSplitRecoveryStalePages(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+	crashName := getTempHashDB(t)
+	defer removeHashDB(crashName)
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(1000)
+	for key := int64(0); key < n; key++ {
+		if err = index.Insert(key, key*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.GetPager().Sync(); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := ioutil.ReadFile(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := n; key < 3*n; key++ {
+		if err = index.Insert(key, key*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Crash with none of the later splits' pages on disk, so that their buckets
+	// have to be rebuilt from the log.
+	crashHashDB(t, dbName, crashName)
+	if err = ioutil.WriteFile(crashName, stale, 0666); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := hash.OpenTable(crashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	checkHashKeys(t, recovered, 0, n)
+}
+
+func testHashCompactRecovery(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+	crashName := getTempHashDB(t)
+	defer removeHashDB(crashName)
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Split a lot, then delete most of the entries and merge the buckets back
+	n := int64(3000)
+	kept := int64(50)
+	for key := int64(0); key < n; key++ {
+		if err = index.Insert(key, key*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := kept; key < n; key++ {
+		if err = index.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.GetTable().Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// The splits from before the merges must not be redone over them.
+	if _, err = os.Stat(dbName + ".split"); !os.IsNotExist(err) {
+		t.Error("Expected the split log to be removed once the table was compacted")
+	}
+	crashHashDB(t, dbName, crashName)
+	recovered, err := hash.OpenTable(crashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	checkHashKeys(t, recovered, 0, kept)
+	if entries, err := recovered.Select(); err != nil || int64(len(entries)) != kept {
+		t.Fatalf("Expected %d entries after recovery, got %d: %v", kept, len(entries), err)
+	}
+}
+
+func testHashTornSplitRecord(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+	crashName := getTempHashDB(t)
+	defer removeHashDB(crashName)
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(1000)
+	for key := int64(0); key < n; key++ {
+		if err = index.Insert(key, key*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.GetPager().Sync(); err != nil {
+		t.Fatal(err)
+	}
+	crashHashDB(t, dbName, crashName)
+	// A record that was cut off means its split never started.
+	log, err := os.OpenFile(crashName+".split", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = log.Write([]byte{100, 0, 0, 0, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	recovered, err := hash.OpenTable(crashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHashKeys(t, recovered, 0, n)
+	// The directory written on close is read back after further splits.
+	for key := n; key < 3*n; key++ {
+		if err = recovered.Insert(key, key*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if recovered, err = hash.OpenTable(crashName); err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	checkHashKeys(t, recovered, 0, 3*n)
+}
+
+func testHashOldFormatRejected(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer removeHashDB(dbName)
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Tables from before the cells had an overflow flag start their meta
+	// file with the global depth.
+	meta := make([]byte, pager.PAGESIZE)
+	binary.PutVarint(meta, 2)
+	if err = ioutil.WriteFile(dbName+".meta", meta, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = hash.OpenTable(dbName); !errors.Is(err, hash.ErrFormatVersion) {
+		t.Fatalf("Expected an old table to be rejected, got %v", err)
+	}
+}
+
+func testHashInRange(t *testing.T) {
+	// Keys of either sign, and zero, along with enough random keys that about
+	// half of them hash to numbers that are negative when signed, still give
+	// buckets within the table.
+	keys := []int64{math.MinInt64, math.MinInt64 + 1, -1, 0, 1, math.MaxInt64}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, r.Int63()-r.Int63())
+	}
+	for _, key := range keys {
+		for _, size := range []int64{1, 4, 7, 1 << 20} {
+			if bucket := hash.XxHasher(key, size); bucket >= uint(size) {
+				t.Fatalf("Key %d gave xxHash bucket %d of %d", key, bucket, size)
+			}
+			if bucket := hash.MurmurHasher(key, size); bucket >= uint(size) {
+				t.Fatalf("Key %d gave MurmurHash bucket %d of %d", key, bucket, size)
+			}
+		}
+		for _, depth := range []int64{0, 3, 20} {
+			if bucket := hash.Hasher(key, depth); bucket < 0 || bucket >= 1<<depth {
+				t.Fatalf("Key %d gave bucket %d of %d", key, bucket, int64(1)<<depth)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	list "github.com/brown-csci1270/db/pkg/list"
+	repl "github.com/brown-csci1270/db/pkg/repl"
+)
+
+func TestList(t *testing.T) {
+	t.Run("TestListMapPopSelf", testListMapPopSelf)
+	t.Run("TestListMissingArgument", testListMissingArgument)
+}
+
+func testListMapPopSelf(t *testing.T) {
+	l := list.NewList()
+	for i := 0; i < 10; i++ {
+		l.PushTail(i)
+	}
+	// Remove every other element while mapping over the list
+	visited := 0
+	l.Map(func(link *list.Link) {
+		visited++
+		if link.GetKey().(int)%2 == 0 {
+			link.PopSelf()
+		}
+	})
+	if visited != 10 {
+		t.Errorf("Expected Map to visit 10 elements, visited %d", visited)
+	}
+	// The odd elements should survive, in order, in both directions
+	expected := []int{1, 3, 5, 7, 9}
+	i := 0
+	for link := l.PeekHead(); link != nil; link = link.GetNext() {
+		if i >= len(expected) || link.GetKey().(int) != expected[i] {
+			t.Fatalf("Unexpected element %v at position %d", link.GetKey(), i)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Fatalf("Expected %d elements, got %d", len(expected), i)
+	}
+	for link := l.PeekTail(); link != nil; link = link.GetPrev() {
+		i--
+		if link.GetKey().(int) != expected[i] {
+			t.Fatalf("Unexpected element %v at position %d going backwards", link.GetKey(), i)
+		}
+	}
+	// Removing the rest should empty the list
+	l.Map(func(link *list.Link) { link.PopSelf() })
+	if l.PeekHead() != nil || l.PeekTail() != nil {
+		t.Error("List is not empty after removing every element")
+	}
+}
+
+func testListMissingArgument(t *testing.T) {
+	triggers := []string{"list_push_head", "list_push_tail", "list_remove", "list_contains"}
+	r := list.ListRepl(list.NewList())
+	// Through the REPL, each command reports its usage
+	printed := runReplChan(t, r, append(triggers, "list_push_head 1", "list_contains 1"))
+	for _, trigger := range triggers {
+		if !strings.Contains(printed, "usage: "+trigger+" <value>") {
+			t.Errorf("%s without a value did not report its usage, got output:\n%s", trigger, printed)
+		}
+	}
+	if !strings.Contains(printed, "found!") {
+		t.Errorf("Commands with a value did not run, got output:\n%s", printed)
+	}
+	// Called directly, each command also returns its usage rather than panicking
+	for _, trigger := range triggers {
+		for _, payload := range []string{trigger, trigger + "  "} {
+			err := r.GetCommands()[trigger](payload, &repl.REPLConfig{})
+			if err == nil || err.Error() != "usage: "+trigger+" <value>" {
+				t.Errorf("Expected a usage error from %q, got %v", payload, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,986 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+)
+
+func getTempPagerDB(t *testing.T) string {
+	tmpfile, err := ioutil.TempFile(".", "db-*")
+	if err != nil {
+		t.Error(err)
+	}
+	defer tmpfile.Close()
+	return tmpfile.Name()
+}
+
+// Get a page, allocating it if it is the next new page.
+func getPage(p *pager.Pager, pagenum int64) (*pager.Page, error) {
+	if pagenum == p.GetNumPages() {
+		return p.AllocatePage()
+	}
+	return p.GetPage(pagenum)
+}
+
+func TestPager(t *testing.T) {
+	t.Run("TestPageClone", testPageClone)
+	t.Run("TestPagerNoDirectIO", testPagerNoDirectIO)
+	t.Run("TestPagerSync", testPagerSync)
+	t.Run("TestPagerFrameStats", testPagerFrameStats)
+	t.Run("TestPagerPrefetch", testPagerPrefetch)
+	t.Run("TestPagerBufferPoolFull", testPagerBufferPoolFull)
+	t.Run("TestPagerWriterAt", testPagerWriterAt)
+	t.Run("TestPagerShortRead", testPagerShortRead)
+	t.Run("TestPagerResidentHit", testPagerResidentHit)
+	t.Run("TestPagerLogBeforeData", testPagerLogBeforeData)
+	t.Run("TestPagerEvictionFlushError", testPagerEvictionFlushError)
+	t.Run("TestPagerEvictor", testPagerEvictor)
+	t.Run("TestPagerFaults", testPagerFaults)
+	t.Run("TestPagerRestoreState", testPagerRestoreState)
+	t.Run("TestPagerAllocateContiguous", testPagerAllocateContiguous)
+	t.Run("TestPagerGetPageOutOfBounds", testPagerGetPageOutOfBounds)
+}
+
+// A WriterAt that records every write, and fails them all if err is set.
+type recordingWriter struct {
+	offsets []int64
+	data    [][]byte
+	err     error
+}
+
+func (w *recordingWriter) WriteAt(p []byte, off int64) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.offsets = append(w.offsets, off)
+	w.data = append(w.data, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// A ReaderAt that counts the reads made through it.
+type countingReader struct {
+	r     io.ReaderAt
+	reads []int64
+}
+
+func (c *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	c.reads = append(c.reads, off)
+	return c.r.ReadAt(p, off)
+}
+
+// A LogFlusher that records its flushes, and the page writes made behind it.
+type fakeLog struct {
+	last    int64
+	durable int64
+	err     error
+	events  []string
+}
+
+func (l *fakeLog) LastLSN() int64    { return l.last }
+func (l *fakeLog) DurableLSN() int64 { return l.durable }
+
+func (l *fakeLog) FlushLog(lsn int64) error {
+	l.events = append(l.events, fmt.Sprintf("flush %d", lsn))
+	if l.err != nil {
+		return l.err
+	}
+	l.durable = l.last
+	return nil
+}
+
+func (l *fakeLog) WriteAt(p []byte, off int64) (int, error) {
+	l.events = append(l.events, fmt.Sprintf("write %d", off/pager.PAGESIZE))
+	return len(p), nil
+}
+
+// A ReaderAt that only ever fills part of the buffer.
+type shortReader struct{}
+
+func (shortReader) ReadAt(p []byte, off int64) (int, error) {
+	return len(p) / 2, io.ErrUnexpectedEOF
+}
+
+func testPageClone(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init the pager
+	p := pager.NewPager()
+	err := p.Open(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := getPage(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := []byte("before")
+	page.Update(original, 0, int64(len(original)))
+	// Clone, then mutate the original
+	clone := page.Clone()
+	if int64(len(clone)) != pager.PAGESIZE {
+		t.Error("Clone has the wrong size")
+	}
+	mutated := []byte("after!")
+	page.Update(mutated, 0, int64(len(mutated)))
+	if !bytes.Equal(clone[:len(original)], original) {
+		t.Error("Clone changed when the original page was mutated")
+	}
+	if !bytes.Equal((*page.GetData())[:len(mutated)], mutated) {
+		t.Error("Original page was not mutated")
+	}
+	page.Put()
+	p.Close()
+}
+
+func testPagerNoDirectIO(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init a pager without directio
+	p := pager.NewPagerWithDirectIO(false)
+	if p.UsesDirectIO() {
+		t.Fatal("Pager should not use directio")
+	}
+	err := p.Open(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write a few pages and flush them
+	for i := int64(0); i < 3; i++ {
+		page, err := getPage(p, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(fmt.Sprintf("page%d", i))
+		page.Update(data, 0, int64(len(data)))
+		p.FlushPage(page)
+		if page.IsDirty() {
+			t.Error("Page still dirty after flush")
+		}
+		page.Put()
+	}
+	p.Close()
+	// Reopen and read the pages back
+	p = pager.NewPagerWithDirectIO(false)
+	err = p.Open(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.GetNumPages() != 3 {
+		t.Errorf("Expected 3 pages, got %d", p.GetNumPages())
+	}
+	for i := int64(0); i < 3; i++ {
+		page, err := getPage(p, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(fmt.Sprintf("page%d", i))
+		if !bytes.Equal((*page.GetData())[:len(data)], data) {
+			t.Errorf("Page %d has the wrong data", i)
+		}
+		page.Put()
+	}
+	p.Close()
+}
+
+func testPagerSync(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init the pager and write to a page
+	p := pager.NewPager()
+	err := p.Open(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := getPage(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("durable")
+	page.Update(data, 0, int64(len(data)))
+	// Sync without closing
+	if err = p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if page.IsDirty() {
+		t.Error("Page still dirty after sync")
+	}
+	// A fresh pager on the same file should see the data
+	other := pager.NewPager()
+	if err = other.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	otherPage, err := getPage(other, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal((*otherPage.GetData())[:len(data)], data) {
+		t.Error("Synced data could not be read back")
+	}
+	otherPage.Put()
+	other.Close()
+	page.Put()
+	p.Close()
+}
+
+func testPagerFrameStats(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init the pager
+	p := pager.NewPager()
+	err := p.Open(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pin three pages and leave two unpinned
+	pinned := make([]*pager.Page, 0)
+	for i := int64(0); i < 5; i++ {
+		page, err := getPage(p, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 {
+			pinned = append(pinned, page)
+		} else {
+			page.Put()
+		}
+	}
+	stats := p.FrameStats()
+	if stats.Pinned != 3 || stats.Unpinned != 2 || stats.Free != pager.NUMPAGES-5 || stats.PageTable != 5 {
+		t.Errorf("Unexpected frame stats: %+v", stats)
+	}
+	for _, page := range pinned {
+		page.Put()
+	}
+	stats = p.FrameStats()
+	if stats.Pinned != 0 || stats.Unpinned != 5 {
+		t.Errorf("Unexpected frame stats after unpinning: %+v", stats)
+	}
+	p.Close()
+}
+
+func testPagerPrefetch(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Write more pages than fit in the buffer pool
+	p := pager.NewPager()
+	err := p.Open(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := int64(pager.NUMPAGES * 2)
+	for i := int64(0); i < n; i++ {
+		page, err := getPage(p, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(fmt.Sprintf("page%d", i))
+		page.Update(data, 0, int64(len(data)))
+		page.Put()
+	}
+	p.Close()
+	// Reopen, pin a page, and prefetch a range that doesn't fit next to it
+	p = pager.NewPager()
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := getPage(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := int64(pager.NUMPAGES)
+	p.Prefetch(start, pager.NUMPAGES)
+	if !p.IsCached(0) {
+		t.Error("Pinned page was evicted by prefetching")
+	}
+	// All but one of the prefetched pages should be hits
+	for i := start; i < start+pager.NUMPAGES-1; i++ {
+		if !p.IsCached(i) {
+			t.Fatalf("Page %d was not prefetched", i)
+		}
+		page, err := getPage(p, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(fmt.Sprintf("page%d", i))
+		if !bytes.Equal((*page.GetData())[:len(data)], data) {
+			t.Errorf("Page %d has the wrong data", i)
+		}
+		page.Put()
+	}
+	// Prefetching past the end of the file shouldn't create pages
+	p.Prefetch(n-1, 10)
+	if p.GetNumPages() != n {
+		t.Errorf("Expected %d pages, got %d", n, p.GetNumPages())
+	}
+	pinned.Put()
+	p.Close()
+}
+
+func testPagerBufferPoolFull(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init the pager
+	p := pager.NewPager()
+	err := p.Open(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pin every frame
+	pinned := make([]*pager.Page, 0)
+	for i := int64(0); i < pager.NUMPAGES; i++ {
+		page, err := getPage(p, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pinned = append(pinned, page)
+	}
+	// Getting a new page should fail cleanly
+	if _, err = getPage(p, pager.NUMPAGES); !errors.Is(err, pager.ErrBufferPoolFull) {
+		t.Errorf("Expected ErrBufferPoolFull for a new page, got %v", err)
+	}
+	if p.GetNumPages() != pager.NUMPAGES {
+		t.Errorf("Failed GetPage changed the page count to %d", p.GetNumPages())
+	}
+	// Once a frame is unpinned, the page can be brought in, evicting page 0
+	pinned[0].Put()
+	page, err := getPage(p, pager.NUMPAGES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Getting the evicted page back should fail cleanly too
+	if _, err = getPage(p, 0); !errors.Is(err, pager.ErrBufferPoolFull) {
+		t.Errorf("Expected ErrBufferPoolFull for an evicted page, got %v", err)
+	}
+	page.Put()
+	for _, page := range pinned[1:] {
+		page.Put()
+	}
+	p.Close()
+}
+
+func testPagerWriterAt(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Create a few pages and write them out to the file
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	pages := make([]*pager.Page, 5)
+	for i := range pages {
+		page, err := getPage(p, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages[i] = page
+	}
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Dirty two of them, then flush through a recording writer
+	w := &recordingWriter{}
+	p.SetIO(nil, w)
+	for _, pagenum := range []int{1, 3} {
+		data := []byte(fmt.Sprintf("page %d", pagenum))
+		pages[pagenum].Update(data, 0, int64(len(data)))
+	}
+	p.FlushAllPages()
+	if len(w.offsets) != 2 {
+		t.Fatalf("Expected 2 writes, got %d at offsets %v", len(w.offsets), w.offsets)
+	}
+	written := make(map[int64][]byte)
+	for i, off := range w.offsets {
+		if int64(len(w.data[i])) != pager.PAGESIZE {
+			t.Errorf("Write at %d is %d bytes, expected a whole page", off, len(w.data[i]))
+		}
+		written[off] = w.data[i]
+	}
+	for _, pagenum := range []int{1, 3} {
+		data, ok := written[int64(pagenum)*pager.PAGESIZE]
+		expected := []byte(fmt.Sprintf("page %d", pagenum))
+		if !ok || !bytes.Equal(data[:len(expected)], expected) {
+			t.Errorf("Page %d was not written at its offset", pagenum)
+		}
+	}
+	// Nothing is dirty anymore, so flushing again writes nothing
+	p.FlushAllPages()
+	if len(w.offsets) != 2 {
+		t.Errorf("Clean pages were written again")
+	}
+	// A failed write leaves the page dirty, to be retried
+	w.err = errors.New("disk full")
+	pages[2].Update([]byte("retry"), 0, 5)
+	p.FlushAllPages()
+	if !pages[2].IsDirty() {
+		t.Error("Page marked clean after a failed write")
+	}
+	w.err = nil
+	p.FlushAllPages()
+	if pages[2].IsDirty() || len(w.offsets) != 3 || w.offsets[2] != 2*pager.PAGESIZE {
+		t.Errorf("Page was not retried after a failed write, writes at %v", w.offsets)
+	}
+	p.SetIO(nil, nil)
+	for _, page := range pages {
+		page.Put()
+	}
+}
+
+func testPagerShortRead(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Write a page out, and drop it from the buffer pool by reopening
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	page, err := getPage(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+	p.Close()
+	p = pager.NewPager()
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// A short read fails the read, and gives the frame back
+	p.SetIO(shortReader{}, nil)
+	if _, err = getPage(p, 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected a short read to fail, got %v", err)
+	}
+	if stats := p.FrameStats(); stats.Free != pager.NUMPAGES {
+		t.Errorf("Expected all %d frames free after a failed read, got %d", pager.NUMPAGES, stats.Free)
+	}
+	// Reading from the file again works
+	p.SetIO(nil, nil)
+	page, err = getPage(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+}
+
+func testPagerResidentHit(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Write a few pages out, then reopen so that none are resident
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	for pagenum := int64(0); pagenum < 3; pagenum++ {
+		page, err := getPage(p, pagenum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Put()
+	}
+	p.Close()
+	p = pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	file, err := os.Open(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader := &countingReader{r: file}
+	p.SetIO(reader, nil)
+	// A miss reads the page exactly once
+	page, err := getPage(p, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reader.reads) != 1 || reader.reads[0] != pager.PAGESIZE {
+		t.Fatalf("Expected one read of page 1, got reads at %v", reader.reads)
+	}
+	// Hits on the page, pinned or not, don't read it again
+	again, err := getPage(p, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != page {
+		t.Error("Hit returned a different page")
+	}
+	again.Put()
+	page.Put()
+	if page, err = getPage(p, 1); err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+	if len(reader.reads) != 1 {
+		t.Errorf("Resident hits read from disk, reads at %v", reader.reads)
+	}
+	// A new page past the end of the file isn't read at all
+	if page, err = getPage(p, 3); err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+	if len(reader.reads) != 1 {
+		t.Errorf("Creating a page read from disk, reads at %v", reader.reads)
+	}
+}
+
+func testPagerLogBeforeData(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	page, err := getPage(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	log := &fakeLog{}
+	p.SetIO(nil, log)
+	p.SetLogFlusher(log)
+	// A page updated after a log record that isn't durable yet flushes the log first
+	log.last = 5
+	page.Update([]byte("ahead"), 0, 5)
+	if page.GetLSN() != 5 {
+		t.Fatalf("Expected the page to be stamped with LSN 5, got %d", page.GetLSN())
+	}
+	p.FlushPage(page)
+	if fmt.Sprint(log.events) != "[flush 5 write 0]" {
+		t.Fatalf("Expected the log to be flushed before the page, got %v", log.events)
+	}
+	// If the log can't be flushed, the page isn't written and stays dirty
+	log.events = nil
+	log.last = 8
+	log.err = errors.New("log unavailable")
+	page.Update([]byte("again"), 0, 5)
+	if err = p.FlushPage(page); err != log.err {
+		t.Errorf("Expected the log's error from the flush, got %v", err)
+	}
+	if fmt.Sprint(log.events) != "[flush 8]" || !page.IsDirty() {
+		t.Fatalf("Expected the page to be held back, got %v", log.events)
+	}
+	log.events = nil
+	log.err = nil
+	p.FlushPage(page)
+	if fmt.Sprint(log.events) != "[flush 8 write 0]" || page.IsDirty() {
+		t.Fatalf("Expected the page to be written after the log, got %v", log.events)
+	}
+	// A page whose log records are all durable is written without a flush
+	log.events = nil
+	page.Update([]byte("durable"), 0, 7)
+	p.FlushPage(page)
+	if fmt.Sprint(log.events) != "[write 0]" {
+		t.Errorf("Expected only a page write, got %v", log.events)
+	}
+}
+
+func testPagerEvictionFlushError(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	log := &fakeLog{}
+	p.SetIO(nil, log)
+	p.SetLogFlusher(log)
+	// Fill the pool with dirty pages, each ahead of the durable log
+	for i := int64(0); i < pager.NUMPAGES; i++ {
+		page, err := getPage(p, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log.last = i + 1
+		page.Update([]byte("dirty"), 0, 5)
+		page.Put()
+	}
+	// Evicting a page whose log can't be flushed fails, and keeps the page
+	log.err = errors.New("log unavailable")
+	if _, err := getPage(p, pager.NUMPAGES); err != log.err {
+		t.Fatalf("Expected the log's error from the eviction, got %v", err)
+	}
+	if p.GetNumPages() != pager.NUMPAGES {
+		t.Errorf("Failed eviction changed the page count to %d", p.GetNumPages())
+	}
+	if !p.IsCached(0) {
+		t.Fatal("Expected the page that failed to flush to stay in the pool")
+	}
+	page, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !page.IsDirty() {
+		t.Error("Expected the page that failed to flush to stay dirty")
+	}
+	page.Put()
+	// Once the log is back, the eviction goes through
+	log.err = nil
+	if page, err = getPage(p, pager.NUMPAGES); err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+}
+
+func testPagerEvictor(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// Keep a few pages pinned, and fill the rest of the pool with dirty unpinned pages
+	pinned := make([]*pager.Page, 4)
+	for i := range pinned {
+		page, err := getPage(p, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pinned[i] = page
+	}
+	for pagenum := int64(len(pinned)); pagenum < pager.NUMPAGES; pagenum++ {
+		page, err := getPage(p, pagenum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(fmt.Sprintf("page %d", pagenum))
+		page.Update(data, 0, int64(len(data)))
+		page.Put()
+	}
+	if free := p.FrameStats().Free; free != 0 {
+		t.Fatalf("Expected a full pool, got %d free frames", free)
+	}
+	if _, err := p.StartEvictor(0, 8); err == nil {
+		t.Error("Expected a low watermark of 0 to be rejected")
+	}
+	stop, err := p.StartEvictor(4, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	// The evictor frees frames up to the high watermark
+	waitForFree := func(n int) {
+		deadline := time.Now().Add(time.Second)
+		for p.FrameStats().Free < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d free frames, got %+v", n, p.FrameStats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitForFree(8)
+	for i, page := range pinned {
+		if !p.IsCached(int64(i)) {
+			t.Fatalf("Pinned page %d was evicted", i)
+		}
+		page.Put()
+	}
+	// Allocating new pages takes free frames, rather than evicting synchronously
+	evictions := p.Evictions()
+	for pagenum := int64(pager.NUMPAGES); pagenum < pager.NUMPAGES+6; pagenum++ {
+		page, err := getPage(p, pagenum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Put()
+	}
+	if p.Evictions() != evictions {
+		t.Errorf("Expected no synchronous evictions, got %d", p.Evictions()-evictions)
+	}
+	// Dropping below the low watermark wakes the evictor up again
+	waitForFree(8)
+	// Evicted pages were flushed first
+	for pagenum := int64(len(pinned)); pagenum < pager.NUMPAGES; pagenum++ {
+		page, err := getPage(p, pagenum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []byte(fmt.Sprintf("page %d", pagenum))
+		if !bytes.Equal((*page.GetData())[:len(expected)], expected) {
+			t.Errorf("Page %d lost its data", pagenum)
+		}
+		page.Put()
+	}
+}
+
+func testPagerFaults(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	// Fill every frame with a page full of junk, then free them all
+	junk := bytes.Repeat([]byte{0xff}, int(pager.PAGESIZE))
+	for pagenum := int64(0); pagenum < pager.NUMPAGES; pagenum++ {
+		page, err := getPage(p, pagenum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Update(junk, 0, pager.PAGESIZE)
+		page.Put()
+	}
+	p.EvictTo(pager.NUMPAGES)
+	// Allocating a page reuses one of those frames, but doesn't read from disk
+	page, err := getPage(p, pager.NUMPAGES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(*page.GetData(), make([]byte, pager.PAGESIZE)) {
+		t.Error("New page was not zeroed")
+	}
+	page.Put()
+	if reads := p.DiskReads(); reads != 0 {
+		t.Errorf("Allocating pages read from disk %d times", reads)
+	}
+	p.Close()
+	// Faulting in an existing page reads it exactly once
+	p = pager.NewPager()
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if page, err = getPage(p, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(*page.GetData(), junk) {
+		t.Error("Faulted in page does not match what was written")
+	}
+	page.Put()
+	if page, err = getPage(p, 1); err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+	if reads := p.DiskReads(); reads != 1 {
+		t.Errorf("Expected a single read, got %d", reads)
+	}
+	// Prefetching reads each page that isn't resident once, page 1 being resident the first time
+	p.Prefetch(0, 8)
+	p.EvictTo(pager.NUMPAGES)
+	p.Prefetch(0, 8)
+	if reads := p.DiskReads(); reads != 16 {
+		t.Errorf("Expected 16 reads, got %d", reads)
+	}
+	if doubles := p.DoubleReads(); doubles != 0 {
+		t.Errorf("Expected no double reads, got %d", doubles)
+	}
+}
+
+func testPagerRestoreState(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// Write out more pages than fit in the pool
+	numPages := int64(pager.NUMPAGES + 4)
+	for pagenum := int64(0); pagenum < numPages; pagenum++ {
+		page, err := getPage(p, pagenum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Put()
+	}
+	// Fill the pool with the pages in reverse, leaving the first two pinned
+	state := pager.PoolState{Unpinned: make([]int64, 0), Pinned: []int64{numPages - 1, numPages - 2}}
+	for pagenum := numPages - 3; int64(len(state.Unpinned)) < pager.NUMPAGES-2; pagenum-- {
+		state.Unpinned = append(state.Unpinned, pagenum)
+	}
+	pinned, err := p.RestoreState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.DumpState(); !reflect.DeepEqual(got, state) {
+		t.Fatalf("Expected restored state %+v, got %+v", state, got)
+	}
+	// Restoring again while pages are pinned fails
+	if _, err = p.RestoreState(state); err == nil {
+		t.Error("Expected restoring with pinned pages to fail")
+	}
+	// Faulting in a page evicts exactly the head of the unpinned list
+	victim := state.Unpinned[0]
+	page, err := getPage(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.IsCached(victim) {
+		t.Errorf("Expected page %d to be evicted", victim)
+	}
+	for _, pagenum := range append(state.Unpinned[1:], state.Pinned...) {
+		if !p.IsCached(pagenum) {
+			t.Errorf("Page %d was evicted instead of %d", pagenum, victim)
+		}
+	}
+	expected := pager.PoolState{Unpinned: state.Unpinned[1:], Pinned: append(state.Pinned, 0)}
+	if got := p.DumpState(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected state %+v after the fault, got %+v", expected, got)
+	}
+	page.Put()
+	for _, page := range pinned {
+		page.Put()
+	}
+}
+
+func testPagerAllocateContiguous(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	page, err := getPage(p, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+	if _, err = p.AllocateContiguous(0); err == nil {
+		t.Error("Allocated an empty block")
+	}
+	// Two goroutines allocate blocks of various sizes at the same time
+	type block struct{ start, end int64 }
+	blocks := make([][]block, 2)
+	var wg sync.WaitGroup
+	for g := range blocks {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := int64(0); i < 50; i++ {
+				n := i%5 + 1
+				start, err := p.AllocateContiguous(n)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				blocks[g] = append(blocks[g], block{start, start + n})
+			}
+		}(g)
+	}
+	wg.Wait()
+	// The blocks tile the pages after page 0, without overlapping
+	all := append(blocks[0], blocks[1]...)
+	sort.Slice(all, func(i, j int) bool { return all[i].start < all[j].start })
+	next := int64(1)
+	for _, b := range all {
+		if b.start != next {
+			t.Fatalf("Expected a block to start at page %d, got [%d, %d)", next, b.start, b.end)
+		}
+		next = b.end
+	}
+	if next != 1+2*150 || p.GetNumPages() != next {
+		t.Fatalf("Expected %d pages, got %d allocated and %d in the pager", 1+2*150, next, p.GetNumPages())
+	}
+	// A reserved page reads back zeroed, and a new page goes after the blocks
+	page, err = getPage(p, next-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(*page.GetData(), make([]byte, pager.PAGESIZE)) {
+		t.Error("Expected a reserved page to be zeroed")
+	}
+	page.Put()
+	if p.GetFreePN() != next {
+		t.Errorf("Expected the next free page to be %d, got %d", next, p.GetFreePN())
+	}
+	// The reservation survives reopening the file
+	p.Close()
+	p = pager.NewPager()
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.GetNumPages() != next {
+		t.Errorf("Expected %d pages after reopening, got %d", next, p.GetNumPages())
+	}
+}
+
+func testPagerGetPageOutOfBounds(t *testing.T) {
+	dbName := filepath.Join(t.TempDir(), "db")
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	// An empty file has no pages to get
+	if _, err := p.GetPage(0); !errors.Is(err, pager.ErrPageOutOfBounds) {
+		t.Errorf("Expected getting a page of an empty file to fail, got %v", err)
+	}
+	for i := int64(0); i < 3; i++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.GetPageNum() != i {
+			t.Errorf("Expected to allocate page %d, got %d", i, page.GetPageNum())
+		}
+		page.Update([]byte("data"), 0, 4)
+		page.Put()
+	}
+	// The next free page, and any page past it, doesn't exist yet
+	for _, pagenum := range []int64{p.GetNumPages(), p.GetNumPages() + 5} {
+		if _, err := p.GetPage(pagenum); !errors.Is(err, pager.ErrPageOutOfBounds) {
+			t.Errorf("Expected getting page %d of %d to fail, got %v", pagenum, p.GetNumPages(), err)
+		}
+	}
+	if p.GetNumPages() != 3 {
+		t.Errorf("Expected getting missing pages not to add any, got %d pages", p.GetNumPages())
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Once reopened, the pages that were written can be read, but the next can't
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := p.GetPage(3); !errors.Is(err, pager.ErrPageOutOfBounds) {
+		t.Errorf("Expected getting the next free page to fail, got %v", err)
+	}
+	page, err := p.GetPage(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal((*page.GetData())[:4], []byte("data")) {
+		t.Error("Expected page 2 to hold what was written to it")
+	}
+	page.Put()
+	// A newly allocated page is zeroed
+	page, err = p.AllocatePage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	if page.GetPageNum() != 3 || !bytes.Equal(*page.GetData(), make([]byte, pager.PAGESIZE)) {
+		t.Error("Expected a new, zeroed page 3")
+	}
+}
@@ -0,0 +1,883 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	db "github.com/brown-csci1270/db/pkg/db"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	query "github.com/brown-csci1270/db/pkg/query"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+	uuid "github.com/google/uuid"
+)
+
+func TestQuery(t *testing.T) {
+	t.Run("TestBloomFilterFPR", testBloomFilterFPR)
+	t.Run("TestDiffCursors", testDiffCursors)
+	t.Run("TestCountDistinct", testCountDistinct)
+	t.Run("TestScanRunningSum", testScanRunningSum)
+	t.Run("TestScalableBloomFilter", testScalableBloomFilter)
+	t.Run("TestJoinRepl", testJoinRepl)
+	t.Run("TestFullOuterMerge", testFullOuterMerge)
+	t.Run("TestJoinProbeError", testJoinProbeError)
+	t.Run("TestHyperLogLog", testHyperLogLog)
+	t.Run("TestBuildBitmapIndex", testBuildBitmapIndex)
+	t.Run("TestJoinSkewedKey", testJoinSkewedKey)
+	t.Run("TestJoinSkewedKeys", testJoinSkewedKeys)
+	t.Run("TestJoinProbeWorkers", testJoinProbeWorkers)
+}
+
+func testBloomFilterFPR(t *testing.T) {
+	// An empty filter should never report a false positive
+	filter := query.CreateFilter(8192)
+	if filter.EstimatedFPR() != 0 {
+		t.Errorf("Expected an empty filter's FPR to be 0, got %f", filter.EstimatedFPR())
+	}
+	// Insert a known number of keys
+	n := int64(2000)
+	for i := int64(0); i < n; i++ {
+		filter.Insert(i)
+	}
+	// Measure the FPR over keys that were never inserted
+	trials := int64(100000)
+	falsePositives := 0
+	for i := n; i < n+trials; i++ {
+		if filter.Contains(i) {
+			falsePositives++
+		}
+	}
+	measured := float64(falsePositives) / float64(trials)
+	estimated := filter.EstimatedFPR()
+	if math.Abs(estimated-measured) > 0.02 {
+		t.Errorf("Estimated FPR %f is too far from measured FPR %f", estimated, measured)
+	}
+}
+
+func testScalableBloomFilter(t *testing.T) {
+	maxFPR := 0.05
+	filter := query.CreateScalableFilter(8192, maxFPR)
+	// Insert 10x as many keys as the first sub-filter was planned for
+	n := 10 * filter.Capacity()
+	for i := int64(0); i < n; i++ {
+		filter.Insert(i)
+	}
+	if filter.NumFilters() < 2 {
+		t.Fatal("Filter did not grow")
+	}
+	// There should be no false negatives
+	for i := int64(0); i < n; i++ {
+		if !filter.Contains(i) {
+			t.Fatalf("Inserted key %d was not found", i)
+		}
+	}
+	// Measure the FPR over keys that were never inserted
+	trials := int64(100000)
+	falsePositives := 0
+	for i := n; i < n+trials; i++ {
+		if filter.Contains(i) {
+			falsePositives++
+		}
+	}
+	measured := float64(falsePositives) / float64(trials)
+	if measured > maxFPR {
+		t.Errorf("Measured FPR %f is over the bound %f", measured, maxFPR)
+	}
+	if estimated := filter.EstimatedFPR(); estimated > maxFPR {
+		t.Errorf("Estimated FPR %f is over the bound %f", estimated, maxFPR)
+	}
+	// A fixed-size filter would have degraded
+	fixed := query.CreateFilter(8192)
+	for i := int64(0); i < n; i++ {
+		fixed.Insert(i)
+	}
+	if fixed.EstimatedFPR() <= maxFPR {
+		t.Errorf("Expected a fixed-size filter to exceed the bound, got %f", fixed.EstimatedFPR())
+	}
+}
+
+func testDiffCursors(t *testing.T) {
+	oldName := getTempBTreeDB(t)
+	defer os.Remove(oldName)
+	newName := getTempBTreeDB(t)
+	defer os.Remove(newName)
+
+	// Build two snapshots of a table, large enough to span several leaves
+	oldIndex, err := btree.OpenTable(oldName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldIndex.Close()
+	newIndex, err := btree.OpenTable(newName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newIndex.Close()
+	n := btree.ENTRIES_PER_LEAF_NODE * 3
+	for i := int64(0); i < n; i++ {
+		if err = oldIndex.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+		// Every 7th key is deleted, every 5th key is changed
+		if i%7 == 0 {
+			continue
+		}
+		value := i
+		if i%5 == 0 {
+			value = -i
+		}
+		if err = newIndex.Insert(i, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Some keys are added before, between and after the old keys
+	for _, key := range []int64{-10, -1, n, n + 10} {
+		if err = newIndex.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldCur, err := oldIndex.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCur, err := newIndex.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, removed, changed, err := query.DiffCursors(oldCur, newCur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Check each delta against what we expect
+	expectKeys := func(name string, entries []utils.Entry, keep func(int64) bool) {
+		i := 0
+		for key := int64(-10); key <= n+10; key++ {
+			if !keep(key) {
+				continue
+			}
+			if i >= len(entries) || entries[i].GetKey() != key {
+				t.Fatalf("Expected key %d in %s", key, name)
+			}
+			i++
+		}
+		if i != len(entries) {
+			t.Fatalf("Expected %d %s entries, got %d", i, name, len(entries))
+		}
+	}
+	expectKeys("added", added, func(key int64) bool {
+		return key == -10 || key == -1 || key == n || key == n+10
+	})
+	expectKeys("removed", removed, func(key int64) bool {
+		return key >= 0 && key < n && key%7 == 0
+	})
+	expectKeys("changed", changed, func(key int64) bool {
+		return key >= 0 && key < n && key%7 != 0 && key%5 == 0
+	})
+	for _, entry := range changed {
+		if entry.GetValue() != -entry.GetKey() {
+			t.Errorf("Changed entry %d has the old value", entry.GetKey())
+		}
+	}
+	// A cursor that fails part way through fails the diff, rather than ending it
+	if oldCur, err = oldIndex.TableStart(); err != nil {
+		t.Fatal(err)
+	}
+	if newCur, err = newIndex.TableStart(); err != nil {
+		t.Fatal(err)
+	}
+	failing := &failingCursor{Cursor: newCur, steps: n / 2}
+	if _, _, _, err = query.DiffCursors(oldCur, failing); !errors.Is(err, errCursorFailed) {
+		t.Errorf("Expected the cursor's error, got %v", err)
+	}
+}
+
+var errCursorFailed = errors.New("cursor failed")
+
+// failingCursor steps like the cursor it wraps, until it has stepped the
+// given number of times, then fails with errCursorFailed.
+type failingCursor struct {
+	utils.Cursor
+	steps int64
+}
+
+func (cursor *failingCursor) StepForward() error {
+	if cursor.steps == 0 {
+		return errCursorFailed
+	}
+	cursor.steps--
+	return cursor.Cursor.StepForward()
+}
+
+func testCountDistinct(t *testing.T) {
+	btreeName := getTempBTreeDB(t)
+	defer os.Remove(btreeName)
+	hashName := getTempHashDB(t)
+	defer removeHashDB(hashName)
+
+	btreeIndex, err := btree.OpenTable(btreeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	hashIndex, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	// All-unique keys in a B+ tree, spanning several leaves
+	n := int64(2000)
+	for i := int64(0); i < n; i++ {
+		if err = btreeIndex.Insert((i*btree_salt)%n, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor, err := btreeIndex.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := query.CountDistinct(cursor); err != nil || count != n {
+		t.Errorf("Expected %d distinct B+ tree keys, got %d (%v)", n, count, err)
+	}
+	// Heavily duplicated keys in a hash table, which only its table allows
+	distinct := int64(17)
+	for i := int64(0); i < n; i++ {
+		if err = hashIndex.GetTable().Insert((i*hash_salt)%distinct, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor, err = hashIndex.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := query.CountDistinct(cursor); err != nil || count != distinct {
+		t.Errorf("Expected %d distinct hash keys, got %d (%v)", distinct, count, err)
+	}
+	// An empty table has no keys
+	emptyName := getTempBTreeDB(t)
+	defer os.Remove(emptyName)
+	emptyIndex, err := btree.OpenTable(emptyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emptyIndex.Close()
+	cursor, err = emptyIndex.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := query.CountDistinct(cursor); err != nil || count != 0 {
+		t.Errorf("Expected no distinct keys in an empty table, got %d (%v)", count, err)
+	}
+}
+
+func testScanRunningSum(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	sum := func(acc int64, e utils.Entry) int64 { return acc + e.GetValue() }
+	// Scanning an empty table yields nothing
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !query.Scan(cursor, 0, sum).IsEnd() {
+		t.Error("Scan over an empty table yielded an entry")
+	}
+	// Insert keys in scrambled order, spanning several leaves
+	n := int64(2000)
+	for i := int64(0); i < n; i++ {
+		key := (i * btree_salt) % n
+		if err = index.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor, err = index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each yielded value should be the sum of all keys so far
+	scan := query.Scan(cursor, 0, sum)
+	count := int64(0)
+	for ; !scan.IsEnd(); count++ {
+		entry, err := scan.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.GetKey() != count {
+			t.Fatalf("Expected key %d, got %d", count, entry.GetKey())
+		}
+		if expected := count * (count + 1) / 2; entry.GetValue() != expected {
+			t.Fatalf("Expected running sum %d at key %d, got %d", expected, count, entry.GetValue())
+		}
+		if err = scan.StepForward(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count != n {
+		t.Errorf("Expected %d entries, got %d", n, count)
+	}
+	if scan.StepForward() == nil {
+		t.Error("Stepping past the end should fail")
+	}
+}
+
+func testJoinRepl(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	// Hash tables currently write their .meta file to the working directory.
+	defer os.Remove("right.meta")
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	// The left table maps k to 10k, the right table maps k to k+100
+	for _, command := range []string{"create btree table left", "create hash table right"} {
+		if err = db.HandleCreateTable(d, command, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	left, _ := d.GetTable("left")
+	right, _ := d.GetTable("right")
+	for k := int64(0); k < 20; k++ {
+		if k < 10 {
+			if err = left.Insert(k, 10*k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = right.Insert(k, k+100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tempFiles, err := filepath.Glob("db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Run the joins through the REPL, capturing what it prints
+	stdout := os.Stdout
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	output := make(chan string)
+	go func() {
+		out, _ := ioutil.ReadAll(reader)
+		output <- string(out)
+	}()
+	commands := make(chan string)
+	done := make(chan bool)
+	go func() {
+		query.QueryRepl(d).RunChan(commands, uuid.New(), "")
+		done <- true
+	}()
+	commands <- "join left key on right key"
+	commands <- "join left key on missing key"
+	close(commands)
+	<-done
+	writer.Close()
+	os.Stdout = stdout
+	printed := <-output
+	// Each key in the left table should have been joined
+	for k := int64(0); k < 10; k++ {
+		pair := fmt.Sprintf("{(%d, %d), (%d, %d)}", k, 10*k, k, k+100)
+		if !strings.Contains(printed, pair) {
+			t.Errorf("Join did not print %s", pair)
+		}
+	}
+	if strings.Count(printed, "{(") != 10 {
+		t.Errorf("Expected 10 pairs, got output:\n%s", printed)
+	}
+	// A missing table should be reported, not hang
+	if !strings.Contains(printed, "find error") {
+		t.Errorf("Join on a missing table did not report an error, got output:\n%s", printed)
+	}
+	// The join's temporary hash tables should have been removed
+	after, err := filepath.Glob("db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(tempFiles) {
+		t.Errorf("Join left temporary files behind: %v", after)
+	}
+}
+
+func testFullOuterMerge(t *testing.T) {
+	leftName := getTempBTreeDB(t)
+	defer os.Remove(leftName)
+	rightName := getTempBTreeDB(t)
+	defer os.Remove(rightName)
+
+	leftIndex, err := btree.OpenTable(leftName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leftIndex.Close()
+	rightIndex, err := btree.OpenTable(rightName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rightIndex.Close()
+	merge := func() *query.OuterMergeCursor {
+		leftCur, err := leftIndex.TableStart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rightCur, err := rightIndex.TableStart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor, err := query.FullOuterMergeCursor(leftCur, rightCur)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cursor
+	}
+	// Merging two empty tables yields nothing
+	if !merge().IsEnd() {
+		t.Fatal("Expected merging empty tables to yield nothing")
+	}
+	// The left table has the even keys, the right table every third key and
+	// then a run of keys past the end of the left table
+	n := btree.ENTRIES_PER_LEAF_NODE * 3
+	for i := int64(0); i < n; i++ {
+		if i%2 == 0 {
+			if err = leftIndex.Insert(i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i%3 == 0 {
+			if err = rightIndex.Insert(i, -i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := n; i < n+20; i++ {
+		if err = rightIndex.Insert(i, -i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor := merge()
+	for key := int64(0); key < n+20; key++ {
+		inLeft := key < n && key%2 == 0
+		inRight := key >= n || key%3 == 0
+		if !inLeft && !inRight {
+			continue
+		}
+		if cursor.IsEnd() {
+			t.Fatalf("Merge ended before key %d", key)
+		}
+		pair, err := cursor.GetPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if left := pair.GetLeft(); inLeft != (left != nil) || (inLeft && (left.GetKey() != key || left.GetValue() != key)) {
+			t.Fatalf("Key %d: unexpected left entry %v", key, left)
+		}
+		if right := pair.GetRight(); inRight != (right != nil) || (inRight && (right.GetKey() != key || right.GetValue() != -key)) {
+			t.Fatalf("Key %d: unexpected right entry %v", key, right)
+		}
+		if err = cursor.StepForward(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !cursor.IsEnd() {
+		t.Error("Expected the merge to end after the last key")
+	}
+	if err = cursor.StepForward(); err == nil {
+		t.Error("Expected stepping past the end to fail")
+	}
+}
+
+func testJoinProbeError(t *testing.T) {
+	leftName := getTempBTreeDB(t)
+	defer os.Remove(leftName)
+	rightName := getTempBTreeDB(t)
+	defer os.Remove(rightName)
+
+	leftIndex, err := btree.OpenTable(leftName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leftIndex.Close()
+	rightIndex, err := btree.OpenTable(rightName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rightIndex.Close()
+	// More matches than the results channel holds, so probes block on it
+	for i := int64(0); i < 5000; i++ {
+		if err = leftIndex.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+		if err = rightIndex.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resultsChan, _, group, cleanup, err := query.Join(ctx, leftIndex, rightIndex, true, true)
+	if cleanup != nil {
+		defer cleanup()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once the channel is full, cancelling makes the blocked probes fail
+	for len(resultsChan) < cap(resultsChan) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	done := make(chan int)
+	go func() {
+		count := 0
+		for range resultsChan {
+			count++
+		}
+		done <- count
+	}()
+	select {
+	case count := <-done:
+		if count >= 5000 {
+			t.Errorf("Expected the failed join to stop early, got all %d pairs", count)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Consumer still blocked on the results channel after the join failed")
+	}
+	if err = group.Wait(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Wait to return the probe's error, got %v", err)
+	}
+}
+
+func testHyperLogLog(t *testing.T) {
+	precision := 14
+	// The estimate should be within three standard errors of the truth
+	tolerance := 3 * 1.04 / math.Sqrt(float64(int(1)<<uint(precision)))
+	checkEstimate := func(name string, hll *query.HyperLogLog, expected int64) {
+		estimate := hll.Estimate()
+		if relErr := math.Abs(float64(estimate-expected)) / float64(expected); relErr > tolerance {
+			t.Errorf("%s: estimated %d distinct keys, expected %d (relative error %f > %f)", name, estimate, expected, relErr, tolerance)
+		}
+	}
+	if _, err := query.CreateHyperLogLog(30); err == nil {
+		t.Error("Created a hyperloglog with too many registers")
+	}
+	hll, err := query.CreateHyperLogLog(precision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hll.Estimate() != 0 {
+		t.Errorf("Expected an empty sketch to estimate 0, got %d", hll.Estimate())
+	}
+	// Small counts are estimated closely, and duplicates don't count
+	for i := int64(0); i < 100; i++ {
+		hll.Add(i)
+		hll.Add(i)
+	}
+	checkEstimate("100 keys", hll, 100)
+	// 1M distinct keys, split between two sketches that overlap
+	n := int64(1000000)
+	left, _ := query.CreateHyperLogLog(precision)
+	right, _ := query.CreateHyperLogLog(precision)
+	all, _ := query.CreateHyperLogLog(precision)
+	for i := int64(0); i < n; i++ {
+		key := i * hash_salt
+		all.Add(key)
+		if i < 600000 {
+			left.Add(key)
+		}
+		if i >= 400000 {
+			right.Add(key)
+		}
+	}
+	checkEstimate("1M keys", all, n)
+	checkEstimate("left", left, 600000)
+	checkEstimate("right", right, 600000)
+	// The merged sketch is the sketch of the union
+	if err = left.Merge(right); err != nil {
+		t.Fatal(err)
+	}
+	if left.Estimate() != all.Estimate() {
+		t.Errorf("Merged sketch estimates %d, sketch of all keys %d", left.Estimate(), all.Estimate())
+	}
+	checkEstimate("merged", left, n)
+	coarse, _ := query.CreateHyperLogLog(precision - 1)
+	if err = left.Merge(coarse); err == nil {
+		t.Error("Merged sketches of different precisions")
+	}
+	// A table scan can be estimated directly
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 5000; i++ {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimate, err := query.EstimateDistinct(cursor, precision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relErr := math.Abs(float64(estimate-5000)) / 5000; relErr > tolerance {
+		t.Errorf("Estimated %d distinct keys in the table, expected 5000", estimate)
+	}
+}
+
+func testBuildBitmapIndex(t *testing.T) {
+	hashName := getTempHashDB(t)
+	defer removeHashDB(hashName)
+	hashIndex, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	// A few distinct values, spread over many keys
+	n := int64(1000)
+	distinct := int64(5)
+	for i := int64(0); i < n; i++ {
+		if err = hashIndex.Insert(i, (i*hash_salt)%distinct); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor, err := hashIndex.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmaps, err := query.BuildBitmapIndex(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(bitmaps)) != distinct {
+		t.Fatalf("Expected %d bitmaps, got %d", distinct, len(bitmaps))
+	}
+	total := uint(0)
+	for _, bits := range bitmaps {
+		total += bits.Count()
+	}
+	if total != uint(n) {
+		t.Errorf("Expected the bitmaps to hold %d keys, got %d", n, total)
+	}
+	for i := int64(0); i < n; i++ {
+		value := (i * hash_salt) % distinct
+		for v, bits := range bitmaps {
+			if bits.Test(uint(i)) != (v == value) {
+				t.Fatalf("Key %d has value %d, but the bitmap for value %d disagrees", i, value, v)
+			}
+		}
+	}
+	// Keys can't be positions in a bitmap if they are negative
+	btreeName := getTempBTreeDB(t)
+	defer os.Remove(btreeName)
+	btreeIndex, err := btree.OpenTable(btreeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	if err = btreeIndex.Insert(-1, 0); err != nil {
+		t.Fatal(err)
+	}
+	cursor, err = btreeIndex.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = query.BuildBitmapIndex(cursor); err == nil {
+		t.Error("Expected a negative key to be rejected")
+	}
+}
+
+// A pair of joined keys.
+type joinedKeys struct {
+	l int64
+	r int64
+}
+
+// Run a join on the tables' values, counting the pairs it yields by key pair.
+func joinOnValues(t *testing.T, left *btree.BTreeIndex, right *btree.BTreeIndex) map[joinedKeys]int {
+	resultsChan, _, group, cleanup, err := query.Join(context.Background(), left, right, false, false)
+	if cleanup != nil {
+		defer cleanup()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := make(map[joinedKeys]int)
+	done := make(chan bool)
+	go func() {
+		for result := range resultsChan {
+			l, r := result.GetLeft(), result.GetRight()
+			if l.GetValue() != r.GetValue() {
+				t.Errorf("Joined entries with different values: %v and %v", l, r)
+			}
+			pairs[joinedKeys{l: l.GetKey(), r: r.GetKey()}]++
+		}
+		done <- true
+	}()
+	err = group.Wait()
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pairs
+}
+
+func testJoinSkewedKey(t *testing.T) {
+	budget := query.JOIN_MEMORY_BUDGET
+	defer func() { query.JOIN_MEMORY_BUDGET = budget }()
+	query.JOIN_MEMORY_BUDGET = 100
+	query.ResetJoinStats()
+	before, err := filepath.Glob("db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	left, leftName := openTempBTree(t)
+	defer os.Remove(leftName)
+	defer left.Close()
+	right, rightName := openTempBTree(t)
+	defer os.Remove(rightName)
+	defer right.Close()
+	// Most entries share the value 7, far more than fit in a hash bucket;
+	// the rest have distinct values, some of them on both sides
+	numSkewed := 3 * hash.BUCKETSIZE
+	for i := int64(0); i < numSkewed+500; i++ {
+		value := int64(7)
+		if i >= numSkewed {
+			value = i
+		}
+		if err := left.Insert(i, value); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 || value == 7 {
+			if err := right.Insert(i, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pairs := joinOnValues(t, left, right)
+	expected := 0
+	for l := int64(0); l < numSkewed+500; l++ {
+		for r := int64(0); r < numSkewed+500; r++ {
+			lSkewed, rSkewed := l < numSkewed, r < numSkewed
+			if (lSkewed && rSkewed) || (!lSkewed && l == r && r%2 == 0) {
+				expected++
+				if pairs[joinedKeys{l: l, r: r}] != 1 {
+					t.Fatalf("Expected pair (%d, %d) once, got it %d times", l, r, pairs[joinedKeys{l: l, r: r}])
+				}
+			}
+		}
+	}
+	if len(pairs) != expected {
+		t.Errorf("Expected %d pairs, got %d", expected, len(pairs))
+	}
+	if peak := query.GetJoinStats().SpillPeak; peak == 0 || peak > query.JOIN_MEMORY_BUDGET {
+		t.Errorf("Expected the spilled entries to be joined within the budget of %d, held %d", query.JOIN_MEMORY_BUDGET, peak)
+	}
+	// The spill files should have been removed along with the hash tables
+	after, err := filepath.Glob("db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+2 {
+		t.Errorf("Join left temporary files behind: %v", after)
+	}
+}
+
+func testJoinSkewedKeys(t *testing.T) {
+	budget := query.JOIN_MEMORY_BUDGET
+	defer func() { query.JOIN_MEMORY_BUDGET = budget }()
+	query.JOIN_MEMORY_BUDGET = 64
+	query.ResetJoinStats()
+	left, leftName := openTempBTree(t)
+	defer os.Remove(leftName)
+	defer left.Close()
+	right, rightName := openTempBTree(t)
+	defer os.Remove(rightName)
+	defer right.Close()
+	// Several values, each with more entries on the left than fit in a hash
+	// bucket, so that the spilled keys must be split up to fit in the budget
+	numValues, perValue := int64(6), 2*hash.BUCKETSIZE
+	for i := int64(0); i < numValues*perValue; i++ {
+		if err := left.Insert(i, i%numValues); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 2*numValues; i++ {
+		if err := right.Insert(i, i%numValues); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pairs := joinOnValues(t, left, right)
+	if int64(len(pairs)) != numValues*perValue*2 {
+		t.Errorf("Expected %d pairs, got %d", numValues*perValue*2, len(pairs))
+	}
+	for p, count := range pairs {
+		if p.l%numValues != p.r%numValues || count != 1 {
+			t.Fatalf("Unexpected pair (%d, %d), joined %d times", p.l, p.r, count)
+		}
+	}
+	if peak := query.GetJoinStats().SpillPeak; peak == 0 || peak > query.JOIN_MEMORY_BUDGET {
+		t.Errorf("Expected the spilled keys to be joined within the budget of %d, held %d", query.JOIN_MEMORY_BUDGET, peak)
+	}
+}
+
+func testJoinProbeWorkers(t *testing.T) {
+	workers := query.PROBE_WORKERS
+	defer func() { query.PROBE_WORKERS = workers }()
+	query.PROBE_WORKERS = 3
+	query.ResetJoinStats()
+	left, leftName := openTempBTree(t)
+	defer os.Remove(leftName)
+	defer left.Close()
+	right, rightName := openTempBTree(t)
+	defer os.Remove(rightName)
+	defer right.Close()
+	// Enough entries for many more buckets than workers; every third value
+	// on the left matches one on the right
+	for i := int64(0); i < 20000; i++ {
+		if err := left.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+		if err := right.Insert(i, 3*i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pairs := joinOnValues(t, left, right)
+	if len(pairs) != 6667 {
+		t.Errorf("Expected 6667 pairs, got %d", len(pairs))
+	}
+	for p, count := range pairs {
+		if p.l != 3*p.r || count != 1 {
+			t.Fatalf("Unexpected pair (%d, %d), joined %d times", p.l, p.r, count)
+		}
+	}
+	stats := query.GetJoinStats()
+	if stats.ProbePeak == 0 || stats.ProbePeak > 3 {
+		t.Errorf("Expected at most 3 probes at once, got %d", stats.ProbePeak)
+	}
+	if stats.ActiveProbes != 0 {
+		t.Errorf("Expected no probes left running, got %d", stats.ActiveProbes)
+	}
+}
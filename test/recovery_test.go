@@ -0,0 +1,1435 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
+	db "github.com/brown-csci1270/db/pkg/db"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	recovery "github.com/brown-csci1270/db/pkg/recovery"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+
+	uuid "github.com/google/uuid"
+	copy "github.com/otiai10/copy"
+)
+
+// Open a database in a temporary folder, along with a log file, lock manager and recovery manager.
+func getTempRecoveryDB(t *testing.T) (*db.Database, *concurrency.TransactionManager, *recovery.RecoveryManager, string) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logName := getTempRecoveryLog(folder)
+	if err = d.CreateLogFile(logName); err != nil {
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(d, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, tm, rm, folder
+}
+
+// Get the log file of a temporary database. It lives outside of the
+// database folder, so that priming the database doesn't replace it.
+func getTempRecoveryLog(folder string) string {
+	return strings.TrimSuffix(folder, "/") + ".log"
+}
+
+// Remove a temporary database folder, its recovery copy, and its log.
+func removeTempRecoveryDB(folder string) {
+	os.RemoveAll(folder)
+	os.RemoveAll(strings.TrimSuffix(folder, "/") + "-recovery")
+	os.Remove(getTempRecoveryLog(folder))
+	segments, _ := filepath.Glob(getTempRecoveryLog(folder) + ".*")
+	for _, segment := range segments {
+		os.Remove(segment)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	t.Run("TestRollbackFromLog", testRollbackFromLog)
+	t.Run("TestRollbackBufferedWrites", testRollbackBufferedWrites)
+	t.Run("TestLogReader", testLogReader)
+	t.Run("TestLogBuffered", testLogBuffered)
+	t.Run("TestRecoverPrepared", testRecoverPrepared)
+	t.Run("TestIncrementalCheckpoint", testIncrementalCheckpoint)
+	t.Run("TestBatchedRedo", testBatchedRedo)
+	t.Run("TestLogSegments", testLogSegments)
+	t.Run("TestRecoverTableSchema", testRecoverTableSchema)
+	t.Run("TestReplayInto", testReplayInto)
+	t.Run("TestVerifyRecoveryCopy", testVerifyRecoveryCopy)
+	t.Run("TestLogSubscriber", testLogSubscriber)
+	t.Run("TestAutoCheckpoint", testAutoCheckpoint)
+	t.Run("TestExportSnapshot", testExportSnapshot)
+	t.Run("TestRecoverAfterCrashedRecovery", testRecoverAfterCrashedRecovery)
+	t.Run("TestRecoverContextCancelled", testRecoverContextCancelled)
+}
+
+func testRollbackFromLog(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	defer d.Close()
+	w := ioutil.Discard
+	clientId := uuid.New()
+
+	// Create a table and start a transaction
+	err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", w, clientId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = recovery.HandleTransaction(d, tm, rm, "transaction begin", w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	// Insert, checkpoint mid-transaction, then insert some more
+	for i := 0; i < 5; i++ {
+		payload := fmt.Sprintf("insert %d %d into t", i, i)
+		if err = recovery.HandleInsert(d, tm, rm, payload, clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = recovery.HandleCheckpoint(d, tm, rm, "checkpoint", w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	for i := 5; i < 10; i++ {
+		payload := fmt.Sprintf("insert %d %d into t", i, i)
+		if err = recovery.HandleInsert(d, tm, rm, payload, clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Roll back with a fresh recovery manager, which has no in-memory stack,
+	// once the old one's buffered records are in the log
+	if err = rm.FlushLog(rm.LastLSN()); err != nil {
+		t.Fatal(err)
+	}
+	rm, err = recovery.NewRecoveryManager(d, tm, getTempRecoveryLog(folder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.Rollback(clientId); err != nil {
+		t.Fatal(err)
+	}
+	// All of the transaction's edits should have been undone
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 10; i++ {
+		if entry, err := table.Find(i); err == nil || entry != nil {
+			t.Errorf("Entry %d was not rolled back", i)
+		}
+	}
+	if _, found := tm.GetTransaction(clientId); found {
+		t.Error("Transaction still running after rollback")
+	}
+	// A transaction that never started has nothing to roll back to
+	if err = rm.Rollback(uuid.New()); err == nil {
+		t.Error("Expected rolling back a transaction with no start log to fail")
+	}
+}
+
+func testRollbackBufferedWrites(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	defer d.Close()
+	tm.SetBufferedWrites(true)
+	w := ioutil.Discard
+	committed := uuid.New()
+	rolledBack := uuid.New()
+	run := func(clientId uuid.UUID, payload string) {
+		var err error
+		switch {
+		case strings.HasPrefix(payload, "transaction"):
+			err = recovery.HandleTransaction(d, tm, rm, payload, w, clientId)
+		case strings.HasPrefix(payload, "insert"):
+			err = recovery.HandleInsert(d, tm, rm, payload, clientId)
+		case strings.HasPrefix(payload, "update"):
+			err = recovery.HandleUpdate(d, tm, rm, payload, clientId)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", w, committed); err != nil {
+		t.Fatal(err)
+	}
+	run(committed, "transaction begin")
+	for i := 0; i < 5; i++ {
+		run(committed, fmt.Sprintf("insert %d %d into t", i, i))
+	}
+	run(committed, "transaction commit")
+	// Buffer updates, then roll them back
+	run(rolledBack, "transaction begin")
+	for i := 0; i < 5; i++ {
+		run(rolledBack, fmt.Sprintf("update t %d %d", i, i+100))
+	}
+	if err := rm.Rollback(rolledBack); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing the rolled back transaction buffered reached the table
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 5; i++ {
+		if entry, err := table.Find(i); err != nil || entry.GetValue() != i {
+			t.Errorf("Expected entry %d to keep its committed value, got %v (%v)", i, entry, err)
+		}
+	}
+	if _, found := tm.GetTransaction(rolledBack); found {
+		t.Error("Transaction still running after rollback")
+	}
+	// Its locks were released
+	run(committed, "transaction begin")
+	run(committed, "update t 0 7")
+	run(committed, "transaction commit")
+	if entry, err := table.Find(0); err != nil || entry.GetValue() != 7 {
+		t.Errorf("Expected a later update to go through, got %v (%v)", entry, err)
+	}
+}
+
+func testLogBuffered(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	defer d.Close()
+	w := ioutil.Discard
+	clientId := uuid.New()
+
+	err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", w, clientId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = recovery.HandleTransaction(d, tm, rm, "transaction begin", w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	// Edits are buffered rather than synced one by one
+	durable := rm.DurableLSN()
+	for i := 0; i < 5; i++ {
+		payload := fmt.Sprintf("insert %d %d into t", i, i)
+		if err = recovery.HandleInsert(d, tm, rm, payload, clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rm.DurableLSN() != durable || rm.LastLSN() <= durable {
+		t.Fatalf("Expected the edits to be buffered, durable LSN went from %d to %d of %d",
+			durable, rm.DurableLSN(), rm.LastLSN())
+	}
+	// Flushing up to an LSN makes the buffered records durable
+	if err = rm.FlushLog(rm.LastLSN()); err != nil {
+		t.Fatal(err)
+	}
+	if rm.DurableLSN() != rm.LastLSN() {
+		t.Fatalf("Expected the log to be durable up to %d, got %d", rm.LastLSN(), rm.DurableLSN())
+	}
+	// A commit is durable once it returns
+	if err = recovery.HandleInsert(d, tm, rm, "insert 5 5 into t", clientId); err != nil {
+		t.Fatal(err)
+	}
+	if err = recovery.HandleTransaction(d, tm, rm, "transaction commit", w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	if rm.DurableLSN() != rm.LastLSN() {
+		t.Fatalf("Expected the commit to be durable, got %d of %d", rm.DurableLSN(), rm.LastLSN())
+	}
+	data, err := ioutil.ReadFile(getTempRecoveryLog(folder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), fmt.Sprintf("< %s commit >", clientId)) {
+		t.Error("Expected the commit record in the log file")
+	}
+}
+
+func testLogReader(t *testing.T) {
+	tmpfile, err := ioutil.TempFile(".", "db-*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	// Hand-write a log file
+	id1 := uuid.New()
+	id2 := uuid.New()
+	lines := []string{
+		"< create btree table t >",
+		fmt.Sprintf("< %s start >", id1),
+		fmt.Sprintf("< %s, t, INSERT, 1, 0, 10 >", id1),
+		fmt.Sprintf("< %s start >", id2),
+		fmt.Sprintf("< %s, %s checkpoint >", id1, id2),
+		fmt.Sprintf("< %s, t, UPDATE, 1, 10, 20 >", id2),
+		fmt.Sprintf("< %s commit >", id1),
+	}
+	tmpfile.WriteString(strings.Join(lines, "\n") + "\n")
+	tmpfile.Close()
+	// Iterate over the records
+	lr, err := recovery.OpenLogReader(tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close()
+	logs := make([]recovery.Log, 0)
+	for {
+		l, err := lr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, l)
+	}
+	if len(logs) != len(lines) {
+		t.Fatalf("Expected %d records, got %d", len(lines), len(logs))
+	}
+	// Check the decoded records
+	if tl, ok := logs[0].(*recovery.TableLog); !ok || tl.GetTableType() != "btree" || tl.GetTableName() != "t" {
+		t.Error("Bad table record")
+	}
+	if sl, ok := logs[1].(*recovery.StartLog); !ok || sl.GetClientID() != id1 {
+		t.Error("Bad start record")
+	}
+	el, ok := logs[2].(*recovery.EditLog)
+	if !ok || el.GetClientID() != id1 || el.GetTableName() != "t" || el.GetAction() != recovery.INSERT_ACTION ||
+		el.GetKey() != 1 || el.GetOldValue() != 0 || el.GetNewValue() != 10 {
+		t.Error("Bad insert record")
+	}
+	cl, ok := logs[4].(*recovery.CheckpointLog)
+	if !ok || len(cl.GetClientIDs()) != 2 || cl.GetClientIDs()[0] != id1 || cl.GetClientIDs()[1] != id2 {
+		t.Error("Bad checkpoint record")
+	}
+	el, ok = logs[5].(*recovery.EditLog)
+	if !ok || el.GetClientID() != id2 || el.GetAction() != recovery.UPDATE_ACTION || el.GetNewValue() != 20 {
+		t.Error("Bad update record")
+	}
+	if cl, ok := logs[6].(*recovery.CommitLog); !ok || cl.GetClientID() != id1 {
+		t.Error("Bad commit record")
+	}
+}
+
+func testRecoverPrepared(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	// Hash tables keep their .meta file in the working directory.
+	defer os.Remove("ht.meta")
+	w := ioutil.Discard
+	prepared := uuid.New()
+	unprepared := uuid.New()
+
+	// Create a btree and a hash table, then checkpoint
+	for _, payload := range []string{"create btree table bt", "create hash table ht"} {
+		if err := recovery.HandleCreateTable(d, tm, rm, payload, w, prepared); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recovery.HandleCheckpoint(d, tm, rm, "checkpoint", w, prepared); err != nil {
+		t.Fatal(err)
+	}
+	// Write to both tables in one transaction and prepare it; leave another unprepared
+	for _, clientId := range []uuid.UUID{prepared, unprepared} {
+		if err := recovery.HandleTransaction(d, tm, rm, "transaction begin", w, clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		for _, table := range []string{"bt", "ht"} {
+			payload := fmt.Sprintf("insert %d %d into %s", i, i, table)
+			if err := recovery.HandleInsert(d, tm, rm, payload, prepared); err != nil {
+				t.Fatal(err)
+			}
+			payload = fmt.Sprintf("insert %d %d into %s", i+10, i, table)
+			if err := recovery.HandleInsert(d, tm, rm, payload, unprepared); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := recovery.HandleTransaction(d, tm, rm, "transaction prepare", w, prepared); err != nil {
+		t.Fatal(err)
+	}
+	// Crash before committing: reopen from the checkpoint copy and recover
+	d.Close()
+	d, err := recovery.Prime(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	tm = concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err = recovery.NewRecoveryManager(d, tm, getTempRecoveryLog(folder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	// The prepared transaction's writes should be committed in both tables,
+	// and the unprepared transaction's writes should be undone
+	for _, tableName := range []string{"bt", "ht"} {
+		table, err := d.GetTable(tableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 5; i++ {
+			if entry, err := table.Find(i); err != nil || entry.GetValue() != i {
+				t.Errorf("Prepared entry %d missing from %s", i, tableName)
+			}
+			if _, err := table.Find(i + 10); err == nil {
+				t.Errorf("Unprepared entry %d not undone in %s", i+10, tableName)
+			}
+		}
+	}
+	if _, found := tm.GetTransaction(prepared); found {
+		t.Error("Prepared transaction still running after recovery")
+	}
+}
+
+func testIncrementalCheckpoint(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	w := ioutil.Discard
+	clientId := uuid.New()
+
+	// Record every copy made into the recovery folder
+	copied := make([]string, 0)
+	rm.SetIncremental(true)
+	rm.SetCopier(func(src, dst string) error {
+		copied = append(copied, filepath.Base(src))
+		return copy.Copy(src, dst)
+	})
+	// Create two tables and write to both
+	for _, payload := range []string{"create btree table a", "create btree table b"} {
+		if err := recovery.HandleCreateTable(d, tm, rm, payload, w, clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		for _, table := range []string{"a", "b"} {
+			payload := fmt.Sprintf("insert %d %d into %s", i, i, table)
+			if err := db.HandleInsert(d, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The first checkpoint copies both tables, along with their schemas
+	rm.Checkpoint()
+	sort.Strings(copied)
+	if strings.Join(copied, ",") != "a,a.schema,b,b.schema" {
+		t.Fatalf("Expected a and b to be copied, got %v", copied)
+	}
+	// After a small change to one table, only that table is copied
+	copied = copied[:0]
+	if err := db.HandleInsert(d, "insert 100 100 into a"); err != nil {
+		t.Fatal(err)
+	}
+	rm.Checkpoint()
+	sort.Strings(copied)
+	if strings.Join(copied, ",") != "a,a.schema" {
+		t.Fatalf("Expected only a to be copied, got %v", copied)
+	}
+	// Nothing changed, so nothing is copied
+	copied = copied[:0]
+	rm.Checkpoint()
+	if len(copied) != 0 {
+		t.Fatalf("Expected nothing to be copied, got %v", copied)
+	}
+	// The recovery folder should hold the latest data
+	d.Close()
+	recovered, err := recovery.Prime(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	table, err := recovered.GetTable("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := table.Find(100); err != nil || entry.GetValue() != 100 {
+		t.Error("Recovery folder is missing the latest change")
+	}
+}
+
+func testLogSegments(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	w := ioutil.Discard
+	committed := uuid.New()
+	running := uuid.New()
+
+	// Create a table and checkpoint, then roll over every few records
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", w, committed); err != nil {
+		t.Fatal(err)
+	}
+	if err := recovery.HandleCheckpoint(d, tm, rm, "checkpoint", w, committed); err != nil {
+		t.Fatal(err)
+	}
+	rm.SetSegmentSize(512)
+	for _, clientId := range []uuid.UUID{committed, running} {
+		if err := recovery.HandleTransaction(d, tm, rm, "transaction begin", w, clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		payload := fmt.Sprintf("insert %d %d into t", i, i)
+		if err := recovery.HandleInsert(d, tm, rm, payload, committed); err != nil {
+			t.Fatal(err)
+		}
+		payload = fmt.Sprintf("insert %d %d into t", i+100, i)
+		if err := recovery.HandleInsert(d, tm, rm, payload, running); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recovery.HandleTransaction(d, tm, rm, "transaction commit", w, committed); err != nil {
+		t.Fatal(err)
+	}
+	segments := rm.Segments()
+	if len(segments) < 3 {
+		t.Fatalf("Expected the log to span several segments, got %v", segments)
+	}
+	for _, segment := range segments {
+		if _, err := os.Stat(segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Crash: reopen from the checkpoint copy and recover across the segments
+	d.Close()
+	d, err := recovery.Prime(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	tm = concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err = recovery.NewRecoveryManager(d, tm, getTempRecoveryLog(folder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rm.Segments(); strings.Join(got, ",") != strings.Join(segments, ",") {
+		t.Fatalf("Expected segments %v after reopening, got %v", segments, got)
+	}
+	if err = rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 50; i++ {
+		if entry, err := table.Find(i); err != nil || entry.GetValue() != i {
+			t.Errorf("Committed entry %d missing after recovery", i)
+		}
+		if _, err := table.Find(i + 100); err == nil {
+			t.Errorf("Uncommitted entry %d not undone", i+100)
+		}
+	}
+	// Nothing is running, so a checkpoint supersedes every earlier segment
+	rm.SetSegmentSize(512)
+	rm.Checkpoint()
+	if remaining := rm.Segments(); len(remaining) >= len(segments) {
+		t.Fatalf("Expected superseded segments to be dropped, got %v", remaining)
+	}
+	for _, segment := range segments[1 : len(segments)-1] {
+		if _, err := os.Stat(segment); !os.IsNotExist(err) {
+			t.Errorf("Superseded segment %s was not dropped", segment)
+		}
+	}
+}
+
+// Write the given log records to a temporary log file.
+func writeTempLog(tb testing.TB, lines []string) string {
+	tmpfile, err := ioutil.TempFile(".", "db-*.log")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer tmpfile.Close()
+	if _, err = tmpfile.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tb.Fatal(err)
+	}
+	return tmpfile.Name()
+}
+
+func testRecoverTableSchema(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	defer d.Close()
+	// Create a table with a schema; its creation is logged with the schema
+	err := recovery.HandleCreateTable(d, tm, rm, "create btree table orders orderid total", ioutil.Discard, uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := utils.Schema{KeyName: "orderid", ValueName: "total", IndexType: "btree"}
+	lr, err := recovery.OpenLogReader(getTempRecoveryLog(folder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := lr.Next()
+	lr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tl, ok := l.(*recovery.TableLog); !ok || tl.GetTableName() != "orders" || tl.GetSchema() != schema {
+		t.Fatalf("Bad table record %+v", l)
+	}
+	// Recovering into an empty database recreates the table with its schema
+	recovered, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeTempRecoveryDB(recovered)
+	recoveredDB, err := db.Open(recovered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recoveredDB.Close()
+	recoverFromLog(t, recoveredDB, getTempRecoveryLog(folder))
+	table, err := recoveredDB.GetTable("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Schema() != schema {
+		t.Errorf("Expected recovered schema %+v, got %+v", schema, table.Schema())
+	}
+}
+
+func testReplayInto(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	w := ioutil.Discard
+	committed := uuid.New()
+	rolledBack := uuid.New()
+
+	// Build two tables across several log segments, with a committed
+	// transaction and a rolled back one
+	rm.SetSegmentSize(512)
+	for _, payload := range []string{"create btree table a", "create btree table b id amount"} {
+		if err := recovery.HandleCreateTable(d, tm, rm, payload, w, committed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, clientId := range []uuid.UUID{committed, rolledBack} {
+		if err := recovery.HandleTransaction(d, tm, rm, "transaction begin", w, clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		payload := fmt.Sprintf("insert %d %d into a", i, i)
+		if err := recovery.HandleInsert(d, tm, rm, payload, committed); err != nil {
+			t.Fatal(err)
+		}
+		payload = fmt.Sprintf("insert %d %d into b", i, i*10)
+		if err := recovery.HandleInsert(d, tm, rm, payload, committed); err != nil {
+			t.Fatal(err)
+		}
+		payload = fmt.Sprintf("insert %d %d into a", i+100, i)
+		if err := recovery.HandleInsert(d, tm, rm, payload, rolledBack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i += 3 {
+		if err := recovery.HandleUpdate(d, tm, rm, fmt.Sprintf("update a %d %d", i, i*1000), committed); err != nil {
+			t.Fatal(err)
+		}
+		if err := recovery.HandleDelete(d, tm, rm, fmt.Sprintf("delete %d from b", i), committed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recovery.HandleTransaction(d, tm, rm, "transaction commit", w, committed); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Rollback(rolledBack); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string][]utils.Entry)
+	for _, name := range []string{"a", "b"} {
+		table, err := d.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want[name], err = table.Select(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Copy the log, segments included
+	logName := getTempRecoveryLog(folder)
+	replayed, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeTempRecoveryDB(replayed)
+	replayLog := getTempRecoveryLog(replayed)
+	segments := rm.Segments()
+	if len(segments) < 2 {
+		t.Fatalf("Expected the log to span several segments, got %v", segments)
+	}
+	for _, segment := range segments {
+		if err = copy.Copy(segment, replayLog+strings.TrimPrefix(segment, logName)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Close()
+	// Replaying into a folder that isn't empty is refused
+	if _, err = recovery.ReplayInto(replayLog, folder); err == nil {
+		t.Error("Expected replaying into a non-empty folder to fail")
+	}
+	// Replay into a fresh database and compare its contents
+	replayedDB, err := recovery.ReplayInto(replayLog, replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayedDB.Close()
+	for _, name := range []string{"a", "b"} {
+		table, err := replayedDB.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := table.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want[name]) {
+			t.Fatalf("Table %s: expected %d entries, got %d", name, len(want[name]), len(got))
+		}
+		for i := range got {
+			if got[i].GetKey() != want[name][i].GetKey() || got[i].GetValue() != want[name][i].GetValue() {
+				t.Errorf("Table %s: expected entry (%d, %d), got (%d, %d)", name,
+					want[name][i].GetKey(), want[name][i].GetValue(), got[i].GetKey(), got[i].GetValue())
+			}
+		}
+	}
+	table, err := replayedDB.GetTable("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema := (utils.Schema{KeyName: "id", ValueName: "amount", IndexType: "btree"}); table.Schema() != schema {
+		t.Errorf("Expected replayed schema %+v, got %+v", schema, table.Schema())
+	}
+}
+
+// Build a committed transaction's log with the given number of edits,
+// in runs that alternate between two tables.
+func testVerifyRecoveryCopy(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	w := ioutil.Discard
+	clientId := uuid.New()
+
+	// Fill a table with enough entries to split it into several leaves
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.HandleInsert(d, fmt.Sprintf("insert %d %d into t", i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rm.Checkpoint()
+	// A fresh checkpoint copy is sound
+	if err := rm.VerifyRecoveryCopy(); err != nil {
+		t.Fatalf("Expected the recovery copy to verify, got %v", err)
+	}
+	// Point the first leaf in the copy at itself, breaking the chain of leaves
+	copyPath := filepath.Join(strings.TrimSuffix(folder, "/")+"-recovery", "t")
+	data, err := ioutil.ReadFile(copyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := false
+	for pn := int64(0); pn*pager.PAGESIZE < int64(len(data)); pn++ {
+		page := data[pn*pager.PAGESIZE : (pn+1)*pager.PAGESIZE]
+		if page[btree.NODETYPE_OFFSET] == 1 {
+			binary.PutVarint(page[btree.RIGHT_SIBLING_PN_OFFSET:btree.RIGHT_SIBLING_PN_OFFSET+btree.RIGHT_SIBLING_PN_SIZE], pn)
+			corrupted = true
+			break
+		}
+	}
+	if !corrupted {
+		t.Fatal("Found no leaf to corrupt")
+	}
+	if err = ioutil.WriteFile(copyPath, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	err = rm.VerifyRecoveryCopy()
+	if !errors.Is(err, btree.ErrBrokenSiblingLink) || !strings.Contains(err.Error(), "table t is corrupt") {
+		t.Fatalf("Expected a broken sibling link in table t, got %v", err)
+	}
+	// A copy cut off partway through a page is corrupt too
+	if err = ioutil.WriteFile(copyPath, data[:len(data)-100], 0666); err != nil {
+		t.Fatal(err)
+	}
+	err = rm.VerifyRecoveryCopy()
+	if err == nil || !strings.Contains(err.Error(), "not a whole number of pages") {
+		t.Fatalf("Expected a truncated copy of table t to fail, got %v", err)
+	}
+	// The live database is unaffected
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = table.(*btree.BTreeIndex).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func buildEditLog(numEdits int) []string {
+	id := uuid.New()
+	lines := []string{"< create btree table a >", "< create btree table b >", fmt.Sprintf("< %s start >", id)}
+	runLength := 50
+	for i := 0; i < numEdits; i++ {
+		table := "a"
+		if (i/runLength)%2 == 1 {
+			table = "b"
+		}
+		key := (i * 7919) % numEdits
+		var line string
+		switch i % 10 {
+		case 7:
+			// Update a key that may not exist yet
+			line = fmt.Sprintf("< %s, %s, UPDATE, %d, 0, %d >", id, table, key, i)
+		case 9:
+			// Insert a key that may already exist
+			line = fmt.Sprintf("< %s, %s, INSERT, %d, 0, %d >", id, table, (key+1)%numEdits, i)
+		default:
+			line = fmt.Sprintf("< %s, %s, INSERT, %d, 0, %d >", id, table, key, i)
+		}
+		lines = append(lines, line)
+		if i%10 == 8 {
+			lines = append(lines, fmt.Sprintf("< %s, %s, DELETE, %d, 0, 0 >", id, table, key))
+		}
+	}
+	return append(lines, fmt.Sprintf("< %s commit >", id))
+}
+
+// Redo every record of a log file one at a time.
+func redoEach(tb testing.TB, d *db.Database, logName string) {
+	rm, err := recovery.NewRecoveryManager(d, concurrency.NewTransactionManager(concurrency.NewLockManager()), logName)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	lr, err := recovery.OpenLogReader(logName)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer lr.Close()
+	for {
+		l, err := lr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		switch l.(type) {
+		case *recovery.TableLog, *recovery.EditLog:
+			if err = rm.Redo(l); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+// Recover a database from a log file.
+func recoverFromLog(tb testing.TB, d *db.Database, logName string) {
+	rm, err := recovery.NewRecoveryManager(d, concurrency.NewTransactionManager(concurrency.NewLockManager()), logName)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = rm.Recover(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func testBatchedRedo(t *testing.T) {
+	logName := writeTempLog(t, buildEditLog(2000))
+	defer os.Remove(logName)
+	// Redo the log one record at a time, and through the batched recovery
+	eachFolder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(eachFolder)
+	eachDB, err := db.Open(eachFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eachDB.Close()
+	redoEach(t, eachDB, logName)
+	batchFolder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeTempRecoveryDB(batchFolder)
+	batchDB, err := db.Open(batchFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batchDB.Close()
+	recoverFromLog(t, batchDB, logName)
+	// Both databases should end up in the same state
+	for _, tableName := range []string{"a", "b"} {
+		eachTable, err := eachDB.GetTable(tableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batchTable, err := batchDB.GetTable(tableName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eachEntries, err := eachTable.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		batchEntries, err := batchTable.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(eachEntries) == 0 || len(eachEntries) != len(batchEntries) {
+			t.Fatalf("Table %s has %d entries after redoing each record, %d after batching",
+				tableName, len(eachEntries), len(batchEntries))
+		}
+		for i := range eachEntries {
+			if eachEntries[i].GetKey() != batchEntries[i].GetKey() ||
+				eachEntries[i].GetValue() != batchEntries[i].GetValue() {
+				t.Fatalf("Entry %d of table %s differs", i, tableName)
+			}
+		}
+	}
+}
+
+// Benchmark redoing a large log one record at a time, or batched by recovery.
+func benchmarkRedo(b *testing.B, redo func(testing.TB, *db.Database, string)) {
+	lines := buildEditLog(100000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		// Recovery checkpoints the log it recovers from, so each run needs a fresh one.
+		logName := writeTempLog(b, lines)
+		folder, err := ioutil.TempDir(".", "db-*")
+		if err != nil {
+			b.Fatal(err)
+		}
+		d, err := db.Open(folder)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		redo(b, d, logName)
+		b.StopTimer()
+		d.Close()
+		removeTempRecoveryDB(folder)
+		os.Remove(logName)
+		b.StartTimer()
+	}
+}
+
+func BenchmarkRedoEach(b *testing.B) {
+	benchmarkRedo(b, redoEach)
+}
+
+func BenchmarkRedoBatched(b *testing.B) {
+	benchmarkRedo(b, recoverFromLog)
+}
+
+func testLogSubscriber(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	defer d.Close()
+	var follower bytes.Buffer
+	rm.SetSubscriber(&follower)
+	w := ioutil.Discard
+	committed := uuid.New()
+	aborted := uuid.New()
+	later := uuid.New()
+	run := func(clientId uuid.UUID, payload string) {
+		var err error
+		switch {
+		case strings.HasPrefix(payload, "transaction"):
+			err = recovery.HandleTransaction(d, tm, rm, payload, w, clientId)
+		case strings.HasPrefix(payload, "insert"):
+			err = recovery.HandleInsert(d, tm, rm, payload, clientId)
+		case strings.HasPrefix(payload, "update"):
+			err = recovery.HandleUpdate(d, tm, rm, payload, clientId)
+		case payload == "abort":
+			err = recovery.HandleAbort(d, tm, rm, payload, w, clientId)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", w, committed); err != nil {
+		t.Fatal(err)
+	}
+	// Two transactions interleave; only one of them commits
+	run(committed, "transaction begin")
+	run(aborted, "transaction begin")
+	run(committed, "insert 1 10 into t")
+	run(aborted, "insert 2 20 into t")
+	run(committed, "insert 3 30 into t")
+	run(aborted, "update t 2 25")
+	if follower.Len() != len("< create btree table t key value >\n") {
+		t.Errorf("Expected only the table record before any commit, got %q", follower.String())
+	}
+	run(committed, "transaction commit")
+	run(aborted, "abort")
+	run(later, "transaction begin")
+	run(later, "update t 1 15")
+	run(later, "transaction commit")
+	// The follower got the table, then each committed transaction whole
+	logs := make([]recovery.Log, 0)
+	for _, line := range strings.Split(strings.TrimSpace(follower.String()), "\n") {
+		l, err := recovery.FromString(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, l)
+	}
+	if len(logs) != 8 {
+		t.Fatalf("Expected 8 records, got %d: %q", len(logs), follower.String())
+	}
+	if tl, ok := logs[0].(*recovery.TableLog); !ok || tl.GetTableName() != "t" {
+		t.Error("Expected the table record first")
+	}
+	expected := []struct {
+		id            uuid.UUID
+		action        recovery.Action
+		key, oldValue int64
+		newValue      int64
+	}{
+		{committed, recovery.INSERT_ACTION, 1, 0, 10},
+		{committed, recovery.INSERT_ACTION, 3, 0, 30},
+		{later, recovery.UPDATE_ACTION, 1, 10, 15},
+	}
+	edits := make([]*recovery.EditLog, 0)
+	for _, l := range logs {
+		if el, ok := l.(*recovery.EditLog); ok {
+			edits = append(edits, el)
+		}
+	}
+	if len(edits) != len(expected) {
+		t.Fatalf("Expected %d edit records, got %d", len(expected), len(edits))
+	}
+	for i, e := range expected {
+		el := edits[i]
+		if el.GetClientID() != e.id || el.GetAction() != e.action || el.GetKey() != e.key ||
+			el.GetOldValue() != e.oldValue || el.GetNewValue() != e.newValue {
+			t.Errorf("Edit record %d is %+v, expected %+v", i, *el, e)
+		}
+	}
+	if cl, ok := logs[4].(*recovery.CommitLog); !ok || cl.GetClientID() != committed {
+		t.Error("Expected the first transaction to end with its commit record")
+	}
+	if cl, ok := logs[7].(*recovery.CommitLog); !ok || cl.GetClientID() != later {
+		t.Error("Expected the last transaction to end with its commit record")
+	}
+	// Once unregistered, the follower gets nothing more
+	rm.SetSubscriber(nil)
+	n := follower.Len()
+	run(later, "transaction begin")
+	run(later, "insert 4 40 into t")
+	run(later, "transaction commit")
+	if follower.Len() != n {
+		t.Error("Expected an unregistered subscriber to get no records")
+	}
+}
+
+// Count the checkpoint records in a log file.
+func countCheckpoints(t *testing.T, logName string) int {
+	lr, err := recovery.OpenLogReader(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close()
+	checkpoints := 0
+	for {
+		l, err := lr.Next()
+		if err == io.EOF {
+			return checkpoints
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := l.(*recovery.CheckpointLog); ok {
+			checkpoints++
+		}
+	}
+}
+
+// Wait up to a second for more than the given number of checkpoint records to
+// be in the log file.
+func waitForCheckpoint(t *testing.T, logName string, checkpoints int) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if countCheckpoints(t, logName) > checkpoints {
+			return true
+		}
+	}
+	return false
+}
+
+func testAutoCheckpoint(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	defer d.Close()
+	w := ioutil.Discard
+	clientId := uuid.New()
+	logName := getTempRecoveryLog(folder)
+	if err := rm.StartAutoCheckpoint(0, 0); err == nil {
+		t.Error("Expected auto checkpoint without a threshold to fail")
+	}
+	// Checkpoint every 20 records
+	if err := rm.StartAutoCheckpoint(20, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.StartAutoCheckpoint(20, 0); err == nil {
+		t.Error("Expected starting auto checkpoint twice to fail")
+	}
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	if err := recovery.HandleTransaction(d, tm, rm, "transaction begin", w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := recovery.HandleInsert(d, tm, rm, fmt.Sprintf("insert %d %d into t", i, i), clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if countCheckpoints(t, logName) != 0 {
+		t.Error("Expected no checkpoint before 20 records were logged")
+	}
+	for i := 10; i < 30; i++ {
+		if err := recovery.HandleInsert(d, tm, rm, fmt.Sprintf("insert %d %d into t", i, i), clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !waitForCheckpoint(t, logName, 0) {
+		t.Error("Expected a checkpoint once 20 records were logged")
+	}
+	if err := recovery.HandleTransaction(d, tm, rm, "transaction commit", w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	rm.StopAutoCheckpoint()
+	rm.StopAutoCheckpoint()
+	// Checkpoint once an interval passes with records logged
+	checkpoints := countCheckpoints(t, logName)
+	if err := rm.StartAutoCheckpoint(0, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer rm.StopAutoCheckpoint()
+	if err := recovery.HandleTransaction(d, tm, rm, "transaction begin", w, clientId); err != nil {
+		t.Fatal(err)
+	}
+	if err := recovery.HandleInsert(d, tm, rm, "insert 100 100 into t", clientId); err != nil {
+		t.Fatal(err)
+	}
+	if !waitForCheckpoint(t, logName, checkpoints) {
+		t.Error("Expected a checkpoint once the interval passed")
+	}
+}
+
+// Export a snapshot of the database, returning the keys exported for each
+// table, in order, and checking that each key's value is ten times the key.
+func exportSnapshotKeys(t *testing.T, rm *recovery.RecoveryManager) map[string][]int64 {
+	var out bytes.Buffer
+	if err := rm.ExportSnapshot(&out); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string][]int64)
+	for _, row := range rows {
+		if len(row) != 3 {
+			t.Fatalf("Expected rows of table, key and value, got %q", row)
+		}
+		key, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := strconv.ParseInt(row[2], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != key*10 {
+			t.Fatalf("Exported entry (%d, %d) of table %s has the wrong value", key, value, row[0])
+		}
+		keys[row[0]] = append(keys[row[0]], key)
+	}
+	return keys
+}
+
+func testExportSnapshot(t *testing.T) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	defer removeTempRecoveryDB(folder)
+	defer os.Remove("h.meta")
+	defer d.Close()
+	w := ioutil.Discard
+	tables := []string{"a", "b", "c"}
+	for _, table := range tables {
+		if err := recovery.HandleCreateTable(d, tm, rm, "create btree table "+table, w, uuid.New()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each transaction inserts the same key into every table, in order, so
+	// every state of the database has a prefix of the keys in each table, with
+	// no table having more keys than the ones before it, nor one fewer than
+	// the table after it.
+	n := 600
+	done := make(chan error, 1)
+	go func() {
+		clientId := uuid.New()
+		for i := 0; i < n; i++ {
+			payloads := []string{"transaction begin"}
+			for _, table := range tables {
+				payloads = append(payloads, fmt.Sprintf("insert %d %d into %s", i, i*10, table))
+			}
+			payloads = append(payloads, "transaction commit")
+			for _, payload := range payloads {
+				var err error
+				if strings.HasPrefix(payload, "transaction") {
+					err = recovery.HandleTransaction(d, tm, rm, payload, w, clientId)
+				} else {
+					err = recovery.HandleInsert(d, tm, rm, payload, clientId)
+				}
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+		done <- nil
+	}()
+	check := func(keys map[string][]int64) {
+		for _, table := range tables {
+			for i, key := range keys[table] {
+				if key != int64(i) {
+					t.Fatalf("Table %s exported key %d at position %d, not a prefix of the keys", table, key, i)
+				}
+			}
+		}
+		for i := 1; i < len(tables); i++ {
+			before, after := len(keys[tables[i-1]]), len(keys[tables[i]])
+			if after > before || after < before-1 {
+				t.Fatalf("Torn export: table %s has %d keys, table %s has %d",
+					tables[i-1], before, tables[i], after)
+			}
+		}
+	}
+	exports := 0
+	for writing := true; writing; exports++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			writing = false
+		default:
+		}
+		check(exportSnapshotKeys(t, rm))
+	}
+	if exports < 2 {
+		t.Error("Expected to export while writing")
+	}
+	// Once writing stops, the export has every key
+	keys := exportSnapshotKeys(t, rm)
+	check(keys)
+	for _, table := range tables {
+		if len(keys[table]) != n {
+			t.Errorf("Expected all %d keys of table %s to be exported, got %d", n, table, len(keys[table]))
+		}
+	}
+	// A hash table's directory isn't in the snapshot, so it can't be exported
+	if err := recovery.HandleCreateTable(d, tm, rm, "create hash table h", w, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.ExportSnapshot(ioutil.Discard); err == nil {
+		t.Error("Expected exporting a hash table to fail")
+	}
+}
+
+// Reopen a crashed database from its recovery copy, with a new recovery manager.
+func reopenRecoveryDB(t *testing.T, d *db.Database, folder string) (*db.Database, *recovery.RecoveryManager) {
+	d.Close()
+	d, err := recovery.Prime(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(d, tm, getTempRecoveryLog(folder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, rm
+}
+
+// Set up a database in the given folder whose log has one committed
+// transaction, which inserted keys [0, 5), and one unfinished transaction, which
+// inserted keys [10, 15), updated keys [0, 5) and deleted key 0. Then crash it,
+// and return it reopened from its recovery copy, ready to be recovered.
+func crashWithUnfinishedTransaction(t *testing.T) (*db.Database, *recovery.RecoveryManager, string, uuid.UUID) {
+	d, tm, rm, folder := getTempRecoveryDB(t)
+	committed := uuid.New()
+	aborted := uuid.New()
+	run := func(clientId uuid.UUID, payloads ...string) {
+		for _, payload := range payloads {
+			var err error
+			switch {
+			case strings.HasPrefix(payload, "transaction"):
+				err = recovery.HandleTransaction(d, tm, rm, payload, ioutil.Discard, clientId)
+			case strings.HasPrefix(payload, "insert"):
+				err = recovery.HandleInsert(d, tm, rm, payload, clientId)
+			case strings.HasPrefix(payload, "update"):
+				err = recovery.HandleUpdate(d, tm, rm, payload, clientId)
+			case strings.HasPrefix(payload, "delete"):
+				err = recovery.HandleDelete(d, tm, rm, payload, clientId)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table bt", ioutil.Discard, committed); err != nil {
+		t.Fatal(err)
+	}
+	rm.Checkpoint()
+	// One transaction commits; the other edits its entries and never finishes
+	run(committed, "transaction begin")
+	for i := 0; i < 5; i++ {
+		run(committed, fmt.Sprintf("insert %d %d into bt", i, i))
+	}
+	run(committed, "transaction commit")
+	run(aborted, "transaction begin")
+	for i := 0; i < 5; i++ {
+		run(aborted, fmt.Sprintf("insert %d %d into bt", i+10, i), fmt.Sprintf("update bt %d %d", i, i+100))
+	}
+	run(aborted, "delete 0 from bt")
+	d, rm = reopenRecoveryDB(t, d, folder)
+	return d, rm, folder, aborted
+}
+
+// Check that recovery kept the committed transaction and undid the unfinished one.
+func checkRecovered(t *testing.T, d *db.Database) {
+	table, err := d.GetTable("bt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 5; i++ {
+		if entry, err := table.Find(i); err != nil || entry.GetValue() != i {
+			t.Errorf("Committed entry %d was not restored", i)
+		}
+		if _, err := table.Find(i + 10); err == nil {
+			t.Errorf("Aborted entry %d was not undone", i+10)
+		}
+	}
+}
+
+// Recover, cancelling once at least the given number of records have been
+// gone through, and checking that progress counts up to a fixed total.
+func recoverUntil(t *testing.T, rm *recovery.RecoveryManager, stopAt int) (int, int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lastDone, lastTotal := 0, -1
+	err := rm.RecoverContext(ctx, func(done, total int) {
+		if done <= lastDone || done > total || (lastTotal != -1 && total != lastTotal) {
+			t.Errorf("Progress went from %d of %d to %d of %d", lastDone, lastTotal, done, total)
+		}
+		lastDone, lastTotal = done, total
+		if stopAt > 0 && done >= stopAt {
+			cancel()
+		}
+	})
+	return lastDone, lastTotal, err
+}
+
+func testRecoverAfterCrashedRecovery(t *testing.T) {
+	d, rm, folder, aborted := crashWithUnfinishedTransaction(t)
+	defer removeTempRecoveryDB(folder)
+	// Find out how far recovery goes, then crash partway through undoing the
+	// aborted transaction, with some of its edits undone
+	_, total, err := recoverUntil(t, rm, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected recovery to stop, got %v", err)
+	}
+	d, rm = reopenRecoveryDB(t, d, folder)
+	if _, _, err = recoverUntil(t, rm, total-3); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected recovery to stop 3 records from the end, got %v", err)
+	}
+	d, rm = reopenRecoveryDB(t, d, folder)
+	defer d.Close()
+	if err = rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	checkRecovered(t, d)
+	// Each of the aborted transaction's 11 edits was undone exactly once
+	lr, err := recovery.OpenLogReader(getTempRecoveryLog(folder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lr.Close()
+	edits := 0
+	for {
+		l, err := lr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if l, ok := l.(*recovery.EditLog); ok && l.GetClientID() == aborted {
+			edits++
+		}
+	}
+	if edits != 22 {
+		t.Errorf("Expected 11 edits and 11 undos of the aborted transaction, got %d records", edits)
+	}
+	// Recovering again, without restarting, changes nothing
+	lsn := rm.LastLSN()
+	if err = rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if rm.LastLSN() != lsn {
+		t.Error("Recovering again wrote to the log")
+	}
+	checkRecovered(t, d)
+}
+
+func testRecoverContextCancelled(t *testing.T) {
+	d, rm, folder, _ := crashWithUnfinishedTransaction(t)
+	defer removeTempRecoveryDB(folder)
+	defer func() { d.Close() }()
+	// Stop while redoing, then while undoing; each run resumes from the last
+	done, total, err := recoverUntil(t, rm, 5)
+	if !errors.Is(err, context.Canceled) || done >= total {
+		t.Fatalf("Expected recovery to stop while redoing, stopped after %d of %d: %v", done, total, err)
+	}
+	done, total, err = recoverUntil(t, rm, total-3)
+	if !errors.Is(err, context.Canceled) || done >= total {
+		t.Fatalf("Expected recovery to stop 3 records from the end, stopped after %d of %d: %v", done, total, err)
+	}
+	// Recovering again, in this process or after a restart, completes
+	if done, total, err = recoverUntil(t, rm, -1); err != nil {
+		t.Fatal(err)
+	}
+	if done != total {
+		t.Errorf("Expected recovery to go through all %d records, went through %d", total, done)
+	}
+	checkRecovered(t, d)
+	d, rm = reopenRecoveryDB(t, d, folder)
+	if err = rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	checkRecovered(t, d)
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	list "github.com/brown-csci1270/db/pkg/list"
+	repl "github.com/brown-csci1270/db/pkg/repl"
+
+	uuid "github.com/google/uuid"
+)
+
+// Run the given commands through the REPL's RunChan, returning what it printed.
+func runReplChan(t *testing.T, r *repl.REPL, commands []string) string {
+	stdout := os.Stdout
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	output := make(chan string)
+	go func() {
+		out, _ := ioutil.ReadAll(reader)
+		output <- string(out)
+	}()
+	c := make(chan string)
+	done := make(chan bool)
+	go func() {
+		r.RunChan(c, uuid.New(), "")
+		done <- true
+	}()
+	for _, command := range commands {
+		c <- command
+	}
+	close(c)
+	<-done
+	writer.Close()
+	os.Stdout = stdout
+	return <-output
+}
+
+func TestREPL(t *testing.T) {
+	t.Run("TestCommandTimeout", testCommandTimeout)
+	t.Run("TestCommandArity", testCommandArity)
+}
+
+func testCommandTimeout(t *testing.T) {
+	// A command that blocks until released, and one that returns right away
+	release := make(chan bool)
+	finished := make(chan bool, 1)
+	r := repl.NewRepl()
+	r.AddCommand("block", func(payload string, replConfig *repl.REPLConfig) error {
+		<-release
+		finished <- true
+		return nil
+	}, "Block until released. usage: block")
+	r.AddCommand("echo", func(payload string, replConfig *repl.REPLConfig) error {
+		io.WriteString(replConfig.GetWriter(), "echoed "+strings.Fields(payload)[1]+"\n")
+		return nil
+	}, "Echo a word. usage: echo <word>")
+	r.SetCommandTimeout(50 * time.Millisecond)
+	defer close(release)
+
+	// The blocking command times out, and the next command still runs
+	start := time.Now()
+	printed := runReplChan(t, r, []string{"block", "echo after"})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("REPL was blocked for %v", elapsed)
+	}
+	if !strings.Contains(printed, "block: "+repl.ErrCommandTimeout.Error()) {
+		t.Errorf("Expected a timeout to be reported, got output:\n%s", printed)
+	}
+	if !strings.Contains(printed, "echoed after") {
+		t.Errorf("Command after the timeout did not run, got output:\n%s", printed)
+	}
+	// The timed out command can still finish in the background
+	release <- true
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Error("Timed out command never finished")
+	}
+}
+
+func testCommandArity(t *testing.T) {
+	// A command that takes exactly one argument
+	calls := 0
+	r := repl.NewRepl()
+	r.AddCommandWithArgs("greet", func(payload string, replConfig *repl.REPLConfig) error {
+		calls++
+		io.WriteString(replConfig.GetWriter(), "hello "+strings.Fields(payload)[1]+"\n")
+		return nil
+	}, "Greet someone. usage: greet <name>", repl.ArgSpec{Names: []string{"name"}})
+	printed := runReplChan(t, r, []string{"greet", "greet a b", "greet world"})
+	if calls != 1 {
+		t.Errorf("Expected only the well-formed command to run, ran %d times", calls)
+	}
+	if strings.Count(printed, "usage: greet <name>") != 2 {
+		t.Errorf("Expected a usage error for each malformed command, got output:\n%s", printed)
+	}
+	if !strings.Contains(printed, "hello world") {
+		t.Errorf("Well-formed command did not run, got output:\n%s", printed)
+	}
+	// List commands that read their argument report their usage rather than panicking
+	combined, err := repl.CombineRepls([]*repl.REPL{list.ListRepl(list.NewList())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed = runReplChan(t, combined, []string{"list_push_head", "list_contains"})
+	for _, usage := range []string{"usage: list_push_head <value>", "usage: list_contains <value>"} {
+		if !strings.Contains(printed, usage) {
+			t.Errorf("Expected %q, got output:\n%s", usage, printed)
+		}
+	}
+}